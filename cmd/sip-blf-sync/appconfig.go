@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfig is the full application configuration. It is read from an optional YAML file
+// (CONFIG_FILE) and then overridden by environment variables: every field tagged `env`
+// takes the variable's value when it is set, so secrets can stay out of the file.
+type AppConfig struct {
+	SIP           SIPSettings           `yaml:"sip"`
+	STUN          STUNSettings          `yaml:"stun"`
+	Graph         GraphSettings         `yaml:"graph"`
+	Extensions    ExtensionsSettings    `yaml:"extensions"`
+	Mapping       MappingSettings       `yaml:"mapping"`
+	StatusMessage StatusMessageSettings `yaml:"status_message"`
+	Preferred     PreferredSettings     `yaml:"preferred_presence"`
+	BusinessHours BusinessHoursSettings `yaml:"business_hours"`
+	Outage        OutageSettings        `yaml:"outage"`
+	Health        HealthSettings        `yaml:"health"`
+	Webhook       WebhookSettings       `yaml:"webhook"`
+	Audit         AuditSettings         `yaml:"audit"`
+	Log           LogSettings           `yaml:"log"`
+
+	// DryRun runs the SIP side fully but only logs the presence changes it would write.
+	DryRun bool `yaml:"dry_run" env:"DRY_RUN"`
+	// InitialSync sets every extension the PBX has not reported once subscriptions are up
+	// to the idle presence, replacing presence left over from a previous run.
+	InitialSync bool `yaml:"initial_sync" env:"INITIAL_SYNC"`
+}
+
+// SIPSettings configures registration and BLF subscriptions.
+type SIPSettings struct {
+	Server      string `yaml:"server" env:"SIP_SERVER"`
+	Transport   string `yaml:"transport" env:"SIP_TRANSPORT"`
+	Username    string `yaml:"username" env:"SIP_USERNAME"`
+	Password    string `yaml:"password" env:"SIP_PASSWORD"`
+	DisplayName string `yaml:"display_name" env:"SIP_DISPLAY_NAME"`
+	ContactIP   string `yaml:"contact_ip" env:"SIP_CONTACT_IP"`
+	// AdvertiseIP and AdvertisePort are the Contact/Via address for 1:1 NAT: they replace
+	// SIP_CONTACT_IP (and STUN) without changing the bind address, which then defaults to
+	// every interface. AdvertisePort 0 advertises the listen port.
+	AdvertiseIP      string `yaml:"advertise_ip" env:"SIP_ADVERTISE_IP"`
+	AdvertisePort    int    `yaml:"advertise_port" env:"SIP_ADVERTISE_PORT"`
+	Listen           string `yaml:"listen" env:"SIP_LISTEN"`
+	PresenceFallback bool   `yaml:"presence_fallback" env:"SIP_PRESENCE_FALLBACK"`
+	SubscribeExpires int    `yaml:"subscribe_expires" env:"SIP_SUBSCRIBE_EXPIRES"` // seconds; 0 = 3600
+	RegisterExpires  int    `yaml:"register_expires" env:"SIP_REGISTER_EXPIRES"`   // seconds; 0 = 3600
+	// SubscribeConcurrency is how many SUBSCRIBEs are sent in parallel at startup; 0 = 8.
+	SubscribeConcurrency int `yaml:"subscribe_concurrency" env:"SIP_SUBSCRIBE_CONCURRENCY"`
+	// UnavailableRetries is how often a REGISTER or SUBSCRIBE answered 503 is retried
+	// (after its Retry-After) before it fails; 0 disables retries.
+	UnavailableRetries int `yaml:"unavailable_retries" env:"SIP_UNAVAILABLE_RETRIES"`
+	// LearnContact corrects a discovered Contact from the Via received/rport the PBX reports.
+	LearnContact bool `yaml:"learn_contact" env:"SIP_LEARN_CONTACT"`
+	// UserAgent is the User-Agent header of every request; ExtraHeaders ("Name: value") are
+	// added to REGISTER and SUBSCRIBE, e.g. for an SBC that routes on X-Tenant.
+	UserAgent    string   `yaml:"user_agent" env:"SIP_USER_AGENT"`
+	ExtraHeaders []string `yaml:"extra_headers" env:"SIP_EXTRA_HEADERS"`
+	// DigestURIHostOnly sends only the server host as the digest auth uri instead of the
+	// Request-URI, for PBXs that expect that form.
+	DigestURIHostOnly bool `yaml:"digest_uri_host_only" env:"SIP_DIGEST_URI_HOST_ONLY"`
+	// KeepaliveInterval is the OPTIONS keepalive period when behind NAT; 0 disables it.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval" env:"SIP_KEEPALIVE_INTERVAL"`
+	// TCPKeepaliveInterval is the CRLF ping period on the connection to the PBX with
+	// SIP_TRANSPORT=tcp; 0 disables it.
+	TCPKeepaliveInterval time.Duration `yaml:"tcp_keepalive_interval" env:"SIP_TCP_KEEPALIVE_INTERVAL"`
+	// StaleWindow flags subscriptions without a NOTIFY for this long (0 disables the
+	// watchdog); with StaleResubscribe they are replaced by a new SUBSCRIBE.
+	StaleWindow      time.Duration `yaml:"stale_window" env:"SIP_STALE_WINDOW"`
+	StaleResubscribe bool          `yaml:"stale_resubscribe" env:"SIP_STALE_RESUBSCRIBE"`
+}
+
+// STUNSettings configures public address discovery behind NAT.
+type STUNSettings struct {
+	Servers         []string      `yaml:"servers" env:"STUN_SERVERS"`
+	Transport       string        `yaml:"transport" env:"STUN_TRANSPORT"`
+	Family          string        `yaml:"family" env:"STUN_FAMILY"` // "" (any), ipv4 or ipv6
+	Parallel        bool          `yaml:"parallel" env:"STUN_PARALLEL"`
+	Strict          bool          `yaml:"strict" env:"STUN_STRICT"`
+	RefreshInterval time.Duration `yaml:"refresh_interval" env:"STUN_REFRESH_INTERVAL"`
+	// Timeout limits each binding request; a failed one is repeated Retries times before
+	// the next server is tried.
+	Timeout time.Duration `yaml:"timeout" env:"STUN_TIMEOUT"`
+	Retries int           `yaml:"retries" env:"STUN_RETRIES"`
+}
+
+// GraphSettings configures the Microsoft Graph app registration and session state.
+type GraphSettings struct {
+	TenantID     string `yaml:"tenant_id" env:"AZURE_TENANT_ID"`
+	ClientID     string `yaml:"client_id" env:"AZURE_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"AZURE_CLIENT_SECRET"`
+	// AuthMode is "app" (client credentials, default), "device-code" (delegated sign-in
+	// of one account, which can then only set its own presence) or "managed" (Azure managed
+	// or workload identity; ClientID optionally names a user-assigned identity).
+	AuthMode string `yaml:"auth_mode" env:"AUTH_MODE"`
+	// Cloud is "commercial" (default), "gcchigh", "dod" or "china"; BaseURL and Scope
+	// override its Graph service root and token scope.
+	Cloud     string `yaml:"cloud" env:"GRAPH_CLOUD"`
+	BaseURL   string `yaml:"base_url" env:"GRAPH_BASE_URL"`
+	Scope     string `yaml:"scope" env:"GRAPH_SCOPE"`
+	StatePath string `yaml:"state_path" env:"PRESENCE_STATE_JSON"`
+	// Expiration is the presence expiration (ISO 8601, PT5M to PT4H); extensions may override it.
+	Expiration string `yaml:"expiration" env:"PRESENCE_EXPIRATION"`
+	// Heartbeat re-sends each user's presence after half its expiration, so a state that
+	// lasts longer than the expiration (a long call) does not lapse in Teams.
+	Heartbeat bool `yaml:"heartbeat" env:"PRESENCE_HEARTBEAT"`
+	// TokenCheckInterval is how often the Graph token is re-acquired to detect failing
+	// credentials; 0 disables the check.
+	TokenCheckInterval time.Duration `yaml:"token_check_interval" env:"GRAPH_TOKEN_CHECK_INTERVAL"`
+	// BreakerThreshold consecutive failed writes for one user skip that user's writes for
+	// BreakerCooldown; 0 disables the breaker.
+	BreakerThreshold int           `yaml:"breaker_threshold" env:"GRAPH_BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown" env:"GRAPH_BREAKER_COOLDOWN"`
+	// Timeout limits each Graph request; 0 disables the limit.
+	Timeout time.Duration `yaml:"timeout" env:"GRAPH_TIMEOUT"`
+}
+
+// ExtensionsSettings selects the extension -> email source: inline entries, a
+// voicemail.conf, or a JSON/CSV file, in that order of preference. With Directory set,
+// emails found in the Graph directory replace those from the source.
+type ExtensionsSettings struct {
+	Path          string           `yaml:"path" env:"EXTENSIONS_JSON"`
+	VoicemailConf string           `yaml:"voicemail_conf" env:"VOICEMAIL_CONF"`
+	Inline        []ExtensionEntry `yaml:"inline"`
+	// Directory is the user attribute holding the extension ("businessPhones" or
+	// "extensionAttribute1"-"extensionAttribute15"); empty disables the lookup.
+	Directory        string        `yaml:"directory" env:"EXTENSIONS_DIRECTORY"`
+	DirectoryRefresh time.Duration `yaml:"directory_refresh" env:"EXTENSIONS_DIRECTORY_REFRESH"` // 0 = startup and SIGHUP only
+	// Normalize is how extensions are normalized before they are matched: "as-is" (default)
+	// or "digits" (see blf.NormalizeExtension).
+	Normalize string `yaml:"normalize" env:"EXTENSIONS_NORMALIZE"`
+}
+
+// MappingSettings overrides the Graph presence per BLF state ("Availability:Activity").
+type MappingSettings struct {
+	Idle    string `yaml:"idle" env:"MAP_IDLE"`
+	Ringing string `yaml:"ringing" env:"MAP_RINGING"`
+	Busy    string `yaml:"busy" env:"MAP_BUSY"`
+	OnHold  string `yaml:"onhold" env:"MAP_ONHOLD"`
+	// Conference is two or more active calls at once (default Busy:InAConferenceCall).
+	Conference string `yaml:"conference" env:"MAP_CONFERENCE"`
+	// IgnoreRinging leaves presence untouched while an extension rings (no Busy flicker
+	// for calls that are never answered).
+	IgnoreRinging bool `yaml:"ignore_ringing" env:"IGNORE_RINGING"`
+	// PresenceMode is "all" (default) or "confirmed-only", which writes presence for
+	// answered calls only: ringing is never written (implies IgnoreRinging).
+	PresenceMode string `yaml:"presence_mode" env:"PRESENCE_MODE"`
+	// RingingGraceMS delays the ringing write by this many milliseconds; calls answered
+	// or ended within it never show ringing (0 = write at once).
+	RingingGraceMS int `yaml:"ringing_grace_ms" env:"RINGING_GRACE_MS"`
+	// DND lists the indicators of Do Not Disturb in NOTIFY bodies (e.g. "dnd"); empty
+	// disables DND detection. DNDMapping overrides its Graph presence (DoNotDisturb:Presenting).
+	DND        []string `yaml:"dnd" env:"DND_MATCH"`
+	DNDMapping string   `yaml:"dnd_mapping" env:"MAP_DND"`
+	// QueueIdle and QueueBusy override the presence of queue entries (type "queue") without
+	// and with calls (default Available:Available and Busy:InACall).
+	QueueIdle string `yaml:"queue_idle" env:"MAP_QUEUE_IDLE"`
+	QueueBusy string `yaml:"queue_busy" env:"MAP_QUEUE_BUSY"`
+}
+
+// StatusMessageSettings configures the optional Teams status message set while on a call.
+// Template may contain {state} and {extension}; idle lines clear the message.
+type StatusMessageSettings struct {
+	Enabled  bool          `yaml:"enabled" env:"STATUS_MESSAGE_ENABLED"`
+	Template string        `yaml:"template" env:"STATUS_MESSAGE_TEMPLATE"`
+	TTL      time.Duration `yaml:"ttl" env:"STATUS_MESSAGE_TTL"` // expiry safety net; 0 disables
+	// MinInterval spaces status message writes per user; changes in between are coalesced.
+	MinInterval time.Duration `yaml:"min_interval" env:"STATUS_MESSAGE_MIN_INTERVAL"`
+}
+
+// HealthSettings configures the optional health and metrics HTTP server.
+type HealthSettings struct {
+	Listen         string `yaml:"listen" env:"HEALTH_LISTEN"`
+	MetricsEnabled bool   `yaml:"metrics_enabled" env:"METRICS_ENABLED"`
+	// OverrideToken enables the presence override API (/override) on the listener; requests
+	// must send it as a bearer token.
+	OverrideToken string `yaml:"override_token" env:"OVERRIDE_TOKEN"`
+}
+
+// WebhookSettings configures the optional outbound webhook for BLF state changes.
+type WebhookSettings struct {
+	URL     string        `yaml:"url" env:"WEBHOOK_URL"`
+	Secret  string        `yaml:"secret" env:"WEBHOOK_SECRET"`
+	Timeout time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT"`
+	Retries int           `yaml:"retries" env:"WEBHOOK_RETRIES"`
+}
+
+// PreferredSettings configures the optional scheduled preferred presence: Presence
+// ("Availability:Activity") is set for every user while Schedule (weekly windows in local
+// time, see parseSchedule) is active. Both or neither must be set.
+type PreferredSettings struct {
+	Presence string `yaml:"presence" env:"PREFERRED_PRESENCE"`
+	Schedule string `yaml:"schedule" env:"PREFERRED_PRESENCE_SCHEDULE"`
+}
+
+// BusinessHoursSettings configures the optional business hours: outside the Schedule
+// windows (see parseSchedule) in TimeZone (IANA name; default the host's local time),
+// BLF updates are skipped or a fixed presence is written, as Outside says (skip,
+// available or offline; default skip).
+type BusinessHoursSettings struct {
+	Schedule string `yaml:"schedule" env:"BUSINESS_HOURS"`
+	TimeZone string `yaml:"timezone" env:"BUSINESS_HOURS_TZ"`
+	Outside  string `yaml:"outside" env:"BUSINESS_HOURS_OUTSIDE"`
+}
+
+// OutageSettings configures what happens to presence when a PBX is lost: once it has
+// been unregistered, or without any active subscription, for Grace, its users get the
+// Presence policy (leave, available or clear; default leave) until it is back.
+type OutageSettings struct {
+	Presence string        `yaml:"presence" env:"OUTAGE_PRESENCE"`
+	Grace    time.Duration `yaml:"grace" env:"OUTAGE_GRACE"`
+}
+
+// AuditSettings configures the optional audit log of presence changes.
+type AuditSettings struct {
+	Path      string `yaml:"path" env:"AUDIT_LOG"`
+	MaxSizeMB int    `yaml:"max_size_mb" env:"AUDIT_LOG_MAX_MB"` // rotate at this size; 0 = never
+}
+
+// LogSettings configures the log handler.
+type LogSettings struct {
+	Format string `yaml:"format" env:"LOG_FORMAT"` // text or json
+	Level  string `yaml:"level" env:"LOG_LEVEL"`   // debug, info, warn or error
+}
+
+// defaultConfig returns the configuration used when neither the file nor the
+// environment sets a value.
+func defaultConfig() AppConfig {
+	return AppConfig{
+		SIP: SIPSettings{
+			Server:            "127.0.0.1:5060",
+			Transport:         "udp",
+			Username:          "blf-client",
+			ContactIP:         "127.0.0.1",
+			UserAgent:         "teams-freepbx-blf/1.0",
+			PresenceFallback:  true,
+			LearnContact:      true,
+			KeepaliveInterval: 25 * time.Second,
+
+			TCPKeepaliveInterval: 30 * time.Second,
+
+			UnavailableRetries: 3,
+		},
+		STUN: STUNSettings{
+			Servers:   []string{"stun.l.google.com", "stun2.l.google.com", "stun3.l.google.com", "stun4.l.google.com"},
+			Transport: "udp",
+			Timeout:   3 * time.Second,
+			Retries:   2,
+		},
+		Graph: GraphSettings{
+			StatePath:          "config/presence-state.json",
+			Expiration:         "PT1H",
+			TokenCheckInterval: 5 * time.Minute,
+			BreakerThreshold:   5,
+			BreakerCooldown:    5 * time.Minute,
+			Timeout:            10 * time.Second,
+		},
+		Extensions:    ExtensionsSettings{Path: "config/extensions.json", DirectoryRefresh: time.Hour},
+		StatusMessage: StatusMessageSettings{Template: "On a call", TTL: time.Hour, MinInterval: 30 * time.Second},
+		Outage:        OutageSettings{Grace: 2 * time.Minute},
+		Health:        HealthSettings{MetricsEnabled: true},
+		Webhook:       WebhookSettings{Timeout: 5 * time.Second, Retries: 3},
+		Audit:         AuditSettings{MaxSizeMB: 100},
+		Log:           LogSettings{Format: "text", Level: "info"},
+	}
+}
+
+// LoadConfig returns the defaults, overlaid with the YAML file at path (skipped when
+// path is empty) and then with any environment variables that are set.
+func LoadConfig(path string) (*AppConfig, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem()); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// applyEnv walks v and sets each field tagged `env` from the environment when the
+// variable is non-empty. Strings are trimmed; string slices are comma-separated.
+// An unrecognised boolean keeps the current value, matching the old env-only behavior.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			if fv.Kind() == reflect.Struct {
+				if err := applyEnv(fv); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		val := strings.TrimSpace(raw)
+		switch {
+		case fv.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			fv.SetInt(int64(d))
+		case fv.Kind() == reflect.String:
+			if key == "SIP_PASSWORD" || key == "AZURE_CLIENT_SECRET" || key == "WEBHOOK_SECRET" || key == "OVERRIDE_TOKEN" {
+				val = raw // secrets are used verbatim
+			}
+			fv.SetString(val)
+		case fv.Kind() == reflect.Bool:
+			if b, ok := parseBool(val); ok {
+				fv.SetBool(b)
+			}
+		case fv.Kind() == reflect.Int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			fv.SetInt(int64(n))
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+			var list []string
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			fv.Set(reflect.ValueOf(list))
+		default:
+			return fmt.Errorf("%s: unsupported config field type %s", key, fv.Type())
+		}
+	}
+	return nil
+}
+
+// parseBool accepts true/false, 1/0, yes/no and on/off (case-insensitive).
+func parseBool(v string) (bool, bool) {
+	switch strings.ToLower(v) {
+	case "yes", "on":
+		return true, true
+	case "no", "off":
+		return false, true
+	}
+	b, err := strconv.ParseBool(v)
+	return b, err == nil
+}
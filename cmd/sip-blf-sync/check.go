@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+	"github.com/darrenwiebe/teams_freepbx/internal/sip"
+)
+
+// errCheckFailed is returned by runCheck when at least one check failed.
+var errCheckFailed = errors.New("check failed")
+
+// checkReport prints the outcome of each check of the check subcommand as one line.
+type checkReport struct {
+	out    io.Writer
+	failed int
+}
+
+// ok reports a passed check.
+func (r *checkReport) ok(name, format string, args ...any) {
+	fmt.Fprintf(r.out, "ok    %-16s %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// skip reports a check that does not apply to the configuration.
+func (r *checkReport) skip(name, format string, args ...any) {
+	fmt.Fprintf(r.out, "skip  %-16s %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// fail reports a failed check; runCheck then returns errCheckFailed.
+func (r *checkReport) fail(name string, err error) {
+	r.failed++
+	fmt.Fprintf(r.out, "FAIL  %-16s %v\n", name, err)
+}
+
+// result reports err as a failure, or the check as passed with the given detail.
+func (r *checkReport) result(name string, err error, detail string) bool {
+	if err != nil {
+		r.fail(name, err)
+		return false
+	}
+	r.ok(name, "%s", detail)
+	return true
+}
+
+// runCheck implements "sip-blf-sync check [-timeout d] [-v]": a pre-flight check of the
+// configuration from the environment or CONFIG_FILE without going live. It validates the
+// settings and the extensions, acquires a Graph token and looks up the first extension's
+// user, runs STUN when the Contact is discovered, and REGISTERs once with every PBX. Each
+// check prints one line to stdout; it returns errCheckFailed when any failed. Nothing is
+// subscribed and no presence is written; the registration is left to expire.
+func runCheck(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	timeout := fs.Duration("timeout", 15*time.Second, "time limit of each network check")
+	verbose := fs.Bool("v", false, "log at LOG_LEVEL to stderr (default: warnings and errors only)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: sip-blf-sync check [-timeout d] [-v]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errors.New("check: no arguments expected")
+	}
+
+	r := &checkReport{out: stdout}
+	cfg, err := LoadConfig(strings.TrimSpace(os.Getenv("CONFIG_FILE")))
+	if !r.result("config", err, firstNonEmpty(os.Getenv("CONFIG_FILE"), "environment")) {
+		return errCheckFailed
+	}
+	logSettings := cfg.Log
+	if !*verbose {
+		logSettings.Level = "warn"
+	}
+	logger, err := newLogger(logSettings, stderr)
+	if !r.result("log", err, cfg.Log.Format+", "+cfg.Log.Level) {
+		logger = slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	}
+	slog.SetDefault(logger)
+
+	policy := preflightSettings(r, cfg)
+
+	ctx := context.Background()
+	graphClient := preflightGraph(ctx, r, cfg, logger, *timeout)
+	if graphClient != nil {
+		defer graphClient.Close()
+	}
+	extensions := preflightExtensions(ctx, r, cfg, graphClient, *timeout)
+	if graphClient != nil && len(extensions) > 0 {
+		first := slices.MinFunc(extensions, func(a, b ExtensionEntry) int { return strings.Compare(a.Extension, b.Extension) })
+		lookupCtx, cancel := context.WithTimeout(ctx, *timeout)
+		id, err := graphClient.ResolveUser(lookupCtx, first.Email)
+		cancel()
+		r.result("graph user", err, fmt.Sprintf("%s (extension %s) is %s", first.Email, first.Extension, id))
+	}
+	preflightSIP(ctx, r, cfg, extensions, policy, *timeout)
+
+	if r.failed > 0 {
+		fmt.Fprintf(stdout, "%d check(s) failed\n", r.failed)
+		return errCheckFailed
+	}
+	fmt.Fprintln(stdout, "all checks passed")
+	return nil
+}
+
+// preflightSettings validates the settings main checks at startup, one report line each,
+// and returns the EXTENSIONS_NORMALIZE policy.
+func preflightSettings(r *checkReport, cfg *AppConfig) string {
+	_, err := graph.ParseExpiration(cfg.Graph.Expiration)
+	r.result("expiration", err, cfg.Graph.Expiration)
+
+	mapping, err := loadStateMapping(cfg.Mapping)
+	if err == nil {
+		_, err = loadQueueMapping(cfg.Mapping)
+	}
+	if err == nil {
+		_, err = parsePresenceMode(cfg.Mapping.PresenceMode)
+	}
+	if err == nil && cfg.Mapping.RingingGraceMS < 0 {
+		err = errors.New("RINGING_GRACE_MS must not be negative")
+	}
+	if err == nil {
+		availability, activity := mapping.ToGraph(blf.StateBusy)
+		r.ok("mapping", "busy is %s/%s", availability, activity)
+	} else {
+		r.fail("mapping", err)
+	}
+
+	policy, err := blf.ParseExtensionPolicy(cfg.Extensions.Normalize)
+	r.result("normalize", err, policy)
+
+	_, err = sip.ParseExtraHeaders(cfg.SIP.ExtraHeaders)
+	r.result("sip headers", err, fmt.Sprintf("%d extra", len(cfg.SIP.ExtraHeaders)))
+
+	if hours, err := newBusinessHours(cfg.BusinessHours); err != nil {
+		r.fail("business hours", err)
+	} else if hours == nil {
+		r.skip("business hours", "BUSINESS_HOURS not set")
+	} else {
+		r.ok("business hours", "open now: %t", hours.open())
+	}
+
+	if preferred, err := newPreferredSchedule(cfg.Preferred, dryRunSink{log: slog.Default()}, nil); err != nil {
+		r.fail("preferred", err)
+	} else if preferred == nil {
+		r.skip("preferred", "PREFERRED_PRESENCE not set")
+	} else {
+		r.ok("preferred", "%s/%s", preferred.availability, preferred.activity)
+	}
+
+	outage, err := parseOutagePresence(cfg.Outage.Presence)
+	if err == nil && cfg.Outage.Grace < 0 {
+		err = errors.New("OUTAGE_GRACE must not be negative")
+	}
+	r.result("outage", err, outage)
+	return policy
+}
+
+// preflightGraph creates the Graph client and acquires a token; it returns nil when DRY_RUN
+// is set or either step failed.
+func preflightGraph(ctx context.Context, r *checkReport, cfg *AppConfig, logger *slog.Logger, timeout time.Duration) *graph.Client {
+	if cfg.DryRun {
+		r.skip("graph token", "DRY_RUN: Graph is not used")
+		return nil
+	}
+	auth, err := graphAuth(cfg.Graph)
+	if err != nil {
+		r.fail("graph token", err)
+		return nil
+	}
+	client, err := graph.NewReadOnlyClient(auth, cfg.Graph.StatePath, logger)
+	if err != nil {
+		r.fail("graph token", err)
+		return nil
+	}
+	client.SetTimeout(cfg.Graph.Timeout)
+	tokenCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.CheckToken(tokenCtx); err != nil {
+		if graph.IsAuthError(err) {
+			err = fmt.Errorf("credentials rejected: %w", err)
+		}
+		r.fail("graph token", err)
+		client.Close()
+		return nil
+	}
+	r.ok("graph token", "acquired (%s, %s)", auth.Mode, auth.Cloud)
+	return client
+}
+
+// preflightExtensions loads and validates the extensions, with the directory when
+// EXTENSIONS_DIRECTORY is set and graphClient is not nil.
+func preflightExtensions(ctx context.Context, r *checkReport, cfg *AppConfig, graphClient *graph.Client, timeout time.Duration) []ExtensionEntry {
+	var directory *directorySource
+	if cfg.Extensions.Directory != "" {
+		attribute, err := graph.ParseDirectoryAttribute(cfg.Extensions.Directory)
+		switch {
+		case err != nil:
+			r.fail("directory", err)
+		case graphClient == nil:
+			r.skip("directory", "no Graph client")
+		default:
+			directory = &directorySource{client: graphClient, attribute: attribute}
+		}
+	}
+	loadCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	extensions, loadedFrom, err := loadExtensionsWithDirectory(loadCtx, cfg.Extensions, directory)
+	if err == nil {
+		extensions, _, err = validateExtensions(extensions)
+	}
+	if err == nil && len(extensions) == 0 {
+		err = errors.New("no extensions")
+	}
+	if !r.result("extensions", err, fmt.Sprintf("%d from %s", len(extensions), loadedFrom)) {
+		return nil
+	}
+	return extensions
+}
+
+// preflightSIP resolves the Contact (running STUN when it is discovered) and REGISTERs once
+// with every PBX the extensions name.
+func preflightSIP(ctx context.Context, r *checkReport, cfg *AppConfig, extensions []ExtensionEntry, policy string, timeout time.Duration) {
+	extraHeaders, err := sip.ParseExtraHeaders(cfg.SIP.ExtraHeaders)
+	if err != nil {
+		r.skip("sip register", "invalid SIP_EXTRA_HEADERS")
+		return
+	}
+	sipCfg := sipConfig(cfg, extraHeaders, policy)
+	webSocket := sip.IsWebSocket(sipCfg.Transport)
+	advertised, err := applyAdvertise(&sipCfg, cfg.SIP.AdvertiseIP, cfg.SIP.AdvertisePort)
+	if err != nil {
+		r.fail("contact", err)
+		return
+	}
+	switch {
+	case webSocket:
+		r.skip("stun", "SIP over WebSocket")
+	case advertised:
+		r.skip("stun", "SIP_ADVERTISE_IP is set")
+	case !sip.IsContactSentinel(sipCfg.ContactIP):
+		r.skip("stun", "SIP_CONTACT_IP is set")
+	default:
+		err := sip.ResolveContactIfNeeded(&sipCfg, slog.Default())
+		if err == nil && sip.IsContactSentinel(sipCfg.ContactIP) {
+			err = errors.New("no public address discovered; check STUN_SERVERS and the network")
+		}
+		if !r.result("stun", err, "public address "+sipCfg.ContactIP) {
+			return
+		}
+	}
+
+	listenSetting := cfg.SIP.Listen
+	if advertised && strings.TrimSpace(listenSetting) == "" {
+		listenSetting = wildcardListenAddr(sipCfg.ContactIP)
+	}
+	listen, err := listenAddr(listenSetting, sipCfg)
+	if err != nil {
+		r.fail("sip listen", err)
+		return
+	}
+	sipCfg.ContactPort = contactPortFor(sipCfg, listen)
+	servers, byServer := groupByServer(extensions, cfg.SIP.Server)
+	if len(servers) == 0 {
+		servers = []string{cfg.SIP.Server}
+	}
+	for i, server := range servers {
+		name := "sip " + server
+		p, err := newPBX(ctx, sipCfg, server, i, listen, byServer[server], nil)
+		if err != nil {
+			r.fail(name, err)
+			continue
+		}
+		r.result(name, preflightRegister(ctx, p, timeout), fmt.Sprintf("registered as %s (listen %s)", cfg.SIP.Username, p.listen))
+		p.client.Close()
+	}
+}
+
+// preflightRegister listens on the PBX's SIP address, so the response can arrive, sends one
+// REGISTER and then removes the binding. A listen address in use usually means the service
+// is already running.
+func preflightRegister(ctx context.Context, p *pbx, timeout time.Duration) error {
+	if !sip.IsWebSocket(p.cfg.Transport) {
+		if err := probeListen(p.cfg.Transport, p.listen); err != nil {
+			return fmt.Errorf("listen on %s (is the service running?): %w", p.listen, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ready := make(chan struct{})
+	started := sync.OnceFunc(func() { close(ready) }) // Serve may restart the listener
+	if sip.IsWebSocket(p.cfg.Transport) {
+		started() // no listener
+	}
+	serveCtx := context.WithValue(ctx, sipgo.ListenReadyCtxKey, sipgo.ListenReadyFuncCtxValue(func(_, _ string) { started() }))
+	go p.client.Serve(serveCtx, p.cfg.Transport, p.listen)
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return fmt.Errorf("SIP listener on %s did not start within %s", p.listen, timeout)
+	}
+	if _, err := p.client.Register(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("no answer to REGISTER within %s", timeout)
+		}
+		return err
+	}
+	// Remove the binding again, so the PBX does not keep a Contact nothing listens on.
+	if err := p.client.Unregister(ctx); err != nil {
+		return fmt.Errorf("registered, but the unregister (Expires: 0) failed: %w", err)
+	}
+	return nil
+}
+
+// probeListen reports whether the SIP listener could bind addr for transport.
+func probeListen(transport, addr string) error {
+	if strings.EqualFold(strings.TrimSpace(transport), "udp") {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
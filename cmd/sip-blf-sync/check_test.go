@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// startPBX runs a SIP server on TCP answering every REGISTER with 200 OK and returns its
+// address.
+func startPBX(t *testing.T) string {
+	t.Helper()
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ua.Close() })
+	pbx, err := sipgo.NewServer(ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbx.OnRegister(func(req *sip.Request, tx sip.ServerTransaction) {
+		res := sip.NewResponseFromRequest(req, 200, "OK", nil)
+		res.AppendHeader(sip.NewHeader("Expires", "60"))
+		tx.Respond(res)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	addr := make(chan string, 1)
+	ready := sipgo.ListenReadyFuncCtxValue(func(_, a string) { addr <- a })
+	go pbx.ListenAndServe(context.WithValue(ctx, sipgo.ListenReadyCtxKey, ready), "tcp", "127.0.0.1:0")
+	select {
+	case a := <-addr:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatal("PBX listener not ready")
+	}
+	return ""
+}
+
+// freeAddr returns a TCP address on 127.0.0.1 nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestRunCheck(t *testing.T) {
+	dir := t.TempDir()
+	extensions := filepath.Join(dir, "extensions.json")
+	if err := os.WriteFile(extensions, []byte(`[{"extension":"101","email":"alice@example.com"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("DRY_RUN", "true")
+	t.Setenv("EXTENSIONS_JSON", extensions)
+	t.Setenv("SIP_TRANSPORT", "tcp")
+	t.Setenv("SIP_SERVER", startPBX(t))
+	t.Setenv("SIP_CONTACT_IP", "127.0.0.1")
+	t.Setenv("SIP_LISTEN", freeAddr(t))
+
+	var out strings.Builder
+	if err := runCheck([]string{"-timeout", "5s"}, &out, io.Discard); err != nil {
+		t.Fatalf("runCheck: %v\n%s", err, &out)
+	}
+	for _, want := range []string{
+		"ok    mapping          busy is Busy/InACall",
+		"ok    extensions       1 from " + extensions,
+		"skip  graph token      DRY_RUN",
+		"skip  stun             SIP_CONTACT_IP is set",
+		"registered as blf-client",
+		"all checks passed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, &out)
+		}
+	}
+
+	t.Setenv("MAP_BUSY", "Sleeping")
+	t.Setenv("SIP_SERVER", freeAddr(t))
+	out.Reset()
+	err := runCheck([]string{"-timeout", "1s"}, &out, io.Discard)
+	if !errors.Is(err, errCheckFailed) {
+		t.Fatalf("runCheck with a bad mapping and no PBX = %v, want errCheckFailed", err)
+	}
+	for _, want := range []string{"FAIL  mapping", "FAIL  sip 127.0.0.1:", "2 check(s) failed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, &out)
+		}
+	}
+}
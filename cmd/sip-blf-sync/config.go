@@ -1,21 +1,56 @@
 package main
 
 import (
+	"bytes"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
 	"github.com/darrenwiebe/teams_freepbx/internal/sip"
 )
 
 const generalSection = "general"
 
-// ExtensionEntry is one row from extensions.json or extensions.csv.
+// Entry types (ExtensionEntry.Type).
+const (
+	entryTypeUser  = "user"  // a phone extension: each call state maps to a presence
+	entryTypeQueue = "queue" // a queue or ring-group hint: any call maps to the queue busy presence
+)
+
+// errNoExtensionsFile is returned by loadExtensionsFromPath when neither file exists.
+var errNoExtensionsFile = errors.New("extensions file not found")
+
+// ExtensionEntry is one row from extensions.json or extensions.csv. Extension may be a
+// range ("2000-2050") or wildcard ("20??"), which expandExtensions turns into one entry
+// per extension.
 type ExtensionEntry struct {
-	Extension string `json:"extension"`
-	Email     string `json:"email"`
+	Extension string `json:"extension" yaml:"extension"`
+	Email     string `json:"email" yaml:"email"`
+	// Expiration optionally overrides the presence expiration for this extension
+	// (ISO 8601, PT5M to PT4H, e.g. "PT20M").
+	Expiration string `json:"expiration,omitempty" yaml:"expiration,omitempty"`
+	// Server is the PBX (host or host:port) the extension lives on; empty means SIP_SERVER.
+	Server string `json:"server,omitempty" yaml:"server,omitempty"`
+	// Type is "user" (default) or "queue" for a queue or ring-group hint, whose state
+	// maps to presence with MAP_QUEUE_* (see presenceSync.onBLF).
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	line       int           // source line for validation messages; 0 when unknown
+	entry      int           // 1-based position in the source before expansion; 0 when unknown
+	spec       string        // range or wildcard this entry was expanded from
+	specErr    error         // why spec could not be expanded
+	expiration time.Duration // parsed Expiration, set by validateExtensions
 }
 
 func loadExtensions(path string) ([]ExtensionEntry, error) {
@@ -23,15 +58,40 @@ func loadExtensions(path string) ([]ExtensionEntry, error) {
 	if err != nil {
 		return nil, err
 	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("%s: expected a JSON array of entries", path)
+	}
 	var list []ExtensionEntry
-	if err := json.Unmarshal(data, &list); err != nil {
+	for dec.More() {
+		line := lineAt(data, dec.InputOffset())
+		var e ExtensionEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		e.line = line
+		list = append(list, e)
+	}
+	if _, err := dec.Token(); err != nil {
 		return nil, err
 	}
 	return list, nil
 }
 
-// loadExtensionsCSV reads extension,email rows from a CSV file. Optional header row
-// "extension,email" (case-insensitive) is detected and skipped. Spaces are trimmed; empty rows skipped.
+// lineAt returns the 1-based line of the first value character at or after offset,
+// skipping whitespace and the comma separating array elements.
+func lineAt(data []byte, offset int64) int {
+	i := int(offset)
+	for i < len(data) && strings.ContainsRune(" \t\r\n,", rune(data[i])) {
+		i++
+	}
+	return bytes.Count(data[:i], []byte("\n")) + 1
+}
+
+// loadExtensionsCSV reads extension,email[,expiration[,server[,type]]] rows from a CSV file. An optional
+// header row starting "extension,email" (case-insensitive) is detected and skipped. Spaces are trimmed; empty rows skipped.
 func loadExtensionsCSV(path string) ([]ExtensionEntry, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -39,12 +99,17 @@ func loadExtensionsCSV(path string) ([]ExtensionEntry, error) {
 	}
 	defer f.Close()
 	r := csv.NewReader(f)
-	records, err := r.ReadAll()
-	if err != nil {
-		return nil, err
-	}
+	r.FieldsPerRecord = -1
 	var list []ExtensionEntry
-	for i, rec := range records {
+	for i := 0; ; i++ {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
 		if len(rec) < 2 {
 			continue
 		}
@@ -57,7 +122,17 @@ func loadExtensionsCSV(path string) ([]ExtensionEntry, error) {
 		if i == 0 && strings.EqualFold(ext, "extension") && strings.EqualFold(email, "email") {
 			continue
 		}
-		list = append(list, ExtensionEntry{Extension: ext, Email: email})
+		e := ExtensionEntry{Extension: ext, Email: email, line: line}
+		if len(rec) > 2 {
+			e.Expiration = strings.TrimSpace(rec[2])
+		}
+		if len(rec) > 3 {
+			e.Server = strings.TrimSpace(rec[3])
+		}
+		if len(rec) > 4 {
+			e.Type = strings.TrimSpace(rec[4])
+		}
+		list = append(list, e)
 	}
 	return list, nil
 }
@@ -77,7 +152,7 @@ func loadExtensionsVoicemail(path string) ([]ExtensionEntry, error) {
 	var list []ExtensionEntry
 	seen := make(map[string]bool)
 	var section string
-	for _, line := range lines {
+	for n, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
@@ -111,7 +186,7 @@ func loadExtensionsVoicemail(path string) ([]ExtensionEntry, error) {
 			continue
 		}
 		seen[key] = true
-		list = append(list, ExtensionEntry{Extension: key, Email: email})
+		list = append(list, ExtensionEntry{Extension: key, Email: email, line: n + 1})
 	}
 	return list, nil
 }
@@ -134,24 +209,328 @@ func loadExtensionsFromPath(path string) ([]ExtensionEntry, string, error) {
 			list, err := loadExtensionsCSV(csvPath)
 			return list, csvPath, err
 		}
-		return nil, "", errors.New("extensions file not found: tried " + path + " and " + csvPath)
+		return nil, "", fmt.Errorf("%w: tried %s and %s", errNoExtensionsFile, path, csvPath)
+	}
+	return nil, "", fmt.Errorf("%w: %s", errNoExtensionsFile, path)
+}
+
+// loadExtensionSource loads extensions from the inline list when present, from
+// VoicemailConf when set, otherwise from Path (with the CSV fallback), and expands range
+// and wildcard entries. Returns the list and where it was loaded from.
+func loadExtensionSource(cfg ExtensionsSettings) ([]ExtensionEntry, string, error) {
+	list, from, err := loadExtensionRows(cfg)
+	return expandExtensions(list), from, err
+}
+
+// loadExtensionRows is loadExtensionSource without the expansion.
+func loadExtensionRows(cfg ExtensionsSettings) ([]ExtensionEntry, string, error) {
+	if len(cfg.Inline) > 0 {
+		return cfg.Inline, "config file (inline)", nil
+	}
+	voicemailConf := strings.TrimSpace(cfg.VoicemailConf)
+	if voicemailConf != "" {
+		if _, err := os.Stat(voicemailConf); err != nil {
+			return nil, "", fmt.Errorf("voicemail conf file not found: %w", err)
+		}
+		list, err := loadExtensionsVoicemail(voicemailConf)
+		return list, voicemailConf, err
+	}
+	return loadExtensionsFromPath(cfg.Path)
+}
+
+// validateExtensions checks loaded entries: every row needs an extension and an email that
+// parses as a bare address (net/mail), an optional expiration must be within Graph's
+// PT5M-PT4H range, an optional type must be "user" or "queue" (set to "user" when empty),
+// a range or wildcard must expand (see expandExtensions), and an extension may appear only
+// once. It returns the valid rows, warnings for emails shared by several
+// extensions (except those expanded from one row), and an error listing every bad row by
+// line (or entry number when the source has no lines).
+func validateExtensions(list []ExtensionEntry) (valid []ExtensionEntry, warnings []string, err error) {
+	var errs []error
+	extAt := make(map[string]string)   // extension -> where first seen
+	emailAt := make(map[string]string) // lower-case email -> where first seen
+	for i, e := range list {
+		where := fmt.Sprintf("entry %d", i+1)
+		if e.line > 0 {
+			where = fmt.Sprintf("line %d", e.line)
+		} else if e.entry > 0 {
+			where = fmt.Sprintf("entry %d", e.entry)
+		}
+		if e.specErr != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, e.specErr))
+			continue
+		}
+		if e.Extension == "" {
+			errs = append(errs, fmt.Errorf("%s: missing extension", where))
+			continue
+		}
+		if addr, perr := mail.ParseAddress(e.Email); perr != nil || addr.Address != e.Email {
+			errs = append(errs, fmt.Errorf("%s: extension %s: invalid email %q", where, e.Extension, e.Email))
+			continue
+		}
+		if first, dup := extAt[e.Extension]; dup {
+			errs = append(errs, fmt.Errorf("%s: duplicate extension %s (first at %s)", where, e.Extension, first))
+			continue
+		}
+		if e.Expiration != "" {
+			d, perr := graph.ParseExpiration(e.Expiration)
+			if perr != nil {
+				errs = append(errs, fmt.Errorf("%s: extension %s: %w", where, e.Extension, perr))
+				continue
+			}
+			e.expiration = d
+		}
+		switch t := strings.ToLower(strings.TrimSpace(e.Type)); t {
+		case "", entryTypeUser:
+			e.Type = entryTypeUser
+		case entryTypeQueue:
+			e.Type = t
+		default:
+			errs = append(errs, fmt.Errorf("%s: extension %s: type %q: want %q or %q", where, e.Extension, e.Type, entryTypeUser, entryTypeQueue))
+			continue
+		}
+		extAt[e.Extension] = where
+		key := strings.ToLower(e.Email)
+		if first, dup := emailAt[key]; dup && !(e.spec != "" && first == where) {
+			warnings = append(warnings, fmt.Sprintf("%s: email %s also used at %s", where, e.Email, first))
+		} else {
+			emailAt[key] = where
+		}
+		valid = append(valid, e)
+	}
+	return valid, warnings, errors.Join(errs...)
+}
+
+// emailMap builds the extension -> email lookup used by the BLF callback, keyed by the
+// extensions normalized per policy (see blf.NormalizeExtension) like the BLF updates.
+func emailMap(extensions []ExtensionEntry, policy string) map[string]string {
+	m := make(map[string]string, len(extensions))
+	for _, e := range extensions {
+		m[blf.NormalizeExtension(e.Extension, policy)] = e.Email
 	}
-	return nil, "", errors.New("extensions file not found: " + path)
+	return m
 }
 
-func getEnv(key, defaultVal string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// expirationMap builds the extension -> presence expiration lookup for entries that
+// override the global expiration, keyed like emailMap.
+func expirationMap(extensions []ExtensionEntry, policy string) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, e := range extensions {
+		if e.expiration > 0 {
+			m[blf.NormalizeExtension(e.Extension, policy)] = e.expiration
+		}
+	}
+	return m
+}
+
+// queueMap builds the set of queue extensions (type "queue"), keyed like emailMap.
+func queueMap(extensions []ExtensionEntry, policy string) map[string]bool {
+	m := make(map[string]bool)
+	for _, e := range extensions {
+		if e.Type == entryTypeQueue {
+			m[blf.NormalizeExtension(e.Extension, policy)] = true
+		}
+	}
+	return m
+}
+
+// groupByServer splits the extensions by PBX. Entries without a server (or naming
+// defaultServer) belong to defaultServer, which always comes first; other servers follow
+// in order of first appearance.
+func groupByServer(extensions []ExtensionEntry, defaultServer string) (servers []string, byServer map[string][]string) {
+	defaultServer = strings.TrimSpace(defaultServer)
+	servers = []string{defaultServer}
+	byServer = map[string][]string{defaultServer: nil}
+	for _, e := range extensions {
+		server := firstNonEmpty(strings.TrimSpace(e.Server), defaultServer)
+		if _, ok := byServer[server]; !ok {
+			servers = append(servers, server)
+		}
+		byServer[server] = append(byServer[server], e.Extension)
 	}
-	return defaultVal
+	return servers, byServer
+}
+
+// diffExtensions returns the extensions present in next but not in prev (added) and
+// those present in prev but not in next (removed).
+func diffExtensions(prev, next map[string]string) (added, removed []string) {
+	for ext := range next {
+		if _, ok := prev[ext]; !ok {
+			added = append(added, ext)
+		}
+	}
+	for ext := range prev {
+		if _, ok := next[ext]; !ok {
+			removed = append(removed, ext)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	return added, removed
+}
+
+// firstNonEmpty returns the first non-empty value.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// loadStateMapping builds the per-state Graph overrides from MAP_IDLE, MAP_RINGING,
+// MAP_BUSY, MAP_ONHOLD, MAP_CONFERENCE and MAP_DND (each "Availability:Activity", e.g. MAP_RINGING=Away:Away).
+// Unset states keep the default mapping; an invalid value is returned as an error.
+func loadStateMapping(m MappingSettings) (blf.Mapping, error) {
+	mapping := make(blf.Mapping)
+	values := map[blf.State]string{
+		blf.StateIdle:    m.Idle,
+		blf.StateRinging: m.Ringing,
+		blf.StateBusy:    m.Busy,
+		blf.StateOnHold:  m.OnHold,
+
+		blf.StateConference: m.Conference,
+		blf.StateDND:        m.DNDMapping,
+	}
+	for _, st := range []blf.State{blf.StateIdle, blf.StateRinging, blf.StateBusy, blf.StateOnHold, blf.StateConference, blf.StateDND} {
+		key := "MAP_" + strings.ToUpper(string(st))
+		v := strings.TrimSpace(values[st])
+		if v == "" {
+			continue
+		}
+		pair, err := blf.ParseMappingValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		mapping[st] = pair
+	}
+	return mapping, nil
+}
+
+// loadQueueMapping parses the MAP_QUEUE_* overrides into the mapping of queue entries,
+// which only have the idle and busy states (see queueState).
+func loadQueueMapping(m MappingSettings) (blf.Mapping, error) {
+	mapping := make(blf.Mapping)
+	for st, v := range map[blf.State]string{blf.StateIdle: m.QueueIdle, blf.StateBusy: m.QueueBusy} {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		pair, err := blf.ParseMappingValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("MAP_QUEUE_%s: %w", strings.ToUpper(string(st)), err)
+		}
+		mapping[st] = pair
+	}
+	return mapping, nil
+}
+
+// Presence modes (PRESENCE_MODE).
+const (
+	presenceModeAll           = "all"
+	presenceModeConfirmedOnly = "confirmed-only"
+)
+
+// parsePresenceMode checks a PRESENCE_MODE value; "" means presenceModeAll.
+func parsePresenceMode(s string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(s)); mode {
+	case "", presenceModeAll:
+		return presenceModeAll, nil
+	case presenceModeConfirmedOnly:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("presence mode %q: want %q or %q", s, presenceModeAll, presenceModeConfirmedOnly)
+	}
+}
+
+// statusMessageFor renders the status message for a BLF state: empty (clear) when idle or
+// in Do Not Disturb (not a call), otherwise template with {state} and {extension} substituted. ok is false for
+// StateUnknown, where the current message is left alone.
+func statusMessageFor(template, extension string, state blf.State) (message string, ok bool) {
+	switch state {
+	case blf.StateUnknown:
+		return "", false
+	case blf.StateIdle, blf.StateDND:
+		return "", true
+	}
+	return strings.NewReplacer("{state}", string(state), "{extension}", extension).Replace(template), true
+}
+
+// listenAddr returns the SIP bind address: SIP_LISTEN (setting) whenever it is set, so a
+// specific interface or port can be bound whatever the Contact, otherwise
+// defaultListenAddr. A setting without a port gets 5060, and a bare ":port" binds every
+// interface.
+func listenAddr(setting string, cfg sip.Config) (string, error) {
+	setting = strings.TrimSpace(setting)
+	if setting == "" {
+		return defaultListenAddr(cfg), nil
+	}
+	host, port, err := net.SplitHostPort(setting)
+	if err != nil {
+		// No port: a host name or (possibly bracketed) IP address alone.
+		host, port = strings.Trim(setting, "[]"), "5060"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("SIP_LISTEN %q: invalid port %q", setting, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// contactPortFor returns the Contact port to advertise for listen: the configured one when
+// set (STUN discovered it), otherwise the listen port when it is not the default 5060, so
+// an explicit SIP_CONTACT_IP with SIP_LISTEN on another port advertises where NOTIFYs are
+// actually received.
+func contactPortFor(cfg sip.Config, listen string) int {
+	if cfg.ContactPort != 0 {
+		return cfg.ContactPort
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 0
+	}
+	if n, _ := strconv.Atoi(port); n != 5060 {
+		return n
+	}
+	return 0
 }
 
 // defaultListenAddr returns the default bind address for the SIP server. When
 // ContactPort is set (STUN was used) or ContactIP is a sentinel (auto/stun/empty),
-// we bind to 0.0.0.0:5060 so we never try to resolve "stun" as a hostname.
+// we bind to the wildcard address on port 5060 so we never try to resolve "stun" as a
+// hostname (see wildcardListenAddr).
 func defaultListenAddr(cfg sip.Config) string {
 	if cfg.ContactPort != 0 || sip.IsContactSentinel(cfg.ContactIP) {
-		return "0.0.0.0:5060"
+		return wildcardListenAddr(cfg.ContactIP)
+	}
+	return net.JoinHostPort(strings.Trim(cfg.ContactIP, "[]"), "5060")
+}
+
+// wildcardListenAddr returns the every-interface bind address on port 5060 for a Contact
+// of contactIP: [::] when it is IPv6, else 0.0.0.0.
+func wildcardListenAddr(contactIP string) string {
+	if ip := net.ParseIP(strings.Trim(contactIP, "[]")); ip != nil && ip.To4() == nil {
+		return "[::]:5060"
+	}
+	return "0.0.0.0:5060"
+}
+
+// applyAdvertise sets the Contact of cfg to SIP_ADVERTISE_IP (ip) and SIP_ADVERTISE_PORT
+// (port, 0 = the listen port) and reports whether it did; an empty ip leaves cfg alone.
+// The advertised address replaces SIP_CONTACT_IP, so STUN is not used.
+func applyAdvertise(cfg *sip.Config, ip string, port int) (bool, error) {
+	ip = strings.Trim(strings.TrimSpace(ip), "[]")
+	if ip == "" {
+		if port != 0 {
+			return false, errors.New("SIP_ADVERTISE_PORT needs SIP_ADVERTISE_IP")
+		}
+		return false, nil
+	}
+	if net.ParseIP(ip) == nil {
+		return false, fmt.Errorf("SIP_ADVERTISE_IP %q: not an IP address", ip)
+	}
+	if port < 0 || port > 65535 {
+		return false, fmt.Errorf("SIP_ADVERTISE_PORT %d: out of range", port)
 	}
-	return cfg.ContactIP + ":5060"
+	cfg.ContactIP, cfg.ContactPort = ip, port
+	return true, nil
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/sip"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateExtensions_JSON(t *testing.T) {
+	path := writeTemp(t, "extensions.json", `[
+  {"extension": "101", "email": "alice@example.com"},
+  {"extension": "102", "email": "not-an-email"},
+  {"extension": "101", "email": "carol@example.com"},
+  {"extension": "103", "email": "Alice@example.com"}
+]`)
+	list, err := loadExtensions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, warnings, err := validateExtensions(list)
+	if err == nil {
+		t.Fatal("validateExtensions: want error for bad email and duplicate extension")
+	}
+	for _, want := range []string{"line 3: extension 102: invalid email", "line 4: duplicate extension 101 (first at line 2)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if len(valid) != 2 || valid[0].Extension != "101" || valid[1].Extension != "103" {
+		t.Errorf("valid = %+v, want extensions 101 and 103", valid)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "line 5") {
+		t.Errorf("warnings = %v, want one duplicate-email warning for line 5", warnings)
+	}
+}
+
+func TestValidateExtensions_CSV(t *testing.T) {
+	path := writeTemp(t, "extensions.csv", "extension,email\n101,alice@example.com\n\n102,bob@\n,dave@example.com\n104,Dave <dave@example.com>\n")
+	list, err := loadExtensionsCSV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := validateExtensions(list)
+	if err == nil {
+		t.Fatal("validateExtensions: want error")
+	}
+	for _, want := range []string{"line 4: extension 102", "line 5: missing extension", "line 6: extension 104"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if len(valid) != 1 || valid[0].Extension != "101" {
+		t.Errorf("valid = %+v, want only 101", valid)
+	}
+}
+
+func TestValidateExtensions_Valid(t *testing.T) {
+	list := []ExtensionEntry{{Extension: "101", Email: "alice@example.com"}, {Extension: "102", Email: "bob@example.com"}}
+	valid, warnings, err := validateExtensions(list)
+	if err != nil || len(warnings) != 0 || len(valid) != 2 {
+		t.Errorf("validateExtensions = %d valid, %v, %v; want 2 valid, no warnings, nil", len(valid), warnings, err)
+	}
+}
+
+func TestValidateExtensions_Expiration(t *testing.T) {
+	path := writeTemp(t, "extensions.json", `[
+  {"extension": "101", "email": "alice@example.com", "expiration": "PT20M"},
+  {"extension": "102", "email": "bob@example.com"},
+  {"extension": "103", "email": "carol@example.com", "expiration": "PT1M"},
+  {"extension": "104", "email": "dave@example.com", "expiration": "PT5H"},
+  {"extension": "105", "email": "erin@example.com", "expiration": "20m"}
+]`)
+	list, err := loadExtensions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := validateExtensions(list)
+	if err == nil {
+		t.Fatal("validateExtensions: want error for out-of-range and malformed expirations")
+	}
+	for _, want := range []string{"line 4: extension 103", "line 5: extension 104", "line 6: extension 105"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	got := expirationMap(valid, blf.ExtensionAsIs)
+	if len(got) != 1 || got["101"] != 20*time.Minute {
+		t.Errorf("expirationMap = %v, want only 101: 20m", got)
+	}
+}
+
+func TestValidateExtensions_Type(t *testing.T) {
+	path := writeTemp(t, "extensions.csv", "101,alice@example.com\nq600,sales@example.com,,,Queue\n102,bob@example.com,,,group\n")
+	list, err := loadExtensionsCSV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := validateExtensions(list)
+	if err == nil || !strings.Contains(err.Error(), `line 3: extension 102: type "group"`) {
+		t.Errorf("error = %v, want the bad type of line 3", err)
+	}
+	if len(valid) != 2 || valid[0].Type != entryTypeUser || valid[1].Type != entryTypeQueue {
+		t.Errorf("valid = %+v, want 101 as user and q600 as queue", valid)
+	}
+	if got := queueMap(valid, blf.ExtensionDigits); len(got) != 1 || !got["600"] {
+		t.Errorf("queueMap = %v, want only 600", got)
+	}
+}
+
+func TestDefaultListenAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  sip.Config
+		want string
+	}{
+		{"IPv4 contact", sip.Config{ContactIP: "192.0.2.10"}, "192.0.2.10:5060"},
+		{"IPv6 contact", sip.Config{ContactIP: "2001:db8::10"}, "[2001:db8::10]:5060"},
+		{"bracketed IPv6 contact", sip.Config{ContactIP: "[2001:db8::10]"}, "[2001:db8::10]:5060"},
+		{"sentinel", sip.Config{ContactIP: "stun"}, "0.0.0.0:5060"},
+		{"STUN IPv4", sip.Config{ContactIP: "203.0.113.5", ContactPort: 40000}, "0.0.0.0:5060"},
+		{"STUN IPv6", sip.Config{ContactIP: "2001:db8::5", ContactPort: 40000}, "[::]:5060"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultListenAddr(tt.cfg); got != tt.want {
+				t.Errorf("defaultListenAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupByServer(t *testing.T) {
+	list := []ExtensionEntry{
+		{Extension: "101"},
+		{Extension: "201", Server: "pbx2.example.com"},
+		{Extension: "102", Server: "pbx1.example.com:5060"},
+		{Extension: "202", Server: " pbx2.example.com "},
+	}
+	servers, byServer := groupByServer(list, "pbx1.example.com:5060")
+	if want := []string{"pbx1.example.com:5060", "pbx2.example.com"}; !slices.Equal(servers, want) {
+		t.Errorf("servers = %v, want %v", servers, want)
+	}
+	if got := byServer["pbx1.example.com:5060"]; !slices.Equal(got, []string{"101", "102"}) {
+		t.Errorf("default server extensions = %v, want [101 102]", got)
+	}
+	if got := byServer["pbx2.example.com"]; !slices.Equal(got, []string{"201", "202"}) {
+		t.Errorf("pbx2 extensions = %v, want [201 202]", got)
+	}
+}
+
+func TestOffsetListenAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		offset int
+		want   string
+		port   int
+	}{
+		{"0.0.0.0:5060", 1, "0.0.0.0:5061", 5061},
+		{"[::]:5070", 2, "[::]:5072", 5072},
+	}
+	for _, tt := range tests {
+		got, port, err := offsetListenAddr(tt.addr, tt.offset)
+		if err != nil || got != tt.want || port != tt.port {
+			t.Errorf("offsetListenAddr(%q, %d) = %q, %d, %v; want %q, %d", tt.addr, tt.offset, got, port, err, tt.want, tt.port)
+		}
+	}
+}
+
+func TestMergeDirectory(t *testing.T) {
+	list := []ExtensionEntry{
+		{Extension: "101", Email: "old@example.com", Expiration: "PT20M", Server: "pbx2.example.com"},
+		{Extension: "102", Email: "bob@example.com"},
+	}
+	byExt := map[string]string{
+		"101": "alice@example.com",
+		"205": "erin@example.com",
+		"103": "carol@example.com",
+	}
+	want := []ExtensionEntry{
+		{Extension: "101", Email: "alice@example.com", Expiration: "PT20M", Server: "pbx2.example.com"},
+		{Extension: "102", Email: "bob@example.com"},
+		{Extension: "103", Email: "carol@example.com"},
+		{Extension: "205", Email: "erin@example.com"},
+	}
+	if got := mergeDirectory(list, byExt); !slices.Equal(got, want) {
+		t.Errorf("mergeDirectory = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := newLogger(LogSettings{Format: "JSON", Level: "warn"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("dropped")
+	log.Warn("kept", "extension", "101")
+	if got := buf.String(); !strings.HasPrefix(got, "{") || strings.Contains(got, "dropped") || !strings.Contains(got, `"extension":"101"`) {
+		t.Errorf("output = %q, want only the warning as JSON", got)
+	}
+
+	if _, err := newLogger(LogSettings{}, &buf); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+	if _, err := newLogger(LogSettings{Format: "logfmt"}, &buf); err == nil {
+		t.Error("format logfmt: want error")
+	}
+	if _, err := newLogger(LogSettings{Level: "verbose"}, &buf); err == nil {
+		t.Error("level verbose: want error")
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	stun := sip.Config{ContactIP: "203.0.113.5", ContactPort: 40000}
+	tests := []struct {
+		setting string
+		cfg     sip.Config
+		want    string
+		port    int // Contact port advertised
+	}{
+		{"", stun, "0.0.0.0:5060", 40000},
+		{"10.0.0.5:5070", stun, "10.0.0.5:5070", 40000},
+		{"", sip.Config{ContactIP: "192.0.2.10"}, "192.0.2.10:5060", 0},
+		{":5070", sip.Config{ContactIP: "192.0.2.10"}, ":5070", 5070},
+		{"10.0.0.5", sip.Config{ContactIP: "192.0.2.10"}, "10.0.0.5:5060", 0},
+		{"[2001:db8::5]", sip.Config{ContactIP: "2001:db8::5"}, "[2001:db8::5]:5060", 0},
+	}
+	for _, tt := range tests {
+		got, err := listenAddr(tt.setting, tt.cfg)
+		if err != nil || got != tt.want {
+			t.Errorf("listenAddr(%q) = %q, %v; want %q", tt.setting, got, err, tt.want)
+			continue
+		}
+		if port := contactPortFor(tt.cfg, got); port != tt.port {
+			t.Errorf("contactPortFor(%q) = %d, want %d", got, port, tt.port)
+		}
+	}
+	if _, err := listenAddr("0.0.0.0:99999", stun); err == nil {
+		t.Error("listenAddr with port 99999: want error")
+	}
+}
+
+func TestApplyAdvertise(t *testing.T) {
+	cfg := sip.Config{ContactIP: "auto"}
+	ok, err := applyAdvertise(&cfg, "198.51.100.20", 5080)
+	if !ok || err != nil || cfg.ContactIP != "198.51.100.20" || cfg.ContactPort != 5080 {
+		t.Fatalf("applyAdvertise = %v, %v; cfg = %+v", ok, err, cfg)
+	}
+	// Bound on every interface, the advertised port is kept in the Contact.
+	listen, err := listenAddr(wildcardListenAddr(cfg.ContactIP), cfg)
+	if err != nil || listen != "0.0.0.0:5060" || contactPortFor(cfg, listen) != 5080 {
+		t.Errorf("listen = %q, %v; contact port %d", listen, err, contactPortFor(cfg, listen))
+	}
+
+	cfg = sip.Config{ContactIP: "127.0.0.1"}
+	if ok, err := applyAdvertise(&cfg, "[2001:db8::20]", 0); !ok || err != nil || cfg.ContactIP != "2001:db8::20" {
+		t.Errorf("IPv6: %v, %v; cfg = %+v", ok, err, cfg)
+	}
+	if got := wildcardListenAddr(cfg.ContactIP); got != "[::]:5060" {
+		t.Errorf("wildcardListenAddr(%q) = %q, want [::]:5060", cfg.ContactIP, got)
+	}
+
+	cfg = sip.Config{ContactIP: "auto"}
+	if ok, err := applyAdvertise(&cfg, "", 0); ok || err != nil || cfg.ContactIP != "auto" {
+		t.Errorf("unset: %v, %v; cfg = %+v", ok, err, cfg)
+	}
+	for _, bad := range []struct {
+		ip   string
+		port int
+	}{{"", 5080}, {"pbx.example.com", 0}, {"198.51.100.20", 70000}} {
+		if _, err := applyAdvertise(&sip.Config{}, bad.ip, bad.port); err == nil {
+			t.Errorf("applyAdvertise(%q, %d): want error", bad.ip, bad.port)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	sched, err := parseSchedule("Mon-Fri 08:00-17:30, Sat/Sun 10:00-12:00, Fri-Mon 20:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := time.UTC
+	tests := []struct {
+		t     time.Time
+		until string // "" = not active
+	}{
+		{time.Date(2024, 5, 6, 8, 0, 0, 0, loc), "2024-05-06 17:30"},   // Monday, start
+		{time.Date(2024, 5, 6, 17, 29, 0, 0, loc), "2024-05-06 17:30"}, // just before the end
+		{time.Date(2024, 5, 6, 17, 30, 0, 0, loc), ""},                 // end is exclusive
+		{time.Date(2024, 5, 6, 7, 59, 0, 0, loc), ""},
+		{time.Date(2024, 5, 6, 21, 0, 0, 0, loc), "2024-05-07 00:00"},  // Fri-Mon wraps over the weekend
+		{time.Date(2024, 5, 7, 21, 0, 0, 0, loc), ""},                  // Tuesday evening
+		{time.Date(2024, 5, 11, 11, 0, 0, 0, loc), "2024-05-11 12:00"}, // Saturday
+		{time.Date(2024, 5, 11, 9, 0, 0, 0, loc), ""},
+	}
+	for _, tt := range tests {
+		until, active := sched.activeUntil(tt.t)
+		got := ""
+		if active {
+			got = until.Format("2006-01-02 15:04")
+		}
+		if got != tt.until {
+			t.Errorf("activeUntil(%s) = %q, want %q", tt.t.Format("Mon 15:04"), got, tt.until)
+		}
+	}
+
+	for _, bad := range []string{"", "Mon", "Mon 09:00", "Xyz 09:00-10:00", "Mon 17:00-09:00", "Mon 09:00-25:00", "Mon 9-17"} {
+		if _, err := parseSchedule(bad); err == nil {
+			t.Errorf("parseSchedule(%q): want error", bad)
+		}
+	}
+}
+
+func TestExpandExtensions(t *testing.T) {
+	path := writeTemp(t, "extensions.json", `[
+  {"extension": "101", "email": "alice@example.com"},
+  {"extension": "2000-2003", "email": "hunt@example.com", "expiration": "PT20M"},
+  {"extension": "31?", "email": "sales@example.com"},
+  {"extension": "09-11", "email": "lobby@example.com"},
+  {"extension": "2050-2000", "email": "bob@example.com"},
+  {"extension": "1-5000", "email": "bob@example.com"},
+  {"extension": "4????", "email": "bob@example.com"}
+]`)
+	list, _, err := loadExtensionSource(ExtensionsSettings{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, warnings, err := validateExtensions(list)
+	if err == nil {
+		t.Fatal("validateExtensions: want errors for the reversed, oversized and wildcard specs")
+	}
+	for _, want := range []string{"line 6: range 2050-2000: start is after end", "line 7: range 1-5000: 5000 extensions", "line 8: wildcard 4????"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v, want none for extensions expanded from one row", warnings)
+	}
+	var exts []string
+	for _, e := range valid {
+		exts = append(exts, e.Extension)
+	}
+	want := []string{"101", "2000", "2001", "2002", "2003", "310", "311", "312", "313", "314", "315", "316", "317", "318", "319", "09", "10", "11"}
+	if !slices.Equal(exts, want) {
+		t.Errorf("extensions = %v, want %v", exts, want)
+	}
+	emails := emailMap(valid, blf.ExtensionAsIs)
+	if emails["2002"] != "hunt@example.com" || expirationMap(valid, blf.ExtensionAsIs)["2003"] != 20*time.Minute {
+		t.Errorf("range entries do not share the row's email and expiration: %v", emails)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+)
+
+// directoryTimeout bounds one directory lookup (all pages).
+const directoryTimeout = time.Minute
+
+// directorySource resolves extension -> UPN from a Graph directory attribute
+// (EXTENSIONS_DIRECTORY). The last successful lookup is kept and reused when a later one
+// fails, so a Graph outage does not drop extensions.
+type directorySource struct {
+	client    *graph.Client
+	attribute string
+	byExt     map[string]string // last successful lookup
+}
+
+// refresh looks the extensions up again; on failure the previous result is kept.
+func (d *directorySource) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, directoryTimeout)
+	defer cancel()
+	byExt, dups, err := d.client.DirectoryExtensions(ctx, d.attribute)
+	if err != nil {
+		slog.Error("directory lookup failed; keeping the previous result", "attribute", d.attribute, "cached", len(d.byExt), "error", err)
+		return
+	}
+	for _, dup := range dups {
+		slog.Warn("extension assigned to several directory users", "attribute", d.attribute, "detail", dup)
+	}
+	d.byExt = byExt
+}
+
+// loadExtensionsWithDirectory loads the extensions source and, with dir, refreshes the
+// directory lookup and merges it in (see mergeDirectory). With a directory, a missing
+// extensions file is not an error: the directory then supplies every extension.
+func loadExtensionsWithDirectory(ctx context.Context, src ExtensionsSettings, dir *directorySource) ([]ExtensionEntry, string, error) {
+	list, loadedFrom, err := loadExtensionSource(src)
+	if dir == nil {
+		return list, loadedFrom, err
+	}
+	if errors.Is(err, errNoExtensionsFile) {
+		list, loadedFrom, err = nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	dir.refresh(ctx)
+	from := fmt.Sprintf("directory (%s)", dir.attribute)
+	if loadedFrom != "" {
+		from = loadedFrom + " + " + from
+	}
+	return mergeDirectory(list, dir.byExt), from, nil
+}
+
+// mergeDirectory applies directory assignments (extension -> UPN) to list: entries whose
+// extension is in the directory take the directory UPN as email, keeping their other
+// settings; entries the directory does not know keep their email; directory extensions
+// missing from list are appended in extension order.
+func mergeDirectory(list []ExtensionEntry, byExt map[string]string) []ExtensionEntry {
+	merged := make([]ExtensionEntry, 0, len(list)+len(byExt))
+	seen := make(map[string]bool, len(list))
+	for _, e := range list {
+		if upn, ok := byExt[e.Extension]; ok {
+			e.Email = upn
+		}
+		seen[e.Extension] = true
+		merged = append(merged, e)
+	}
+	var extra []string
+	for ext := range byExt {
+		if !seen[ext] {
+			extra = append(extra, ext)
+		}
+	}
+	slices.Sort(extra)
+	for _, ext := range extra {
+		merged = append(merged, ExtensionEntry{Extension: ext, Email: byExt[ext]})
+	}
+	return merged
+}
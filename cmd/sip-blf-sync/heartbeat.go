@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+)
+
+// heartbeatCheckInterval is how often runHeartbeat looks for presences due for a re-assert.
+const heartbeatCheckInterval = time.Minute
+
+// assertion is the presence last written for a user's session extension.
+type assertion struct {
+	email        string
+	availability string
+	activity     string
+	at           time.Time
+}
+
+// reassertInterval returns how long a presence written for the session extension stays
+// fresh: half its presence expiration.
+func (p *presenceSync) reassertInterval(session string) time.Duration {
+	d := p.expirationFor(session)
+	if d <= 0 {
+		d = graph.DefaultExpiration
+	}
+	return d / 2
+}
+
+// runHeartbeat re-asserts every heartbeatCheckInterval until ctx is done (see heartbeat).
+func (p *presenceSync) runHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.heartbeat(time.Now())
+	}
+}
+
+// heartbeat writes again each presence written longer than its reassertInterval ago,
+// skipping the sink's unchanged-state check, so Graph does not expire a state that lasts
+// longer than the presence expiration (an hour-long call, a quiet day). The writes are not
+// audited. Pinned users are left to their pin, which re-asserts itself; users whose
+// extension was removed or is no longer their session are forgotten. Outside the business
+// hours nothing is written unless Available is forced: in skip mode the last state may be
+// out of date, and in offline mode the sessions were cleared.
+func (p *presenceSync) heartbeat(now time.Time) {
+	if p.hours != nil && !p.hours.open() {
+		if _, _, forced := p.hours.forced(); !forced {
+			return
+		}
+	}
+	emails := *p.emails.Load()
+	p.asserted.Range(func(k, v any) bool {
+		session, a := k.(string), v.(assertion)
+		email, ok := emails[session]
+		if !ok || !strings.EqualFold(email, a.email) || p.userState(emails, email).session != session {
+			p.asserted.CompareAndDelete(k, v)
+			return true
+		}
+		if now.Sub(a.at) < p.reassertInterval(session) || p.pinned(session) {
+			return true
+		}
+		ctx, cancel := context.WithTimeout(p.baseContext(), presenceWriteTimeout)
+		defer cancel()
+		set := p.presenceSetter(true)
+		if err := set(ctx, a.email, session, a.availability, a.activity, p.expirationFor(session)); err != nil {
+			if !errors.Is(err, graph.ErrCircuitOpen) && p.baseContext().Err() == nil {
+				p.log.Warn("presence heartbeat failed", "extension", session, "email", a.email, "error", err)
+			}
+			return true
+		}
+		p.log.Debug("presence re-asserted", "extension", session, "email", a.email, "availability", a.availability, "age", now.Sub(a.at).Round(time.Second))
+		fresh := a
+		fresh.at = now
+		if !p.asserted.CompareAndSwap(k, v, fresh) {
+			// A write of a new presence raced with this one and may have reached Graph
+			// first; send the new presence again so the stale one does not stick.
+			if cur, ok := p.asserted.Load(session); ok {
+				c := cur.(assertion)
+				if err := set(ctx, c.email, session, c.availability, c.activity, p.expirationFor(session)); err != nil && !errors.Is(err, graph.ErrCircuitOpen) {
+					p.log.Warn("presence heartbeat failed", "extension", session, "email", c.email, "error", err)
+				}
+			}
+		}
+		return true
+	})
+}
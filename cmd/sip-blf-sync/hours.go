@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // BUSINESS_HOURS_TZ works on hosts without a zoneinfo database
+)
+
+// BUSINESS_HOURS_OUTSIDE values: what presenceSync does with BLF updates outside the hours.
+const (
+	outsideHoursSkip      = "skip"      // write nothing; presence keeps its last value
+	outsideHoursAvailable = "available" // write Available/Available for every user
+	outsideHoursOffline   = "offline"   // clear the presence session of every user
+)
+
+// businessHoursCheckInterval is how often runBusinessHours looks for the hours opening or closing.
+const businessHoursCheckInterval = time.Minute
+
+// parseOutsideHours checks a BUSINESS_HOURS_OUTSIDE value; "" means outsideHoursSkip.
+func parseOutsideHours(s string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case "", outsideHoursSkip:
+		return outsideHoursSkip, nil
+	case outsideHoursAvailable, outsideHoursOffline:
+		return v, nil
+	}
+	return "", fmt.Errorf("outside hours %q: want %q, %q or %q", s, outsideHoursSkip, outsideHoursAvailable, outsideHoursOffline)
+}
+
+// businessHours gates presence writes on weekly windows (BUSINESS_HOURS) in a time zone
+// (BUSINESS_HOURS_TZ).
+type businessHours struct {
+	schedule schedule
+	loc      *time.Location
+	outside  string // outsideHours* constant
+	now      func() time.Time
+}
+
+// newBusinessHours returns the businessHours for settings, or nil when BUSINESS_HOURS is
+// not set.
+func newBusinessHours(settings BusinessHoursSettings) (*businessHours, error) {
+	spec := strings.TrimSpace(settings.Schedule)
+	if spec == "" {
+		if strings.TrimSpace(settings.TimeZone) != "" || strings.TrimSpace(settings.Outside) != "" {
+			return nil, errors.New("BUSINESS_HOURS_TZ and BUSINESS_HOURS_OUTSIDE need BUSINESS_HOURS")
+		}
+		return nil, nil
+	}
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	loc := time.Local
+	if tz := strings.TrimSpace(settings.TimeZone); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("time zone: %w", err)
+		}
+	}
+	outside, err := parseOutsideHours(settings.Outside)
+	if err != nil {
+		return nil, err
+	}
+	return &businessHours{schedule: sched, loc: loc, outside: outside, now: time.Now}, nil
+}
+
+// open reports whether the current time falls inside the business hours.
+func (h *businessHours) open() bool {
+	_, ok := h.schedule.activeUntil(h.now().In(h.loc))
+	return ok
+}
+
+// forced returns the presence written outside the hours; ok is false in skip and offline
+// mode.
+func (h *businessHours) forced() (availability, activity string, ok bool) {
+	if h.outside == outsideHoursAvailable {
+		return "Available", "Available", true
+	}
+	return "", "", false
+}
+
+// clears reports whether presence sessions are cleared outside the hours (offline mode).
+// Graph's setPresence does not accept Offline, so the session is cleared instead and Teams
+// falls back to the user's own presence, Offline once they have signed out.
+func (h *businessHours) clears() bool {
+	return h.outside == outsideHoursOffline
+}
+
+// closed reports whether p's business hours are closed. When they are and a presence is
+// forced outside them, it writes that presence to the user's session extension, or in
+// offline mode clears the session if one is still asserted; the caller then writes
+// nothing else.
+func (p *presenceSync) closed(email, session string) bool {
+	if p.hours == nil || p.hours.open() {
+		return false
+	}
+	p.cancelRinging(session)
+	if availability, activity, ok := p.hours.forced(); ok {
+		p.writeFixed(p.baseContext(), email, session, availability, activity, false)
+	} else if _, asserted := p.asserted.Load(session); asserted && p.hours.clears() {
+		p.clearOutsideHours(email, session)
+	}
+	return true
+}
+
+// clearOutsideHours clears the user's presence session of session's extension in offline
+// mode. A failed clear keeps the assertion, so the next BLF update tries again.
+func (p *presenceSync) clearOutsideHours(email, session string) {
+	ctx, cancel := context.WithTimeout(p.baseContext(), presenceWriteTimeout)
+	defer cancel()
+	if err := p.sink.ClearPresence(ctx, email, session); err != nil {
+		p.log.Error("clear presence", "extension", session, "email", email, "error", err)
+		return
+	}
+	p.written.Delete(session)
+	p.asserted.Delete(session)
+}
+
+// runBusinessHours checks every businessHoursCheckInterval until ctx is done whether the
+// business hours opened or closed. When they close with a forced presence, every user gets
+// it (in offline mode, a cleared presence session); when they open, every user is resynced to their current state. Pinned users are left
+// alone.
+func (p *presenceSync) runBusinessHours(ctx context.Context) {
+	ticker := time.NewTicker(businessHoursCheckInterval)
+	defer ticker.Stop()
+	open := p.hours.open()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if now := p.hours.open(); now != open {
+			open = now
+			p.businessHoursChanged(ctx, open)
+		}
+	}
+}
+
+// businessHoursChanged writes every user's presence after the business hours opened or
+// closed (see runBusinessHours).
+func (p *presenceSync) businessHoursChanged(ctx context.Context, open bool) {
+	availability, activity, forced := p.hours.forced()
+	if open {
+		p.log.Info("business hours open; resyncing presence")
+	} else {
+		p.log.Info("business hours closed", "outside", p.hours.outside)
+		if !forced && !p.hours.clears() {
+			return
+		}
+	}
+	emails := *p.emails.Load()
+	seen := make(map[string]bool)
+	for _, email := range emails {
+		key := strings.ToLower(email)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if open {
+			p.resync(emails, email)
+			continue
+		}
+		if user := p.userState(emails, email); !p.pinned(user.session) {
+			p.cancelRinging(user.session)
+			if !forced {
+				p.clearOutsideHours(emails[user.session], user.session)
+				continue
+			}
+			p.writeFixed(ctx, emails[user.session], user.session, availability, activity, false)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// newLogger returns the logger for LOG_FORMAT and LOG_LEVEL, writing to w. An empty
+// format or level means text and info.
+func newLogger(s LogSettings, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(firstNonEmpty(strings.TrimSpace(s.Level), "info"))); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL %q: want debug, info, warn or error", s.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := strings.ToLower(strings.TrimSpace(s.Format)); format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT %q: want text or json", s.Format)
+	}
+}
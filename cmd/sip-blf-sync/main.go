@@ -2,138 +2,625 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
+	"github.com/darrenwiebe/teams_freepbx/internal/audit"
 	"github.com/darrenwiebe/teams_freepbx/internal/blf"
 	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+	"github.com/darrenwiebe/teams_freepbx/internal/health"
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
 	"github.com/darrenwiebe/teams_freepbx/internal/sip"
+	"github.com/darrenwiebe/teams_freepbx/internal/webhook"
 )
 
+// shutdownTimeout bounds the unsubscribe teardown on SIGINT/SIGTERM.
+const shutdownTimeout = 5 * time.Second
+
+// webhookBuffer is how many BLF events may queue for the webhook before new ones are dropped.
+const webhookBuffer = 256
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "parse" {
+		_ = godotenv.Load(".env.local")
+		_ = godotenv.Load()
+		if err := runParse(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		_ = godotenv.Load(".env.local")
+		_ = godotenv.Load()
+		if err := runCheck(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			if errors.Is(err, errCheckFailed) {
+				os.Exit(1)
+			}
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(2)
+		}
+		return
+	}
+
+	skipInvalid := flag.Bool("skip-invalid", false, "drop invalid or duplicate extension rows instead of exiting")
+	watch := flag.Bool("watch", false, "print a line per BLF update (extension, state change, user) to stderr")
+	flag.Parse()
+
 	_ = godotenv.Load(".env.local")
 	_ = godotenv.Load()
 
-	extensionsPath := getEnv("EXTENSIONS_JSON", "config/extensions.json")
-	voicemailConf := strings.TrimSpace(getEnv("VOICEMAIL_CONF", ""))
-	statePath := getEnv("PRESENCE_STATE_JSON", "config/presence-state.json")
+	cfg, err := LoadConfig(strings.TrimSpace(os.Getenv("CONFIG_FILE")))
+	if err != nil {
+		slog.Error("load config", "error", err)
+		os.Exit(1)
+	}
+
+	// Every component logs through the default logger, so set it before creating any.
+	logger, err := newLogger(cfg.Log, os.Stderr)
+	if err != nil {
+		slog.Error("invalid log settings", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	expiration, err := graph.ParseExpiration(cfg.Graph.Expiration)
+	if err != nil {
+		slog.Error("invalid PRESENCE_EXPIRATION", "error", err)
+		os.Exit(1)
+	}
 
-	var extensions []ExtensionEntry
-	var loadedFrom string
-	if voicemailConf != "" {
-		if _, err := os.Stat(voicemailConf); err != nil {
-			slog.Error("voicemail conf file not found", "path", voicemailConf, "error", err)
+	mapping, err := loadStateMapping(cfg.Mapping)
+	if err != nil {
+		slog.Error("invalid state mapping", "error", err)
+		os.Exit(1)
+	}
+	queueMapping, err := loadQueueMapping(cfg.Mapping)
+	if err != nil {
+		slog.Error("invalid queue state mapping", "error", err)
+		os.Exit(1)
+	}
+	presenceMode, err := parsePresenceMode(cfg.Mapping.PresenceMode)
+	if err != nil {
+		slog.Error("invalid PRESENCE_MODE", "error", err)
+		os.Exit(1)
+	}
+	if cfg.Mapping.RingingGraceMS < 0 {
+		slog.Error("invalid RINGING_GRACE_MS: must not be negative", "value", cfg.Mapping.RingingGraceMS)
+		os.Exit(1)
+	}
+	if cfg.Mapping.RingingGraceMS > 0 && (presenceMode == presenceModeConfirmedOnly || cfg.Mapping.IgnoreRinging) {
+		slog.Warn("ringing is never written; RINGING_GRACE_MS has no effect")
+	}
+	switch {
+	case presenceMode == presenceModeConfirmedOnly && cfg.Mapping.Ringing != "":
+		slog.Warn("PRESENCE_MODE is confirmed-only; MAP_RINGING has no effect")
+	case cfg.Mapping.IgnoreRinging && cfg.Mapping.Ringing != "":
+		slog.Warn("IGNORE_RINGING is set; MAP_RINGING has no effect")
+	}
+
+	// In dry-run mode no Graph client is created; presence changes are only logged.
+	var graphClient *graph.Client
+	var sink PresenceSink = dryRunSink{log: slog.Default().With("component", "dryrun")}
+	if cfg.DryRun {
+		slog.Warn("DRY_RUN enabled: presence changes are logged, not sent to Graph")
+	} else {
+		auth, err := graphAuth(cfg.Graph)
+		if err != nil {
+			slog.Error("invalid Graph settings", "error", err)
 			os.Exit(1)
 		}
-		var err error
-		extensions, err = loadExtensionsVoicemail(voicemailConf)
+		graphClient, err = graph.NewClient(auth, cfg.Graph.StatePath, logger)
 		if err != nil {
-			slog.Error("load voicemail conf", "error", err, "path", voicemailConf)
+			slog.Error("create graph client", "error", err)
 			os.Exit(1)
 		}
-		loadedFrom = voicemailConf
-	} else {
-		var err error
-		extensions, loadedFrom, err = loadExtensionsFromPath(extensionsPath)
+		graphClient.SetCircuitBreaker(cfg.Graph.BreakerThreshold, cfg.Graph.BreakerCooldown)
+		graphClient.SetStatusMessageInterval(cfg.StatusMessage.MinInterval)
+		graphClient.SetTimeout(cfg.Graph.Timeout)
+		sink = graphClient
+	}
+
+	// With EXTENSIONS_DIRECTORY, extension -> user assignments come from the Graph directory,
+	// falling back to the extensions source for extensions the directory does not know.
+	var directory *directorySource
+	if cfg.Extensions.Directory != "" {
+		attribute, err := graph.ParseDirectoryAttribute(cfg.Extensions.Directory)
 		if err != nil {
-			slog.Error("load extensions", "error", err, "path", extensionsPath)
+			slog.Error("invalid EXTENSIONS_DIRECTORY", "error", err)
 			os.Exit(1)
 		}
+		if graphClient == nil {
+			slog.Warn("EXTENSIONS_DIRECTORY is ignored in DRY_RUN mode (no Graph client)")
+		} else {
+			directory = &directorySource{client: graphClient, attribute: attribute}
+		}
 	}
-	slog.Info("loaded extensions", "count", len(extensions), "from", loadedFrom)
 
-	extList := make([]string, 0, len(extensions))
-	emailByExt := make(map[string]string)
-	for _, e := range extensions {
-		extList = append(extList, e.Extension)
-		emailByExt[e.Extension] = e.Email
+	extensions, loadedFrom, err := loadExtensionsWithDirectory(context.Background(), cfg.Extensions, directory)
+	if err != nil {
+		slog.Error("load extensions", "error", err, "path", firstNonEmpty(cfg.Extensions.VoicemailConf, cfg.Extensions.Path))
+		os.Exit(1)
+	}
+	if extensions, err = checkExtensions(extensions, loadedFrom, *skipInvalid); err != nil {
+		slog.Error("invalid extensions (use --skip-invalid to drop bad rows)", "from", loadedFrom, "error", err)
+		os.Exit(1)
 	}
+	slog.Info("loaded extensions", "count", len(extensions), "from", loadedFrom)
 
-	graphClient, err := graph.NewClient(
-		getEnv("AZURE_TENANT_ID", ""),
-		getEnv("AZURE_CLIENT_ID", ""),
-		getEnv("AZURE_CLIENT_SECRET", ""),
-		statePath,
-	)
+	extensionPolicy, err := blf.ParseExtensionPolicy(cfg.Extensions.Normalize)
 	if err != nil {
-		slog.Error("create graph client", "error", err)
+		slog.Error("invalid EXTENSIONS_NORMALIZE", "error", err)
 		os.Exit(1)
 	}
 
-	onBLF := func(extension string, state blf.State) {
-		email, ok := emailByExt[extension]
-		if !ok {
-			slog.Warn("BLF for unknown extension", "extension", extension)
-			return
+	// emailByExt is swapped wholesale on SIGHUP reload; readers always see a complete map.
+	var emailByExt atomic.Pointer[map[string]string]
+	initial := emailMap(extensions, extensionPolicy)
+	emailByExt.Store(&initial)
+	var expirationByExt atomic.Pointer[map[string]time.Duration]
+	initialExpirations := expirationMap(extensions, extensionPolicy)
+	expirationByExt.Store(&initialExpirations)
+	var queueByExt atomic.Pointer[map[string]bool]
+	initialQueues := queueMap(extensions, extensionPolicy)
+	queueByExt.Store(&initialQueues)
+
+	var auditLog *audit.Log
+	if cfg.Audit.Path != "" && cfg.DryRun {
+		slog.Warn("DRY_RUN enabled: AUDIT_LOG ignored")
+	} else if cfg.Audit.Path != "" {
+		if cfg.Audit.MaxSizeMB < 0 {
+			slog.Error("invalid AUDIT_LOG_MAX_MB: must not be negative", "value", cfg.Audit.MaxSizeMB)
+			os.Exit(1)
 		}
-		availability, activity := state.ToGraph()
-		ctx := context.Background()
-		if err := graphClient.SetPresence(ctx, email, extension, availability, activity); err != nil {
-			slog.Error("set presence", "extension", extension, "email", email, "error", err)
-			return
+		auditLog, err = audit.Open(cfg.Audit.Path, int64(cfg.Audit.MaxSizeMB)<<20)
+		if err != nil {
+			slog.Error("audit log", "path", cfg.Audit.Path, "error", err)
+			os.Exit(1)
 		}
-		slog.Info("presence updated", "extension", extension, "state", state, "availability", availability)
+		slog.Info("audit log enabled", "path", cfg.Audit.Path)
 	}
 
-	stunServersRaw := strings.Split(getEnv("STUN_SERVERS", "stun.l.google.com,stun2.l.google.com,stun3.l.google.com,stun4.l.google.com"), ",")
-	stunServers := make([]string, 0, len(stunServersRaw))
-	for _, s := range stunServersRaw {
-		if s := strings.TrimSpace(s); s != "" {
-			stunServers = append(stunServers, s)
-		}
+	hours, err := newBusinessHours(cfg.BusinessHours)
+	if err != nil {
+		slog.Error("invalid BUSINESS_HOURS", "error", err)
+		os.Exit(1)
+	}
+
+	outagePresence, err := parseOutagePresence(cfg.Outage.Presence)
+	if err != nil {
+		slog.Error("invalid OUTAGE_PRESENCE", "error", err)
+		os.Exit(1)
 	}
-	sipCfg := sip.Config{
-		Server:      strings.TrimSpace(getEnv("SIP_SERVER", "127.0.0.1:5060")),
-		Transport:   strings.TrimSpace(getEnv("SIP_TRANSPORT", "udp")),
-		Username:    strings.TrimSpace(getEnv("SIP_USERNAME", "blf-client")),
-		Password:    getEnv("SIP_PASSWORD", ""),
-		ContactIP:   strings.TrimSpace(getEnv("SIP_CONTACT_IP", "127.0.0.1")),
-		STUNServers: stunServers,
-		UserAgent:   "teams-freepbx-blf/1.0",
+	if cfg.Outage.Grace < 0 {
+		slog.Error("invalid OUTAGE_GRACE: must not be negative", "value", cfg.Outage.Grace)
+		os.Exit(1)
+	}
+
+	// root is the parent of every presence write; it is cancelled at shutdown so writes
+	// stuck on an unresponsive Graph do not hold the process.
+	root, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+
+	presence := &presenceSync{
+		sink:    sink,
+		mapping: mapping,
+		emails:  &emailByExt,
+		status:  cfg.StatusMessage,
+		log:     slog.Default(),
+		ctx:     root,
+
+		ignoreRinging: cfg.Mapping.IgnoreRinging,
+		confirmedOnly: presenceMode == presenceModeConfirmedOnly,
+		ringingGrace:  time.Duration(cfg.Mapping.RingingGraceMS) * time.Millisecond,
+		expiration:    expiration,
+		expirations:   &expirationByExt,
+		queues:        &queueByExt,
+		queueMapping:  queueMapping,
+		audit:         auditLog,
+		hours:         hours,
 	}
 
+	preferred, err := newPreferredSchedule(cfg.Preferred, sink, &emailByExt)
+	if err != nil {
+		slog.Error("invalid PREFERRED_PRESENCE/PREFERRED_PRESENCE_SCHEDULE", "error", err)
+		os.Exit(1)
+	}
+
+	extraHeaders, err := sip.ParseExtraHeaders(cfg.SIP.ExtraHeaders)
+	if err != nil {
+		slog.Error("invalid SIP_EXTRA_HEADERS", "error", err)
+		os.Exit(1)
+	}
+	sipCfg := sipConfig(cfg, extraHeaders, extensionPolicy)
+
+	// Over a WebSocket NOTIFYs come back on the client's own connection: no STUN, no
+	// listener and no Contact address to maintain.
+	webSocket := sip.IsWebSocket(sipCfg.Transport)
+	if webSocket {
+		slog.Info("SIP over WebSocket; SIP_CONTACT_IP, SIP_LISTEN and STUN are not used", "transport", sipCfg.Transport)
+	}
+	advertised, err := applyAdvertise(&sipCfg, cfg.SIP.AdvertiseIP, cfg.SIP.AdvertisePort)
+	if err != nil {
+		slog.Error("invalid SIP_ADVERTISE_IP/SIP_ADVERTISE_PORT", "error", err)
+		os.Exit(1)
+	}
+	if advertised {
+		slog.Info("advertising a fixed Contact address; STUN not used", "ip", sipCfg.ContactIP, "port", sipCfg.ContactPort)
+	}
+	stunContact := !webSocket && sip.IsContactSentinel(sipCfg.ContactIP)
 	if err := sip.ResolveContactIfNeeded(&sipCfg, slog.Default()); err != nil {
 		slog.Error("STUN discovery failed", "error", err)
 		os.Exit(1)
 	}
-	if sip.IsContactSentinel(sipCfg.ContactIP) {
+	// Only a discovered Contact is corrected from Via received/rport; an explicit one is kept.
+	sipCfg.LearnContact = stunContact && cfg.SIP.LearnContact
+	if !webSocket && sip.IsContactSentinel(sipCfg.ContactIP) {
 		slog.Error("SIP_CONTACT_IP is auto/stun/empty but STUN did not set a valid address; check STUN_SERVERS and network")
 		os.Exit(1)
 	}
 
-	sipClient, err := sip.NewClient(sipCfg, extList, onBLF)
+	// One SIP client per PBX: SIP_SERVER plus any "server" named in the extensions file.
+	servers, byServer := groupByServer(extensions, cfg.SIP.Server)
+	// SIP_LISTEN only picks the local socket; the Contact keeps the STUN-discovered (or
+	// configured) public address, so a specific NIC can be bound behind NAT.
+	// An advertised Contact (1:1 NAT) is not an address of this host: bind every interface.
+	listenSetting := cfg.SIP.Listen
+	if advertised && strings.TrimSpace(listenSetting) == "" {
+		listenSetting = wildcardListenAddr(sipCfg.ContactIP)
+	}
+	listen, err := listenAddr(listenSetting, sipCfg)
 	if err != nil {
-		slog.Error("create sip client", "error", err)
+		slog.Error("invalid SIP_LISTEN", "error", err)
 		os.Exit(1)
 	}
-	defer sipClient.Close()
+	sipCfg.ContactPort = contactPortFor(sipCfg, listen)
+	var pbxs pbxSet
+	defer pbxs.Close()
+	for i, server := range servers {
+		p, err := newPBX(context.Background(), sipCfg, server, i, listen, byServer[server], presence.onBLF)
+		if err != nil {
+			slog.Error("set up PBX", "error", err)
+			os.Exit(1)
+		}
+		pbxs = append(pbxs, p)
+	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(root, os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	go func() {
-		listenAddr := strings.TrimSpace(getEnv("SIP_LISTEN", defaultListenAddr(sipCfg)))
-		if err := sipClient.ListenAndServe(ctx, sipCfg.Transport, listenAddr); err != nil && ctx.Err() == nil {
-			slog.Error("sip server", "error", err)
+	// The SIP listeners outlive ctx so responses to the shutdown unsubscribes can still arrive.
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+	for _, p := range pbxs {
+		go p.client.Serve(serverCtx, p.cfg.Transport, p.listen)
+	}
+
+	if graphClient != nil {
+		// Rejected credentials will not fix themselves: stop now with a clear message. Other
+		// failures (network) are retried by WatchToken and surface on /readyz. With
+		// AUTH_MODE=device-code and no signed-in account this waits for the sign-in.
+		if err := graphClient.CheckToken(ctx); graph.IsAuthError(err) {
+			slog.Error("Graph rejected the credentials; check AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET (expired secret?), with AUTH_MODE=device-code sign in again, or with AUTH_MODE=managed check the identity", "error", err)
+			os.Exit(1)
+		} else if err != nil {
+			slog.Warn("graph token acquisition failed", "error", err)
+		}
+		if cfg.Graph.TokenCheckInterval > 0 {
+			go graphClient.WatchToken(ctx, cfg.Graph.TokenCheckInterval)
+		}
+	}
+
+	if cfg.Webhook.URL != "" {
+		fwd := webhook.New(webhook.Config{
+			URL:     cfg.Webhook.URL,
+			Secret:  cfg.Webhook.Secret,
+			Timeout: cfg.Webhook.Timeout,
+			Retries: cfg.Webhook.Retries,
+			Mapping: mapping,
+			Email: func(ext string) (string, bool) {
+				email, ok := (*emailByExt.Load())[ext]
+				return email, ok
+			},
+		})
+		for _, p := range pbxs {
+			go fwd.Run(ctx, p.client.Events(webhookBuffer))
+		}
+		slog.Info("webhook forwarding enabled", "url", cfg.Webhook.URL)
+	}
+
+	// --watch is for checking BLF by hand; its lines go to stderr along with the logs.
+	if *watch {
+		w := newWatcher(os.Stderr, func(ext string) (string, bool) {
+			email, ok := (*emailByExt.Load())[ext]
+			return email, ok
+		})
+		for _, p := range pbxs {
+			server := ""
+			if len(pbxs) > 1 {
+				server = p.server
+			}
+			go w.run(ctx, server, p.client.Events(watchBuffer))
+		}
+	}
+
+	if cfg.Health.OverrideToken != "" && cfg.Health.Listen == "" {
+		slog.Warn("OVERRIDE_TOKEN is set but HEALTH_LISTEN is not; the override API is not served")
+	}
+	if addr := cfg.Health.Listen; addr != "" {
+		hs := health.NewServer(addr, readinessChecks(pbxs, graphClient)...)
+		hs.Handle("GET /subscriptions", pbxs.subscriptionsHandler())
+		if cfg.Health.MetricsEnabled {
+			hs.Handle("GET /metrics", metrics.Handler())
 		}
-	}()
+		if token := cfg.Health.OverrideToken; token != "" {
+			h := presence.overrideHandler(token)
+			hs.Handle("/override", h)
+			hs.Handle("/override/", h)
+			slog.Info("presence override API enabled", "addr", addr)
+		}
+		go func() {
+			if err := hs.ListenAndServe(ctx); err != nil {
+				slog.Error("health server", "error", err)
+			}
+		}()
+	}
 
-	if err := sipClient.Register(ctx); err != nil {
+	if err := pbxs.Register(ctx); err != nil {
 		slog.Error("register", "error", err)
 		os.Exit(1)
 	}
 
-	if err := sipClient.Subscribe(ctx); err != nil {
+	if err := pbxs.Subscribe(ctx); err != nil {
 		slog.Error("subscribe", "error", err)
 		os.Exit(1)
 	}
 
-	slog.Info("sip-blf-sync running", "extensions", len(extList))
-	<-ctx.Done()
-	slog.Info("shutting down")
+	if cfg.InitialSync {
+		go presence.initialSync(ctx)
+	}
+
+	if hours != nil {
+		go presence.runBusinessHours(ctx)
+		slog.Info("business hours enabled", "schedule", cfg.BusinessHours.Schedule, "timezone", hours.loc, "outside", hours.outside, "open", hours.open())
+	}
+
+	if outagePresence != outageLeave {
+		w := &outageWatch{action: outagePresence, grace: cfg.Outage.Grace, pbxs: make(map[string]pbxStatus), policy: extensionPolicy, now: time.Now}
+		for _, p := range pbxs {
+			w.pbxs[p.server] = p.client
+		}
+		go presence.runOutageWatch(ctx, w)
+		slog.Info("outage presence enabled", "presence", outagePresence, "grace", cfg.Outage.Grace)
+	}
+
+	if cfg.Graph.Heartbeat {
+		go presence.runHeartbeat(ctx)
+		slog.Info("presence heartbeat enabled", "after", expiration/2)
+	}
+
+	if preferred != nil {
+		go preferred.run(ctx)
+		slog.Info("scheduled preferred presence enabled", "presence", cfg.Preferred.Presence, "schedule", cfg.Preferred.Schedule)
+	}
+
+	for _, p := range pbxs {
+		// Refresh the registration and subscriptions before the lifetimes the PBX granted lapse.
+		go p.client.RunRefresh(ctx)
+		// Behind NAT (STUN discovered the Contact), keep the binding NOTIFYs arrive through open.
+		if stunContact && cfg.SIP.KeepaliveInterval > 0 {
+			go p.client.RunKeepalive(ctx, cfg.SIP.KeepaliveInterval)
+		}
+		// Over TCP, keep the connection NOTIFYs come back on alive and notice when it drops.
+		if cfg.SIP.TCPKeepaliveInterval > 0 {
+			go p.client.RunTCPKeepalive(ctx, cfg.SIP.TCPKeepaliveInterval)
+		}
+		// Re-register and re-subscribe after transport failures (listener errors, unreachable PBX).
+		go p.client.Supervise(ctx)
+		// Flag (and optionally re-subscribe) extensions whose NOTIFYs stopped arriving.
+		if cfg.SIP.StaleWindow > 0 {
+			go p.client.RunStaleWatchdog(ctx, cfg.SIP.StaleWindow, cfg.SIP.StaleResubscribe)
+		}
+
+		if stunContact && cfg.STUN.RefreshInterval > 0 {
+			go p.client.WatchPublicAddress(ctx, cfg.STUN.RefreshInterval)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// The directory is looked up again periodically as well as on SIGHUP.
+	var directoryRefresh <-chan time.Time
+	if directory != nil && cfg.Extensions.DirectoryRefresh > 0 {
+		ticker := time.NewTicker(cfg.Extensions.DirectoryRefresh)
+		defer ticker.Stop()
+		directoryRefresh = ticker.C
+	}
+
+	slog.Info("sip-blf-sync running", "extensions", len(extensions), "servers", len(pbxs))
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("shutting down")
+			cancelRoot()
+			unsubCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			pbxs.Unsubscribe(unsubCtx)
+			cancel()
+			if graphClient != nil {
+				if err := graphClient.Close(); err != nil {
+					slog.Error("write presence state file failed", "path", cfg.Graph.StatePath, "error", err)
+				}
+			}
+			if auditLog != nil {
+				if err := auditLog.Close(); err != nil {
+					slog.Error("close audit log failed", "path", cfg.Audit.Path, "error", err)
+				}
+			}
+			return
+		case <-hup:
+			reloadExtensions(ctx, pbxs, sink, &emailByExt, &expirationByExt, &queueByExt, cfg.Extensions, directory, cfg.SIP.Server, extensionPolicy, *skipInvalid)
+		case <-directoryRefresh:
+			reloadExtensions(ctx, pbxs, sink, &emailByExt, &expirationByExt, &queueByExt, cfg.Extensions, directory, cfg.SIP.Server, extensionPolicy, *skipInvalid)
+		}
+	}
+}
+
+// sipConfig returns the SIP client settings of cfg shared by every PBX, before the Contact
+// is resolved (STUN or SIP_ADVERTISE_IP) and the server is set.
+func sipConfig(cfg *AppConfig, extraHeaders []sip.Header, extensionPolicy string) sip.Config {
+	return sip.Config{
+		Transport:   cfg.SIP.Transport,
+		Username:    cfg.SIP.Username,
+		Password:    cfg.SIP.Password,
+		ContactIP:   cfg.SIP.ContactIP,
+		STUNServers: cfg.STUN.Servers,
+		UserAgent:   cfg.SIP.UserAgent,
+
+		STUNParallel:     cfg.STUN.Parallel,
+		STUNStrict:       cfg.STUN.Strict,
+		STUNTransport:    strings.ToLower(cfg.STUN.Transport),
+		STUNFamily:       strings.ToLower(cfg.STUN.Family),
+		STUNTimeout:      cfg.STUN.Timeout,
+		STUNRetries:      cfg.STUN.Retries,
+		PresenceFallback: cfg.SIP.PresenceFallback,
+		DisplayName:      cfg.SIP.DisplayName,
+		SubscribeExpires: cfg.SIP.SubscribeExpires,
+		RegisterExpires:  cfg.SIP.RegisterExpires,
+
+		SubscribeConcurrency: cfg.SIP.SubscribeConcurrency,
+		UnavailableRetries:   cfg.SIP.UnavailableRetries,
+		DNDIndicators:        cfg.Mapping.DND,
+		DigestURIHostOnly:    cfg.SIP.DigestURIHostOnly,
+		ExtraHeaders:         extraHeaders,
+		ExtensionPolicy:      extensionPolicy,
+	}
+}
+
+// graphAuth returns the graph.Auth of the Graph settings, checking AUTH_MODE and GRAPH_CLOUD.
+func graphAuth(g GraphSettings) (graph.Auth, error) {
+	mode, err := graph.ParseAuthMode(g.AuthMode)
+	if err != nil {
+		return graph.Auth{}, fmt.Errorf("AUTH_MODE: %w", err)
+	}
+	cloud, err := graph.ParseCloud(g.Cloud)
+	if err != nil {
+		return graph.Auth{}, fmt.Errorf("GRAPH_CLOUD: %w", err)
+	}
+	return graph.Auth{
+		Mode:         mode,
+		TenantID:     g.TenantID,
+		ClientID:     g.ClientID,
+		ClientSecret: g.ClientSecret,
+		Cloud:        cloud,
+		BaseURL:      g.BaseURL,
+		Scope:        g.Scope,
+	}, nil
+}
+
+// reloadExtensions re-reads the extensions source, subscribes to added extensions,
+// unsubscribes removed ones (clearing their presence session) and swaps in the new
+// extension -> email map. Extensions that moved to another PBX are re-subscribed there;
+// a PBX that was not configured at startup needs a restart. Inline extensions are re-read
+// from CONFIG_FILE, and with dir the directory is looked up again. The maps are keyed by
+// the extensions normalized per policy, the startup EXTENSIONS_NORMALIZE the SIP clients
+// use. On a load error the current configuration is kept.
+func reloadExtensions(ctx context.Context, pbxs pbxSet, sink PresenceSink, emailByExt *atomic.Pointer[map[string]string], expirationByExt *atomic.Pointer[map[string]time.Duration], queueByExt *atomic.Pointer[map[string]bool], src ExtensionsSettings, dir *directorySource, defaultServer, policy string, skipInvalid bool) {
+	if path := strings.TrimSpace(os.Getenv("CONFIG_FILE")); path != "" {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			slog.Error("reload config failed; keeping current configuration", "error", err)
+			return
+		}
+		src = cfg.Extensions
+	}
+	extensions, loadedFrom, err := loadExtensionsWithDirectory(ctx, src, dir)
+	if err != nil {
+		slog.Error("reload extensions failed; keeping current configuration", "error", err, "path", firstNonEmpty(src.VoicemailConf, src.Path))
+		return
+	}
+	if extensions, err = checkExtensions(extensions, loadedFrom, skipInvalid); err != nil {
+		slog.Error("reload: invalid extensions; keeping current configuration", "from", loadedFrom, "error", err)
+		return
+	}
+	next := emailMap(extensions, policy)
+	prev := *emailByExt.Load()
+	added, removed := diffExtensions(prev, next)
+	slog.Info("reloading extensions", "from", loadedFrom, "count", len(extensions), "added", added, "removed", removed)
+
+	// Publish the new maps before subscribing so NOTIFYs for new extensions resolve;
+	// NOTIFYs for removed extensions are ignored from here on.
+	expirations := expirationMap(extensions, policy)
+	expirationByExt.Store(&expirations)
+	queues := queueMap(extensions, policy)
+	queueByExt.Store(&queues)
+	emailByExt.Store(&next)
+	_, byServer := groupByServer(extensions, defaultServer)
+	if unknown := pbxs.apply(ctx, byServer); len(unknown) > 0 {
+		slog.Warn("reload: new PBX servers need a restart; their extensions are not monitored", "servers", unknown)
+	}
+	for _, ext := range removed {
+		if err := sink.ClearPresence(ctx, prev[ext], ext); err != nil {
+			slog.Warn("reload: clear presence failed", "extension", ext, "error", err)
+		}
+	}
+}
+
+// checkExtensions validates the loaded extensions and logs the emails shared by several
+// extensions (whose states are aggregated per user, see presenceSync.onBLF). With
+// skipInvalid, bad rows are logged and dropped; otherwise any bad row is an error.
+func checkExtensions(list []ExtensionEntry, from string, skipInvalid bool) ([]ExtensionEntry, error) {
+	valid, warnings, err := validateExtensions(list)
+	for _, w := range warnings {
+		slog.Info("email shared by several extensions; presence follows the busiest", "from", from, "detail", w)
+	}
+	if err == nil {
+		return valid, nil
+	}
+	if !skipInvalid {
+		return nil, err
+	}
+	slog.Warn("skipping invalid extension rows", "from", from, "dropped", len(list)-len(valid), "error", err)
+	return valid, nil
+}
+
+// readinessChecks returns the /readyz checks: registered to every PBX, at least one active
+// subscription on each PBX with extensions, no symmetric NAT detected, and a Graph token
+// acquired (skipped in dry-run mode, where graphClient is nil).
+func readinessChecks(pbxs pbxSet, graphClient *graph.Client) []health.Check {
+	checks := []health.Check{
+		{Name: "sip_registered", Fn: pbxs.registrationError},
+		{Name: "sip_subscriptions", Fn: pbxs.subscriptionError},
+		{Name: "nat", Fn: func() error {
+			// STUN runs once for all PBXs, so the first client speaks for every one.
+			if pbxs[0].client.SymmetricNAT() {
+				return errors.New("symmetric NAT detected; NOTIFYs may not reach the STUN-discovered Contact (forward the SIP port or set SIP_CONTACT_IP)")
+			}
+			return nil
+		}},
+	}
+	if graphClient != nil {
+		checks = append(checks, health.Check{Name: "graph_token", Fn: func() error {
+			if !graphClient.TokenAcquired() {
+				return errors.New("no Graph token acquired")
+			}
+			return nil
+		}})
+	}
+	return checks
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// OUTAGE_PRESENCE values: what presenceSync does for the users of a PBX it lost.
+const (
+	outageLeave     = "leave"     // write nothing; presence keeps its last value
+	outageAvailable = "available" // write the idle mapping (Available/Available by default)
+	outageClear     = "clear"     // clear the users' presence sessions
+)
+
+// outageCheckInterval is how often runOutageWatch looks at the PBX registrations.
+const outageCheckInterval = 10 * time.Second
+
+// parseOutagePresence checks an OUTAGE_PRESENCE value; "" means outageLeave.
+func parseOutagePresence(s string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case "", outageLeave:
+		return outageLeave, nil
+	case outageAvailable, outageClear:
+		return v, nil
+	}
+	return "", fmt.Errorf("outage presence %q: want %q, %q or %q", s, outageLeave, outageAvailable, outageClear)
+}
+
+// pbxStatus is what the outage watch needs of a PBX's SIP client (*sip.Client).
+type pbxStatus interface {
+	Registered() bool
+	Extensions() []string
+	ActiveSubscriptions() int
+}
+
+// outageWatch notices PBXs that lost their registration, or all their subscriptions, for
+// longer than grace (OUTAGE_GRACE) and sets the presence of their users as action
+// (OUTAGE_PRESENCE) says; when the PBX is back, the users are resynced.
+type outageWatch struct {
+	action string // outage* constant other than outageLeave
+	grace  time.Duration
+	pbxs   map[string]pbxStatus // server -> client
+	policy string               // EXTENSIONS_NORMALIZE: the clients' extensions are raw, the maps normalized
+	now    func() time.Time
+
+	down map[string]time.Time // server -> when it was first seen down
+	lost map[string][]string  // server -> extensions whose users got the outage presence
+}
+
+// healthy reports whether the PBX is registered and, when it has extensions, has at least
+// one active subscription.
+func healthy(s pbxStatus) bool {
+	return s.Registered() && (len(s.Extensions()) == 0 || s.ActiveSubscriptions() > 0)
+}
+
+// runOutageWatch checks every outageCheckInterval until ctx is done (see outageWatch.check).
+func (p *presenceSync) runOutageWatch(ctx context.Context, w *outageWatch) {
+	ticker := time.NewTicker(outageCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		w.check(p)
+	}
+}
+
+// check applies the outage presence for each PBX down for longer than the grace period
+// and resyncs the users of each lost PBX that is healthy again.
+func (w *outageWatch) check(p *presenceSync) {
+	if w.down == nil {
+		w.down = make(map[string]time.Time)
+		w.lost = make(map[string][]string)
+	}
+	now := w.now()
+	for server, s := range w.pbxs {
+		if healthy(s) {
+			delete(w.down, server)
+			if exts, ok := w.lost[server]; ok {
+				delete(w.lost, server)
+				p.outageEnded(server, exts)
+			}
+			continue
+		}
+		since, ok := w.down[server]
+		if !ok {
+			w.down[server] = now
+			continue
+		}
+		if _, ok := w.lost[server]; !ok && now.Sub(since) >= w.grace {
+			exts := make([]string, 0, len(s.Extensions()))
+			for _, ext := range s.Extensions() {
+				exts = append(exts, blf.NormalizeExtension(ext, w.policy))
+			}
+			w.lost[server] = exts
+			p.outageStarted(server, exts, w.action, now.Sub(since))
+		}
+	}
+}
+
+// outageStarted forgets the reported states of exts, marks their users as stranded and
+// writes them the outage presence: the idle mapping, or a cleared presence session.
+// Pinned users are left alone, and outside the business hours the idle mapping gives way
+// to what BUSINESS_HOURS_OUTSIDE says.
+func (p *presenceSync) outageStarted(server string, exts []string, action string, down time.Duration) {
+	p.log.Warn("PBX lost; setting outage presence", "pbx", server, "down", down.Round(time.Second), "extensions", len(exts), "presence", action)
+	for _, ext := range exts {
+		p.reported.Delete(ext) // the call states are unknown until the PBX sends them again
+	}
+	emails := *p.emails.Load()
+	for _, session := range p.sessions(emails, exts) {
+		p.strandMu.Lock()
+		if p.stranded == nil {
+			p.stranded = make(map[string]bool)
+		}
+		p.stranded[session] = true
+		p.strandMu.Unlock()
+		if p.pinned(session) {
+			continue
+		}
+		p.cancelRinging(session)
+		email := emails[session]
+		if action == outageClear {
+			ctx, cancel := context.WithTimeout(p.baseContext(), presenceWriteTimeout)
+			if err := p.sink.ClearPresence(ctx, email, session); err != nil {
+				p.log.Error("clear presence", "extension", session, "email", email, "error", err)
+			}
+			cancel()
+			p.written.Delete(session)
+			p.asserted.Delete(session) // no presence session left to keep fresh
+			continue
+		}
+		if p.closed(email, session) {
+			continue
+		}
+		availability, activity := p.mappingFor(session).ToGraph(blf.StateIdle)
+		p.writeFixed(p.baseContext(), email, session, availability, activity, false)
+	}
+}
+
+// outageEnded unmarks the users of exts and writes the presence of their current state,
+// as reported by the NOTIFYs of the new subscriptions (idle when none arrived yet).
+func (p *presenceSync) outageEnded(server string, exts []string) {
+	p.log.Info("PBX back; resyncing presence", "pbx", server, "extensions", len(exts))
+	emails := *p.emails.Load()
+	for _, session := range p.sessions(emails, exts) {
+		p.strandMu.Lock()
+		delete(p.stranded, session)
+		p.strandMu.Unlock()
+		p.resync(emails, emails[session])
+	}
+}
+
+// sessions returns the session extensions of the users mapped to exts, once per user.
+// Extensions no longer mapped are skipped.
+func (p *presenceSync) sessions(emails map[string]string, exts []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, ext := range exts {
+		email, ok := emails[ext]
+		if !ok {
+			continue
+		}
+		if session := p.userState(emails, email).session; !seen[session] {
+			seen[session] = true
+			out = append(out, session)
+		}
+	}
+	return out
+}
+
+// isStranded reports whether the user with the given session extension has the outage
+// presence: their PBX is lost, so their call state is unknown.
+func (p *presenceSync) isStranded(session string) bool {
+	p.strandMu.Lock()
+	defer p.strandMu.Unlock()
+	return p.stranded[session]
+}
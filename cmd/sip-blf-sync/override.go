@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// errUnknownExtension is returned by setPin and removePin for an extension that is not mapped.
+var errUnknownExtension = errors.New("unknown extension")
+
+// pin is a presence pinned through the override API for one user.
+type pin struct {
+	extension    string // extension named in the request
+	email        string
+	availability string
+	activity     string
+	until        time.Time   // zero = until unpinned
+	timer        *time.Timer // next re-assert, or the end of the pin
+}
+
+// setPin pins the presence of the user mapped to extension to availability/activity for
+// ttl (0 = until removePin), replacing an earlier pin. Pinning any extension of a user with
+// several pins the user: BLF updates are not written for them while the pin lasts. The pin
+// is re-asserted before the presence expires and the user resynced to their call state
+// when it ends.
+func (p *presenceSync) setPin(extension, availability, activity string, ttl time.Duration) (*pin, error) {
+	emails := *p.emails.Load()
+	email, ok := emails[extension]
+	if !ok {
+		return nil, errUnknownExtension
+	}
+	session := p.userState(emails, email).session
+	pn := &pin{extension: extension, email: emails[session], availability: availability, activity: activity}
+	if ttl > 0 {
+		pn.until = time.Now().Add(ttl)
+	}
+	p.pinMu.Lock()
+	if p.pins == nil {
+		p.pins = make(map[string]*pin)
+	}
+	if old, ok := p.pins[session]; ok {
+		old.timer.Stop()
+	}
+	p.pins[session] = pn
+	pn.timer = time.AfterFunc(p.pinInterval(session, pn), func() { p.pinTick(session, pn) })
+	p.pinMu.Unlock()
+
+	p.cancelRinging(session)
+	p.log.Info("presence pinned", "extension", extension, "email", pn.email, "availability", availability, "activity", activity, "ttl", ttl)
+	p.writeFixed(p.baseContext(), pn.email, session, availability, activity, false)
+	return pn, nil
+}
+
+// removePin removes the pin of the user mapped to extension and resyncs their presence.
+// It reports whether there was a pin.
+func (p *presenceSync) removePin(extension string) (bool, error) {
+	emails := *p.emails.Load()
+	email, ok := emails[extension]
+	if !ok {
+		return false, errUnknownExtension
+	}
+	session := p.userState(emails, email).session
+	if !p.dropPin(session, nil) {
+		return false, nil
+	}
+	p.log.Info("presence unpinned", "extension", extension, "email", email)
+	p.resync(emails, email)
+	return true, nil
+}
+
+// dropPin removes the pin of the user with the given session extension, if it is pn (any
+// pin when pn is nil). It reports whether a pin was removed.
+func (p *presenceSync) dropPin(session string, pn *pin) bool {
+	p.pinMu.Lock()
+	defer p.pinMu.Unlock()
+	cur, ok := p.pins[session]
+	if !ok || pn != nil && cur != pn {
+		return false
+	}
+	cur.timer.Stop()
+	delete(p.pins, session)
+	return true
+}
+
+// pinned reports whether the user with the given session extension has a pin.
+func (p *presenceSync) pinned(session string) bool {
+	p.pinMu.Lock()
+	defer p.pinMu.Unlock()
+	_, ok := p.pins[session]
+	return ok
+}
+
+// pinInterval returns how long until pn is next re-asserted or ends: half the presence
+// expiration of the session, or the time left when that is sooner.
+func (p *presenceSync) pinInterval(session string, pn *pin) time.Duration {
+	d := p.reassertInterval(session)
+	if !pn.until.IsZero() {
+		d = min(d, time.Until(pn.until))
+	}
+	return max(d, 0)
+}
+
+// pinTick ends pn when its ttl is up (resyncing the user) and otherwise re-asserts it and
+// schedules the next tick. It does nothing once pn was replaced or removed.
+func (p *presenceSync) pinTick(session string, pn *pin) {
+	if !pn.until.IsZero() && !time.Now().Before(pn.until) {
+		if p.dropPin(session, pn) {
+			p.log.Info("presence pin expired", "extension", pn.extension, "email", pn.email)
+			p.resync(*p.emails.Load(), pn.email)
+		}
+		return
+	}
+	p.pinMu.Lock()
+	current := p.pins[session] == pn
+	if current {
+		pn.timer = time.AfterFunc(p.pinInterval(session, pn), func() { p.pinTick(session, pn) })
+	}
+	p.pinMu.Unlock()
+	if current {
+		p.writeFixed(p.baseContext(), pn.email, session, pn.availability, pn.activity, true)
+	}
+}
+
+// pinRequest is the body of POST /override/{ext}. Activity defaults to Availability; TTL
+// is a duration such as "30m" (empty = until DELETE /override/{ext}).
+type pinRequest struct {
+	Availability string `json:"availability"`
+	Activity     string `json:"activity"`
+	TTL          string `json:"ttl"`
+}
+
+// pinJSON is a pin as served by the override API.
+type pinJSON struct {
+	Extension    string     `json:"extension"`
+	Email        string     `json:"email"`
+	Availability string     `json:"availability"`
+	Activity     string     `json:"activity"`
+	Until        *time.Time `json:"until,omitempty"`
+}
+
+func (pn *pin) toJSON() pinJSON {
+	j := pinJSON{Extension: pn.extension, Email: pn.email, Availability: pn.availability, Activity: pn.activity}
+	if !pn.until.IsZero() {
+		j.Until = &pn.until
+	}
+	return j
+}
+
+// overrideHandler serves the override API for the health listener, each request
+// authenticated with "Authorization: Bearer <token>":
+//
+//	GET /override          the current pins, as a JSON array
+//	POST /override/{ext}   pin the extension's user (body: pinRequest)
+//	DELETE /override/{ext} remove the pin and resume call-driven presence
+func (p *presenceSync) overrideHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /override", func(w http.ResponseWriter, _ *http.Request) {
+		p.pinMu.Lock()
+		out := []pinJSON{}
+		for _, session := range slices.Sorted(maps.Keys(p.pins)) {
+			out = append(out, p.pins[session].toJSON())
+		}
+		p.pinMu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	})
+	mux.HandleFunc("POST /override/{ext}", func(w http.ResponseWriter, r *http.Request) {
+		var req pinRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if strings.TrimSpace(req.Activity) == "" {
+			req.Activity = blf.ActivityFor(req.Availability)
+		}
+		pair, err := blf.ParseMappingValue(req.Availability + ":" + req.Activity)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, "ttl: want a positive duration such as 30m")
+				return
+			}
+		}
+		pn, err := p.setPin(r.PathValue("ext"), pair[0], pair[1], ttl)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, pn.toJSON())
+	})
+	mux.HandleFunc("DELETE /override/{ext}", func(w http.ResponseWriter, r *http.Request) {
+		removed, err := p.removePin(r.PathValue("ext"))
+		switch {
+		case err != nil:
+			writeError(w, http.StatusNotFound, err.Error())
+		case !removed:
+			writeError(w, http.StatusNotFound, "extension is not pinned")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// parseResult is what the parse subcommand reports for one NOTIFY body.
+type parseResult struct {
+	Body         string         `json:"body"` // "dialog-info", "pidf" or "xpidf"
+	Extension    string         `json:"extension,omitempty"`
+	Version      *uint64        `json:"version,omitempty"`
+	Partial      bool           `json:"partial,omitempty"`
+	Dialogs      []parsedDialog `json:"dialogs,omitempty"`
+	State        blf.State      `json:"state"`
+	Availability string         `json:"availability"`
+	Activity     string         `json:"activity"`
+}
+
+// parsedDialog is one dialog of a dialog-info body.
+type parsedDialog struct {
+	ID    string    `json:"id"`
+	State blf.State `json:"state"`
+}
+
+// runParse implements "sip-blf-sync parse [-json] [file]": it reads a dialog-info, PIDF or XPIDF
+// body (or a whole captured NOTIFY, whose headers are skipped) from file or stdin and prints
+// how the service would interpret it. The Graph values follow the configured MAP_* overrides.
+func runParse(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: sip-blf-sync parse [-json] [file|-]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("parse: at most one file")
+	}
+
+	in := stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(strings.TrimSpace(os.Getenv("CONFIG_FILE")))
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	mapping, err := loadStateMapping(cfg.Mapping)
+	if err != nil {
+		return fmt.Errorf("invalid state mapping: %w", err)
+	}
+
+	res := parseNotifyBody(notifyBody(data), mapping, cfg.Mapping.DND)
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	printParseResult(stdout, res)
+	return nil
+}
+
+// notifyBody returns the body of a captured SIP message (the part after the first blank
+// line when data starts with a request or status line), or data unchanged.
+func notifyBody(data []byte) []byte {
+	data = bytes.TrimLeft(data, "\r\n\t ")
+	if !bytes.HasPrefix(data, []byte("NOTIFY ")) && !bytes.HasPrefix(data, []byte("SIP/2.0 ")) {
+		return data
+	}
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(data, []byte(sep)); i >= 0 {
+			return data[i+len(sep):]
+		}
+	}
+	return nil
+}
+
+// parseNotifyBody interprets body like the SIP client does for a NOTIFY: dialog-info when
+// it parses as such, otherwise as a presence (PIDF) body; dnd are the DND_MATCH indicators.
+func parseNotifyBody(body []byte, mapping blf.Mapping, dnd []string) parseResult {
+	var res parseResult
+	if doc, err := blf.ParseDialogDocument(body); err == nil && bytes.Contains(body, []byte("dialog-info")) {
+		res.Body = "dialog-info"
+		res.Extension = blf.ExtensionFromDialogInfo(body)
+		if doc.HasVersion {
+			res.Version = &doc.Version
+		}
+		res.Partial = doc.Partial
+		for _, d := range doc.Dialogs {
+			res.Dialogs = append(res.Dialogs, parsedDialog{ID: d.ID, State: d.State})
+		}
+		res.State = doc.State()
+	} else {
+		res.Body = "pidf"
+		if xpidf, err := blf.ParseXPIDF(body); err == nil {
+			res.Body = "xpidf"
+			res.Extension = xpidf.Extension()
+		} else if pidf, err := blf.ParsePIDF(body); err == nil {
+			res.Extension = blf.UserFromURI(pidf.Entity)
+		}
+		res.State = blf.ParsePresenceBody(body)
+	}
+	if blf.DetectDND(body, dnd) {
+		res.State = blf.StateDND
+	}
+	res.Availability, res.Activity = mapping.ToGraph(res.State)
+	return res
+}
+
+// printParseResult writes res as aligned "field: value" lines.
+func printParseResult(w io.Writer, res parseResult) {
+	fmt.Fprintf(w, "body:         %s\n", res.Body)
+	fmt.Fprintf(w, "extension:    %s\n", firstNonEmpty(res.Extension, "(none)"))
+	if res.Body == "dialog-info" {
+		version := "(none)"
+		if res.Version != nil {
+			version = fmt.Sprint(*res.Version)
+		}
+		kind := "full"
+		if res.Partial {
+			kind = "partial"
+		}
+		fmt.Fprintf(w, "version:      %s (%s)\n", version, kind)
+		for _, d := range res.Dialogs {
+			fmt.Fprintf(w, "dialog:       %s %s\n", firstNonEmpty(d.ID, "(no id)"), d.State)
+		}
+	}
+	fmt.Fprintf(w, "state:        %s\n", res.State)
+	fmt.Fprintf(w, "availability: %s\n", res.Availability)
+	fmt.Fprintf(w, "activity:     %s\n", res.Activity)
+}
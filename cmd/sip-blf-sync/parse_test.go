@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func TestParseNotifyBody_CapturedNotify(t *testing.T) {
+	captured := []byte("NOTIFY sip:blf@10.0.0.5:5060 SIP/2.0\r\n" +
+		"Event: dialog\r\n" +
+		"Content-Type: application/dialog-info+xml\r\n" +
+		"\r\n" +
+		`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="4" state="partial" entity="sip:101@pbx.example.com">` +
+		`<dialog id="a1"><state>confirmed</state></dialog>` +
+		`<dialog id="a2"><state>early</state></dialog>` +
+		`</dialog-info>`)
+	mapping := blf.Mapping{blf.StateBusy: {"DoNotDisturb", "Presenting"}}
+
+	res := parseNotifyBody(notifyBody(captured), mapping, nil)
+	if res.Body != "dialog-info" || res.Extension != "101" || res.State != blf.StateBusy {
+		t.Errorf("got body %q extension %q state %q, want dialog-info 101 busy", res.Body, res.Extension, res.State)
+	}
+	if res.Version == nil || *res.Version != 4 || !res.Partial {
+		t.Errorf("version = %v partial = %v, want 4 partial", res.Version, res.Partial)
+	}
+	if len(res.Dialogs) != 2 || res.Dialogs[1] != (parsedDialog{ID: "a2", State: blf.StateRinging}) {
+		t.Errorf("dialogs = %+v", res.Dialogs)
+	}
+	if res.Availability != "DoNotDisturb" || res.Activity != "Presenting" {
+		t.Errorf("graph = %s/%s, want the MAP_BUSY override DoNotDisturb/Presenting", res.Availability, res.Activity)
+	}
+}
+
+func TestParseNotifyBody_PIDF(t *testing.T) {
+	body := []byte(`<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="pres:102@pbx.example.com">` +
+		`<tuple id="t1"><status><basic>closed</basic></status></tuple></presence>`)
+	res := parseNotifyBody(notifyBody(body), nil, nil)
+	want := parseResult{Body: "pidf", Extension: "102", State: blf.StateIdle, Availability: "Available", Activity: "Available"}
+	if res.Body != want.Body || res.Extension != want.Extension || res.State != want.State ||
+		res.Availability != want.Availability || res.Activity != want.Activity {
+		t.Errorf("parseNotifyBody = %+v, want %+v", res, want)
+	}
+}
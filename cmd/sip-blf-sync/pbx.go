@@ -0,0 +1,239 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/sip"
+)
+
+// pbx is one PBX server and the SIP client registered to it. Every PBX reports to the
+// same BLF callback, so extensions on all of them map to Graph presence the same way.
+type pbx struct {
+	server string     // as configured: SIP_SERVER or an extension's "server"
+	cfg    sip.Config // with the resolved server and this client's Contact
+	listen string     // SIP listen address
+	client *sip.Client
+}
+
+// pbxSet is every monitored PBX, the default server (SIP_SERVER) first.
+type pbxSet []*pbx
+
+// newPBX creates the client for server, the index-th PBX. base carries the shared settings
+// and the (possibly STUN-discovered) Contact, and listen is the first PBX's listen address.
+// Each client needs its own socket, so later PBXs listen on the following ports and
+// advertise that port in their Contact. STUN mapped none of those sockets, so with a
+// discovered Contact their public port is learnt from the Via rport the PBX reports
+// (SIP_LEARN_CONTACT is implied). The client logs with a "pbx" attribute naming server.
+func newPBX(ctx context.Context, base sip.Config, server string, index int, listen string, extensions []string, onBLF sip.BLFHandler) (*pbx, error) {
+	cfg := base
+	cfg.Server = server
+	if err := sip.ResolveServer(ctx, &cfg, slog.Default()); err != nil {
+		return nil, fmt.Errorf("resolve SIP server %s: %w", server, err)
+	}
+	if index > 0 {
+		addr, port, err := offsetListenAddr(listen, index)
+		if err != nil {
+			return nil, fmt.Errorf("listen address for %s: %w", server, err)
+		}
+		listen, cfg.ContactPort = addr, port
+		if cfg.ContactDiscovered && !cfg.LearnContact {
+			slog.Info("learning the Contact port from Via rport for an additional PBX behind NAT", "server", server, "listen", listen)
+			cfg.LearnContact = true
+		}
+	}
+	client, err := sip.NewClient(cfg, extensions, onBLF, slog.Default().With("pbx", server))
+	if err != nil {
+		return nil, fmt.Errorf("create sip client for %s: %w", server, err)
+	}
+	slog.Info("SIP server", "server", server, "target", cfg.Server, "listen", listen, "extensions", len(extensions))
+	return &pbx{server: server, cfg: cfg, listen: listen, client: client}, nil
+}
+
+// offsetListenAddr returns addr with its port increased by offset, and that port.
+func offsetListenAddr(addr string, offset int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("port %q: %w", portStr, err)
+	}
+	port += offset
+	return net.JoinHostPort(host, strconv.Itoa(port)), port, nil
+}
+
+// get returns the PBX configured as server, or nil.
+func (s pbxSet) get(server string) *pbx {
+	for _, p := range s {
+		if p.server == server {
+			return p
+		}
+	}
+	return nil
+}
+
+// Close closes every client.
+func (s pbxSet) Close() {
+	for _, p := range s {
+		p.client.Close()
+	}
+}
+
+// Register registers with every PBX, stopping at the first failure.
+func (s pbxSet) Register(ctx context.Context) error {
+	for _, p := range s {
+		granted, err := p.client.Register(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.server, err)
+		}
+		slog.Info("registered", "pbx", p.server, "expires", granted)
+	}
+	return nil
+}
+
+// Subscribe subscribes on every PBX that has extensions, stopping at the first PBX where
+// all subscriptions failed.
+func (s pbxSet) Subscribe(ctx context.Context) error {
+	for _, p := range s {
+		if len(p.client.Extensions()) == 0 {
+			continue
+		}
+		if err := p.client.Subscribe(ctx); err != nil {
+			return fmt.Errorf("%s: %w", p.server, err)
+		}
+	}
+	return nil
+}
+
+// Unsubscribe ends the subscriptions on every PBX.
+func (s pbxSet) Unsubscribe(ctx context.Context) {
+	for _, p := range s {
+		p.client.Unsubscribe(ctx)
+	}
+}
+
+// apply moves each PBX to the extensions byServer lists for it: removed extensions are
+// unsubscribed first (so an extension moving between PBXs is never watched twice), then
+// added ones are subscribed. Servers without a running client are returned; they need a
+// restart to be monitored.
+func (s pbxSet) apply(ctx context.Context, byServer map[string][]string) (unknown []string) {
+	added := make(map[*pbx][]string)
+	for _, p := range s {
+		next := make(map[string]string)
+		for _, ext := range byServer[p.server] {
+			next[ext] = ""
+		}
+		prev := make(map[string]string)
+		for _, ext := range p.client.Extensions() {
+			prev[ext] = ""
+		}
+		var removed []string
+		added[p], removed = diffExtensions(prev, next)
+		p.client.RemoveExtensions(ctx, removed)
+	}
+	for _, p := range s {
+		if err := p.client.AddExtensions(ctx, added[p]); err != nil {
+			slog.Warn("reload: some extensions could not be subscribed", "server", p.server, "error", err)
+		}
+	}
+	for server := range byServer {
+		if s.get(server) == nil {
+			unknown = append(unknown, server)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// registrationError lists the PBXs whose last REGISTER failed, or returns nil.
+func (s pbxSet) registrationError() error {
+	var errs []error
+	for _, p := range s {
+		if !p.client.Registered() {
+			errs = append(errs, fmt.Errorf("not registered to SIP server %s", p.server))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// subscriptionError lists the PBXs that have extensions but no active subscription, or returns nil.
+func (s pbxSet) subscriptionError() error {
+	var errs []error
+	for _, p := range s {
+		if len(p.client.Extensions()) > 0 && p.client.ActiveSubscriptions() == 0 {
+			errs = append(errs, fmt.Errorf("no active BLF subscriptions on %s", p.server))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// subscriptionJSON is one extension in the /subscriptions response.
+type subscriptionJSON struct {
+	Server     string     `json:"server"`
+	Extension  string     `json:"extension"`
+	Subscribed bool       `json:"subscribed"`
+	Event      string     `json:"event,omitempty"`
+	CallID     string     `json:"call_id,omitempty"`
+	FromTag    string     `json:"from_tag,omitempty"`
+	ToTag      string     `json:"to_tag,omitempty"`
+	Expires    string     `json:"expires,omitempty"`
+	RefreshAt  *time.Time `json:"refresh_at,omitempty"`
+	LastNotify *time.Time `json:"last_notify,omitempty"`
+	LastState  blf.State  `json:"last_state,omitempty"`
+	Stale      bool       `json:"stale,omitempty"`
+	// Terminated is the reason the PBX ended the subscription with ("terminated" when it
+	// gave none), while it is not re-established.
+	Terminated    string     `json:"terminated,omitempty"`
+	ResubscribeAt *time.Time `json:"resubscribe_at,omitempty"`
+}
+
+// subscriptionsHandler serves GET /subscriptions: the subscription status of every
+// monitored extension on every PBX, as a JSON array.
+func (s pbxSet) subscriptionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		out := []subscriptionJSON{}
+		for _, p := range s {
+			for _, st := range p.client.Subscriptions() {
+				sj := subscriptionJSON{
+					Server:     p.server,
+					Extension:  st.Extension,
+					Subscribed: st.Subscribed,
+					Event:      st.Event,
+					CallID:     st.CallID,
+					FromTag:    st.FromTag,
+					ToTag:      st.ToTag,
+					LastState:  st.LastState,
+					Stale:      st.Stale,
+				}
+				if st.Subscribed {
+					sj.Expires = st.Expires.String()
+					sj.RefreshAt = &st.RefreshAt
+				}
+				if !st.LastNotify.IsZero() {
+					sj.LastNotify = &st.LastNotify
+				}
+				if st.Terminated {
+					sj.Terminated = cmp.Or(st.TerminatedReason, "terminated")
+					if !st.ResubscribeAt.IsZero() {
+						sj.ResubscribeAt = &st.ResubscribeAt
+					}
+				}
+				out = append(out, sj)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
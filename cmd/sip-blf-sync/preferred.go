@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+)
+
+// preferredCheckInterval is how often preferredSchedule checks its schedule.
+const preferredCheckInterval = time.Minute
+
+var _ preferredSink = (*graph.Client)(nil)
+
+// preferredSink sets and clears users' preferred presence. *graph.Client implements it;
+// dryRunSink logs instead.
+type preferredSink interface {
+	SetPreferredPresence(ctx context.Context, userID, availability, activity string, expiration time.Duration) error
+	ClearPreferredPresence(ctx context.Context, userID string) error
+}
+
+func (s dryRunSink) SetPreferredPresence(_ context.Context, userID, availability, activity string, expiration time.Duration) error {
+	s.log.Info("dry run: would set preferred presence", "user", userID, "availability", availability, "activity", activity, "expiration", expiration)
+	return nil
+}
+
+func (s dryRunSink) ClearPreferredPresence(_ context.Context, userID string) error {
+	s.log.Info("dry run: would clear preferred presence", "user", userID)
+	return nil
+}
+
+// preferredSchedule sets a preferred presence (PREFERRED_PRESENCE) for every mapped user
+// while the schedule (PREFERRED_PRESENCE_SCHEDULE) is active and clears it afterwards. Teams
+// shows the preferred presence instead of the call-driven presence sessions while it is
+// set, so calls do not show during the windows; the sessions keep being written and show
+// again once it is cleared. Each write expires at the window's end, so a preferred presence
+// left by a stopped service clears itself.
+type preferredSchedule struct {
+	sink         preferredSink
+	availability string
+	activity     string
+	schedule     schedule
+	emails       *atomic.Pointer[map[string]string] // extension -> email; swapped on reload
+	log          *slog.Logger
+	now          func() time.Time
+
+	applied map[string]string // lower-cased email -> email with the preferred presence set
+}
+
+// newPreferredSchedule returns the preferredSchedule for settings writing to sink, or nil
+// when the feature is off (neither setting given).
+func newPreferredSchedule(settings PreferredSettings, sink PresenceSink, emails *atomic.Pointer[map[string]string]) (*preferredSchedule, error) {
+	presence, spec := strings.TrimSpace(settings.Presence), strings.TrimSpace(settings.Schedule)
+	if presence == "" && spec == "" {
+		return nil, nil
+	}
+	if presence == "" || spec == "" {
+		return nil, errors.New("PREFERRED_PRESENCE and PREFERRED_PRESENCE_SCHEDULE must be set together")
+	}
+	availability, activity, err := graph.ParsePreferredPresence(presence)
+	if err != nil {
+		return nil, err
+	}
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	ps, ok := sink.(preferredSink)
+	if !ok {
+		return nil, errors.New("presence backend cannot set preferred presence")
+	}
+	return &preferredSchedule{
+		sink:         ps,
+		availability: availability,
+		activity:     activity,
+		schedule:     sched,
+		emails:       emails,
+		log:          slog.Default().With("component", "preferred"),
+		now:          time.Now,
+	}, nil
+}
+
+// run checks the schedule now and every preferredCheckInterval until ctx is done.
+func (p *preferredSchedule) run(ctx context.Context) {
+	ticker := time.NewTicker(preferredCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check sets the preferred presence of users that lack it while the schedule is active and
+// clears it for the others (all users outside the windows, removed users inside them).
+// Failed writes are retried on the next check.
+func (p *preferredSchedule) check(ctx context.Context) {
+	if p.applied == nil {
+		p.applied = make(map[string]string)
+	}
+	now := p.now()
+	until, active := p.schedule.activeUntil(now)
+	want := make(map[string]string)
+	if active {
+		// A user with several extensions is written with the email of the lowest, as in onBLF.
+		emails := *p.emails.Load()
+		for _, ext := range slices.Sorted(maps.Keys(emails)) {
+			if key := strings.ToLower(emails[ext]); want[key] == "" {
+				want[key] = emails[ext]
+			}
+		}
+	}
+	for key, email := range p.applied {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if err := p.sink.ClearPreferredPresence(ctx, email); err != nil {
+			p.log.Warn("clear preferred presence failed; retrying later", "email", email, "error", err)
+			continue
+		}
+		delete(p.applied, key)
+		p.log.Info("preferred presence cleared", "email", email)
+	}
+	expiration := until.Sub(now).Round(time.Minute)
+	for _, key := range slices.Sorted(maps.Keys(want)) {
+		email := want[key]
+		if _, ok := p.applied[key]; ok {
+			continue
+		}
+		if err := p.sink.SetPreferredPresence(ctx, email, p.availability, p.activity, max(expiration, time.Minute)); err != nil {
+			if !errors.Is(err, graph.ErrCircuitOpen) {
+				p.log.Warn("set preferred presence failed; retrying later", "email", email, "error", err)
+			}
+			continue
+		}
+		p.applied[key] = email
+		p.log.Info("preferred presence set", "email", email, "availability", p.availability, "activity", p.activity, "until", until.Format(time.DateTime))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxExtensionSpan caps how many extensions one range or wildcard entry expands to, so a
+// typo such as "2000-20500" does not subscribe thousands of extensions.
+const maxExtensionSpan = 1000
+
+// expandExtensions replaces range ("2000-2050") and wildcard ("20??", each ? one digit)
+// entries with one entry per extension, all sharing the row's email and other settings.
+// A spec that cannot be expanded is kept as is with specErr set, so validateExtensions
+// reports it with the other bad rows. Plain entries are returned unchanged.
+func expandExtensions(list []ExtensionEntry) []ExtensionEntry {
+	out := make([]ExtensionEntry, 0, len(list))
+	for i, e := range list {
+		e.entry = i + 1
+		exts, isSpec, err := expandExtensionSpec(strings.TrimSpace(e.Extension))
+		if !isSpec {
+			out = append(out, e)
+			continue
+		}
+		e.spec = e.Extension
+		if err != nil {
+			e.specErr = err
+			out = append(out, e)
+			continue
+		}
+		for _, ext := range exts {
+			e.Extension = ext
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// expandExtensionSpec expands a range or wildcard spec; isSpec is false for a plain
+// extension. Both ends of a range must be digits; when they have the same length, leading
+// zeros are kept ("001-010").
+func expandExtensionSpec(spec string) (exts []string, isSpec bool, err error) {
+	if lo, hi, ok := strings.Cut(spec, "-"); ok && allDigits(lo) && allDigits(hi) {
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil {
+			return nil, true, fmt.Errorf("range %s: bounds out of range", spec)
+		}
+		if from > to {
+			return nil, true, fmt.Errorf("range %s: start is after end", spec)
+		}
+		if to-from+1 > maxExtensionSpan {
+			return nil, true, fmt.Errorf("range %s: %d extensions, at most %d per entry", spec, to-from+1, maxExtensionSpan)
+		}
+		width := 0
+		if len(lo) == len(hi) {
+			width = len(lo)
+		}
+		for n := from; n <= to; n++ {
+			exts = append(exts, fmt.Sprintf("%0*d", width, n))
+		}
+		return exts, true, nil
+	}
+	wild := strings.Count(spec, "?")
+	if wild == 0 || !allDigits(strings.ReplaceAll(spec, "?", "0")) {
+		return nil, false, nil
+	}
+	if wild > 3 { // 10^wild extensions; 3 wildcards already reach maxExtensionSpan
+		return nil, true, fmt.Errorf("wildcard %s: more than %d extensions", spec, maxExtensionSpan)
+	}
+	exts = []string{""}
+	for _, r := range spec {
+		var next []string
+		for _, prefix := range exts {
+			if r != '?' {
+				next = append(next, prefix+string(r))
+				continue
+			}
+			for d := '0'; d <= '9'; d++ {
+				next = append(next, prefix+string(d))
+			}
+		}
+		exts = next
+	}
+	return exts, true, nil
+}
+
+// allDigits reports whether s is a non-empty string of ASCII digits.
+func allDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a set of weekly time windows in local time, e.g. "Mon-Fri 08:00-17:30,
+// Sat 09:00-12:00" (see parseSchedule).
+type schedule []scheduleWindow
+
+// scheduleWindow is one window: the days it applies to and its start and end as minutes
+// after midnight (end is after start; 1440 is midnight at the end of the day).
+type scheduleWindow struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSchedule parses comma-separated "<days> <HH:MM>-<HH:MM>" windows. Days are a
+// three-letter weekday ("Mon"), a range ("Mon-Fri", which may wrap as in "Fri-Mon") or
+// several of those joined by "/" ("Mon/Wed/Fri"). A window ends on the day it starts;
+// "24:00" is the end of the day.
+func parseSchedule(s string) (schedule, error) {
+	var sched schedule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		days, hours, ok := strings.Cut(part, " ")
+		if !ok {
+			return nil, fmt.Errorf("schedule window %q: want \"<days> <HH:MM>-<HH:MM>\"", part)
+		}
+		var w scheduleWindow
+		if err := parseDays(days, &w.days); err != nil {
+			return nil, fmt.Errorf("schedule window %q: %w", part, err)
+		}
+		from, to, ok := strings.Cut(strings.TrimSpace(hours), "-")
+		if !ok {
+			return nil, fmt.Errorf("schedule window %q: want a time range such as 09:00-17:00", part)
+		}
+		var err error
+		if w.start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("schedule window %q: %w", part, err)
+		}
+		if w.end, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("schedule window %q: %w", part, err)
+		}
+		if w.end <= w.start {
+			return nil, fmt.Errorf("schedule window %q: end must be after start", part)
+		}
+		sched = append(sched, w)
+	}
+	if len(sched) == 0 {
+		return nil, fmt.Errorf("schedule %q: no windows", s)
+	}
+	return sched, nil
+}
+
+// parseDays marks the days of spec ("Mon", "Mon-Fri", "Sat/Sun") in days.
+func parseDays(spec string, days *[7]bool) error {
+	for _, item := range strings.Split(spec, "/") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, ok := weekdays[strings.ToLower(strings.TrimSpace(first))]
+		if !ok {
+			return fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[strings.ToLower(strings.TrimSpace(last))]; !ok {
+				return fmt.Errorf("unknown day %q", last)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" (00:00 to 24:00) as minutes after midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hour, herr := strconv.Atoi(h)
+	minute, merr := strconv.Atoi(m)
+	if !ok || herr != nil || merr != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("time %q: want HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// activeUntil reports whether t falls in a window and, if so, when that window ends
+// (the latest end among the windows containing t).
+func (s schedule) activeUntil(t time.Time) (time.Time, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	var until time.Time
+	for _, w := range s {
+		if !w.days[t.Weekday()] || minute < w.start || minute >= w.end {
+			continue
+		}
+		if end := time.Date(t.Year(), t.Month(), t.Day(), 0, w.end, 0, 0, t.Location()); end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero()
+}
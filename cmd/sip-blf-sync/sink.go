@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/audit"
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+)
+
+var _ PresenceSink = (*graph.Client)(nil)
+
+// PresenceSink is the presence backend the BLF callback writes to. *graph.Client
+// implements it; dryRunSink logs instead, and tests use a fake.
+type PresenceSink interface {
+	// SetPresence sets the user's availability/activity for the extension's session,
+	// expiring after expiration (0 = the Graph default).
+	SetPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error
+	// SetStatusMessage sets (or, when message is empty, clears) the user's status message.
+	SetStatusMessage(ctx context.Context, userID, extension, message string, ttl time.Duration) error
+	// ClearPresence ends the extension's presence session for the user.
+	ClearPresence(ctx context.Context, userID, extension string) error
+}
+
+// dryRunSink logs the presence changes that would be written (DRY_RUN=true).
+type dryRunSink struct {
+	log *slog.Logger
+}
+
+func (s dryRunSink) SetPresence(_ context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	s.log.Info("dry run: would set presence", "user", userID, "extension", extension, "availability", availability, "activity", activity, "expiration", expiration)
+	return nil
+}
+
+func (s dryRunSink) SetStatusMessage(_ context.Context, userID, extension, message string, ttl time.Duration) error {
+	s.log.Info("dry run: would set status message", "user", userID, "extension", extension, "message", message, "ttl", ttl)
+	return nil
+}
+
+func (s dryRunSink) ClearPresence(_ context.Context, userID, extension string) error {
+	s.log.Info("dry run: would clear presence", "user", userID, "extension", extension)
+	return nil
+}
+
+// presenceWriteTimeout bounds one presence write (with its status message), so a write
+// stuck on an unresponsive Graph does not block the user's later updates.
+const presenceWriteTimeout = 30 * time.Second
+
+// presenceSync turns BLF state changes into presence writes on a PresenceSink.
+type presenceSync struct {
+	sink    PresenceSink
+	mapping blf.Mapping
+	emails  *atomic.Pointer[map[string]string] // extension -> email; swapped on reload
+	status  StatusMessageSettings
+	log     *slog.Logger
+	// ctx is the parent of every presence write (nil = context.Background()); main
+	// cancels it at shutdown, abandoning writes still in flight.
+	ctx context.Context
+
+	// expiration is the presence expiration; expirations holds per-extension overrides
+	// (swapped on reload together with emails).
+	expiration  time.Duration
+	expirations *atomic.Pointer[map[string]time.Duration]
+
+	// queues holds the queue extensions (swapped on reload together with emails): their
+	// state is reduced to idle or busy (see queueState) and mapped with queueMapping.
+	queues       *atomic.Pointer[map[string]bool]
+	queueMapping blf.Mapping
+
+	// ignoreRinging skips ringing updates, keeping the current presence. An unanswered
+	// call then ends in idle, which the Graph client's unchanged-state cache drops.
+	ignoreRinging bool
+	// confirmedOnly (PRESENCE_MODE=confirmed-only) writes presence for answered calls only.
+	// Ringing is never written, whatever ignoreRinging and the ringing mapping say; when
+	// an answered call ends while another call rings, the end of the call is written as idle.
+	confirmedOnly bool
+	// ringingGrace (RINGING_GRACE_MS) holds a ringing write back: it is written only if the
+	// user still rings after the grace period, so calls declined or ended within it never
+	// show. Any other state cancels the held write and is written at once.
+	ringingGrace time.Duration
+	graceMu      sync.Mutex
+	graceTimers  map[string]*time.Timer // user's session extension -> held ringing write
+
+	// reported holds the extensions that had a BLF update since startup with their last
+	// state (extension -> blf.State); onBLF aggregates it per user and initialSync leaves
+	// users with a reported extension alone.
+	reported sync.Map
+
+	// audit (AUDIT_LOG, nil = disabled) records each successful presence write whose state
+	// differs from the last one written for the user; written holds that state per
+	// session extension (blf.State).
+	audit   *audit.Log
+	written sync.Map
+
+	// hours (BUSINESS_HOURS, nil = always open) gates the writes: outside the hours BLF
+	// updates are skipped or replaced by a fixed presence (see businessHours).
+	hours *businessHours
+
+	// pins holds the presences pinned through the override API (see setPin), keyed by the
+	// user's session extension; BLF updates for a pinned user are not written.
+	pinMu sync.Mutex
+	pins  map[string]*pin
+
+	// asserted holds the presence last written per session extension (assertion); the
+	// heartbeat (PRESENCE_HEARTBEAT) re-sends it before Graph expires it.
+	asserted sync.Map
+
+	// stranded holds the session extensions of the users of a PBX lost for longer than
+	// OUTAGE_GRACE (see outageWatch); they are not resynced until the PBX is back.
+	strandMu sync.Mutex
+	stranded map[string]bool
+
+	// userMu serializes the aggregate-and-write of each user (lower-case email ->
+	// *sync.Mutex), so NOTIFYs for two of a user's extensions arriving at once, e.g. from
+	// two PBXs, cannot write a stale aggregate last.
+	userMu sync.Map
+}
+
+// presenceForcer is implemented by sinks that skip unchanged presence writes
+// (*graph.Client); pins use it to re-assert their presence before it expires.
+type presenceForcer interface {
+	ForceSetPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error
+}
+
+// presenceBatcher is implemented by sinks that can write many users' presence in one
+// request (*graph.Client); initialSync uses it to avoid Graph throttling.
+type presenceBatcher interface {
+	SetPresenceBatch(ctx context.Context, updates []graph.PresenceUpdate) map[string]error
+}
+
+// onBLF is the sip.BLFHandler: it maps the state of the extension's user to Graph presence
+// and, when enabled, updates the status message. A user with several extensions (e.g. a
+// desk phone and a softphone) gets the aggregate of their states (see userState), so an
+// idle extension does not clear a call on another. Unknown extensions are ignored.
+func (p *presenceSync) onBLF(extension string, state blf.State) {
+	emails := *p.emails.Load()
+	email, ok := emails[extension]
+	if !ok {
+		p.log.Warn("BLF for unknown extension", "extension", extension)
+		return
+	}
+	if p.isQueue(extension) {
+		state = queueState(state)
+	}
+	defer p.lockUser(email)()
+	prev := p.userState(emails, email)
+	p.reported.Store(extension, state)
+	user := p.userState(emails, email)
+	if p.pinned(user.session) {
+		p.log.Debug("presence pinned; BLF update not written", "extension", extension)
+		return
+	}
+	if p.closed(emails[user.session], user.session) {
+		p.log.Debug("outside business hours; BLF update not written", "extension", extension)
+		return
+	}
+	state = user.state
+	if state == blf.StateRinging {
+		switch {
+		case p.confirmedOnly && onCall(prev.state):
+			// The answered call ended; the ringing one does not count yet.
+			state = blf.StateIdle
+		case p.confirmedOnly || p.ignoreRinging:
+			p.log.Debug("ringing ignored; presence unchanged", "extension", extension)
+			return
+		}
+	}
+	if state == blf.StateRinging && p.ringingGrace > 0 {
+		p.holdRinging(user.session, email)
+		return
+	}
+	p.cancelRinging(user.session)
+	p.write(emails[user.session], user.session, user.source, state)
+}
+
+// lockUser locks the presence writes of the user with email (case insensitive) and returns
+// the unlock function.
+func (p *presenceSync) lockUser(email string) func() {
+	v, _ := p.userMu.LoadOrStore(strings.ToLower(email), new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// holdRinging starts the grace timer for the user with the given session extension,
+// unless one is already running (a repeated ringing NOTIFY does not extend the grace).
+func (p *presenceSync) holdRinging(session, email string) {
+	p.graceMu.Lock()
+	defer p.graceMu.Unlock()
+	if p.graceTimers == nil {
+		p.graceTimers = make(map[string]*time.Timer)
+	}
+	if _, ok := p.graceTimers[session]; ok {
+		return
+	}
+	p.log.Debug("ringing held for the grace period", "extension", session, "grace", p.ringingGrace)
+	var t *time.Timer
+	t = time.AfterFunc(p.ringingGrace, func() {
+		p.graceMu.Lock()
+		current := p.graceTimers[session] == t
+		if current {
+			delete(p.graceTimers, session)
+		}
+		p.graceMu.Unlock()
+		if !current {
+			return
+		}
+		defer p.lockUser(email)()
+		emails := *p.emails.Load()
+		if user := p.userState(emails, email); user.state == blf.StateRinging && user.session == session && !p.pinned(session) {
+			p.write(emails[session], session, user.source, blf.StateRinging)
+		}
+	})
+	p.graceTimers[session] = t
+}
+
+// cancelRinging drops a held ringing write for the user with the given session extension.
+func (p *presenceSync) cancelRinging(session string) {
+	p.graceMu.Lock()
+	defer p.graceMu.Unlock()
+	if t, ok := p.graceTimers[session]; ok {
+		t.Stop()
+		delete(p.graceTimers, session)
+	}
+}
+
+// baseContext returns p.ctx, or context.Background() when it is not set.
+func (p *presenceSync) baseContext() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// write sets the user's presence (and status message, when enabled) for state, using the
+// presence session of the session extension; extension is the one reporting state. The
+// write gives up after presenceWriteTimeout or when p.ctx is cancelled.
+func (p *presenceSync) write(email, session, extension string, state blf.State) {
+	availability, activity := p.mappingFor(extension).ToGraph(state)
+	ctx, cancel := context.WithTimeout(p.baseContext(), presenceWriteTimeout)
+	defer cancel()
+	if err := p.setPresence(ctx, email, session, availability, activity, false); err != nil {
+		switch {
+		case errors.Is(err, graph.ErrCircuitOpen):
+			// Logged once by the Graph client when the breaker opened.
+			p.log.Debug("presence write skipped", "extension", extension, "email", email, "error", err)
+			return
+		case p.baseContext().Err() != nil:
+			p.log.Warn("presence write abandoned at shutdown", "extension", extension, "email", email)
+			return
+		}
+		p.log.Error("set presence", "extension", extension, "email", email, "error", err)
+		return
+	}
+	p.log.Info("presence updated", "extension", extension, "state", state, "availability", availability)
+	p.recordAudit(email, session, extension, state, availability, activity)
+	if !p.status.Enabled {
+		return
+	}
+	if msg, ok := statusMessageFor(p.status.Template, extension, state); ok {
+		if err := p.sink.SetStatusMessage(ctx, email, session, msg, p.status.TTL); err != nil && !errors.Is(err, graph.ErrCircuitOpen) {
+			p.log.Error("set status message", "extension", extension, "email", email, "error", err)
+		}
+	}
+}
+
+// writeFixed sets a presence not derived from BLF (a pin or the presence forced outside
+// the business hours) for the user with the given session extension; force skips the
+// sink's unchanged-state check when it has one. It is not audited: the BLF state is not
+// what Teams shows, so the next audited write is recorded whatever the state was before.
+// Like write, it gives up after presenceWriteTimeout.
+func (p *presenceSync) writeFixed(ctx context.Context, email, session, availability, activity string, force bool) {
+	ctx, cancel := context.WithTimeout(ctx, presenceWriteTimeout)
+	defer cancel()
+	if err := p.setPresence(ctx, email, session, availability, activity, force); err != nil {
+		if !errors.Is(err, graph.ErrCircuitOpen) {
+			p.log.Error("set presence", "extension", session, "email", email, "error", err)
+		}
+		return
+	}
+	p.written.Delete(session)
+}
+
+// presenceSetter returns the sink's SetPresence or, with force, its ForceSetPresence when
+// it has one.
+func (p *presenceSync) presenceSetter(force bool) func(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	if f, ok := p.sink.(presenceForcer); ok && force {
+		return f.ForceSetPresence
+	}
+	return p.sink.SetPresence
+}
+
+// setPresence writes availability/activity to the user's session extension with its
+// expiration and, when that succeeds, records it for the heartbeat; force skips the sink's
+// unchanged-state check when it has one.
+func (p *presenceSync) setPresence(ctx context.Context, email, session, availability, activity string, force bool) error {
+	if err := p.presenceSetter(force)(ctx, email, session, availability, activity, p.expirationFor(session)); err != nil {
+		return err
+	}
+	p.asserted.Store(session, assertion{email: email, availability: availability, activity: activity, at: time.Now()})
+	return nil
+}
+
+// resync writes the presence of the user's current state (idle when no extension reported
+// one), unless the user is pinned or stranded by a PBX outage or the business hours are
+// closed.
+func (p *presenceSync) resync(emails map[string]string, email string) {
+	defer p.lockUser(email)()
+	user := p.userState(emails, email)
+	if p.pinned(user.session) || p.isStranded(user.session) || p.closed(emails[user.session], user.session) {
+		return
+	}
+	state, source := user.state, user.source
+	if state == blf.StateUnknown || state == blf.StateRinging && (p.confirmedOnly || p.ignoreRinging) {
+		state = blf.StateIdle
+	}
+	if source == "" {
+		source = user.session
+	}
+	p.write(emails[user.session], user.session, source, state)
+}
+
+// recordAudit writes an audit record for a presence write of state, unless auditing is
+// off or state is what was last written for the user (session extension).
+func (p *presenceSync) recordAudit(email, session, extension string, state blf.State, availability, activity string) {
+	if p.audit == nil {
+		return
+	}
+	var from blf.State
+	if prev, ok := p.written.Swap(session, state); ok {
+		if from = prev.(blf.State); from == state {
+			return
+		}
+	}
+	p.audit.Write(audit.Record{
+		Timestamp:    time.Now().UTC(),
+		Extension:    extension,
+		Email:        email,
+		FromState:    from,
+		ToState:      state,
+		Availability: availability,
+		Activity:     activity,
+	})
+}
+
+// userStatePriority ranks the states of a user's extensions: the highest-ranked one is
+// the user's state. A call outranks Do Not Disturb, which outranks ringing and idle;
+// StateUnknown (not ranked) counts only when no extension reported anything else.
+var userStatePriority = map[blf.State]int{
+	blf.StateIdle:       1,
+	blf.StateRinging:    2,
+	blf.StateDND:        3,
+	blf.StateOnHold:     4,
+	blf.StateBusy:       5,
+	blf.StateConference: 6,
+}
+
+// userPresence is the aggregate state of one user's extensions.
+type userPresence struct {
+	state   blf.State // StateUnknown when no extension reported yet
+	source  string    // extension reporting state; "" when none
+	session string    // lowest extension of the user: its presence session carries the user's presence
+}
+
+// userState aggregates the last reported states of every extension mapped to email (case
+// insensitive) in emails. All writes for the user use one presence session, so Teams does
+// not keep a stale state of another extension's session.
+func (p *presenceSync) userState(emails map[string]string, email string) userPresence {
+	u := userPresence{state: blf.StateUnknown}
+	for ext, e := range emails {
+		if !strings.EqualFold(e, email) {
+			continue
+		}
+		if u.session == "" || ext < u.session {
+			u.session = ext
+		}
+		v, ok := p.reported.Load(ext)
+		if !ok {
+			continue
+		}
+		st := v.(blf.State)
+		rank, best := userStatePriority[st], userStatePriority[u.state]
+		if u.source == "" || rank > best || rank == best && ext < u.source {
+			u.state, u.source = st, ext
+		}
+	}
+	return u
+}
+
+// queueState reduces the state of a queue extension to idle or busy: any call of the queue
+// or ring group, ringing or answered, makes it busy. DND is not a queue state and counts as
+// idle.
+func queueState(state blf.State) blf.State {
+	switch state {
+	case blf.StateUnknown:
+		return state
+	case blf.StateRinging, blf.StateBusy, blf.StateOnHold, blf.StateConference:
+		return blf.StateBusy
+	}
+	return blf.StateIdle
+}
+
+// isQueue reports whether extension is a queue entry (type "queue").
+func (p *presenceSync) isQueue(extension string) bool {
+	return p.queues != nil && (*p.queues.Load())[extension]
+}
+
+// mappingFor returns the state mapping of extension: queueMapping for a queue entry.
+func (p *presenceSync) mappingFor(extension string) blf.Mapping {
+	if p.isQueue(extension) {
+		return p.queueMapping
+	}
+	return p.mapping
+}
+
+// onCall reports whether state is one with an answered call.
+func onCall(state blf.State) bool {
+	switch state {
+	case blf.StateBusy, blf.StateOnHold, blf.StateConference:
+		return true
+	}
+	return false
+}
+
+// initialSync sets the presence of every mapped user none of whose extensions the PBX has
+// reported since startup to the idle mapping (Available/Available by default), so presence
+// left over from a previous run is replaced by a known baseline (INITIAL_SYNC). Users with
+// an extension whose state the PBX sent with its initial NOTIFY are skipped: onBLF already
+// wrote their current state. The initial NOTIFYs keep arriving while the sync runs, so a
+// user whose extension reported meanwhile is written their current state again afterwards,
+// in case the idle presence overwrote it. Outside the business hours the users get the
+// forced presence instead, a cleared presence session in offline mode, or nothing in skip
+// mode. Writes go through SetPresenceBatch when the sink supports it.
+func (p *presenceSync) initialSync(ctx context.Context) {
+	emails := *p.emails.Load()
+	exts := make([]string, 0, len(emails))
+	seen := make(map[string]bool)
+	for _, email := range emails {
+		key := strings.ToLower(email)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if user := p.userState(emails, email); user.source == "" && !p.pinned(user.session) {
+			exts = append(exts, user.session)
+		}
+	}
+	slices.Sort(exts)
+	if len(exts) == 0 {
+		p.log.Info("initial sync: every extension already reported its state")
+		return
+	}
+	availability, activity := p.mapping.ToGraph(blf.StateIdle)
+	closed := p.hours != nil && !p.hours.open()
+	if closed {
+		var ok bool
+		if availability, activity, ok = p.hours.forced(); !ok && p.hours.clears() {
+			for _, ext := range exts {
+				p.clearOutsideHours(emails[ext], ext)
+			}
+			p.log.Info("initial sync: presence cleared outside business hours", "extensions", len(exts))
+			return
+		} else if !ok {
+			p.log.Info("initial sync skipped: outside business hours")
+			return
+		}
+	}
+	updates := make([]graph.PresenceUpdate, 0, len(exts))
+	for _, ext := range exts {
+		u := graph.PresenceUpdate{
+			UserID:       emails[ext],
+			Extension:    ext,
+			Availability: availability,
+			Activity:     activity,
+			Expiration:   p.expirationFor(ext),
+		}
+		if !closed && p.isQueue(ext) {
+			u.Availability, u.Activity = p.queueMapping.ToGraph(blf.StateIdle)
+		}
+		updates = append(updates, u)
+	}
+
+	failed := make(map[string]error)
+	if b, ok := p.sink.(presenceBatcher); ok {
+		failed = b.SetPresenceBatch(ctx, updates)
+	} else {
+		for _, u := range updates {
+			if err := p.sink.SetPresence(ctx, u.UserID, u.Extension, u.Availability, u.Activity, u.Expiration); err != nil {
+				failed[u.UserID] = err
+			}
+		}
+	}
+	for user, err := range failed {
+		p.log.Warn("initial sync: set presence failed", "email", user, "error", err)
+	}
+	for _, u := range updates {
+		if _, ok := failed[u.UserID]; ok {
+			continue
+		}
+		p.asserted.Store(u.Extension, assertion{email: u.UserID, availability: u.Availability, activity: u.Activity, at: time.Now()})
+		if !closed {
+			p.recordAudit(u.UserID, u.Extension, u.Extension, blf.StateIdle, u.Availability, u.Activity)
+		}
+	}
+	for _, u := range updates {
+		if user := p.userState(emails, u.UserID); user.source != "" {
+			p.log.Debug("initial sync: extension reported during the sync; writing its state again", "extension", user.source)
+			p.resync(emails, u.UserID)
+		}
+	}
+	p.log.Info("initial sync done", "extensions", len(updates), "failed", len(failed), "availability", availability, "activity", activity)
+}
+
+// expirationFor returns the presence expiration for extension: its override when set,
+// otherwise the global expiration.
+func (p *presenceSync) expirationFor(extension string) time.Duration {
+	if p.expirations != nil {
+		if d, ok := (*p.expirations.Load())[extension]; ok {
+			return d
+		}
+	}
+	return p.expiration
+}
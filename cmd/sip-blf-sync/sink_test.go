@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/audit"
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/graph"
+)
+
+// fakeSink records PresenceSink calls as strings.
+type fakeSink struct {
+	mu          sync.Mutex // held ringing writes come from timer goroutines
+	calls       []string
+	expirations []time.Duration // per SetPresence call
+	presenceErr error
+}
+
+func (f *fakeSink) SetPresence(_ context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("presence %s %s %s/%s", userID, extension, availability, activity))
+	f.expirations = append(f.expirations, expiration)
+	return f.presenceErr
+}
+
+func (f *fakeSink) SetStatusMessage(_ context.Context, userID, extension, message string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("status %s %s %q %s", userID, extension, message, ttl))
+	return nil
+}
+
+func (f *fakeSink) ClearPresence(_ context.Context, userID, extension string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("clear %s %s", userID, extension))
+	return nil
+}
+
+func newTestSync(sink PresenceSink, status StatusMessageSettings) *presenceSync {
+	var emails atomic.Pointer[map[string]string]
+	m := map[string]string{"101": "alice@example.com"}
+	emails.Store(&m)
+	return &presenceSync{
+		sink:    sink,
+		mapping: blf.Mapping{blf.StateRinging: {"Away", "Away"}},
+		emails:  &emails,
+		status:  status,
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestPresenceSync_OnBLF(t *testing.T) {
+	status := StatusMessageSettings{Enabled: true, Template: "On a call ({state})", TTL: time.Hour}
+	tests := []struct {
+		name   string
+		ext    string
+		state  blf.State
+		status StatusMessageSettings
+		want   []string
+	}{
+		{"unknown extension", "999", blf.StateBusy, status, nil},
+		{"busy without status", "101", blf.StateBusy, StatusMessageSettings{}, []string{"presence alice@example.com 101 Busy/InACall"}},
+		{"busy with status", "101", blf.StateBusy, status, []string{
+			"presence alice@example.com 101 Busy/InACall",
+			`status alice@example.com 101 "On a call (busy)" 1h0m0s`,
+		}},
+		{"mapping override", "101", blf.StateRinging, status, []string{
+			"presence alice@example.com 101 Away/Away",
+			`status alice@example.com 101 "On a call (ringing)" 1h0m0s`,
+		}},
+		{"idle clears status", "101", blf.StateIdle, status, []string{
+			"presence alice@example.com 101 Available/Available",
+			`status alice@example.com 101 "" 1h0m0s`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{}
+			newTestSync(sink, tt.status).onBLF(tt.ext, tt.state)
+			if fmt.Sprint(sink.calls) != fmt.Sprint(tt.want) {
+				t.Errorf("calls = %q, want %q", sink.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestPresenceSync_IgnoreRinging(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{Enabled: true, Template: "On a call"})
+	p.ignoreRinging = true
+	p.onBLF("101", blf.StateRinging)
+	if len(sink.calls) != 0 {
+		t.Errorf("ringing: calls = %q, want none", sink.calls)
+	}
+	p.onBLF("101", blf.StateBusy)
+	if len(sink.calls) != 2 {
+		t.Errorf("busy: calls = %q, want presence and status", sink.calls)
+	}
+}
+
+func TestPresenceSync_ConfirmedOnly(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	p.confirmedOnly = true
+	p.onBLF("101", blf.StateRinging)
+	if len(sink.calls) != 0 {
+		t.Fatalf("ringing: calls = %q, want none", sink.calls)
+	}
+	p.onBLF("101", blf.StateBusy)
+	p.onBLF("101", blf.StateRinging) // call ended, another one rings
+	p.onBLF("101", blf.StateRinging)
+	p.onBLF("101", blf.StateIdle)
+	want := []string{
+		"presence alice@example.com 101 Busy/InACall",
+		"presence alice@example.com 101 Available/Available",
+		"presence alice@example.com 101 Available/Available",
+	}
+	if fmt.Sprint(sink.calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", sink.calls, want)
+	}
+}
+
+func (f *fakeSink) SetPreferredPresence(_ context.Context, userID, availability, activity string, expiration time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("preferred %s %s/%s %s", userID, availability, activity, expiration))
+	return nil
+}
+
+func (f *fakeSink) ClearPreferredPresence(_ context.Context, userID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("clear preferred %s", userID))
+	return nil
+}
+
+func (f *fakeSink) snapshot() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+func TestPresenceSync_RingingGrace(t *testing.T) {
+	const grace = 20 * time.Millisecond
+	ringing := "presence alice@example.com 101 Away/Away"
+	tests := []struct {
+		name   string
+		states []blf.State
+		want   []string
+	}{
+		{"ended within grace", []blf.State{blf.StateRinging, blf.StateIdle}, []string{
+			"presence alice@example.com 101 Available/Available",
+		}},
+		{"answered within grace", []blf.State{blf.StateRinging, blf.StateBusy}, []string{
+			"presence alice@example.com 101 Busy/InACall",
+		}},
+		{"still ringing", []blf.State{blf.StateRinging, blf.StateRinging}, []string{ringing}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{}
+			p := newTestSync(sink, StatusMessageSettings{})
+			p.ringingGrace = grace
+			for _, s := range tt.states {
+				p.onBLF("101", s)
+			}
+			if got := sink.snapshot(); len(got) > 1 || len(got) == 1 && got[0] == ringing {
+				t.Fatalf("calls within grace = %q", got)
+			}
+			time.Sleep(5 * grace)
+			if got := sink.snapshot(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("calls = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPresenceSync_SeveralExtensions(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{Enabled: true, Template: "On {extension}"})
+	m := map[string]string{"101": "alice@example.com", "201": "Alice@example.com", "102": "bob@example.com"}
+	p.emails.Store(&m)
+
+	p.onBLF("201", blf.StateBusy) // softphone call
+	p.onBLF("101", blf.StateIdle) // desk phone idle: still busy
+	p.onBLF("201", blf.StateIdle)
+	want := []string{
+		"presence alice@example.com 101 Busy/InACall",
+		`status alice@example.com 101 "On 201" 0s`,
+		"presence alice@example.com 101 Busy/InACall",
+		`status alice@example.com 101 "On 201" 0s`,
+		"presence alice@example.com 101 Available/Available",
+		`status alice@example.com 101 "" 0s`,
+	}
+	if fmt.Sprint(sink.calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", sink.calls, want)
+	}
+}
+
+func TestPresenceSync_Queue(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	p.ignoreRinging = true
+	m := map[string]string{"101": "alice@example.com", "q600": "sales@example.com"}
+	p.emails.Store(&m)
+	var queues atomic.Pointer[map[string]bool]
+	q := map[string]bool{"q600": true}
+	queues.Store(&q)
+	p.queues = &queues
+	p.queueMapping = blf.Mapping{blf.StateBusy: {"Busy", "Busy"}}
+
+	p.onBLF("q600", blf.StateRinging) // a caller waits in the queue
+	p.onBLF("q600", blf.StateOnHold)
+	p.onBLF("q600", blf.StateDND)
+	p.onBLF("101", blf.StateBusy) // a user: the user mapping
+	want := []string{
+		"presence sales@example.com q600 Busy/Busy",
+		"presence sales@example.com q600 Busy/Busy",
+		"presence sales@example.com q600 Available/Available",
+		"presence alice@example.com 101 Busy/InACall",
+	}
+	if fmt.Sprint(sink.calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", sink.calls, want)
+	}
+}
+
+func TestUserState(t *testing.T) {
+	p := newTestSync(&fakeSink{}, StatusMessageSettings{})
+	emails := map[string]string{"101": "alice@example.com", "201": "alice@example.com", "301": "alice@example.com"}
+	if u := p.userState(emails, "alice@example.com"); u.state != blf.StateUnknown || u.source != "" || u.session != "101" {
+		t.Errorf("nothing reported: %+v, want unknown with session 101", u)
+	}
+	p.reported.Store("301", blf.StateDND)
+	p.reported.Store("201", blf.StateRinging)
+	if u := p.userState(emails, "alice@example.com"); u.state != blf.StateDND || u.source != "301" {
+		t.Errorf("DND and ringing: %+v, want DND from 301", u)
+	}
+	p.reported.Store("101", blf.StateOnHold)
+	if u := p.userState(emails, "alice@example.com"); u.state != blf.StateOnHold || u.source != "101" {
+		t.Errorf("held call: %+v, want on hold from 101", u)
+	}
+}
+
+func TestPresenceSync_Expiration(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	p.expiration = time.Hour
+	overrides := map[string]time.Duration{"101": 20 * time.Minute}
+	p.expirations = &atomic.Pointer[map[string]time.Duration]{}
+	p.expirations.Store(&overrides)
+	p.onBLF("101", blf.StateBusy)
+
+	overrides = map[string]time.Duration{}
+	p.expirations.Store(&overrides)
+	p.onBLF("101", blf.StateIdle)
+
+	want := []time.Duration{20 * time.Minute, time.Hour}
+	if fmt.Sprint(sink.expirations) != fmt.Sprint(want) {
+		t.Errorf("expirations = %v, want %v", sink.expirations, want)
+	}
+}
+
+func TestPresenceSync_PresenceErrorSkipsStatus(t *testing.T) {
+	sink := &fakeSink{presenceErr: errors.New("graph down")}
+	newTestSync(sink, StatusMessageSettings{Enabled: true, Template: "On a call"}).onBLF("101", blf.StateBusy)
+	if len(sink.calls) != 1 {
+		t.Errorf("calls = %q, want only the failed presence write", sink.calls)
+	}
+}
+
+// batchSink is a fakeSink that also supports SetPresenceBatch.
+type batchSink struct {
+	fakeSink
+	batches [][]graph.PresenceUpdate
+	during  func() // run while the batch is in flight, e.g. a NOTIFY arriving
+}
+
+func (b *batchSink) SetPresenceBatch(_ context.Context, updates []graph.PresenceUpdate) map[string]error {
+	if b.during != nil {
+		b.during()
+	}
+	b.batches = append(b.batches, updates)
+	return nil
+}
+
+func TestPresenceSync_InitialSync(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	m := map[string]string{"101": "alice@example.com", "102": "bob@example.com", "103": "carol@example.com"}
+	p.emails.Store(&m)
+	p.onBLF("102", blf.StateBusy)
+	sink.calls = nil
+
+	p.initialSync(context.Background())
+	want := []string{
+		"presence alice@example.com 101 Available/Available",
+		"presence carol@example.com 103 Available/Available",
+	}
+	if fmt.Sprint(sink.calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", sink.calls, want)
+	}
+}
+
+func TestPresenceSync_InitialSyncBatch(t *testing.T) {
+	sink := &batchSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	p.initialSync(context.Background())
+	if len(sink.calls) != 0 {
+		t.Errorf("calls = %q, want none outside the batch", sink.calls)
+	}
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].UserID != "alice@example.com" {
+		t.Errorf("batches = %+v, want one update for alice", sink.batches)
+	}
+
+	// A NOTIFY processed while the batch is in flight is written again once the batch,
+	// which may have reached Graph last, is done.
+	sink = &batchSink{}
+	p = newTestSync(sink, StatusMessageSettings{})
+	sink.during = func() { p.onBLF("101", blf.StateBusy) }
+	p.initialSync(context.Background())
+	want := []string{
+		"presence alice@example.com 101 Busy/InACall",
+		"presence alice@example.com 101 Busy/InACall",
+	}
+	if fmt.Sprint(sink.calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", sink.calls, want)
+	}
+}
+
+// gatedSink is a fakeSink whose first SetPresence waits for release.
+type gatedSink struct {
+	fakeSink
+	entered, release chan struct{}
+	n                atomic.Int32
+}
+
+func (g *gatedSink) SetPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	if g.n.Add(1) == 1 {
+		close(g.entered)
+		<-g.release
+	}
+	return g.fakeSink.SetPresence(ctx, userID, extension, availability, activity, expiration)
+}
+
+// TestPresenceSync_ConcurrentExtensions has NOTIFYs for two extensions of one user arrive at
+// once: the aggregate written last must include both.
+func TestPresenceSync_ConcurrentExtensions(t *testing.T) {
+	sink := &gatedSink{entered: make(chan struct{}), release: make(chan struct{})}
+	p := newTestSync(sink, StatusMessageSettings{})
+	m := map[string]string{"101": "alice@example.com", "102": "alice@example.com"}
+	p.emails.Store(&m)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.onBLF("101", blf.StateIdle) // held in the sink until released
+	}()
+	<-sink.entered
+	go func() {
+		defer wg.Done()
+		p.onBLF("102", blf.StateBusy)
+	}()
+	time.Sleep(20 * time.Millisecond) // let the second NOTIFY reach the user's lock
+	close(sink.release)
+	wg.Wait()
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if n := len(sink.calls); n == 0 || sink.calls[n-1] != "presence alice@example.com 101 Busy/InACall" {
+		t.Errorf("calls = %q, want Busy/InACall written last", sink.calls)
+	}
+}
+
+func TestPresenceSync_Audit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestSync(&fakeSink{}, StatusMessageSettings{})
+	p.audit = l
+	p.onBLF("101", blf.StateBusy)
+	p.onBLF("101", blf.StateBusy)
+	p.onBLF("101", blf.StateIdle)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log = %q, want 2 records", lines)
+	}
+	var r audit.Record
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Extension != "101" || r.Email != "alice@example.com" || r.FromState != blf.StateBusy || r.ToState != blf.StateIdle || r.Availability != "Available" {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestPreferredSchedule(t *testing.T) {
+	var emails atomic.Pointer[map[string]string]
+	m := map[string]string{"101": "alice@example.com", "201": "Alice@example.com"}
+	emails.Store(&m)
+	sink := &fakeSink{}
+	p, err := newPreferredSchedule(PreferredSettings{Presence: "available", Schedule: "Mon-Fri 09:00-17:00"}, sink, &emails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 6, 8, 30, 0, 0, time.Local) // Monday
+	p.now = func() time.Time { return now }
+	p.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ctx := context.Background()
+	p.check(ctx) // before the window
+	now = now.Add(time.Hour)
+	p.check(ctx)
+	p.check(ctx) // already set
+	m2 := map[string]string{"101": "alice@example.com", "102": "bob@example.com"}
+	emails.Store(&m2)
+	p.check(ctx) // bob added during the window
+	now = time.Date(2024, 5, 6, 17, 0, 0, 0, time.Local)
+	p.check(ctx)
+
+	got := sink.snapshot()
+	slices.Sort(got[2:])
+	want := []string{
+		"preferred alice@example.com Available/Available 7h30m0s",
+		"preferred bob@example.com Available/Available 7h30m0s",
+		"clear preferred alice@example.com",
+		"clear preferred bob@example.com",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+
+	for _, bad := range []PreferredSettings{
+		{Presence: "Available"},
+		{Presence: "Busy:InACall", Schedule: "Mon 09:00-10:00"},
+		{Presence: "Available", Schedule: "weekdays"},
+	} {
+		if _, err := newPreferredSchedule(bad, sink, &emails); err == nil {
+			t.Errorf("newPreferredSchedule(%+v): want error", bad)
+		}
+	}
+}
+
+func TestPresenceSync_BusinessHours(t *testing.T) {
+	for _, tc := range []struct {
+		outside string
+		want    []string
+	}{
+		{"skip", []string{
+			"presence alice@example.com 101 Busy/InACall",
+		}},
+		{"available", []string{
+			"presence alice@example.com 101 Available/Available",
+			"presence alice@example.com 101 Available/Available",
+			"presence alice@example.com 101 Busy/InACall",
+			"presence alice@example.com 101 Available/Available",
+			"presence alice@example.com 101 Available/Available",
+		}},
+		{"offline", []string{
+			"presence alice@example.com 101 Busy/InACall",
+			"clear alice@example.com 101",
+		}},
+	} {
+		t.Run(tc.outside, func(t *testing.T) {
+			hours, err := newBusinessHours(BusinessHoursSettings{Schedule: "Mon-Fri 09:00-17:00", TimeZone: "America/Edmonton", Outside: tc.outside})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Date(2024, 5, 6, 14, 30, 0, 0, time.UTC) // Monday 08:30 in Edmonton
+			hours.now = func() time.Time { return now }
+			sink := &fakeSink{}
+			p := newTestSync(sink, StatusMessageSettings{})
+			p.hours = hours
+
+			p.onBLF("101", blf.StateRinging)
+			p.onBLF("101", blf.StateBusy)
+			now = now.Add(time.Hour)
+			p.businessHoursChanged(context.Background(), hours.open())
+			now = now.Add(9 * time.Hour) // 17:30: closed again
+			p.businessHoursChanged(context.Background(), hours.open())
+			p.onBLF("101", blf.StateIdle)
+			if fmt.Sprint(sink.calls) != fmt.Sprint(tc.want) {
+				t.Errorf("calls = %q, want %q", sink.calls, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []BusinessHoursSettings{
+		{TimeZone: "UTC"},
+		{Schedule: "Mon 09:00-17:00", TimeZone: "Mars/Olympus"},
+		{Schedule: "Mon 09:00-17:00", Outside: "away"},
+	} {
+		if _, err := newBusinessHours(bad); err == nil {
+			t.Errorf("newBusinessHours(%+v): want error", bad)
+		}
+	}
+}
+
+// fakePBX is a pbxStatus with settable health.
+type fakePBX struct {
+	registered bool
+	exts       []string
+	active     int
+}
+
+func (f *fakePBX) Registered() bool         { return f.registered }
+func (f *fakePBX) Extensions() []string     { return f.exts }
+func (f *fakePBX) ActiveSubscriptions() int { return f.active }
+
+func TestPresenceSync_Outage(t *testing.T) {
+	for _, tc := range []struct {
+		action string
+		want   []string
+	}{
+		{outageAvailable, []string{
+			"presence alice@example.com 101 Busy/InACall",
+			"presence alice@example.com 101 Available/Available",
+			"presence alice@example.com 101 Busy/InACall",
+			"presence alice@example.com 101 Busy/InACall", // resync; Graph drops it as unchanged
+		}},
+		{outageClear, []string{
+			"presence alice@example.com 101 Busy/InACall",
+			"clear alice@example.com 101",
+			"presence alice@example.com 101 Busy/InACall",
+			"presence alice@example.com 101 Busy/InACall", // resync; Graph drops it as unchanged
+		}},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			sink := &fakeSink{}
+			p := newTestSync(sink, StatusMessageSettings{})
+			pbx := &fakePBX{registered: true, exts: []string{"101"}, active: 1}
+			now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+			w := &outageWatch{action: tc.action, grace: time.Minute, pbxs: map[string]pbxStatus{"pbx": pbx}, now: func() time.Time { return now }}
+
+			p.onBLF("101", blf.StateBusy)
+			w.check(p)
+			pbx.registered, pbx.active = false, 0
+			w.check(p)
+			now = now.Add(30 * time.Second)
+			w.check(p) // within the grace period
+			if len(sink.calls) != 1 {
+				t.Fatalf("calls within the grace period = %q", sink.calls)
+			}
+			now = now.Add(time.Minute)
+			w.check(p)
+			w.check(p) // applied once
+			p.resync(*p.emails.Load(), "alice@example.com")
+			if len(sink.calls) != 2 {
+				t.Fatalf("calls during the outage = %q, want one outage write", sink.calls)
+			}
+
+			pbx.registered, pbx.active = true, 1
+			p.onBLF("101", blf.StateBusy) // initial NOTIFY of the new subscription
+			w.check(p)
+			if fmt.Sprint(sink.calls) != fmt.Sprint(tc.want) {
+				t.Errorf("calls = %q, want %q", sink.calls, tc.want)
+			}
+			if p.isStranded("101") {
+				t.Error("101 still stranded after the PBX came back")
+			}
+		})
+	}
+
+	// The client reports its raw extensions; with EXTENSIONS_NORMALIZE=digits the users are
+	// still found. Outside the business hours (skip mode) nothing is written.
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	hours, err := newBusinessHours(BusinessHoursSettings{Schedule: "Mon-Fri 09:00-17:00", TimeZone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 6, 20, 0, 0, 0, time.UTC)
+	hours.now = func() time.Time { return now }
+	p.hours = hours
+	p.reported.Store("101", blf.StateBusy)
+	pbx := &fakePBX{exts: []string{"+101"}}
+	w := &outageWatch{action: outageAvailable, pbxs: map[string]pbxStatus{"pbx": pbx}, policy: blf.ExtensionDigits, now: func() time.Time { return now }}
+	w.check(p)
+	w.check(p)
+	if _, ok := p.reported.Load("101"); ok || !p.isStranded("101") {
+		t.Error("normalized extension 101 not treated as lost")
+	}
+	if len(sink.calls) != 0 {
+		t.Errorf("calls outside business hours = %q, want none", sink.calls)
+	}
+
+	if _, err := parseOutagePresence("away"); err == nil {
+		t.Error(`parseOutagePresence("away"): want error`)
+	}
+}
+
+func TestPresenceSync_Override(t *testing.T) {
+	sink := &fakeSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	h := p.overrideHandler("s3cret")
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("POST", "/override/101", `{"availability":"Busy"}`, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want 401", rec.Code)
+	}
+	if rec := do("POST", "/override/101", `{"availability":"Busy","activity":"Lunch"}`, "s3cret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad activity: status %d, want 400", rec.Code)
+	}
+	if rec := do("POST", "/override/999", `{"availability":"Busy"}`, "s3cret"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown extension: status %d, want 404", rec.Code)
+	}
+	if rec := do("POST", "/override/101", `{"availability":"busy","activity":"inaconferencecall","ttl":"1h"}`, "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("pin: status %d: %s", rec.Code, rec.Body)
+	}
+	p.onBLF("101", blf.StateBusy) // suppressed while pinned
+	rec := do("GET", "/override", "", "s3cret")
+	var pins []pinJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &pins); err != nil || len(pins) != 1 || pins[0].Activity != "InAConferenceCall" || pins[0].Until == nil {
+		t.Errorf("GET /override = %s, want the pin", rec.Body)
+	}
+	if rec := do("DELETE", "/override/101", "", "s3cret"); rec.Code != http.StatusNoContent {
+		t.Errorf("unpin: status %d, want 204", rec.Code)
+	}
+	if rec := do("DELETE", "/override/101", "", "s3cret"); rec.Code != http.StatusNotFound {
+		t.Errorf("unpin again: status %d, want 404", rec.Code)
+	}
+
+	// A pin with a ttl ends by itself.
+	if _, err := p.setPin("101", "Away", "Away", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sink.snapshot()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	want := []string{
+		"presence alice@example.com 101 Busy/InAConferenceCall",
+		"presence alice@example.com 101 Busy/InACall",
+		"presence alice@example.com 101 Away/Away",
+		"presence alice@example.com 101 Busy/InACall",
+	}
+	if got := sink.snapshot(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
+
+// blockingSink is a PresenceSink whose SetPresence waits for its context, like a write to
+// an unresponsive Graph.
+type blockingSink struct {
+	fakeSink
+	started chan struct{}
+}
+
+func (b *blockingSink) SetPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	close(b.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// forcingSink is a fakeSink that also implements presenceForcer, recording "force ..." calls.
+type forcingSink struct {
+	fakeSink
+}
+
+func (f *forcingSink) ForceSetPresence(_ context.Context, userID, extension, availability, activity string, _ time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("force %s %s %s/%s", userID, extension, availability, activity))
+	return nil
+}
+
+func TestPresenceSync_Heartbeat(t *testing.T) {
+	sink := &forcingSink{}
+	p := newTestSync(sink, StatusMessageSettings{})
+	p.expiration = 20 * time.Minute
+	start := time.Now()
+	p.onBLF("101", blf.StateBusy) // an hour-long call: no further NOTIFY
+
+	p.heartbeat(start.Add(5 * time.Minute)) // still fresh
+	p.heartbeat(start.Add(11 * time.Minute))
+	p.heartbeat(start.Add(15 * time.Minute)) // re-asserted 4 minutes ago
+	p.heartbeat(start.Add(22 * time.Minute))
+	want := []string{
+		"presence alice@example.com 101 Busy/InACall",
+		"force alice@example.com 101 Busy/InACall",
+		"force alice@example.com 101 Busy/InACall",
+	}
+	if fmt.Sprint(sink.calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %q, want %q", sink.calls, want)
+	}
+
+	m := map[string]string{"102": "bob@example.com"} // 101 removed on reload
+	p.emails.Store(&m)
+	p.heartbeat(start.Add(time.Hour))
+	if len(sink.calls) != len(want) {
+		t.Errorf("removed extension: calls = %q, want no further write", sink.calls[len(want):])
+	}
+	if _, ok := p.asserted.Load("101"); ok {
+		t.Error("removed extension is still tracked")
+	}
+}
+
+func TestPresenceSync_ShutdownCancelsWrite(t *testing.T) {
+	sink := &blockingSink{started: make(chan struct{})}
+	p := newTestSync(sink, StatusMessageSettings{Enabled: true, Template: "On a call"})
+	ctx, cancel := context.WithCancel(context.Background())
+	p.ctx = ctx
+
+	done := make(chan struct{})
+	go func() {
+		p.onBLF("101", blf.StateBusy)
+		close(done)
+	}()
+	<-sink.started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onBLF did not return after the root context was cancelled")
+	}
+	if calls := sink.snapshot(); len(calls) != 0 {
+		t.Errorf("calls after the abandoned write = %v, want none", calls)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// watchBuffer is how many BLF events may queue for --watch before new ones are dropped.
+const watchBuffer = 256
+
+// watcher prints the BLF events of --watch: one line per NOTIFY with the extension's
+// previous and new state and the user it maps to, for checking that BLF is flowing
+// without reading the logs.
+type watcher struct {
+	out   io.Writer
+	email func(ext string) (string, bool)
+
+	mu   sync.Mutex // one watch goroutine per PBX
+	last map[string]blf.State
+}
+
+// newWatcher returns a watcher printing to out; email resolves an extension to its user.
+func newWatcher(out io.Writer, email func(ext string) (string, bool)) *watcher {
+	fmt.Fprintf(out, "%-12s %-10s %-22s %s\n", "TIME", "EXTENSION", "STATE", "USER")
+	return &watcher{out: out, email: email, last: make(map[string]blf.State)}
+}
+
+// run prints the events of one PBX until ctx is done or events is closed. server is
+// printed with each line when several PBXs are watched ("" otherwise).
+func (w *watcher) run(ctx context.Context, server string, events <-chan blf.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			w.print(server, ev)
+		}
+	}
+}
+
+// print writes the line for ev, e.g. "14:03:07.512 1001       idle -> ringing        alice@example.com".
+func (w *watcher) print(server string, ev blf.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	state := string(ev.State)
+	if prev, ok := w.last[ev.Extension]; !ok {
+		state = "-> " + state
+	} else if prev == ev.State {
+		state += " (unchanged)"
+	} else {
+		state = string(prev) + " -> " + state
+	}
+	w.last[ev.Extension] = ev.State
+	user, ok := w.email(ev.Extension)
+	if !ok {
+		user = "(not mapped)"
+	}
+	if server != "" {
+		user += "  [" + server + "]"
+	}
+	fmt.Fprintf(w.out, "%-12s %-10s %-22s %s\n", ev.Time.Format("15:04:05.000"), ev.Extension, state, user)
+}
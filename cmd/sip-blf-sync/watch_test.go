@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func TestWatcher(t *testing.T) {
+	var out strings.Builder
+	emails := map[string]string{"1001": "alice@example.com"}
+	w := newWatcher(&out, func(ext string) (string, bool) {
+		email, ok := emails[ext]
+		return email, ok
+	})
+	at := time.Date(2024, 5, 1, 14, 3, 7, 512e6, time.UTC)
+	events := make(chan blf.Event, 4)
+	events <- blf.Event{Extension: "1001", State: blf.StateIdle, Time: at}
+	events <- blf.Event{Extension: "1001", State: blf.StateRinging, Time: at}
+	events <- blf.Event{Extension: "1001", State: blf.StateRinging, Time: at}
+	events <- blf.Event{Extension: "1002", State: blf.StateBusy, Time: at}
+	close(events)
+
+	w.run(context.Background(), "pbx2.example.com", events) // returns once events is drained
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{
+		"TIME         EXTENSION  STATE                  USER",
+		"14:03:07.512 1001       -> idle                alice@example.com  [pbx2.example.com]",
+		"14:03:07.512 1001       idle -> ringing        alice@example.com  [pbx2.example.com]",
+		"14:03:07.512 1001       ringing (unchanged)    alice@example.com  [pbx2.example.com]",
+		"14:03:07.512 1002       -> busy                (not mapped)  [pbx2.example.com]",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("output:\n%s", out.String())
+	}
+	for i, line := range want {
+		if lines[i] != line {
+			t.Errorf("line %d = %q, want %q", i, lines[i], line)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package audit keeps an append-only record of the presence changes written to Graph
+// (AUDIT_LOG), one JSON object per line. It is independent of the operational slog
+// output and its level.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// syncInterval is how often buffered records are written out and fsynced.
+const syncInterval = time.Second
+
+// Record is one presence change. FromState is empty for the first write of a user since
+// startup.
+type Record struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Extension    string    `json:"extension"`
+	Email        string    `json:"email"`
+	FromState    blf.State `json:"fromState,omitempty"`
+	ToState      blf.State `json:"toState"`
+	Availability string    `json:"graphAvailability"`
+	Activity     string    `json:"graphActivity"`
+}
+
+// Log appends Records to a file through a buffer that is flushed and fsynced every
+// second and on Close. When the file would grow past maxSize the file is renamed to
+// path.<20060102T150405> and a new one started.
+//
+// Write and Close may be called from any goroutine.
+type Log struct {
+	path    string
+	maxSize int64 // bytes; 0 = never rotate
+	log     *slog.Logger
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens (or creates) the audit log at path for appending. maxSize is the size in
+// bytes at which the file is rotated (0 = never).
+func Open(path string, maxSize int64) (*Log, error) {
+	l := &Log{
+		path:    path,
+		maxSize: maxSize,
+		log:     slog.Default().With("component", "audit"),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// open opens the file at l.path; l.mu is held or l is not shared yet.
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), fi.Size()
+	return nil
+}
+
+// Write appends r. Errors are logged, not returned: the presence write it records has
+// already happened.
+func (l *Log) Write(r Record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		l.log.Error("encode audit record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		l.log.Error("audit log closed; record dropped", "extension", r.Extension, "state", r.ToState)
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.log.Error("rotate audit log", "error", err)
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		l.log.Error("write audit log", "error", err)
+	}
+}
+
+// rotate moves the current file aside and starts a new one; l.mu is held.
+func (l *Log) rotate() error {
+	if err := l.sync(); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	aside := rotatedName(l.path, time.Now())
+	if err := os.Rename(l.path, aside); err != nil {
+		// Keep appending to the full file rather than losing records.
+		if oerr := l.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	l.log.Info("audit log rotated", "previous", aside)
+	return l.open()
+}
+
+// rotatedName returns path.<time>, adding -1, -2, ... when that file exists (several
+// rotations within a second).
+func rotatedName(path string, now time.Time) string {
+	name := path + "." + now.Format("20060102T150405")
+	for i, candidate := 1, name; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// sync flushes the buffer and fsyncs the file; l.mu is held.
+func (l *Log) sync() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// run syncs the file every syncInterval until Close.
+func (l *Log) run() {
+	defer close(l.done)
+	t := time.NewTicker(syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			l.mu.Lock()
+			if l.f != nil && l.w.Buffered() > 0 {
+				if err := l.sync(); err != nil {
+					l.log.Error("sync audit log", "error", err)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Close writes out the buffered records and closes the file. Later Writes are dropped.
+func (l *Log) Close() error {
+	close(l.stop)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []Record
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l.Write(Record{Timestamp: ts, Extension: "101", Email: "alice@example.com", ToState: blf.StateIdle, Availability: "Available", Activity: "Available"})
+	l.Write(Record{Timestamp: ts, Extension: "101", Email: "alice@example.com", FromState: blf.StateIdle, ToState: blf.StateBusy, Availability: "Busy", Activity: "InACall"})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := readRecords(t, path)
+	if len(recs) != 2 {
+		t.Fatalf("records = %+v, want 2", recs)
+	}
+	if r := recs[1]; r.FromState != blf.StateIdle || r.ToState != blf.StateBusy || r.Availability != "Busy" || !r.Timestamp.Equal(ts) {
+		t.Errorf("record = %+v", r)
+	}
+
+	// Reopening appends.
+	l, err = Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Record{Timestamp: ts, Extension: "101", ToState: blf.StateIdle})
+	l.Close()
+	if recs := readRecords(t, path); len(recs) != 3 {
+		t.Errorf("after reopen: %d records, want 3", len(recs))
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		l.Write(Record{Timestamp: time.Now(), Extension: "101", Email: "alice@example.com", ToState: blf.StateBusy, Availability: "Busy", Activity: "InACall"})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 200 {
+			t.Errorf("%s: %d bytes, want at most 200", f, fi.Size())
+		}
+		total += len(readRecords(t, f))
+	}
+	if len(files) < 2 || total != 5 {
+		t.Errorf("files = %v with %d records, want rotated files holding 5", files, total)
+	}
+}
@@ -0,0 +1,74 @@
+package blf
+
+import (
+	"bytes"
+	"strings"
+)
+
+// DetectDND reports whether a NOTIFY body signals Do Not Disturb. indicators are matched
+// case-insensitively: as substrings of the PIDF notes (document, tuple and person) and
+// against the RPID activity names of a presence body, and against the dialog state
+// strings of a dialog-info body (for dialplans that report e.g. <state>dnd</state>).
+// With no indicators it always returns false, so PBXs that send no DND information are
+// unaffected.
+func DetectDND(body []byte, indicators []string) bool {
+	if len(indicators) == 0 {
+		return false
+	}
+	if bytes.Contains(body, []byte("dialog-info")) {
+		return dialogDND(body, indicators)
+	}
+	doc, err := ParsePIDF(body)
+	if err != nil {
+		return false
+	}
+	notes := append([]string(nil), doc.Notes...)
+	for _, t := range doc.Tuples {
+		notes = append(notes, t.Notes...)
+	}
+	for _, per := range doc.Persons {
+		notes = append(notes, per.Notes...)
+	}
+	for _, note := range notes {
+		note = strings.ToLower(note)
+		for _, ind := range indicators {
+			if ind = strings.ToLower(strings.TrimSpace(ind)); ind != "" && strings.Contains(note, ind) {
+				return true
+			}
+		}
+	}
+	return anyEqualFold(doc.activities(), indicators)
+}
+
+// dialogDND reports whether any dialog of a dialog-info body has a state equal to one of
+// indicators.
+func dialogDND(body []byte, indicators []string) bool {
+	var states []string
+	var info DialogInfo
+	if err := unmarshalXML(body, &info); err == nil {
+		for i := range info.Dialogs {
+			states = append(states, info.Dialogs[i].dialogState())
+		}
+	} else {
+		var infoNoNS dialogInfoNoNS
+		if err := unmarshalXML(body, &infoNoNS); err != nil {
+			return false
+		}
+		for _, d := range infoNoNS.Dialogs {
+			states = append(states, dialogStateStr(d.State, d.StateAttr))
+		}
+	}
+	return anyEqualFold(states, indicators)
+}
+
+// anyEqualFold reports whether any of values equals one of indicators, ignoring case.
+func anyEqualFold(values, indicators []string) bool {
+	for _, v := range values {
+		for _, ind := range indicators {
+			if ind = strings.TrimSpace(ind); ind != "" && strings.EqualFold(v, ind) {
+				return true
+			}
+		}
+	}
+	return false
+}
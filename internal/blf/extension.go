@@ -0,0 +1,48 @@
+package blf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Extension normalization policies for NormalizeExtension.
+const (
+	ExtensionAsIs   = "as-is"  // keep the characters of the extension
+	ExtensionDigits = "digits" // keep only its digits
+)
+
+// ParseExtensionPolicy checks a normalization policy; "" means ExtensionAsIs.
+func ParseExtensionPolicy(s string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case "", ExtensionAsIs:
+		return ExtensionAsIs, nil
+	case ExtensionDigits:
+		return v, nil
+	}
+	return "", fmt.Errorf("extension normalization %q: want %q or %q", s, ExtensionAsIs, ExtensionDigits)
+}
+
+// NormalizeExtension returns extension in the form its user is looked up by, so PBXs that
+// format an extension differently from the configuration still match. Surrounding
+// whitespace, an Asterisk context suffix ("1001@from-internal") and parameters ("1001;x=y")
+// are removed. With ExtensionDigits every other non-digit is removed too ("+1001" and
+// "10-01" give "1001"), unless that leaves nothing (an extension such as "reception").
+// Leading zeros are kept: "0101" and "101" are different extensions on most PBXs.
+func NormalizeExtension(extension, policy string) string {
+	extension, _, _ = strings.Cut(extension, "@")
+	extension, _, _ = strings.Cut(extension, ";")
+	extension = strings.TrimSpace(extension)
+	if policy != ExtensionDigits {
+		return extension
+	}
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, extension)
+	if digits == "" {
+		return extension
+	}
+	return digits
+}
@@ -0,0 +1,40 @@
+package blf
+
+import "testing"
+
+func TestNormalizeExtension(t *testing.T) {
+	tests := []struct {
+		in, asIs, digits string
+	}{
+		{"1001", "1001", "1001"},
+		{" 1001 ", "1001", "1001"},
+		{"+1001", "+1001", "1001"},
+		{"1001@from-internal", "1001", "1001"},
+		{"+1 (555) 123-4567", "+1 (555) 123-4567", "15551234567"},
+		{"10-01", "10-01", "1001"},
+		{"1001;ovl=1", "1001", "1001"},
+		{"*1001@ext-local", "*1001", "1001"},
+		{"0101", "0101", "0101"}, // leading zeros are kept
+		{"reception", "reception", "reception"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeExtension(tt.in, ExtensionAsIs); got != tt.asIs {
+			t.Errorf("NormalizeExtension(%q, as-is) = %q, want %q", tt.in, got, tt.asIs)
+		}
+		if got := NormalizeExtension(tt.in, ExtensionDigits); got != tt.digits {
+			t.Errorf("NormalizeExtension(%q, digits) = %q, want %q", tt.in, got, tt.digits)
+		}
+	}
+}
+
+func TestParseExtensionPolicy(t *testing.T) {
+	for in, want := range map[string]string{"": ExtensionAsIs, "as-is": ExtensionAsIs, " Digits ": ExtensionDigits} {
+		if got, err := ParseExtensionPolicy(in); err != nil || got != want {
+			t.Errorf("ParseExtensionPolicy(%q) = %q %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseExtensionPolicy("strip"); err == nil {
+		t.Error("ParseExtensionPolicy(strip): want error")
+	}
+}
@@ -1,21 +1,88 @@
 package blf
 
+import (
+	"fmt"
+	"strings"
+)
+
 // GraphAvailability and GraphActivity are the values for Microsoft Graph setPresence.
 const (
 	GraphAvailabilityAvailable = "Available"
 	GraphAvailabilityBusy      = "Busy"
 	GraphActivityAvailable     = "Available"
 	GraphActivityInACall       = "InACall"
+	GraphActivityConference    = "InAConferenceCall"
+
+	GraphAvailabilityDoNotDisturb = "DoNotDisturb"
+	GraphActivityPresenting       = "Presenting"
 )
 
+// graphPresences are the availability/activity pairs Graph setPresence accepts for a
+// presence session, and so the values accepted in a configured Mapping.
+var graphPresences = [][2]string{
+	{"Available", "Available"},
+	{"Busy", "InACall"},
+	{"Busy", "InAConferenceCall"},
+	{"Away", "Away"},
+	{"DoNotDisturb", "Presenting"},
+}
+
 // ToGraph maps BLF state to Graph availability and activity.
 func (s State) ToGraph() (availability, activity string) {
 	switch s {
 	case StateIdle:
 		return GraphAvailabilityAvailable, GraphActivityAvailable
-	case StateRinging, StateBusy:
+	case StateRinging, StateBusy, StateOnHold:
+		// Graph has no session activity for a held call, so it shows as a call.
 		return GraphAvailabilityBusy, GraphActivityInACall
+	case StateConference:
+		return GraphAvailabilityBusy, GraphActivityConference
+	case StateDND:
+		return GraphAvailabilityDoNotDisturb, GraphActivityPresenting
 	default:
 		return GraphAvailabilityAvailable, GraphActivityAvailable
 	}
 }
+
+// Mapping overrides the Graph availability/activity pair for individual states.
+// States not present fall back to State.ToGraph.
+type Mapping map[State][2]string
+
+// ToGraph maps s using the configured override, or the default mapping when unset.
+func (m Mapping) ToGraph(s State) (availability, activity string) {
+	if pair, ok := m[s]; ok {
+		return pair[0], pair[1]
+	}
+	return s.ToGraph()
+}
+
+// ParseMappingValue parses "Availability:Activity" (e.g. "Busy:InACall") and checks the
+// pair against those Graph accepts. Matching is case-insensitive; the canonical spelling is
+// returned.
+func ParseMappingValue(v string) ([2]string, error) {
+	avail, act, ok := strings.Cut(strings.TrimSpace(v), ":")
+	if !ok {
+		return [2]string{}, fmt.Errorf("mapping %q: want Availability:Activity", v)
+	}
+	for _, pair := range graphPresences {
+		if strings.EqualFold(pair[0], strings.TrimSpace(avail)) && strings.EqualFold(pair[1], strings.TrimSpace(act)) {
+			return pair, nil
+		}
+	}
+	supported := make([]string, len(graphPresences))
+	for i, pair := range graphPresences {
+		supported[i] = pair[0] + ":" + pair[1]
+	}
+	return [2]string{}, fmt.Errorf("mapping %q: unsupported presence (want one of %s)", v, strings.Join(supported, ", "))
+}
+
+// ActivityFor returns the first activity Graph accepts with availability (e.g. Presenting
+// for DoNotDisturb), or "" when it accepts none.
+func ActivityFor(availability string) string {
+	for _, pair := range graphPresences {
+		if strings.EqualFold(pair[0], strings.TrimSpace(availability)) {
+			return pair[1]
+		}
+	}
+	return ""
+}
@@ -3,7 +3,15 @@ package blf
 import (
 	"bytes"
 	"encoding/xml"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// Media types of the NOTIFY bodies understood (see also ContentTypeXPIDF).
+const (
+	ContentTypeDialogInfo = "application/dialog-info+xml"
+	ContentTypePIDF       = "application/pidf+xml"
 )
 
 // State is the normalized BLF state for an extension.
@@ -13,6 +21,12 @@ const (
 	StateIdle    State = "idle"
 	StateRinging State = "ringing"
 	StateBusy    State = "busy"
+	StateOnHold  State = "onhold"
+	// StateConference is two or more active (confirmed, not held) calls at once, e.g. a
+	// three-way conference.
+	StateConference State = "conference"
+	// StateDND is Do Not Disturb, reported only when DND indicators are configured (see DetectDND).
+	StateDND     State = "dnd"
 	StateUnknown State = "unknown"
 )
 
@@ -20,6 +34,7 @@ const (
 type Event struct {
 	Extension string
 	State     State
+	Time      time.Time // when the NOTIFY was processed
 }
 
 // DialogInfo is the RFC 4235 dialog event package XML (simplified).
@@ -27,9 +42,11 @@ type Event struct {
 // The document uses namespace urn:ietf:params:xml:ns:dialog-info; dialog
 // state is a child element <state>, not an attribute.
 type DialogInfo struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:dialog-info dialog-info"`
-	Entity  string   `xml:"entity,attr"` // e.g. sip:1001@server
-	Dialogs []Dialog `xml:"urn:ietf:params:xml:ns:dialog-info dialog"`
+	XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:dialog-info dialog-info"`
+	Entity   string   `xml:"entity,attr"`  // e.g. sip:1001@server
+	Version  string   `xml:"version,attr"` // increments by one per NOTIFY within a subscription
+	DocState string   `xml:"state,attr"`   // "full" or "partial"
+	Dialogs  []Dialog `xml:"urn:ietf:params:xml:ns:dialog-info dialog"`
 }
 
 // Dialog represents a single dialog in the dialog-info document.
@@ -42,14 +59,43 @@ type Dialog struct {
 	Direction string `xml:"direction,attr"`
 	Local     struct {
 		Identity string `xml:"urn:ietf:params:xml:ns:dialog-info identity"`
-		Target   string `xml:"urn:ietf:params:xml:ns:dialog-info target"`
+		Target   Target `xml:"urn:ietf:params:xml:ns:dialog-info target"`
 	} `xml:"urn:ietf:params:xml:ns:dialog-info local"`
 	Remote struct {
 		Identity string `xml:"urn:ietf:params:xml:ns:dialog-info identity"`
-		Target   string `xml:"urn:ietf:params:xml:ns:dialog-info target"`
+		Target   Target `xml:"urn:ietf:params:xml:ns:dialog-info target"`
 	} `xml:"urn:ietf:params:xml:ns:dialog-info remote"`
 }
 
+// Target is a participant's target URI with its feature parameters (RFC 4235 section 4.1.6.2),
+// e.g. <target uri="sip:1001@pbx"><param pname="+sip.rendering" pval="no"/></target>.
+type Target struct {
+	URI    string  `xml:"uri,attr"`
+	Params []Param `xml:"urn:ietf:params:xml:ns:dialog-info param"`
+}
+
+// Param is a single <param pname="..." pval="..."/> on a target.
+type Param struct {
+	Name  string `xml:"pname,attr"`
+	Value string `xml:"pval,attr"`
+}
+
+// renderingOff reports whether params contain +sip.rendering="no", which PBXs such as
+// Asterisk send on the local target while the call is on hold.
+func renderingOff(params []Param) bool {
+	for _, p := range params {
+		if strings.EqualFold(strings.TrimSpace(p.Name), "+sip.rendering") && strings.EqualFold(strings.TrimSpace(p.Value), "no") {
+			return true
+		}
+	}
+	return false
+}
+
+// onHold reports whether the local side of the dialog is on hold.
+func (d *Dialog) onHold() bool {
+	return renderingOff(d.Local.Target.Params)
+}
+
 // dialogState returns the effective dialog state (child <state> element or state attribute).
 func (d *Dialog) dialogState() string {
 	s := strings.TrimSpace(d.State)
@@ -64,47 +110,135 @@ type dialogNoNS struct {
 	ID        string `xml:"id,attr"`
 	State     string `xml:"state"`
 	StateAttr string `xml:"state,attr"`
+	Local     struct {
+		Target struct {
+			Params []Param `xml:"param"`
+		} `xml:"target"`
+	} `xml:"local"`
 }
 
 type dialogInfoNoNS struct {
-	XMLName xml.Name   `xml:"dialog-info"`
-	Entity  string     `xml:"entity,attr"`
-	Dialogs []dialogNoNS `xml:"dialog"`
+	XMLName  xml.Name     `xml:"dialog-info"`
+	Entity   string       `xml:"entity,attr"`
+	Version  string       `xml:"version,attr"`
+	DocState string       `xml:"state,attr"`
+	Dialogs  []dialogNoNS `xml:"dialog"`
 }
 
 // ParseDialogInfo parses RFC 4235 dialog-info XML and returns the effective
-// BLF state: idle (no dialogs or all terminated), ringing (early/trying), or busy (confirmed).
+// BLF state: idle (no dialogs or all terminated), ringing (early/trying), busy (confirmed),
+// or on hold (confirmed with the local target's +sip.rendering="no"). With several dialogs
+// the highest-priority state wins (busy > on hold > ringing > idle).
 // Uses the RFC namespace first; if unmarshal fails (e.g. PBX omits xmlns), retries without namespace.
 func ParseDialogInfo(body []byte) State {
+	doc, err := ParseDialogDocument(body)
+	if err != nil {
+		return StateUnknown
+	}
+	return doc.State()
+}
+
+// Document is a dialog-info document normalised across the namespaced and no-namespace forms.
+type Document struct {
+	Entity     string
+	Version    uint64
+	HasVersion bool // false when the version attribute is missing or not a number
+	Partial    bool // state="partial": only changed dialogs are listed
+	Dialogs    []DialogStatus
+}
+
+// DialogStatus is the BLF state of one dialog in a Document.
+type DialogStatus struct {
+	ID    string
+	State State
+}
+
+// State returns the aggregate state of the document's dialogs.
+func (d *Document) State() State {
+	states := make([]State, 0, len(d.Dialogs))
+	for _, ds := range d.Dialogs {
+		states = append(states, ds.State)
+	}
+	return Aggregate(states)
+}
+
+// ParseDialogDocument parses dialog-info XML into a Document. Uses the RFC namespace first;
+// if unmarshal fails (e.g. PBX omits xmlns), retries without namespace.
+func ParseDialogDocument(body []byte) (*Document, error) {
 	var info DialogInfo
-	if err := xml.Unmarshal(body, &info); err == nil {
-		return dialogsToState(info.Dialogs)
+	if err := unmarshalXML(body, &info); err == nil {
+		doc := newDocument(info.Entity, info.Version, info.DocState)
+		for i := range info.Dialogs {
+			d := &info.Dialogs[i]
+			doc.Dialogs = append(doc.Dialogs, DialogStatus{ID: d.ID, State: dialogToState(d.dialogState(), d.onHold())})
+		}
+		return doc, nil
 	}
 	var infoNoNS dialogInfoNoNS
-	if err := xml.Unmarshal(body, &infoNoNS); err != nil {
-		return StateUnknown
+	if err := unmarshalXML(body, &infoNoNS); err != nil {
+		return nil, err
+	}
+	doc := newDocument(infoNoNS.Entity, infoNoNS.Version, infoNoNS.DocState)
+	for _, d := range infoNoNS.Dialogs {
+		st := dialogToState(dialogStateStr(d.State, d.StateAttr), renderingOff(d.Local.Target.Params))
+		doc.Dialogs = append(doc.Dialogs, DialogStatus{ID: d.ID, State: st})
+	}
+	return doc, nil
+}
+
+func newDocument(entity, version, docState string) *Document {
+	doc := &Document{
+		Entity:  entity,
+		Partial: strings.EqualFold(strings.TrimSpace(docState), "partial"),
 	}
-	return dialogsNoNSToState(infoNoNS.Dialogs)
+	if v, err := strconv.ParseUint(strings.TrimSpace(version), 10, 64); err == nil {
+		doc.Version, doc.HasVersion = v, true
+	}
+	return doc
+}
+
+// statePriority orders states for aggregating several dialogs: a conference outranks an
+// active call, which outranks a held call, which outranks ringing, which outranks idle.
+var statePriority = map[State]int{
+	StateIdle:       0,
+	StateRinging:    1,
+	StateOnHold:     2,
+	StateBusy:       3,
+	StateConference: 4,
 }
 
-func dialogsToState(dialogs []Dialog) State {
-	if len(dialogs) == 0 {
+// dialogToState maps one dialog's state string (lower-cased) to a BLF state.
+// Unrecognised non-empty states are treated as busy.
+func dialogToState(s string, held bool) State {
+	switch {
+	case s == "terminated" || s == "":
 		return StateIdle
+	case s == "trying" || s == "early" || s == "proceeding":
+		return StateRinging
+	case s == "confirmed" && held:
+		return StateOnHold
+	default:
+		return StateBusy
 	}
-	for _, d := range dialogs {
-		s := d.dialogState()
-		switch {
-		case s == "terminated" || s == "":
-			continue
-		case s == "trying" || s == "early" || s == "proceeding":
-			return StateRinging
-		case s == "confirmed":
-			return StateBusy
-		default:
-			return StateBusy
+}
+
+// Aggregate returns the highest-priority state among states (idle when empty). Two or
+// more busy dialogs make StateConference; a held call next to an active one stays busy.
+func Aggregate(states []State) State {
+	best := StateIdle
+	busy := 0
+	for _, st := range states {
+		if st == StateBusy {
+			busy++
 		}
+		if statePriority[st] > statePriority[best] {
+			best = st
+		}
+	}
+	if busy >= 2 {
+		return StateConference
 	}
-	return StateIdle
+	return best
 }
 
 func dialogStateStr(s, sAttr string) string {
@@ -115,63 +249,37 @@ func dialogStateStr(s, sAttr string) string {
 	return s
 }
 
-func dialogsNoNSToState(dialogs []dialogNoNS) State {
-	if len(dialogs) == 0 {
-		return StateIdle
-	}
-	for _, d := range dialogs {
-		s := dialogStateStr(d.State, d.StateAttr)
-		switch {
-		case s == "terminated" || s == "":
-			continue
-		case s == "trying" || s == "early" || s == "proceeding":
-			return StateRinging
-		case s == "confirmed":
-			return StateBusy
-		default:
-			return StateBusy
-		}
-	}
-	return StateIdle
-}
-
 // ExtensionFromDialogInfo parses dialog-info XML and returns the entity/extension
-// (e.g. "1001") from the entity attribute or the first dialog's local identity.
+// (e.g. "1001") from the entity attribute or the first dialog's local identity; see
+// UserFromURI for the URI schemes understood.
 func ExtensionFromDialogInfo(body []byte) string {
 	var info DialogInfo
-	if err := xml.Unmarshal(body, &info); err != nil {
+	if err := unmarshalXML(body, &info); err != nil {
 		return ""
 	}
-	if info.Entity != "" {
-		// entity is e.g. "sip:1001@pbx.example.com"
-		if idx := strings.Index(info.Entity, ":"); idx >= 0 {
-			rest := info.Entity[idx+1:]
-			if at := strings.Index(rest, "@"); at >= 0 {
-				return rest[:at]
-			}
-			return rest
-		}
+	if ext := UserFromURI(info.Entity); ext != "" {
+		return ext
 	}
-	if len(info.Dialogs) > 0 && info.Dialogs[0].Local.Identity != "" {
-		ident := info.Dialogs[0].Local.Identity
-		if idx := strings.Index(ident, ":"); idx >= 0 {
-			rest := ident[idx+1:]
-			if at := strings.Index(rest, "@"); at >= 0 {
-				return rest[:at]
-			}
-			return rest
-		}
+	if len(info.Dialogs) > 0 {
+		return UserFromURI(info.Dialogs[0].Local.Identity)
 	}
 	return ""
 }
 
-// ParsePresenceBody parses a presence event body (RFC 3856 style) if needed.
-// Some PBXs send presence instead of dialog. This is a minimal parser;
-// extend if your PBX uses presence for BLF.
+// ParsePresenceBody parses a presence event body (RFC 3856 / PIDF) if needed.
+// Some PBXs send presence instead of dialog. The body is decoded as XPIDF when it has
+// atoms (see XPIDF.State), otherwise as PIDF (see PIDF.State); substring matching on
+// "open"/"closed" is only used when it is not valid presence XML.
 func ParsePresenceBody(body []byte) State {
 	if bytes.Contains(body, []byte("dialog-info")) {
 		return ParseDialogInfo(body)
 	}
+	if doc, err := ParseXPIDF(body); err == nil {
+		return doc.State()
+	}
+	if doc, err := ParsePIDF(body); err == nil {
+		return doc.State()
+	}
 	if bytes.Contains(body, []byte("closed")) && !bytes.Contains(body, []byte("open")) {
 		return StateIdle
 	}
@@ -59,3 +59,280 @@ func TestExtensionFromDialogInfo(t *testing.T) {
 		t.Errorf("ExtensionFromDialogInfo = %q, want 6000", got)
 	}
 }
+
+func TestParseDialogInfo_OnHold(t *testing.T) {
+	// Asterisk marks a held call with +sip.rendering="no" on the local target
+	held := []byte(`<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="3" state="full" entity="sip:6000@pbx.example.com">
+  <dialog id="abc123" direction="recipient">
+    <state>confirmed</state>
+    <local>
+      <identity>sip:6000@pbx.example.com</identity>
+      <target uri="sip:6000@pbx.example.com">
+        <param pname="+sip.rendering" pval="no"/>
+      </target>
+    </local>
+  </dialog>
+</dialog-info>`)
+	if got := ParseDialogInfo(held); got != StateOnHold {
+		t.Errorf("ParseDialogInfo(held) = %v, want OnHold", got)
+	}
+
+	heldNoNS := []byte(`<?xml version="1.0"?>
+<dialog-info version="3" state="full" entity="sip:6000@pbx">
+  <dialog id="x">
+    <state>confirmed</state>
+    <local><target uri="sip:6000@pbx"><param pname="+sip.rendering" pval="no"/></target></local>
+  </dialog>
+</dialog-info>`)
+	if got := ParseDialogInfo(heldNoNS); got != StateOnHold {
+		t.Errorf("ParseDialogInfo(held, no namespace) = %v, want OnHold", got)
+	}
+
+	rendering := []byte(`<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="4" state="full" entity="sip:6000@pbx.example.com">
+  <dialog id="abc123" direction="recipient">
+    <state>confirmed</state>
+    <local>
+      <target uri="sip:6000@pbx.example.com">
+        <param pname="+sip.rendering" pval="yes"/>
+      </target>
+    </local>
+  </dialog>
+</dialog-info>`)
+	if got := ParseDialogInfo(rendering); got != StateBusy {
+		t.Errorf("ParseDialogInfo(rendering=yes) = %v, want Busy", got)
+	}
+
+	if a, act := StateOnHold.ToGraph(); a != GraphAvailabilityBusy || act != GraphActivityInACall {
+		t.Errorf("StateOnHold.ToGraph() = %s/%s, want Busy/InACall", a, act)
+	}
+}
+
+func TestParsePresenceBody_PIDF(t *testing.T) {
+	onThePhone := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" xmlns:dm="urn:ietf:params:xml:ns:pidf:data-model"
+  xmlns:rpid="urn:ietf:params:xml:ns:pidf:rpid" entity="pres:6000@pbx.example.com">
+  <tuple id="6000"><status><basic>open</basic></status></tuple>
+  <dm:person><rpid:activities><rpid:on-the-phone/></rpid:activities></dm:person>
+  <note>On the phone</note>
+</presence>`)
+	if got := ParsePresenceBody(onThePhone); got != StateBusy {
+		t.Errorf("ParsePresenceBody(on-the-phone) = %v, want Busy", got)
+	}
+
+	closed := []byte(`<?xml version="1.0"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="pres:6000@pbx.example.com">
+  <tuple id="6000"><status><basic>closed</basic></status><note>Unavailable</note></tuple>
+</presence>`)
+	if got := ParsePresenceBody(closed); got != StateIdle {
+		t.Errorf("ParsePresenceBody(closed) = %v, want Idle", got)
+	}
+
+	// "open" appears in the note; the old substring heuristic would have said Busy
+	ready := []byte(`<?xml version="1.0"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="pres:6000@pbx.example.com">
+  <tuple id="6000"><status><basic>open</basic></status><note>Ready, line open</note></tuple>
+</presence>`)
+	if got := ParsePresenceBody(ready); got != StateIdle {
+		t.Errorf("ParsePresenceBody(open, no activity) = %v, want Idle", got)
+	}
+
+	away := []byte(`<?xml version="1.0"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" xmlns:rpid="urn:ietf:params:xml:ns:pidf:rpid" entity="pres:6000@pbx">
+  <tuple id="6000"><status><basic>open</basic><rpid:activities><rpid:away/></rpid:activities></status></tuple>
+</presence>`)
+	if got := ParsePresenceBody(away); got != StateUnknown {
+		t.Errorf("ParsePresenceBody(away) = %v, want Unknown", got)
+	}
+
+	// Not XML: substring fallback
+	if got := ParsePresenceBody([]byte("status: closed")); got != StateIdle {
+		t.Errorf("ParsePresenceBody(non-XML closed) = %v, want Idle", got)
+	}
+}
+
+func TestMapping(t *testing.T) {
+	pair, err := ParseMappingValue("away:away")
+	if err != nil {
+		t.Fatalf("ParseMappingValue(away:away) error: %v", err)
+	}
+	m := Mapping{StateRinging: pair}
+	if a, act := m.ToGraph(StateRinging); a != "Away" || act != "Away" {
+		t.Errorf("Mapping.ToGraph(ringing) = %s/%s, want Away/Away", a, act)
+	}
+	if a, act := m.ToGraph(StateBusy); a != GraphAvailabilityBusy || act != GraphActivityInACall {
+		t.Errorf("Mapping.ToGraph(busy) = %s/%s, want default Busy/InACall", a, act)
+	}
+	if a, act := m.ToGraph(StateConference); a != GraphAvailabilityBusy || act != "InAConferenceCall" {
+		t.Errorf("Mapping.ToGraph(conference) = %s/%s, want default Busy/InAConferenceCall", a, act)
+	}
+	if a, act := m.ToGraph(StateDND); a != "DoNotDisturb" || act != "Presenting" {
+		t.Errorf("Mapping.ToGraph(dnd) = %s/%s, want default DoNotDisturb/Presenting", a, act)
+	}
+
+	for _, bad := range []string{"Busy", "Busy:Napping", "Sleeping:InACall", "", "Busy:OnHold", "DoNotDisturb:DoNotDisturb", "Offline:OffWork"} {
+		if _, err := ParseMappingValue(bad); err == nil {
+			t.Errorf("ParseMappingValue(%q) = nil error, want error", bad)
+		}
+	}
+	if got := ActivityFor("doNotDisturb"); got != "Presenting" {
+		t.Errorf("ActivityFor(doNotDisturb) = %q, want Presenting", got)
+	}
+}
+
+func TestParseDialogInfo_MultipleDialogs(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want State
+	}{
+		{"early then confirmed", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>early</state></dialog>
+  <dialog id="b"><state>confirmed</state></dialog>
+</dialog-info>`, StateBusy},
+		{"terminated then early", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>terminated</state></dialog>
+  <dialog id="b"><state>early</state></dialog>
+</dialog-info>`, StateRinging},
+		{"held and active", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>confirmed</state><local><target uri="sip:6000@pbx"><param pname="+sip.rendering" pval="no"/></target></local></dialog>
+  <dialog id="b"><state>confirmed</state></dialog>
+</dialog-info>`, StateBusy},
+		{"held and ringing", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>trying</state></dialog>
+  <dialog id="b"><state>confirmed</state><local><target uri="sip:6000@pbx"><param pname="+sip.rendering" pval="no"/></target></local></dialog>
+</dialog-info>`, StateOnHold},
+		{"two active calls", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a" direction="initiator"><state>confirmed</state></dialog>
+  <dialog id="b" direction="recipient"><state>confirmed</state></dialog>
+</dialog-info>`, StateConference},
+		{"two active calls and a held one", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>confirmed</state></dialog>
+  <dialog id="b"><state>confirmed</state><local><target uri="sip:6000@pbx"><param pname="+sip.rendering" pval="no"/></target></local></dialog>
+  <dialog id="c"><state>confirmed</state></dialog>
+</dialog-info>`, StateConference},
+		{"no namespace two active calls", `<dialog-info version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a" state="confirmed"/>
+  <dialog id="b"><state>confirmed</state></dialog>
+</dialog-info>`, StateConference},
+		{"no namespace early then confirmed", `<dialog-info version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>early</state></dialog>
+  <dialog id="b"><state>confirmed</state></dialog>
+</dialog-info>`, StateBusy},
+		{"no namespace all terminated", `<dialog-info version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>terminated</state></dialog>
+  <dialog id="b" state="terminated"/>
+</dialog-info>`, StateIdle},
+		{"no namespace proceeding then terminated", `<dialog-info version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>proceeding</state></dialog>
+  <dialog id="b"><state>terminated</state></dialog>
+</dialog-info>`, StateRinging},
+	}
+	for _, tt := range tests {
+		if got := ParseDialogInfo([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: ParseDialogInfo = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseDialogDocument_VersionAndState(t *testing.T) {
+	body := []byte(`<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="7" state="partial" entity="sip:6000@pbx">
+  <dialog id="a"><state>terminated</state></dialog>
+</dialog-info>`)
+	doc, err := ParseDialogDocument(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doc.HasVersion || doc.Version != 7 || !doc.Partial {
+		t.Errorf("ParseDialogDocument = version %d (has %v), partial %v; want 7, true, true", doc.Version, doc.HasVersion, doc.Partial)
+	}
+	if len(doc.Dialogs) != 1 || doc.Dialogs[0].ID != "a" || doc.Dialogs[0].State != StateIdle {
+		t.Errorf("ParseDialogDocument dialogs = %+v", doc.Dialogs)
+	}
+}
+
+func TestDetectDND(t *testing.T) {
+	pidfNote := []byte(`<?xml version="1.0"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" xmlns:dm="urn:ietf:params:xml:ns:pidf:data-model" entity="pres:6000@pbx">
+  <tuple id="6000"><status><basic>open</basic></status></tuple>
+  <dm:person><dm:note>DND</dm:note></dm:person>
+</presence>`)
+	tupleNote := []byte(`<?xml version="1.0"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="pres:6000@pbx">
+  <tuple id="6000"><status><basic>closed</basic></status><note>Do Not Disturb enabled</note></tuple>
+</presence>`)
+	dialogDND := []byte(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="dnd"><state>dnd</state></dialog>
+</dialog-info>`)
+	busy := []byte(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>confirmed</state></dialog>
+</dialog-info>`)
+	indicators := []string{"dnd", "do not disturb"}
+	tests := []struct {
+		name       string
+		body       []byte
+		indicators []string
+		want       bool
+	}{
+		{"person note", pidfNote, indicators, true},
+		{"tuple note substring", tupleNote, indicators, true},
+		{"dialog state", dialogDND, indicators, true},
+		{"busy dialog", busy, indicators, false},
+		{"not configured", pidfNote, nil, false},
+		{"other indicator", pidfNote, []string{"away"}, false},
+	}
+	for _, tt := range tests {
+		if got := DetectDND(tt.body, tt.indicators); got != tt.want {
+			t.Errorf("%s: DetectDND = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseXPIDF(t *testing.T) {
+	xpidf := func(status, substatus string) []byte {
+		return []byte(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE presence PUBLIC "-//IETF//DTD RFCxxxx XPIDF 1.0//EN" "xpidf.dtd">
+<presence>
+  <presentity uri="sip:1001@pbx.example.com;method=SUBSCRIBE"/>
+  <atom id="1001">
+    <address uri="sip:1001@pbx.example.com;user=ip" priority="0.800000">
+      <status status="` + status + `"/>
+      <msnsubstatus substatus="` + substatus + `"/>
+    </address>
+  </atom>
+</presence>`)
+	}
+	tests := []struct {
+		status, substatus string
+		want              State
+	}{
+		{"open", "online", StateIdle},
+		{"inuse", "onthephone", StateBusy},
+		{"busy", "", StateBusy},
+		{"open", "onthephone", StateBusy},
+		{"closed", "offline", StateIdle},
+		{"away", "", StateUnknown},
+	}
+	for _, tt := range tests {
+		doc, err := ParseXPIDF(xpidf(tt.status, tt.substatus))
+		if err != nil {
+			t.Fatalf("ParseXPIDF(%s): %v", tt.status, err)
+		}
+		if got := doc.State(); got != tt.want {
+			t.Errorf("status %q substatus %q: State() = %v, want %v", tt.status, tt.substatus, got, tt.want)
+		}
+		if got := ParsePresenceBody(xpidf(tt.status, tt.substatus)); got != tt.want {
+			t.Errorf("status %q: ParsePresenceBody = %v, want %v", tt.status, got, tt.want)
+		}
+		if ext := doc.Extension(); ext != "1001" {
+			t.Errorf("Extension() = %q, want 1001", ext)
+		}
+	}
+
+	pidf := []byte(`<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="pres:6000@pbx"><tuple id="t"><status><basic>open</basic></status></tuple></presence>`)
+	if _, err := ParseXPIDF(pidf); err == nil {
+		t.Error("ParseXPIDF(PIDF) succeeded, want an error")
+	}
+}
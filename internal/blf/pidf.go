@@ -0,0 +1,89 @@
+package blf
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// PIDF is a presence document (RFC 3863) with the RPID activities extension (RFC 4480).
+// Elements are matched by local name so the pidf, data-model (dm:) and rpid: prefixes
+// used by different PBXs all decode the same way.
+type PIDF struct {
+	XMLName xml.Name     `xml:"presence"`
+	Entity  string       `xml:"entity,attr"` // e.g. pres:1001@pbx.example.com
+	Tuples  []PIDFTuple  `xml:"tuple"`
+	Persons []PIDFPerson `xml:"person"`
+	Notes   []string     `xml:"note"`
+}
+
+// PIDFTuple is one <tuple> with its <status><basic> value (open or closed).
+type PIDFTuple struct {
+	ID         string         `xml:"id,attr"`
+	Basic      string         `xml:"status>basic"`
+	Activities PIDFActivities `xml:"status>activities"`
+	Notes      []string       `xml:"note"`
+}
+
+// PIDFPerson is a data-model <person> element carrying RPID activities.
+type PIDFPerson struct {
+	Activities PIDFActivities `xml:"activities"`
+	Notes      []string       `xml:"note"`
+}
+
+// PIDFActivities holds the RPID activity elements, e.g. <rpid:on-the-phone/>.
+type PIDFActivities struct {
+	Items []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// names returns the lower-cased local names of the activities.
+func (a PIDFActivities) names() []string {
+	out := make([]string, 0, len(a.Items))
+	for _, it := range a.Items {
+		out = append(out, strings.ToLower(it.XMLName.Local))
+	}
+	return out
+}
+
+// activities returns all RPID activity names found in the document.
+func (p *PIDF) activities() []string {
+	var out []string
+	for _, t := range p.Tuples {
+		out = append(out, t.Activities.names()...)
+	}
+	for _, per := range p.Persons {
+		out = append(out, per.Activities.names()...)
+	}
+	return out
+}
+
+// State maps the document to a BLF state: on-the-phone or busy activities are busy,
+// other activities are unknown, and without activities basic closed or open is idle.
+func (p *PIDF) State() State {
+	acts := p.activities()
+	if len(acts) > 0 {
+		for _, a := range acts {
+			if a == "on-the-phone" || a == "busy" {
+				return StateBusy
+			}
+		}
+		return StateUnknown
+	}
+	for _, t := range p.Tuples {
+		switch strings.ToLower(strings.TrimSpace(t.Basic)) {
+		case "closed", "open":
+			return StateIdle
+		}
+	}
+	return StateUnknown
+}
+
+// ParsePIDF unmarshals a PIDF document. The error is non-nil if the body is not PIDF XML.
+func ParsePIDF(body []byte) (*PIDF, error) {
+	var doc PIDF
+	if err := unmarshalXML(body, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
@@ -0,0 +1,81 @@
+package blf
+
+import (
+	"net/url"
+	"strings"
+)
+
+// UserFromURI returns the extension identified by an entity or identity URI:
+//
+//   - sip:, sips: and pres: URIs give their user part ("sip:1001@pbx" -> "1001"), without
+//     user parameters ("sip:1001;ovl=1@pbx") and percent-decoded. A URI without a user part
+//     ("sip:pbx.example.com") identifies a host, not an extension, and gives "".
+//   - tel: URIs give the number without parameters, visual separators or a leading "+"
+//     ("tel:+1-555-123-4567;phone-context=x" -> "15551234567"); so do sip: URIs with
+//     ;user=phone.
+//
+// Schemes are case-insensitive, and a URI in angle brackets ("<sip:1001@pbx>") is accepted.
+// Other schemes and malformed URIs give "".
+func UserFromURI(uri string) string {
+	uri = strings.TrimSpace(uri)
+	if strings.HasPrefix(uri, "<") {
+		end := strings.Index(uri, ">")
+		if end < 0 {
+			return ""
+		}
+		uri = uri[1:end]
+	}
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(scheme) {
+	case "tel":
+		number, _, _ := strings.Cut(rest, ";")
+		return normalizeNumber(number)
+	case "sip", "sips", "pres":
+		userinfo, hostpart, ok := strings.Cut(rest, "@")
+		if !ok {
+			return ""
+		}
+		user, _, _ := strings.Cut(userinfo, ";")
+		user, _, _ = strings.Cut(user, ":") // user:password
+		user, err := url.PathUnescape(user)
+		if err != nil {
+			return ""
+		}
+		if hasURIParam(hostpart, "user", "phone") {
+			return normalizeNumber(user)
+		}
+		return user
+	default:
+		return ""
+	}
+}
+
+// hasURIParam reports whether the ;-separated parameters after the host in hostpart
+// include name=value (both case-insensitive).
+func hasURIParam(hostpart, name, value string) bool {
+	hostpart, _, _ = strings.Cut(hostpart, "?") // headers
+	params := strings.Split(hostpart, ";")
+	for _, p := range params[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		if strings.EqualFold(strings.TrimSpace(k), name) && strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeNumber strips the visual separators RFC 3966 allows ("-", ".", "(", ")") and a
+// leading "+" from a telephone number.
+func normalizeNumber(number string) string {
+	number = strings.TrimPrefix(strings.TrimSpace(number), "+")
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '.', '(', ')', ' ':
+			return -1
+		}
+		return r
+	}, number)
+}
@@ -0,0 +1,53 @@
+package blf
+
+import "testing"
+
+func TestUserFromURI(t *testing.T) {
+	tests := []struct {
+		name, uri, want string
+	}{
+		{"sip", "sip:1001@pbx.example.com", "1001"},
+		{"sip with port and params", "sip:1001@pbx.example.com:5060;transport=udp", "1001"},
+		{"sips", "sips:1001@pbx.example.com", "1001"},
+		{"pres", "pres:1001@pbx.example.com", "1001"},
+		{"upper-case scheme", "SIP:1001@pbx.example.com", "1001"},
+		{"angle brackets", " <sip:1001@pbx.example.com> ", "1001"},
+		{"user parameter", "sip:1001;ovl=1@pbx.example.com", "1001"},
+		{"user with password", "sip:1001:secret@pbx.example.com", "1001"},
+		{"percent-encoded user", "sip:%2A97@pbx.example.com", "*97"},
+		{"user=phone", "sip:+1-555-123-4567@gw.example.com;user=phone", "15551234567"},
+		{"tel", "tel:+15551234", "15551234"},
+		{"tel with separators", "tel:+1 (555) 123.4567", "15551234567"},
+		{"tel with parameters", "tel:7042;phone-context=example.com", "7042"},
+		{"hostless sip", "sip:pbx.example.com", ""},
+		{"no scheme", "1001@pbx.example.com", ""},
+		{"unknown scheme", "mailto:1001@example.com", ""},
+		{"unclosed bracket", "<sip:1001@pbx.example.com", ""},
+		{"bad escape", "sip:10%zz@pbx.example.com", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UserFromURI(tt.uri); got != tt.want {
+				t.Errorf("UserFromURI(%q) = %q, want %q", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtensionFromDialogInfo_Schemes(t *testing.T) {
+	tests := []struct {
+		entity, identity, want string
+	}{
+		{"tel:+15551234", "", "15551234"},
+		{"pres:1001@pbx.example.com", "", "1001"},
+		{"sip:pbx.example.com", "sips:1002@pbx.example.com", "1002"},
+	}
+	for _, tt := range tests {
+		body := []byte(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="` + tt.entity + `">` +
+			`<dialog id="a"><state>confirmed</state><local><identity>` + tt.identity + `</identity></local></dialog></dialog-info>`)
+		if got := ExtensionFromDialogInfo(body); got != tt.want {
+			t.Errorf("entity %q identity %q: ExtensionFromDialogInfo = %q, want %q", tt.entity, tt.identity, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package blf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/html/charset"
+)
+
+// utf8BOM is the UTF-8 byte-order mark some PBXs put before the XML declaration.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Limits on the NOTIFY bodies unmarshalXML decodes. Bodies come from the network; real
+// dialog-info and PIDF documents are a few KiB and nest a handful of elements deep.
+const (
+	MaxBodySize = 256 << 10 // bytes
+	maxXMLDepth = 64        // nested elements
+)
+
+// Errors of unmarshalXML for bodies it refuses to decode.
+var (
+	errBodyTooLarge = fmt.Errorf("XML body larger than %d bytes", MaxBodySize)
+	errXMLDirective = errors.New("XML directive not allowed (only a DOCTYPE without internal subset is)")
+	errXMLTooDeep   = fmt.Errorf("XML nested more than %d elements deep", maxXMLDepth)
+)
+
+// unmarshalXML is xml.Unmarshal for NOTIFY bodies: a leading UTF-8 BOM is skipped, and
+// documents declaring another encoding (encoding="ISO-8859-1", windows-1252, ...) are
+// decoded to UTF-8 instead of being rejected. Bodies over MaxBodySize, nested deeper than
+// maxXMLDepth or carrying a directive other than a plain DOCTYPE (XPIDF bodies name an
+// external DTD, which is never fetched) are refused, so no ENTITY can be declared; entities
+// other than the five predefined ones are errors (strict mode).
+func unmarshalXML(body []byte, v any) error {
+	if len(body) > MaxBodySize {
+		return errBodyTooLarge
+	}
+	raw := xml.NewDecoder(bytes.NewReader(bytes.TrimPrefix(body, utf8BOM)))
+	raw.CharsetReader = charset.NewReaderLabel
+	return xml.NewTokenDecoder(&guardedTokens{raw: raw}).Decode(v)
+}
+
+// guardedTokens passes on the raw tokens of an XML document, failing on directives other
+// than a DOCTYPE without internal subset and on nesting deeper than maxXMLDepth. The
+// xml.Decoder reading from it checks that elements are balanced and resolves namespaces.
+type guardedTokens struct {
+	raw   *xml.Decoder
+	depth int
+}
+
+func (g *guardedTokens) Token() (xml.Token, error) {
+	t, err := g.raw.RawToken()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case xml.Directive:
+		if !bytes.HasPrefix(t, []byte("DOCTYPE")) || bytes.ContainsAny(t, "[<") {
+			return nil, errXMLDirective
+		}
+	case xml.StartElement:
+		if g.depth++; g.depth > maxXMLDepth {
+			return nil, errXMLTooDeep
+		}
+	case xml.EndElement:
+		g.depth--
+	}
+	return t, nil
+}
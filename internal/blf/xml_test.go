@@ -0,0 +1,144 @@
+package blf
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseDialogInfo_BOM(t *testing.T) {
+	body := readFixture(t, "dialog-info-bom.xml")
+	if got := ParseDialogInfo(body); got != StateBusy {
+		t.Errorf("ParseDialogInfo = %v, want busy", got)
+	}
+	if got := ExtensionFromDialogInfo(body); got != "2001" {
+		t.Errorf("ExtensionFromDialogInfo = %q, want 2001", got)
+	}
+}
+
+func TestParseDialogInfo_Latin1(t *testing.T) {
+	body := readFixture(t, "dialog-info-latin1.xml")
+	if got := ParseDialogInfo(body); got != StateRinging {
+		t.Errorf("ParseDialogInfo = %v, want ringing", got)
+	}
+	if got := ExtensionFromDialogInfo(body); got != "2002" {
+		t.Errorf("ExtensionFromDialogInfo = %q, want 2002", got)
+	}
+	var info struct {
+		Dialogs []struct {
+			Identity struct {
+				Display string `xml:"display,attr"`
+			} `xml:"local>identity"`
+		} `xml:"dialog"`
+	}
+	if err := unmarshalXML(body, &info); err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Dialogs[0].Identity.Display; got != "Jürgen Müller" {
+		t.Errorf("identity display = %q, want it decoded from ISO-8859-1", got)
+	}
+}
+
+func TestParsePIDF_Latin1(t *testing.T) {
+	body := readFixture(t, "pidf-latin1.xml")
+	doc, err := ParsePIDF(body)
+	if err != nil {
+		t.Fatalf("ParsePIDF: %v", err)
+	}
+	if len(doc.Tuples) != 1 || len(doc.Tuples[0].Notes) != 1 || doc.Tuples[0].Notes[0] != "Am Telefon (Büro)" {
+		t.Errorf("tuples = %+v, want one note decoded from ISO-8859-1", doc.Tuples)
+	}
+	if got := ParsePresenceBody(body); got != StateIdle {
+		t.Errorf("ParsePresenceBody = %v, want idle (decoded as PIDF, not by substring)", got)
+	}
+}
+
+func TestUnmarshalXML_Refused(t *testing.T) {
+	var v struct{}
+	deep := strings.Repeat("<a>", maxXMLDepth+1) + strings.Repeat("</a>", maxXMLDepth+1)
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"too large", "<a>" + strings.Repeat(" ", MaxBodySize) + "</a>", errBodyTooLarge},
+		{"too deep", deep, errXMLTooDeep},
+		{"entity declaration", `<!DOCTYPE a [<!ENTITY x "boom">]><a>&x;</a>`, errXMLDirective},
+		{"external entity", `<!DOCTYPE a [<!ENTITY x SYSTEM "file:///etc/passwd">]><a>&x;</a>`, errXMLDirective},
+		{"bare entity", `<!ENTITY x "boom"><a/>`, errXMLDirective},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := unmarshalXML([]byte(tt.body), &v); !errors.Is(err, tt.want) {
+				t.Errorf("unmarshalXML = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalXML_Accepted(t *testing.T) {
+	var v struct {
+		Name string `xml:"name"`
+	}
+	for _, body := range []string{
+		strings.Repeat("<a>", maxXMLDepth-1) + "<name>x</name>" + strings.Repeat("</a>", maxXMLDepth-1),
+		`<!DOCTYPE a PUBLIC "-//IETF//DTD RFCxxxx XPIDF 1.0//EN" "xpidf.dtd"><a><name>x</name></a>`,
+	} {
+		if err := unmarshalXML([]byte(body), &v); err != nil {
+			t.Errorf("unmarshalXML(%.40q): %v", body, err)
+		}
+	}
+	if err := unmarshalXML([]byte(`<a><name>&undefined;</name></a>`), &v); err == nil {
+		t.Error("unmarshalXML accepted an undefined entity")
+	}
+}
+
+// FuzzParseDialogInfo checks that arbitrary NOTIFY bodies never panic the parsers and are
+// dealt with quickly, yielding one of the known states.
+func FuzzParseDialogInfo(f *testing.F) {
+	for _, name := range []string{"dialog-info-bom.xml", "dialog-info-latin1.xml", "pidf-latin1.xml"} {
+		body, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	for _, seed := range []string{
+		`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:1001@pbx"><dialog id="a"><state>confirmed</state></dialog></dialog-info>`,
+		`<dialog-info version="x"><dialog><state>early`,
+		`<!DOCTYPE d [<!ENTITY a "aaaaaaaaaa"><!ENTITY b "&a;&a;&a;&a;&a;">]><dialog-info>&b;</dialog-info>`,
+		strings.Repeat("<dialog-info>", 10000),
+		`<?xml version="1.0" encoding="nonsense"?><dialog-info/>`,
+		"\xef\xbb\xbf<presence><tuple><status><basic>open</basic></status></tuple></presence>",
+	} {
+		f.Add([]byte(seed))
+	}
+	known := map[State]bool{StateIdle: true, StateRinging: true, StateBusy: true, StateOnHold: true,
+		StateConference: true, StateDND: true, StateUnknown: true}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		start := time.Now()
+		got := ParseDialogInfo(body)
+		presence := ParsePresenceBody(body)
+		_ = ExtensionFromDialogInfo(body)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("parsing %d bytes took %s", len(body), elapsed)
+		}
+		if !known[got] || !known[presence] {
+			t.Errorf("states %q, %q: want known states", got, presence)
+		}
+		if len(body) > MaxBodySize && got != StateUnknown {
+			t.Errorf("oversized body parsed as %q", got)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package blf
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+// ContentTypeXPIDF is the media type of XPIDF bodies.
+const ContentTypeXPIDF = "application/xpidf+xml"
+
+// XPIDF is a legacy presence document (application/xpidf+xml), the pre-PIDF draft format
+// still sent by older PBXs and endpoints:
+//
+//	<presence><presentity uri="sip:1001@pbx"/>
+//	  <atom id="1001"><address uri="sip:1001@pbx"><status status="inuse"/></address></atom>
+//	</presence>
+type XPIDF struct {
+	XMLName    xml.Name `xml:"presence"`
+	Presentity struct {
+		URI string `xml:"uri,attr"`
+	} `xml:"presentity"`
+	Atoms []XPIDFAtom `xml:"atom"`
+}
+
+// XPIDFAtom is one <atom> with the addresses of the presentity.
+type XPIDFAtom struct {
+	ID        string         `xml:"id,attr"`
+	Addresses []XPIDFAddress `xml:"address"`
+}
+
+// XPIDFAddress is one <address> with its status (open, closed, inuse, busy, ...) and the
+// optional msnsubstatus (online, onthephone, away, ...) some PBXs add.
+type XPIDFAddress struct {
+	URI    string `xml:"uri,attr"`
+	Status struct {
+		Value string `xml:"status,attr"`
+	} `xml:"status"`
+	Substatus struct {
+		Value string `xml:"substatus,attr"`
+	} `xml:"msnsubstatus"`
+}
+
+// State maps the document to a BLF state: an address in use or busy (or with the
+// onthephone substatus) is busy, otherwise an open or closed address is idle.
+func (x *XPIDF) State() State {
+	state := StateUnknown
+	for _, a := range x.Atoms {
+		for _, addr := range a.Addresses {
+			status := strings.ToLower(strings.TrimSpace(addr.Status.Value))
+			switch {
+			case status == "inuse" || status == "busy" || strings.EqualFold(strings.TrimSpace(addr.Substatus.Value), "onthephone"):
+				return StateBusy
+			case status == "open" || status == "closed":
+				state = StateIdle
+			}
+		}
+	}
+	return state
+}
+
+// Extension returns the extension of the presentity (see UserFromURI), or of the first
+// address when there is no presentity.
+func (x *XPIDF) Extension() string {
+	if ext := UserFromURI(x.Presentity.URI); ext != "" {
+		return ext
+	}
+	for _, a := range x.Atoms {
+		if len(a.Addresses) > 0 {
+			return UserFromURI(a.Addresses[0].URI)
+		}
+	}
+	return ""
+}
+
+// ParseXPIDF unmarshals an XPIDF document. The error is non-nil if the body is not XML
+// with a presence root holding at least one atom (PIDF documents have none).
+func ParseXPIDF(body []byte) (*XPIDF, error) {
+	var doc XPIDF
+	if err := unmarshalXML(body, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Atoms) == 0 {
+		return nil, errors.New("not an XPIDF document: no atom")
+	}
+	return &doc, nil
+}
@@ -0,0 +1,151 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Auth modes for NewClient.
+const (
+	// AuthApp uses client credentials (app-only). It needs the Presence.ReadWrite.All
+	// application permission and can set the presence of every mapped user.
+	AuthApp = "app"
+	// AuthDeviceCode signs in one account (e.g. a service account) with the device code
+	// flow. It needs only the delegated Presence.ReadWrite permission, and Graph then lets
+	// the client set the presence of the signed-in account only.
+	AuthDeviceCode = "device-code"
+	// AuthManaged uses the Azure managed identity of the host (ACI, App Service, VM) or,
+	// when AZURE_FEDERATED_TOKEN_FILE is set, AKS workload identity; no secret is needed.
+	// Like AuthApp it needs the Presence.ReadWrite.All application permission, assigned to
+	// the identity.
+	AuthManaged = "managed"
+)
+
+// ErrNotSignedInUser is returned with AuthDeviceCode for a user other than the signed-in account.
+var ErrNotSignedInUser = errors.New("delegated auth can only set the signed-in account's presence")
+
+// Auth selects how NewClient authenticates to Graph.
+type Auth struct {
+	Mode         string // AuthApp ("" is the same), AuthDeviceCode or AuthManaged
+	TenantID     string // not needed with AuthManaged
+	ClientID     string // with AuthManaged, of a user-assigned identity ("" = system-assigned)
+	ClientSecret string // AuthApp only
+
+	Cloud   string // CloudCommercial ("" is the same), CloudGCCHigh, CloudDoD or CloudChina
+	BaseURL string // Graph service root overriding the cloud's, e.g. "https://graph.microsoft.us/v1.0"
+	Scope   string // app-only scope overriding the one derived from the service root
+}
+
+// ParseAuthMode checks an AUTH_MODE value; "" means AuthApp.
+func ParseAuthMode(s string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(s)); mode {
+	case "", AuthApp:
+		return AuthApp, nil
+	case AuthDeviceCode, AuthManaged:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("auth mode %q: want %q, %q or %q", s, AuthApp, AuthDeviceCode, AuthManaged)
+	}
+}
+
+// delegated reports whether the client uses device-code auth.
+func (c *Client) delegated() bool {
+	return c.deviceCode != nil
+}
+
+// acquireToken gets a Graph token. With device-code auth and no signed-in account yet it
+// runs the device code sign-in (logging the code and URL, then waiting for the user) and
+// persists the account in the state file.
+func (c *Client) acquireToken(ctx context.Context) error {
+	opts := policy.TokenRequestOptions{Scopes: c.scopes}
+	if c.delegated() && c.state.AuthRecord() == nil {
+		rec, err := c.deviceCode.Authenticate(ctx, c.scopes)
+		if err != nil {
+			return err
+		}
+		if err := c.state.SetAuthRecord(rec); err != nil {
+			return fmt.Errorf("save signed-in account: %w", err)
+		}
+		c.log.Info("signed in to Graph", "account", rec.Username)
+		return nil
+	}
+	_, err := c.cred.GetToken(ctx, opts)
+	return err
+}
+
+// signedInUserID returns the object ID of the signed-in account if upn is that account,
+// otherwise ErrNotSignedInUser. The object ID is the first part of the home account ID
+// ("<object ID>.<tenant ID>"), so no directory lookup (or permission for one) is needed.
+func (c *Client) signedInUserID(upn string) (string, error) {
+	rec := c.state.AuthRecord()
+	if rec == nil {
+		return "", errors.New("not signed in to Graph")
+	}
+	if !strings.EqualFold(upn, rec.Username) {
+		return "", fmt.Errorf("%w: %s (signed in as %s)", ErrNotSignedInUser, upn, rec.Username)
+	}
+	oid, _, _ := strings.Cut(rec.HomeAccountID, ".")
+	if oid == "" {
+		return "", errors.New("signed-in account has no object ID")
+	}
+	return oid, nil
+}
+
+// credential returns the token credential for auth, requesting tokens from the Entra ID
+// authority of the given cloud (the azidentity default when zero).
+func credential(auth Auth, authority cloud.Configuration, state *SessionState, log *slog.Logger) (azcore.TokenCredential, *deviceCodeCredential, error) {
+	switch auth.Mode {
+	case AuthDeviceCode:
+		cred, err := newDeviceCodeCredential(auth, authority, state, log)
+		return cred, cred, err
+	case AuthManaged:
+		cred, err := newManagedCredential(auth, authority, log)
+		return cred, nil, err
+	}
+	cred, err := azidentity.NewClientSecretCredential(auth.TenantID, auth.ClientID, auth.ClientSecret, &azidentity.ClientSecretCredentialOptions{
+		ClientOptions: azcore.ClientOptions{Cloud: authority},
+	})
+	return cred, nil, err
+}
+
+// newManagedCredential returns the credential of AuthManaged: workload identity when the
+// AKS webhook injected AZURE_FEDERATED_TOKEN_FILE, otherwise the managed identity of the
+// host, user-assigned when auth.ClientID is set.
+func newManagedCredential(auth Auth, authority cloud.Configuration, log *slog.Logger) (azcore.TokenCredential, error) {
+	if os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" {
+		log.Info("Graph auth: workload identity", "client_id", auth.ClientID)
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientOptions: azcore.ClientOptions{Cloud: authority},
+			ClientID:      auth.ClientID,
+			TenantID:      auth.TenantID,
+		})
+	}
+	opts := azidentity.ManagedIdentityCredentialOptions{ClientOptions: azcore.ClientOptions{Cloud: authority}}
+	if auth.ClientID != "" {
+		opts.ID = azidentity.ClientID(auth.ClientID)
+		log.Info("Graph auth: user-assigned managed identity", "client_id", auth.ClientID)
+	} else {
+		log.Info("Graph auth: system-assigned managed identity")
+	}
+	return azidentity.NewManagedIdentityCredential(&opts)
+}
+
+// authHint suggests what to check when token acquisition fails.
+func (c *Client) authHint() string {
+	if c.delegated() {
+		return "the refresh token may have expired or been revoked; delete auth_record and token_cache from the state file and restart to sign in again"
+	}
+	if c.authMode == AuthManaged {
+		return "check that the host has a managed identity (with AZURE_CLIENT_ID naming a user-assigned one) and that it was granted Presence.ReadWrite.All"
+	}
+	return "check that AZURE_CLIENT_SECRET has not expired and the app still has Presence.ReadWrite.All consent"
+}
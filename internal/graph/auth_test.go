@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+)
+
+func TestParseAuthMode(t *testing.T) {
+	for in, want := range map[string]string{"": AuthApp, "APP": AuthApp, " device-code ": AuthDeviceCode, "Managed": AuthManaged} {
+		if got, err := ParseAuthMode(in); err != nil || got != want {
+			t.Errorf("ParseAuthMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseAuthMode("secret"); err == nil {
+		t.Error(`ParseAuthMode("secret"): want error`)
+	}
+}
+
+func TestCredential_Managed(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+	cred, deviceCode, err := credential(Auth{Mode: AuthManaged, ClientID: "11111111-1111-1111-1111-111111111111"}, cloud.Configuration{}, nil, log)
+	if err != nil || deviceCode != nil {
+		t.Fatalf("credential = %v, %v", deviceCode, err)
+	}
+	if _, ok := cred.(*azidentity.ManagedIdentityCredential); !ok {
+		t.Errorf("credential = %T, want a managed identity credential", cred)
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("federated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	cred, _, err = credential(Auth{Mode: AuthManaged, TenantID: "contoso.onmicrosoft.com", ClientID: "11111111-1111-1111-1111-111111111111"}, cloud.Configuration{}, nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cred.(*azidentity.WorkloadIdentityCredential); !ok {
+		t.Errorf("credential with AZURE_FEDERATED_TOKEN_FILE = %T, want a workload identity credential", cred)
+	}
+}
+
+// testCache is the MSAL token cache as the cache accessor sees it.
+type testCache struct{ data []byte }
+
+func (c *testCache) Marshal() ([]byte, error) { return c.data, nil }
+
+func (c *testCache) Unmarshal(data []byte) error {
+	c.data = data
+	return nil
+}
+
+// TestStateTokenCache checks that the device-code token cache survives a restart in the
+// state file, next to the signed-in account.
+func TestStateTokenCache(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadSessionState(path, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, deviceCode, err := credential(Auth{Mode: AuthDeviceCode, ClientID: "11111111-1111-1111-1111-111111111111"}, cloud.Configuration{}, state, log)
+	if err != nil || cred != deviceCode {
+		t.Fatalf("credential = %T, %v; want the device-code credential", cred, err)
+	}
+	accessor := stateTokenCache{state}
+	if err := accessor.Replace(t.Context(), &testCache{}, cache.ReplaceHints{}); err != nil {
+		t.Fatalf("Replace with no cache: %v", err)
+	}
+	const tokens = `{"RefreshToken":{"k":{"secret":"refresh"}}}`
+	if err := accessor.Export(t.Context(), &testCache{data: []byte(tokens)}, cache.ExportHints{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := accessor.Export(t.Context(), &testCache{data: []byte("not json")}, cache.ExportHints{}); err == nil {
+		t.Error("Export of a cache that is not JSON: want error")
+	}
+	if err := state.SetAuthRecord(azidentity.AuthenticationRecord{Username: "svc@example.com", HomeAccountID: "oid.tid", Version: "1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := LoadSessionState(path, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &testCache{}
+	if err := (stateTokenCache{again}).Replace(t.Context(), got, cache.ReplaceHints{}); err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, got.data) // the state file is indented
+	if compact.String() != tokens || again.AuthRecord() == nil || again.AuthRecord().Username != "svc@example.com" {
+		t.Errorf("reloaded cache %s, account %+v; want %s and svc@example.com", got.data, again.AuthRecord(), tokens)
+	}
+}
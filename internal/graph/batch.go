@@ -0,0 +1,123 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
+)
+
+// maxBatchSize is the Graph JSON $batch limit on requests per batch.
+const maxBatchSize = 20
+
+// PresenceUpdate is one user's presence for SetPresenceBatch.
+type PresenceUpdate struct {
+	UserID       string // email (userPrincipalName)
+	Extension    string
+	Availability string
+	Activity     string
+	Expiration   time.Duration // 0 = DefaultExpiration
+}
+
+// SetPresenceBatch sets presence for many users using Graph $batch (up to 20 requests per
+// batch), e.g. for the initial bulk sync. It returns the failures keyed by UserID; an empty
+// map means every update succeeded. Individual changes should keep using SetPresence.
+func (c *Client) SetPresenceBatch(ctx context.Context, updates []PresenceUpdate) map[string]error {
+	failed := make(map[string]error)
+	adapter := c.graph.GetAdapter()
+	for start := 0; start < len(updates); start += maxBatchSize {
+		chunk := updates[start:min(start+maxBatchSize, len(updates))]
+		batch := msgraphcore.NewBatchRequest(adapter)
+		byStep := make(map[string]PresenceUpdate, len(chunk))
+		for _, u := range chunk {
+			if err := c.breaker.allow(u.UserID); err != nil {
+				failed[u.UserID] = err
+				continue
+			}
+			if err := c.addPresenceStep(ctx, batch, byStep, u); err != nil {
+				failed[u.UserID] = err
+				c.breaker.record(u.UserID, err)
+			}
+		}
+		if len(byStep) == 0 {
+			continue
+		}
+
+		began := time.Now()
+		var resp msgraphcore.BatchResponse
+		err := c.doWithRetry(ctx, "setPresence batch", func(ctx context.Context) error {
+			var err error
+			resp, err = batch.Send(ctx, adapter)
+			return err
+		})
+		elapsed := time.Since(began)
+		if err != nil {
+			c.log.Error("setPresence batch failed", "requests", len(byStep), "error", err, "error_chain", errorChain(err))
+			for _, u := range byStep {
+				failed[u.UserID] = err
+				metrics.PresenceWrite(u.Extension, err, elapsed)
+				c.breaker.record(u.UserID, err)
+			}
+			continue
+		}
+		statuses := resp.GetStatusCodes()
+		for id, u := range byStep {
+			var itemErr error
+			if status, ok := statuses[id]; !ok {
+				itemErr = fmt.Errorf("setPresence batch: no response for %s", u.UserID)
+			} else if status >= 300 {
+				itemErr = classifyStatus(int(status), "", fmt.Errorf("setPresence batch: status %d for %s", status, u.UserID))
+				if errors.Is(itemErr, ErrUserNotFound) {
+					c.forgetUserID(u.UserID)
+				}
+			}
+			metrics.PresenceWrite(u.Extension, itemErr, elapsed)
+			c.breaker.record(u.UserID, itemErr)
+			c.lastWrittenMu.Lock()
+			if itemErr == nil {
+				c.lastWritten[u.Extension] = [2]string{u.Availability, u.Activity}
+			} else {
+				delete(c.lastWritten, u.Extension)
+			}
+			c.lastWrittenMu.Unlock()
+			if itemErr != nil {
+				c.log.Error("setPresence batch item failed", "user", u.UserID, "extension", u.Extension, "error", itemErr)
+				failed[u.UserID] = itemErr
+			}
+		}
+		c.log.Info("setPresence batch sent", "requests", len(byStep), "duration", elapsed)
+	}
+	return failed
+}
+
+// addPresenceStep adds the setPresence request for u to batch, keyed by its step ID in byStep.
+func (c *Client) addPresenceStep(ctx context.Context, batch msgraphcore.BatchRequest, byStep map[string]PresenceUpdate, u PresenceUpdate) error {
+	objectID, err := c.resolveUserID(ctx, u.UserID)
+	if err != nil {
+		return err
+	}
+	sessionID, err := c.sessionID(u.Extension)
+	if err != nil {
+		return err
+	}
+	body := users.NewItemPresenceSetPresencePostRequestBody()
+	body.SetSessionId(&sessionID)
+	body.SetAvailability(&u.Availability)
+	body.SetActivity(&u.Activity)
+	body.SetExpirationDuration(isoExpiration(u.Expiration))
+	info, err := c.graph.Users().ByUserId(objectID).Presence().SetPresence().ToPostRequestInformation(ctx, body, nil)
+	if err != nil {
+		return err
+	}
+	step, err := batch.AddBatchRequestStep(*info)
+	if err != nil {
+		return err
+	}
+	byStep[*step.GetId()] = u
+	return nil
+}
@@ -0,0 +1,105 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults: DefaultBreakerThreshold consecutive failed writes for one user
+// open the breaker for DefaultBreakerCooldown.
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 5 * time.Minute
+)
+
+// ErrCircuitOpen is returned (wrapped) for writes skipped because the user's breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open for user")
+
+// breaker is a per-user circuit breaker for Graph writes. After threshold consecutive
+// failures for a user, writes for that user are skipped until cooldown has passed; then a
+// single probe write is let through, which closes the breaker on success or reopens it for
+// another cooldown on failure. Rejected credentials and cancelled requests are not the
+// user's fault and do not count.
+type breaker struct {
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+	now       func() time.Time
+	log       *slog.Logger
+
+	mu    sync.Mutex
+	users map[string]*breakerState // lower-case user -> state
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time // zero while closed
+	probing   bool      // the probe after a cooldown is in flight
+}
+
+func newBreaker(threshold int, cooldown time.Duration, log *slog.Logger) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now, log: log, users: make(map[string]*breakerState)}
+}
+
+// allow reports whether a write for user may be sent, or returns ErrCircuitOpen.
+func (b *breaker) allow(user string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.users[strings.ToLower(user)]
+	if st == nil || st.openUntil.IsZero() {
+		return nil
+	}
+	if now := b.now(); now.Before(st.openUntil) || st.probing {
+		return fmt.Errorf("%w %s (until %s)", ErrCircuitOpen, user, st.openUntil.Format(time.TimeOnly))
+	}
+	st.probing = true
+	b.log.Info("circuit breaker cooldown over, probing user", "user", user)
+	return nil
+}
+
+// record updates user's breaker with the outcome of a write that allow let through.
+// A failed probe reopens the breaker whatever the error, so the user is probed again after
+// the next cooldown rather than left waiting on a probe that will never be recorded.
+func (b *breaker) record(user string, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	key := strings.ToLower(user)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.users[key]
+	if err == nil {
+		if st != nil && !st.openUntil.IsZero() {
+			b.log.Info("circuit breaker closed; writes for user resumed", "user", user)
+		}
+		delete(b.users, key)
+		return
+	}
+	if st != nil && st.probing {
+		st.probing = false
+		st.openUntil = b.now().Add(b.cooldown)
+		b.log.Warn("circuit breaker probe failed; writes for user stay skipped", "user", user, "cooldown", b.cooldown, "error", err)
+		return
+	}
+	if IsAuthError(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if st == nil {
+		st = &breakerState{}
+		b.users[key] = st
+	}
+	st.failures++
+	switch {
+	case st.openUntil.IsZero() && st.failures >= b.threshold:
+		st.openUntil = b.now().Add(b.cooldown)
+		b.log.Error("circuit breaker open: skipping writes for user after repeated failures",
+			"user", user, "failures", st.failures, "cooldown", b.cooldown, "error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	b := newBreaker(3, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.now = func() time.Time { return now }
+	fail := errors.New("503 service unavailable")
+
+	for i := 0; i < 3; i++ {
+		if err := b.allow("alice@example.com"); err != nil {
+			t.Fatalf("write %d: allow = %v, want nil", i, err)
+		}
+		b.record("alice@example.com", fail)
+	}
+	if err := b.allow("ALICE@example.com"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after threshold: allow = %v, want ErrCircuitOpen", err)
+	}
+	if err := b.allow("bob@example.com"); err != nil {
+		t.Fatalf("other user: allow = %v, want nil", err)
+	}
+
+	// After the cooldown exactly one probe goes through; its failure reopens the breaker.
+	now = now.Add(time.Minute)
+	if err := b.allow("alice@example.com"); err != nil {
+		t.Fatalf("probe: allow = %v, want nil", err)
+	}
+	if err := b.allow("alice@example.com"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("during probe: allow = %v, want ErrCircuitOpen", err)
+	}
+	b.record("alice@example.com", fail)
+	now = now.Add(30 * time.Second)
+	if err := b.allow("alice@example.com"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after failed probe: allow = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes the breaker and resets the failure count.
+	now = now.Add(30 * time.Second)
+	if err := b.allow("alice@example.com"); err != nil {
+		t.Fatalf("second probe: allow = %v, want nil", err)
+	}
+	b.record("alice@example.com", nil)
+	b.record("alice@example.com", fail)
+	if err := b.allow("alice@example.com"); err != nil {
+		t.Fatalf("after recovery: allow = %v, want nil", err)
+	}
+}
+
+func TestBreakerIgnoresAuthAndCancel(t *testing.T) {
+	b := newBreaker(1, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.record("alice@example.com", context.Canceled)
+	b.record("alice@example.com", context.DeadlineExceeded)
+	if err := b.allow("alice@example.com"); err != nil {
+		t.Fatalf("allow = %v, want nil", err)
+	}
+}
+
+// TestBreakerProbeTimeout checks that a probe ending in an error that is not counted still
+// reopens the breaker, so the user is probed again after the next cooldown.
+func TestBreakerProbeTimeout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	b := newBreaker(1, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.now = func() time.Time { return now }
+	b.record("alice@example.com", errors.New("503 service unavailable"))
+
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled} {
+		now = now.Add(time.Minute)
+		if got := b.allow("alice@example.com"); got != nil {
+			t.Fatalf("probe before %v: allow = %v, want nil", err, got)
+		}
+		b.record("alice@example.com", err)
+		if got := b.allow("alice@example.com"); !errors.Is(got, ErrCircuitOpen) {
+			t.Fatalf("after probe failed with %v: allow = %v, want ErrCircuitOpen", err, got)
+		}
+	}
+	now = now.Add(time.Minute)
+	if err := b.allow("alice@example.com"); err != nil {
+		t.Fatalf("after cooldown: allow = %v, want another probe", err)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(0, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for i := 0; i < 10; i++ {
+		b.record("alice@example.com", errors.New("boom"))
+	}
+	if err := b.allow("alice@example.com"); err != nil {
+		t.Fatalf("allow = %v, want nil", err)
+	}
+}
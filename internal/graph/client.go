@@ -3,71 +3,309 @@ package graph
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	msalerrors "github.com/AzureAD/microsoft-authentication-library-for-go/apps/errors"
+	"github.com/google/uuid"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
 	"github.com/microsoft/kiota-abstractions-go/serialization"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/microsoftgraph/msgraph-sdk-go/users"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
 )
 
+// Presence expiration bounds. Graph accepts PT5M to PT4H; a zero expiration passed to
+// SetPresence means DefaultExpiration.
 const (
-	graphScope = "https://graph.microsoft.com/.default"
-	expiration = "PT1H" // 1 hour; valid range PT5M to PT4H
+	DefaultExpiration = time.Hour
+	MinExpiration     = 5 * time.Minute
+	MaxExpiration     = 4 * time.Hour
 )
 
-// Client sets Teams presence via Microsoft Graph (app-only auth).
+// ParseExpiration parses an ISO 8601 duration such as "PT20M" and checks it against
+// Graph's PT5M-PT4H range.
+func ParseExpiration(s string) (time.Duration, error) {
+	iso, err := serialization.ParseISODuration(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("expiration %q: %w", s, err)
+	}
+	d, err := iso.ToDuration()
+	if err != nil {
+		return 0, fmt.Errorf("expiration %q: %w", s, err)
+	}
+	if d < MinExpiration || d > MaxExpiration {
+		return 0, fmt.Errorf("expiration %q: must be between PT5M and PT4H", s)
+	}
+	return d, nil
+}
+
+// Client sets Teams presence via Microsoft Graph, with app-only (AuthApp, AuthManaged) or
+// delegated (AuthDeviceCode) auth.
 type Client struct {
-	graph       *msgraphsdk.GraphServiceClient
-	clientID    string // application ID; required as sessionId for app-only SetPresence
-	state       *SessionState
-	log         *slog.Logger
-	userIDCache map[string]string // UPN/email -> object ID (GUID); guarded by userIDCacheMu
+	graph         *msgraphsdk.GraphServiceClient
+	cred          azcore.TokenCredential
+	deviceCode    *deviceCodeCredential // set with AuthDeviceCode
+	authMode      string                // Auth.Mode
+	scopes        []string
+	tokenOK       atomic.Bool // a Graph token has been acquired (explicitly or by a successful call)
+	clientID      string      // application (client) ID
+	state         *SessionState
+	log           *slog.Logger
+	userIDCache   map[string]string      // UPN/email -> object ID (GUID); guarded by userIDCacheMu
+	userLookups   map[string]*userLookup // UPN/email -> lookup in flight; guarded by userIDCacheMu
 	userIDCacheMu sync.RWMutex
+	lastWritten   map[string][2]string // extension -> last {availability, activity} written; guarded by lastWrittenMu
+	lastStatus    map[string]string    // extension -> last status message written; guarded by lastWrittenMu
+	lastWrittenMu sync.Mutex
+	breaker       *breaker // per-user circuit breaker for presence and status writes
+	status        *statusThrottle
+	timeout       time.Duration // limit of one Graph request; 0 = none (see SetTimeout)
+}
+
+// NewClient creates a Graph client authenticating as auth selects, in the cloud it names
+// (commercial by default), with the given session
+// state for persistence of session IDs (and, for AuthDeviceCode, the signed-in account).
+// With AuthDeviceCode and no account signed in yet, the first CheckToken runs the sign-in.
+// The client logs to log (slog.Default() when nil).
+func NewClient(auth Auth, statePath string, log *slog.Logger) (*Client, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	log = log.With("component", "graph")
+	state, err := LoadSessionState(statePath, log)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(auth, state, log)
 }
 
-// NewClient creates a Graph client using client credentials (tenant, client ID, secret)
-// and the given session state for persistence of session IDs.
-func NewClient(tenantID, clientID, clientSecret, statePath string) (*Client, error) {
-	cred, err := azidentity.NewClientSecretCredential(tenantID, clientID, clientSecret, nil)
+// NewReadOnlyClient is NewClient with the state file opened by OpenSessionStateReadOnly:
+// session IDs, user IDs and a device code sign-in are kept in memory only, so the client
+// can run beside the service without overwriting its state.
+func NewReadOnlyClient(auth Auth, statePath string, log *slog.Logger) (*Client, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	log = log.With("component", "graph")
+	state, err := OpenSessionStateReadOnly(statePath, log)
 	if err != nil {
 		return nil, err
 	}
-	graph, err := msgraphsdk.NewGraphServiceClientWithCredentials(cred, []string{graphScope})
+	return newClient(auth, state, log)
+}
+
+func newClient(auth Auth, state *SessionState, log *slog.Logger) (*Client, error) {
+	ep, err := endpointsFor(auth)
 	if err != nil {
 		return nil, err
 	}
-	state, err := LoadSessionState(statePath)
+	cred, deviceCode, err := credential(auth, ep.authority, state, log)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
+	scopes := []string{ep.scope}
+	if deviceCode != nil {
+		scopes = []string{ep.delegatedScope()}
+	}
+	graph, err := msgraphsdk.NewGraphServiceClientWithCredentialsAndHosts(cred, scopes, []string{ep.host})
+	if err != nil {
+		return nil, err
+	}
+	graph.GetAdapter().SetBaseUrl(ep.baseURL)
+	graph.PathParameters["baseurl"] = ep.baseURL
+	if ep.baseURL != cloudPresets[CloudCommercial].baseURL {
+		log.Info("Graph endpoint", "base_url", ep.baseURL, "scope", scopes[0])
+	}
+	c := &Client{
 		graph:       graph,
-		clientID:    clientID,
+		cred:        cred,
+		deviceCode:  deviceCode,
+		authMode:    auth.Mode,
+		scopes:      scopes,
+		clientID:    auth.ClientID,
 		state:       state,
-		log:         slog.Default().With("component", "graph"),
-		userIDCache: make(map[string]string),
-	}, nil
+		log:         log,
+		userIDCache: state.UserIDs(),
+		lastWritten: make(map[string][2]string),
+		lastStatus:  make(map[string]string),
+		breaker:     newBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown, log),
+		timeout:     DefaultTimeout,
+	}
+	c.status = newStatusThrottle(DefaultStatusMessageInterval, c.writeStatusMessage, log)
+	return c, nil
+}
+
+// SetCircuitBreaker configures the per-user circuit breaker: after threshold consecutive
+// failed writes for a user, writes for that user fail fast with ErrCircuitOpen for cooldown,
+// then one probe write decides whether to resume. threshold 0 disables the breaker. Call it
+// before the client is used.
+func (c *Client) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	c.breaker = newBreaker(threshold, cooldown, c.log)
+}
+
+// SetStatusMessageInterval sets the minimum time between status message writes for one
+// user (see SetStatusMessage); 0 disables the limit. Call it before the client is used.
+func (c *Client) SetStatusMessageInterval(interval time.Duration) {
+	c.status = newStatusThrottle(interval, c.writeStatusMessage, c.log)
+}
+
+// CheckToken acquires a token for the Graph scope and records whether it succeeded. With
+// AuthDeviceCode and no signed-in account it blocks until the device code sign-in completes.
+func (c *Client) CheckToken(ctx context.Context) error {
+	err := c.acquireToken(ctx)
+	c.tokenOK.Store(err == nil)
+	return err
+}
+
+// IsAuthError reports whether err is a rejected credential (Entra ID answered the token
+// request with an error, e.g. a wrong or expired client secret) rather than a network problem.
+func IsAuthError(err error) bool {
+	var authErr *azidentity.AuthenticationFailedError
+	var callErr msalerrors.CallErr // device-code auth
+	return errors.As(err, &authErr) || errors.As(err, &callErr)
+}
+
+// WatchToken acquires a token every interval until ctx is cancelled, so failing credentials
+// (an expired or rotated secret, revoked consent) are reported even while no presence is
+// written. The first failure is logged as an error with a hint, repeats as warnings, and
+// recovery as info; TokenAcquired follows each check.
+func (c *Client) WatchToken(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.CheckToken(ctx)
+		switch {
+		case err == nil && failing:
+			failing = false
+			c.log.Info("Graph token acquisition recovered")
+		case err != nil && ctx.Err() != nil:
+			return
+		case err != nil && !failing:
+			failing = true
+			c.log.Error("Graph token acquisition is failing; presence updates will fail until it recovers",
+				"error", err,
+				"credentials_rejected", IsAuthError(err),
+				"hint", c.authHint())
+		case err != nil:
+			c.log.Warn("Graph token acquisition still failing", "error", err)
+		}
+	}
+}
+
+// TokenAcquired reports whether a Graph token was acquired by the last CheckToken or a
+// successful Graph call.
+func (c *Client) TokenAcquired() bool {
+	return c.tokenOK.Load()
+}
+
+// Close writes pending session state changes to the state file; call it on shutdown.
+func (c *Client) Close() error {
+	return c.state.Flush()
 }
 
 // resolveUserID returns the Graph user object ID (GUID) for the given UPN or email.
-// It caches results so each user is looked up only once.
+// It caches results in memory and in the session state file, so each user is looked up
+// only once, also across restarts; forgetUserID drops a stale entry. Concurrent calls for
+// a user not cached yet share one lookup (see sharedLookup). With AuthDeviceCode only the
+// signed-in account resolves (see signedInUserID).
 func (c *Client) resolveUserID(ctx context.Context, upn string) (string, error) {
+	if c.delegated() {
+		return c.signedInUserID(upn)
+	}
 	c.userIDCacheMu.RLock()
 	if id, ok := c.userIDCache[upn]; ok {
 		c.userIDCacheMu.RUnlock()
 		return id, nil
 	}
 	c.userIDCacheMu.RUnlock()
+	return c.sharedLookup(ctx, upn)
+}
+
+// userLookup is a Graph user lookup in flight; id and err are set before done is closed.
+type userLookup struct {
+	done chan struct{}
+	id   string
+	err  error
+}
 
-	user, err := c.graph.Users().ByUserId(upn).Get(ctx, nil)
+// sharedLookup looks upn up with lookupUserID unless a lookup for it is already in flight,
+// in which case it waits for that one's result (or for ctx to be done). A waiter whose
+// lookup failed only because the caller that sent it gave up tries again itself.
+func (c *Client) sharedLookup(ctx context.Context, upn string) (string, error) {
+	c.userIDCacheMu.Lock()
+	if id, ok := c.userIDCache[upn]; ok {
+		c.userIDCacheMu.Unlock()
+		return id, nil
+	}
+	if l, ok := c.userLookups[upn]; ok {
+		c.userIDCacheMu.Unlock()
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if ctx.Err() == nil && (errors.Is(l.err, context.Canceled) || errors.Is(l.err, context.DeadlineExceeded)) {
+			return c.sharedLookup(ctx, upn)
+		}
+		return l.id, l.err
+	}
+	l := &userLookup{done: make(chan struct{})}
+	if c.userLookups == nil {
+		c.userLookups = make(map[string]*userLookup)
+	}
+	c.userLookups[upn] = l
+	c.userIDCacheMu.Unlock()
+
+	l.id, l.err = c.lookupUserID(ctx, upn)
+	c.userIDCacheMu.Lock()
+	delete(c.userLookups, upn)
+	c.userIDCacheMu.Unlock()
+	close(l.done)
+	return l.id, l.err
+}
+
+// ResolveUser looks up the Graph user object ID of the given UPN or email, bypassing the
+// cache (and caching the result), so the credentials' permission to read users is checked;
+// the check subcommand uses it. With AuthDeviceCode only the signed-in account resolves.
+func (c *Client) ResolveUser(ctx context.Context, upn string) (string, error) {
+	if c.delegated() {
+		return c.signedInUserID(upn)
+	}
+	return c.lookupUserID(ctx, upn)
+}
+
+// lookupUserID gets the object ID of upn from Graph and caches it (see resolveUserID).
+func (c *Client) lookupUserID(ctx context.Context, upn string) (string, error) {
+	var user models.Userable
+	err := c.attempt(ctx, "get user", func(ctx context.Context) error {
+		var err error
+		user, err = c.graph.Users().ByUserId(upn).Get(ctx, nil)
+		return err
+	})
 	if err != nil {
-		return "", err
+		return "", classifyGraphError(err)
 	}
 	if user == nil {
-		return "", errors.New("user not found")
+		return "", fmt.Errorf("%w: %s", ErrUserNotFound, upn)
 	}
 	id := user.GetId()
 	if id == nil || *id == "" {
@@ -77,33 +315,154 @@ func (c *Client) resolveUserID(ctx context.Context, upn string) (string, error)
 	c.userIDCacheMu.Lock()
 	c.userIDCache[upn] = *id
 	c.userIDCacheMu.Unlock()
+	if err := c.state.SetUserID(upn, *id); err != nil {
+		c.log.Warn("persist user object ID failed", "upn", upn, "error", err)
+	}
 	c.log.Debug("resolved user to object ID", "upn", upn, "objectId", *id)
 	return *id, nil
 }
 
+// forgetUserID drops the cached object ID of upn after Graph reported the user as not found
+// (deleted, or renamed so the UPN now belongs to someone else), so the next call re-resolves it.
+func (c *Client) forgetUserID(upn string) {
+	if c.delegated() {
+		return
+	}
+	c.userIDCacheMu.Lock()
+	delete(c.userIDCache, upn)
+	c.userIDCacheMu.Unlock()
+	if err := c.state.DeleteUserID(upn); err != nil {
+		c.log.Warn("persist user object ID failed", "upn", upn, "error", err)
+	}
+	c.log.Info("forgot cached user object ID after user not found", "upn", upn)
+}
+
+// sessionID returns the persistent presence session ID for the extension. On first use a
+// UUID is generated and stored in the session state file so the same ID is reused across restarts.
+//
+// With AuthDeviceCode the session is the application's session of the signed-in user, and
+// Graph expects the application (client) ID as sessionId; every extension of that user
+// then shares one session.
+func (c *Client) sessionID(extension string) (string, error) {
+	if c.delegated() {
+		return c.clientID, nil
+	}
+	if id := c.state.GetSessionID(extension); id != "" {
+		return id, nil
+	}
+	id := uuid.NewString()
+	if err := c.state.SetSessionID(extension, id); err != nil {
+		return "", err
+	}
+	c.log.Debug("created presence session", "extension", extension, "sessionId", id)
+	return id, nil
+}
+
 // SetPresence sets the user's Teams presence. userID is the user's email (userPrincipalName).
 // The UPN is resolved to the Graph object ID (GUID) via GET /users/{upn}; the GUID is used for the presence call.
 // availability and activity are Graph values (e.g. "Available", "Busy", "InACall").
-// For app-only auth, sessionId must be the application (client) ID.
-func (c *Client) SetPresence(ctx context.Context, userID, extension, availability, activity string) error {
+// sessionId is a stable per-extension UUID persisted in the session state file (the client
+// ID with AuthDeviceCode, which can only set the signed-in account's presence).
+// expiration is how long Graph keeps the presence without a refresh (0 = DefaultExpiration).
+// The call is skipped when the same availability/activity was last written successfully for
+// the extension; use ForceSetPresence or ResetPresenceCache to resync.
+func (c *Client) SetPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	c.lastWrittenMu.Lock()
+	last, ok := c.lastWritten[extension]
+	c.lastWrittenMu.Unlock()
+	if ok && last == [2]string{availability, activity} {
+		c.log.Debug("presence unchanged, skipping setPresence", "user", userID, "extension", extension, "availability", availability, "activity", activity)
+		return nil
+	}
+	return c.ForceSetPresence(ctx, userID, extension, availability, activity, expiration)
+}
+
+// ForceSetPresence is SetPresence without the unchanged-state check (e.g. for a resync after
+// reconnect). The written values become the new last-written state for the extension.
+// While the user's circuit breaker is open the write is skipped with ErrCircuitOpen.
+func (c *Client) ForceSetPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	if err := c.breaker.allow(userID); err != nil {
+		c.lastWrittenMu.Lock()
+		delete(c.lastWritten, extension)
+		c.lastWrittenMu.Unlock()
+		return err
+	}
+	start := time.Now()
+	err := c.setPresence(ctx, userID, extension, availability, activity, expiration)
+	metrics.PresenceWrite(extension, err, time.Since(start))
+	c.breaker.record(userID, err)
+
+	c.lastWrittenMu.Lock()
+	if err == nil {
+		c.lastWritten[extension] = [2]string{availability, activity}
+	} else {
+		delete(c.lastWritten, extension)
+	}
+	c.lastWrittenMu.Unlock()
+	return err
+}
+
+// ResetPresenceCache forgets the last-written presence and status message of every
+// extension so the next SetPresence / UpdateStatusMessage for each is sent to Graph.
+func (c *Client) ResetPresenceCache() {
+	c.lastWrittenMu.Lock()
+	clear(c.lastWritten)
+	clear(c.lastStatus)
+	c.lastWrittenMu.Unlock()
+}
+
+// ClearPresence clears the presence session of extension for the user (Graph clearPresence
+// with the extension's sessionId), so Teams falls back to the user's other sessions.
+func (c *Client) ClearPresence(ctx context.Context, userID, extension string) error {
+	c.lastWrittenMu.Lock()
+	delete(c.lastWritten, extension)
+	c.lastWrittenMu.Unlock()
+
 	objectID, err := c.resolveUserID(ctx, userID)
 	if err != nil {
 		c.log.Error("resolve user ID failed", "user", userID, "extension", extension, "error", err)
 		return err
 	}
+	sessionID, err := c.sessionID(extension)
+	if err != nil {
+		c.log.Error("session ID failed", "extension", extension, "error", err)
+		return err
+	}
+	body := users.NewItemPresenceClearPresencePostRequestBody()
+	body.SetSessionId(&sessionID)
+	err = c.doWithRetry(ctx, "clearPresence", func(ctx context.Context) error {
+		return c.graph.Users().ByUserId(objectID).Presence().ClearPresence().Post(ctx, body, nil)
+	})
+	if err != nil {
+		c.log.Error("clearPresence failed", "user", userID, "extension", extension, "error", err, "error_chain", errorChain(err))
+		return err
+	}
+	c.log.Debug("clearPresence ok", "user", userID, "extension", extension)
+	return nil
+}
 
-	body := users.NewItemPresenceSetPresencePostRequestBody()
-	body.SetSessionId(&c.clientID)
-	body.SetAvailability(&availability)
-	body.SetActivity(&activity)
-	dur, err := parseISODuration(expiration)
+func (c *Client) setPresence(ctx context.Context, userID, extension, availability, activity string, expiration time.Duration) error {
+	objectID, err := c.resolveUserID(ctx, userID)
 	if err != nil {
+		c.log.Error("resolve user ID failed", "user", userID, "extension", extension, "error", err)
 		return err
 	}
-	body.SetExpirationDuration(dur)
+	sessionID, err := c.sessionID(extension)
+	if err != nil {
+		c.log.Error("session ID failed", "extension", extension, "error", err)
+		return err
+	}
+
+	body := users.NewItemPresenceSetPresencePostRequestBody()
+	body.SetSessionId(&sessionID)
+	body.SetAvailability(&availability)
+	body.SetActivity(&activity)
+	body.SetExpirationDuration(isoExpiration(expiration))
 
 	reqConfig := &users.ItemPresenceSetPresenceRequestBuilderPostRequestConfiguration{}
-	err = c.graph.Users().ByUserId(objectID).Presence().SetPresence().Post(ctx, body, reqConfig)
+	err = c.doWithRetry(ctx, "setPresence", func(ctx context.Context) error {
+		return c.graph.Users().ByUserId(objectID).Presence().SetPresence().Post(ctx, body, reqConfig)
+	})
 	if err != nil {
 		c.log.Error("setPresence failed",
 			"user", userID,
@@ -112,8 +471,15 @@ func (c *Client) SetPresence(ctx context.Context, userID, extension, availabilit
 			"activity", activity,
 			"error", err,
 			"error_chain", errorChain(err))
+		if IsAuthError(err) {
+			c.tokenOK.Store(false)
+		}
+		if errors.Is(err, ErrUserNotFound) {
+			c.forgetUserID(userID)
+		}
 		return err
 	}
+	c.tokenOK.Store(true)
 	c.log.Debug("setPresence ok", "user", userID, "extension", extension, "availability", availability)
 	return nil
 }
@@ -131,12 +497,101 @@ func errorChain(err error) string {
 	return s
 }
 
-func parseISODuration(s string) (*serialization.ISODuration, error) {
-	return serialization.ParseISODuration(s)
+// isoExpiration converts a presence expiration to the Graph duration, using
+// DefaultExpiration for zero.
+func isoExpiration(d time.Duration) *serialization.ISODuration {
+	if d <= 0 {
+		d = DefaultExpiration
+	}
+	return serialization.FromDuration(d)
+}
+
+// ErrNoPresence is returned by GetPresence when Graph has no presence information for the user.
+var ErrNoPresence = errors.New("user has no presence information")
+
+// GetPresence returns the user's current Teams availability and activity. userID is the user's
+// email (userPrincipalName), resolved to the object ID like SetPresence. Returns ErrNoPresence
+// (possibly wrapped) when the user has no presence yet.
+func (c *Client) GetPresence(ctx context.Context, userID string) (availability, activity string, err error) {
+	objectID, err := c.resolveUserID(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	var presence models.Presenceable
+	err = c.attempt(ctx, "getPresence", func(ctx context.Context) error {
+		var err error
+		presence, err = c.graph.Users().ByUserId(objectID).Presence().Get(ctx, nil)
+		return err
+	})
+	if err != nil {
+		var apiErr abstractions.ApiErrorable
+		if errors.As(err, &apiErr) && apiErr.GetStatusCode() == http.StatusNotFound {
+			return "", "", fmt.Errorf("%w: %v", ErrNoPresence, err)
+		}
+		c.log.Error("getPresence failed", "user", userID, "error", err)
+		return "", "", classifyGraphError(err)
+	}
+	if presence == nil || presence.GetAvailability() == nil {
+		return "", "", ErrNoPresence
+	}
+	availability = *presence.GetAvailability()
+	if a := presence.GetActivity(); a != nil {
+		activity = *a
+	}
+	return availability, activity, nil
+}
+
+// SetStatusMessage sets the user's status message for extension unless the same message
+// was last written for it. userID is the user's email (userPrincipalName), resolved to the
+// object ID as for SetPresence. An empty message clears the status message. A non-empty
+// message with ttl > 0 gets an expiryDateTime ttl from now, so Teams clears it even if the
+// matching idle NOTIFY is lost. Writes for one user are at least the status message
+// interval apart (see SetStatusMessageInterval): a message arriving sooner is held and
+// written when the interval ends, replaced by any newer one meanwhile, and nil is returned.
+func (c *Client) SetStatusMessage(ctx context.Context, userID, extension, message string, ttl time.Duration) error {
+	c.lastWrittenMu.Lock()
+	last, ok := c.lastStatus[extension]
+	c.lastWrittenMu.Unlock()
+	if ok && last == message {
+		c.status.cancel(userID) // a held change was undone before it was written
+		return nil
+	}
+	return c.status.submit(ctx, statusWrite{userID: userID, extension: extension, message: message, ttl: ttl})
 }
 
-// SetStatusMessage sets the user's presence status message (optional).
-func (c *Client) SetStatusMessage(ctx context.Context, userID, message string) error {
+// writeStatusMessage sends one status message write and records it as the last one.
+func (c *Client) writeStatusMessage(ctx context.Context, w statusWrite) error {
+	err := c.breaker.allow(w.userID)
+	if err == nil {
+		err = c.setStatusMessage(ctx, w.userID, w.message, w.ttl)
+		c.breaker.record(w.userID, err)
+	}
+	c.lastWrittenMu.Lock()
+	if err == nil {
+		c.lastStatus[w.extension] = w.message
+	} else {
+		delete(c.lastStatus, w.extension)
+	}
+	c.lastWrittenMu.Unlock()
+	return err
+}
+
+// expiryDateTime converts t to the Graph dateTimeTimeZone form (ISO 8601 local time in UTC).
+func expiryDateTime(t time.Time) models.DateTimeTimeZoneable {
+	dt := models.NewDateTimeTimeZone()
+	value := t.UTC().Format("2006-01-02T15:04:05.0000000")
+	zone := "UTC"
+	dt.SetDateTime(&value)
+	dt.SetTimeZone(&zone)
+	return dt
+}
+
+func (c *Client) setStatusMessage(ctx context.Context, userID, message string, ttl time.Duration) error {
+	objectID, err := c.resolveUserID(ctx, userID)
+	if err != nil {
+		c.log.Error("resolve user ID failed", "user", userID, "error", err)
+		return err
+	}
 	msg := models.NewPresenceStatusMessage()
 	itemBody := models.NewItemBody()
 	content := message
@@ -144,11 +599,16 @@ func (c *Client) SetStatusMessage(ctx context.Context, userID, message string) e
 	itemBody.SetContent(&content)
 	itemBody.SetContentType(&contentType)
 	msg.SetMessage(itemBody)
+	if message != "" && ttl > 0 {
+		msg.SetExpiryDateTime(expiryDateTime(time.Now().Add(ttl)))
+	}
 	body := users.NewItemPresenceSetStatusMessagePostRequestBody()
 	body.SetStatusMessage(msg)
 
 	reqConfig := &users.ItemPresenceSetStatusMessageRequestBuilderPostRequestConfiguration{}
-	err := c.graph.Users().ByUserId(userID).Presence().SetStatusMessage().Post(ctx, body, reqConfig)
+	err = c.doWithRetry(ctx, "setStatusMessage", func(ctx context.Context) error {
+		return c.graph.Users().ByUserId(objectID).Presence().SetStatusMessage().Post(ctx, body, reqConfig)
+	})
 	if err != nil {
 		c.log.Error("setStatusMessage failed", "user", userID, "error", err)
 		return err
@@ -0,0 +1,117 @@
+package graph
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microsoft/kiota-abstractions-go/authentication"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+)
+
+// newFakeGraphClient returns a client sending its Graph requests, unauthenticated, to handler.
+func newFakeGraphClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	adapter, err := msgraphsdk.NewGraphRequestAdapter(&authentication.AnonymousAuthenticationProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.SetBaseUrl(srv.URL)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	state, err := LoadSessionState(filepath.Join(t.TempDir(), "state.json"), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{
+		graph:       msgraphsdk.NewGraphServiceClient(adapter),
+		state:       state,
+		log:         log,
+		userIDCache: make(map[string]string),
+		timeout:     DefaultTimeout,
+	}
+}
+
+func TestResolveUserID_Concurrent(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	c := newFakeGraphClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id": "00000000-0000-0000-0000-000000000001"}`)
+	}))
+
+	const callers = 10
+	var wg sync.WaitGroup
+	ids := make([]string, callers)
+	errs := make([]error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i], errs[i] = c.resolveUserID(context.Background(), "alice@example.com")
+		}()
+	}
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // let the other callers join the lookup
+	close(release)
+	wg.Wait()
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Graph requests = %d, want 1", n)
+	}
+	for i := range callers {
+		if errs[i] != nil || ids[i] != "00000000-0000-0000-0000-000000000001" {
+			t.Errorf("caller %d: %q, %v", i, ids[i], errs[i])
+		}
+	}
+	if len(c.userLookups) != 0 {
+		t.Errorf("lookups in flight after the calls: %v", c.userLookups)
+	}
+}
+
+func TestResolveUserID_LeaderCancelled(t *testing.T) {
+	var requests atomic.Int32
+	c := newFakeGraphClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-r.Context().Done() // the first caller gives up
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id": "00000000-0000-0000-0000-000000000002"}`)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := c.resolveUserID(ctx, "bob@example.com")
+		leader <- err
+	}()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan string, 1)
+	go func() {
+		id, _ := c.resolveUserID(context.Background(), "bob@example.com")
+		waiter <- id
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-leader; err == nil {
+		t.Error("cancelled caller: want an error")
+	}
+	if id := <-waiter; id != "00000000-0000-0000-0000-000000000002" {
+		t.Errorf("waiter = %q, want the ID from its own lookup", id)
+	}
+}
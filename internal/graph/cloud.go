@@ -0,0 +1,79 @@
+package graph
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+// Clouds for Auth.Cloud. GCC (moderate) tenants use the commercial endpoints.
+const (
+	CloudCommercial = "commercial"
+	CloudGCCHigh    = "gcchigh"
+	CloudDoD        = "dod"
+	CloudChina      = "china" // operated by 21Vianet
+)
+
+// cloudPresets holds the Entra ID authority and Graph service root of each cloud. The
+// commercial authority is left unset, so azidentity keeps honouring AZURE_AUTHORITY_HOST.
+var cloudPresets = map[string]struct {
+	authority cloud.Configuration
+	baseURL   string
+}{
+	CloudCommercial: {baseURL: "https://graph.microsoft.com/v1.0"},
+	CloudGCCHigh:    {authority: cloud.AzureGovernment, baseURL: "https://graph.microsoft.us/v1.0"},
+	CloudDoD:        {authority: cloud.AzureGovernment, baseURL: "https://dod-graph.microsoft.us/v1.0"},
+	CloudChina:      {authority: cloud.AzureChina, baseURL: "https://microsoftgraph.chinacloudapi.cn/v1.0"},
+}
+
+// ParseCloud checks a GRAPH_CLOUD value; "" means CloudCommercial.
+func ParseCloud(s string) (string, error) {
+	switch c := strings.ToLower(strings.TrimSpace(s)); c {
+	case "", CloudCommercial:
+		return CloudCommercial, nil
+	case CloudGCCHigh, CloudDoD, CloudChina:
+		return c, nil
+	}
+	return "", fmt.Errorf("graph cloud %q: want %q, %q, %q or %q", s, CloudCommercial, CloudGCCHigh, CloudDoD, CloudChina)
+}
+
+// endpoints is where the client signs in and sends its Graph requests.
+type endpoints struct {
+	authority cloud.Configuration
+	baseURL   string // Graph service root, e.g. "https://graph.microsoft.us/v1.0"
+	host      string // host of baseURL; the only one the SDK sends tokens to
+	scope     string // app-only scope, e.g. "https://graph.microsoft.us/.default"
+}
+
+// endpointsFor returns the endpoints of auth.Cloud with auth.BaseURL and auth.Scope
+// overriding the service root and scope. The scope defaults to the .default scope of the
+// service root's origin.
+func endpointsFor(auth Auth) (endpoints, error) {
+	name, err := ParseCloud(auth.Cloud)
+	if err != nil {
+		return endpoints{}, err
+	}
+	preset := cloudPresets[name]
+	e := endpoints{authority: preset.authority, baseURL: preset.baseURL}
+	if base := strings.TrimSpace(auth.BaseURL); base != "" {
+		e.baseURL = strings.TrimRight(base, "/")
+	}
+	u, err := url.Parse(e.baseURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return endpoints{}, fmt.Errorf("graph base URL %q: want an https URL such as https://graph.microsoft.us/v1.0", auth.BaseURL)
+	}
+	e.host = u.Hostname()
+	e.scope = strings.TrimSpace(auth.Scope)
+	if e.scope == "" {
+		e.scope = "https://" + u.Host + "/.default"
+	}
+	return e, nil
+}
+
+// delegatedScope returns the scope requested with AuthDeviceCode: Presence.ReadWrite of the
+// app-only scope's resource. The refresh token (offline_access) is added by the library.
+func (e endpoints) delegatedScope() string {
+	return strings.TrimSuffix(e.scope, "/.default") + "/Presence.ReadWrite"
+}
@@ -0,0 +1,63 @@
+package graph
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+func TestEndpointsFor(t *testing.T) {
+	tests := []struct {
+		auth          Auth
+		baseURL, host string
+		scope         string
+		authority     string
+	}{
+		{Auth{}, "https://graph.microsoft.com/v1.0", "graph.microsoft.com", "https://graph.microsoft.com/.default", ""},
+		{Auth{Cloud: "GCCHigh"}, "https://graph.microsoft.us/v1.0", "graph.microsoft.us", "https://graph.microsoft.us/.default", cloud.AzureGovernment.ActiveDirectoryAuthorityHost},
+		{Auth{Cloud: "dod"}, "https://dod-graph.microsoft.us/v1.0", "dod-graph.microsoft.us", "https://dod-graph.microsoft.us/.default", cloud.AzureGovernment.ActiveDirectoryAuthorityHost},
+		{Auth{Cloud: "china"}, "https://microsoftgraph.chinacloudapi.cn/v1.0", "microsoftgraph.chinacloudapi.cn", "https://microsoftgraph.chinacloudapi.cn/.default", cloud.AzureChina.ActiveDirectoryAuthorityHost},
+		{Auth{BaseURL: "https://graph.example.net:8443/beta/"}, "https://graph.example.net:8443/beta", "graph.example.net", "https://graph.example.net:8443/.default", ""},
+		{Auth{Cloud: "gcchigh", BaseURL: "https://graph.example.us/v1.0", Scope: "https://graph.microsoft.us/.default"}, "https://graph.example.us/v1.0", "graph.example.us", "https://graph.microsoft.us/.default", cloud.AzureGovernment.ActiveDirectoryAuthorityHost},
+	}
+	for _, tt := range tests {
+		e, err := endpointsFor(tt.auth)
+		if err != nil {
+			t.Errorf("endpointsFor(%+v): %v", tt.auth, err)
+			continue
+		}
+		if e.baseURL != tt.baseURL || e.host != tt.host || e.scope != tt.scope || e.authority.ActiveDirectoryAuthorityHost != tt.authority {
+			t.Errorf("endpointsFor(%+v) = %s %s %s %q, want %s %s %s %q", tt.auth, e.baseURL, e.host, e.scope, e.authority.ActiveDirectoryAuthorityHost, tt.baseURL, tt.host, tt.scope, tt.authority)
+		}
+	}
+	if e, _ := endpointsFor(Auth{Cloud: "gcchigh"}); e.delegatedScope() != "https://graph.microsoft.us/Presence.ReadWrite" {
+		t.Errorf("delegatedScope = %s", e.delegatedScope())
+	}
+	for _, bad := range []Auth{{Cloud: "azure"}, {BaseURL: "http://graph.microsoft.us/v1.0"}, {BaseURL: "graph.microsoft.us"}} {
+		if _, err := endpointsFor(bad); err == nil {
+			t.Errorf("endpointsFor(%+v): want error", bad)
+		}
+	}
+}
+
+func TestNewClient_Cloud(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c, err := NewClient(Auth{
+		TenantID:     "contoso.onmicrosoft.us",
+		ClientID:     "11111111-1111-1111-1111-111111111111",
+		ClientSecret: "secret",
+		Cloud:        CloudDoD,
+	}, filepath.Join(t.TempDir(), "state.json"), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.graph.GetAdapter().GetBaseUrl(); got != "https://dod-graph.microsoft.us/v1.0" {
+		t.Errorf("base URL = %s, want the DoD service root", got)
+	}
+	if len(c.scopes) != 1 || c.scopes[0] != "https://dod-graph.microsoft.us/.default" {
+		t.Errorf("scopes = %v, want the DoD .default scope", c.scopes)
+	}
+}
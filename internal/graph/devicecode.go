@@ -0,0 +1,169 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
+)
+
+// organizationsTenant is the tenant device-code auth signs in to without AZURE_TENANT_ID:
+// any work or school account.
+const organizationsTenant = "organizations"
+
+// deviceCodeCredential is the credential of AuthDeviceCode: the device code flow of an
+// MSAL public client whose token cache, refresh token included, is kept in the state file.
+// azidentity's DeviceCodeCredential can only persist it in the OS keyring, which containers
+// lack, so every restart there asked for a new sign-in.
+type deviceCodeCredential struct {
+	client public.Client
+	state  *SessionState
+	log    *slog.Logger
+}
+
+// newDeviceCodeCredential creates the device-code credential for auth, signing in at the
+// authority of the given cloud. state supplies the account signed in on an earlier run and
+// stores the token cache, so tokens are requested silently for that account.
+func newDeviceCodeCredential(auth Auth, authority cloud.Configuration, state *SessionState, log *slog.Logger) (*deviceCodeCredential, error) {
+	host := authority.ActiveDirectoryAuthorityHost
+	if host == "" {
+		host = cloud.AzurePublic.ActiveDirectoryAuthorityHost
+	}
+	tenant := auth.TenantID
+	if tenant == "" {
+		tenant = organizationsTenant
+	}
+	client, err := public.New(auth.ClientID,
+		public.WithAuthority(strings.TrimRight(host, "/")+"/"+tenant),
+		public.WithCache(stateTokenCache{state}))
+	if err != nil {
+		return nil, err
+	}
+	return &deviceCodeCredential{client: client, state: state, log: log}, nil
+}
+
+// Authenticate runs the device code sign-in for scopes, logging the code and URL and then
+// waiting for the user, and returns the signed-in account.
+func (c *deviceCodeCredential) Authenticate(ctx context.Context, scopes []string) (azidentity.AuthenticationRecord, error) {
+	_, rec, err := c.signIn(ctx, scopes, "")
+	return rec, err
+}
+
+// GetToken returns a token for the signed-in account from the token cache, redeeming the
+// refresh token when the cached one expired. When that fails (no cached tokens, e.g. after
+// an upgrade, or a revoked refresh token) it runs the device code sign-in again, as
+// azidentity does, and stores the account.
+func (c *deviceCodeCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	res, err := c.silent(ctx, opts)
+	if err != nil {
+		c.log.Warn("no Graph token for the signed-in account; signing in again", "error", err)
+		var rec azidentity.AuthenticationRecord
+		if res, rec, err = c.signIn(ctx, opts.Scopes, opts.Claims); err != nil {
+			return azcore.AccessToken{}, err
+		}
+		if err := c.state.SetAuthRecord(rec); err != nil {
+			return azcore.AccessToken{}, fmt.Errorf("save signed-in account: %w", err)
+		}
+		c.log.Info("signed in to Graph", "account", rec.Username)
+	}
+	return azcore.AccessToken{Token: res.AccessToken, ExpiresOn: res.ExpiresOn}, nil
+}
+
+// silent requests a token for the signed-in account without user interaction.
+func (c *deviceCodeCredential) silent(ctx context.Context, opts policy.TokenRequestOptions) (public.AuthResult, error) {
+	rec := c.state.AuthRecord()
+	if rec == nil {
+		return public.AuthResult{}, errors.New("not signed in to Graph")
+	}
+	accounts, err := c.client.Accounts(ctx)
+	if err != nil {
+		return public.AuthResult{}, err
+	}
+	for _, account := range accounts {
+		if account.HomeAccountID != rec.HomeAccountID {
+			continue
+		}
+		silentOpts := []public.AcquireSilentOption{public.WithSilentAccount(account)}
+		if opts.Claims != "" {
+			silentOpts = append(silentOpts, public.WithClaims(opts.Claims))
+		}
+		return c.client.AcquireTokenSilent(ctx, opts.Scopes, silentOpts...)
+	}
+	return public.AuthResult{}, fmt.Errorf("no cached tokens for %s", rec.Username)
+}
+
+// signIn runs the device code flow and returns its token and the signed-in account.
+func (c *deviceCodeCredential) signIn(ctx context.Context, scopes []string, claims string) (public.AuthResult, azidentity.AuthenticationRecord, error) {
+	var opts []public.AcquireByDeviceCodeOption
+	if claims != "" {
+		opts = append(opts, public.WithClaims(claims))
+	}
+	dc, err := c.client.AcquireTokenByDeviceCode(ctx, scopes, opts...)
+	if err != nil {
+		return public.AuthResult{}, azidentity.AuthenticationRecord{}, err
+	}
+	c.log.Warn("Graph sign-in required: "+dc.Result.Message, "url", dc.Result.VerificationURL, "code", dc.Result.UserCode)
+	res, err := dc.AuthenticationResult(ctx)
+	if err != nil {
+		return public.AuthResult{}, azidentity.AuthenticationRecord{}, err
+	}
+	rec, err := authenticationRecord(res)
+	return res, rec, err
+}
+
+// authenticationRecord returns the account of a sign-in as azidentity records it, so state
+// files written before the token cache moved there still name the account.
+func authenticationRecord(res public.AuthResult) (azidentity.AuthenticationRecord, error) {
+	issuer, err := url.Parse(res.IDToken.Issuer)
+	if err != nil || issuer.Host == "" {
+		return azidentity.AuthenticationRecord{}, fmt.Errorf("sign-in returned an ID token with issuer %q", res.IDToken.Issuer)
+	}
+	tenant := res.IDToken.TenantID
+	if tenant == "" {
+		tenant = strings.Trim(issuer.Path, "/")
+	}
+	username := res.IDToken.PreferredUsername
+	if username == "" {
+		username = res.IDToken.UPN
+	}
+	return azidentity.AuthenticationRecord{
+		Authority:     issuer.Scheme + "://" + issuer.Host,
+		ClientID:      res.IDToken.Audience,
+		HomeAccountID: res.Account.HomeAccountID,
+		TenantID:      tenant,
+		Username:      username,
+		Version:       "1.0",
+	}, nil
+}
+
+// stateTokenCache keeps the MSAL token cache in the state file (see SessionState.TokenCache).
+type stateTokenCache struct {
+	state *SessionState
+}
+
+// Replace loads the cache from the state.
+func (t stateTokenCache) Replace(_ context.Context, c cache.Unmarshaler, _ cache.ReplaceHints) error {
+	data := t.state.TokenCache()
+	if len(data) == 0 {
+		return nil
+	}
+	return c.Unmarshal(data)
+}
+
+// Export stores the cache in the state.
+func (t stateTokenCache) Export(_ context.Context, c cache.Marshaler, _ cache.ExportHints) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.state.SetTokenCache(data)
+}
@@ -0,0 +1,171 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// DirectoryBusinessPhones selects the extension from the users' business phones (see
+// PhoneExtension); the other directory attributes are "extensionAttribute1" to
+// "extensionAttribute15" (onPremisesExtensionAttributes), holding the bare extension.
+const DirectoryBusinessPhones = "businessPhones"
+
+// directoryPageSize is the $top of each users page.
+const directoryPageSize = 999
+
+// extensionAttributes are the getters of onPremisesExtensionAttributes 1 to 15.
+var extensionAttributes = []func(models.OnPremisesExtensionAttributesable) *string{
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute1,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute2,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute3,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute4,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute5,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute6,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute7,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute8,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute9,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute10,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute11,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute12,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute13,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute14,
+	models.OnPremisesExtensionAttributesable.GetExtensionAttribute15,
+}
+
+// ParseDirectoryAttribute checks a directory attribute name (case-insensitive) and returns
+// its canonical spelling: DirectoryBusinessPhones or "extensionAttribute1" to "extensionAttribute15".
+func ParseDirectoryAttribute(s string) (string, error) {
+	name := strings.TrimSpace(s)
+	if strings.EqualFold(name, DirectoryBusinessPhones) {
+		return DirectoryBusinessPhones, nil
+	}
+	if len(name) > len("extensionAttribute") && strings.EqualFold(name[:len("extensionAttribute")], "extensionAttribute") {
+		if n, err := strconv.Atoi(name[len("extensionAttribute"):]); err == nil && n >= 1 && n <= len(extensionAttributes) {
+			return "extensionAttribute" + strconv.Itoa(n), nil
+		}
+	}
+	return "", fmt.Errorf("directory attribute %q: want %s or extensionAttribute1-15", s, DirectoryBusinessPhones)
+}
+
+// DirectoryExtensions lists the enabled users in the directory and returns extension ->
+// userPrincipalName for those whose attribute (see ParseDirectoryAttribute) holds an
+// extension. When several users carry the same extension the first UPN in sorted order
+// wins and the others are reported in dups. Needs the User.Read.All application permission;
+// not available with AuthDeviceCode.
+func (c *Client) DirectoryExtensions(ctx context.Context, attribute string) (byExt map[string]string, dups []string, err error) {
+	if c.delegated() {
+		return nil, nil, errors.New("directory lookup needs app-only auth")
+	}
+	attribute, err = ParseDirectoryAttribute(attribute)
+	if err != nil {
+		return nil, nil, err
+	}
+	sel := []string{"userPrincipalName", "businessPhones"}
+	if attribute != DirectoryBusinessPhones {
+		sel = []string{"userPrincipalName", "onPremisesExtensionAttributes"}
+	}
+	filter := "accountEnabled eq true"
+	top := int32(directoryPageSize)
+	cfg := &users.UsersRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.UsersRequestBuilderGetQueryParameters{Select: sel, Filter: &filter, Top: &top},
+	}
+	var page models.UserCollectionResponseable
+	err = c.doWithRetry(ctx, "list users", func(ctx context.Context) error {
+		var err error
+		page, err = c.graph.Users().Get(ctx, cfg)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	iter, err := msgraphcore.NewPageIterator[models.Userable](page, c.graph.GetAdapter(), models.CreateUserCollectionResponseFromDiscriminatorValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	upnsByExt := make(map[string][]string)
+	err = iter.Iterate(ctx, func(u models.Userable) bool {
+		upn := u.GetUserPrincipalName()
+		if upn == nil || *upn == "" {
+			return true
+		}
+		for _, ext := range userExtensions(u, attribute) {
+			upnsByExt[ext] = append(upnsByExt[ext], *upn)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	byExt = make(map[string]string, len(upnsByExt))
+	for ext, upns := range upnsByExt {
+		slices.Sort(upns)
+		upns = slices.Compact(upns)
+		byExt[ext] = upns[0]
+		if len(upns) > 1 {
+			dups = append(dups, fmt.Sprintf("extension %s: %s (ignored: %s)", ext, upns[0], strings.Join(upns[1:], ", ")))
+		}
+	}
+	slices.Sort(dups)
+	c.log.Debug("directory lookup", "attribute", attribute, "extensions", len(byExt))
+	return byExt, dups, nil
+}
+
+// userExtensions returns the extensions the attribute assigns to u.
+func userExtensions(u models.Userable, attribute string) []string {
+	if attribute == DirectoryBusinessPhones {
+		var exts []string
+		for _, phone := range u.GetBusinessPhones() {
+			if ext := PhoneExtension(phone); ext != "" {
+				exts = append(exts, ext)
+			}
+		}
+		return exts
+	}
+	attrs := u.GetOnPremisesExtensionAttributes()
+	if attrs == nil {
+		return nil
+	}
+	n, _ := strconv.Atoi(strings.TrimPrefix(attribute, "extensionAttribute"))
+	if v := extensionAttributes[n-1](attrs); v != nil && strings.TrimSpace(*v) != "" {
+		return []string{strings.TrimSpace(*v)}
+	}
+	return nil
+}
+
+// PhoneExtension returns the extension in a business phone number: the digits after an
+// "x", "ext" or "ext." marker ("+1 555 0100 x101", "555-0100 ext. 101"), or the whole
+// number when it is a short internal one of up to 6 digits ("101"). Other numbers have
+// no extension and return "".
+func PhoneExtension(phone string) string {
+	lower := strings.ToLower(strings.TrimSpace(phone))
+	for _, marker := range []string{"ext.", "ext", "x"} {
+		if i := strings.LastIndex(lower, marker); i >= 0 {
+			if ext := strings.TrimSpace(lower[i+len(marker):]); ext != "" && allDigits(ext) {
+				return ext
+			}
+		}
+	}
+	if lower != "" && len(lower) <= 6 && allDigits(lower) {
+		return lower
+	}
+	return ""
+}
+
+// allDigits reports whether s consists of ASCII digits only.
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII || !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
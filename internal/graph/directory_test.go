@@ -0,0 +1,42 @@
+package graph
+
+import "testing"
+
+func TestPhoneExtension(t *testing.T) {
+	tests := []struct {
+		phone, want string
+	}{
+		{"+1 555 0100 x101", "101"},
+		{"555-0100 ext. 2040", "2040"},
+		{"555-0100 Ext 7", "7"},
+		{"101", "101"},
+		{" 4321 ", "4321"},
+		{"+1 555 0100", ""},
+		{"5550100", ""},
+		{"+44 20 7946 0958 extension", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := PhoneExtension(tt.phone); got != tt.want {
+			t.Errorf("PhoneExtension(%q) = %q, want %q", tt.phone, got, tt.want)
+		}
+	}
+}
+
+func TestParseDirectoryAttribute(t *testing.T) {
+	for in, want := range map[string]string{
+		"businessPhones":       DirectoryBusinessPhones,
+		"BUSINESSPHONES":       DirectoryBusinessPhones,
+		"extensionAttribute1":  "extensionAttribute1",
+		"ExtensionAttribute15": "extensionAttribute15",
+	} {
+		if got, err := ParseDirectoryAttribute(in); err != nil || got != want {
+			t.Errorf("ParseDirectoryAttribute(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "mobilePhone", "extensionAttribute0", "extensionAttribute16", "extensionAttribute"} {
+		if _, err := ParseDirectoryAttribute(in); err == nil {
+			t.Errorf("ParseDirectoryAttribute(%q) succeeded, want error", in)
+		}
+	}
+}
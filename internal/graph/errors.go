@@ -0,0 +1,78 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// Kinds of Graph API errors. The errors of the client's Graph requests wrap one of them
+// when the response matched (see classifyGraphError), together with the SDK error, so
+// callers can use errors.Is instead of matching status codes or messages.
+var (
+	// ErrUserNotFound: Graph answered 404, e.g. for a deleted or renamed user.
+	ErrUserNotFound = errors.New("graph user not found")
+	// ErrThrottled: Graph answered 429, 503 or 509 and retrying did not help.
+	ErrThrottled = errors.New("graph request throttled")
+	// ErrForbidden: Graph answered 403; the app lacks a permission or admin consent.
+	ErrForbidden = errors.New("graph request forbidden")
+)
+
+// graphError is a Graph API error classified by classifyGraphError. It matches its kind
+// with errors.Is and the SDK error with errors.As.
+type graphError struct {
+	kind   error
+	status int
+	code   string // OData error code, e.g. "Request_ResourceNotFound"; may be empty
+	err    error
+}
+
+func (e *graphError) Error() string {
+	if e.code != "" {
+		return fmt.Sprintf("%v (%d %s): %v", e.kind, e.status, e.code, e.err)
+	}
+	return fmt.Sprintf("%v (%d): %v", e.kind, e.status, e.err)
+}
+
+func (e *graphError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// classifyGraphError wraps err in ErrUserNotFound, ErrThrottled or ErrForbidden when it is
+// a Graph API error with the matching HTTP status; other errors (nil, network, token,
+// timeout, unmatched statuses) and errors already classified are returned unchanged.
+func classifyGraphError(err error) error {
+	var apiErr abstractions.ApiErrorable
+	var classified *graphError
+	if err == nil || errors.As(err, &classified) || !errors.As(err, &apiErr) {
+		return err
+	}
+	var code string
+	var odataErr *odataerrors.ODataError
+	if errors.As(err, &odataErr) {
+		if main := odataErr.GetErrorEscaped(); main != nil && main.GetCode() != nil {
+			code = *main.GetCode()
+		}
+	}
+	return classifyStatus(apiErr.GetStatusCode(), code, err)
+}
+
+// classifyStatus wraps err, the error of a Graph response with the given HTTP status and
+// OData code, in the matching kind (see classifyGraphError).
+func classifyStatus(status int, code string, err error) error {
+	var kind error
+	switch status {
+	case http.StatusNotFound:
+		kind = ErrUserNotFound
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, 509:
+		kind = ErrThrottled
+	case http.StatusForbidden:
+		kind = ErrForbidden
+	default:
+		return err
+	}
+	return &graphError{kind: kind, status: status, code: code, err: err}
+}
@@ -0,0 +1,67 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+)
+
+// odataError returns the SDK error of a Graph response with status and OData code.
+func odataError(status int, code string) error {
+	e := odataerrors.NewODataError()
+	e.ResponseStatusCode = status
+	main := odataerrors.NewMainError()
+	main.SetCode(&code)
+	e.SetErrorEscaped(main)
+	return e
+}
+
+func TestClassifyGraphError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error // nil: returned unchanged
+	}{
+		{"not found", odataError(404, "Request_ResourceNotFound"), ErrUserNotFound},
+		{"throttled", odataError(429, "TooManyRequests"), ErrThrottled},
+		{"unavailable", &abstractions.ApiError{ResponseStatusCode: 503}, ErrThrottled},
+		{"forbidden", fmt.Errorf("setPresence: %w", odataError(403, "Authorization_RequestDenied")), ErrForbidden},
+		{"bad request", odataError(400, "BadRequest"), nil},
+		{"network", errors.New("connection refused"), nil},
+		{"canceled", context.Canceled, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyGraphError(tt.err)
+			if tt.want == nil {
+				if got != tt.err {
+					t.Errorf("classifyGraphError = %v, want the error unchanged", got)
+				}
+				return
+			}
+			if !errors.Is(got, tt.want) {
+				t.Errorf("classifyGraphError = %v, want %v", got, tt.want)
+			}
+			var apiErr abstractions.ApiErrorable
+			if !errors.As(got, &apiErr) {
+				t.Error("classified error does not wrap the SDK error")
+			}
+			if again := classifyGraphError(got); again != got {
+				t.Errorf("classifying twice = %v, want the error unchanged", again)
+			}
+		})
+	}
+
+	got := classifyGraphError(odataError(404, "Request_ResourceNotFound"))
+	if !strings.Contains(got.Error(), "(404 Request_ResourceNotFound)") {
+		t.Errorf("error = %q, want the status and OData code", got)
+	}
+	if classifyGraphError(nil) != nil {
+		t.Error("classifyGraphError(nil) != nil")
+	}
+}
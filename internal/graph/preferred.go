@@ -0,0 +1,94 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// preferredActivities are the availability/activity pairs setUserPreferredPresence accepts.
+var preferredActivities = map[string]string{
+	"Available":    "Available",
+	"Busy":         "Busy",
+	"DoNotDisturb": "DoNotDisturb",
+	"BeRightBack":  "BeRightBack",
+	"Away":         "Away",
+	"Offline":      "OffWork",
+}
+
+// ParsePreferredPresence checks an "Availability:Activity" preferred presence (the activity
+// may be omitted) against the pairs Graph accepts: Available:Available, Busy:Busy,
+// DoNotDisturb:DoNotDisturb, BeRightBack:BeRightBack, Away:Away and Offline:OffWork.
+func ParsePreferredPresence(s string) (availability, activity string, err error) {
+	availability, activity, _ = strings.Cut(strings.TrimSpace(s), ":")
+	availability, activity = strings.TrimSpace(availability), strings.TrimSpace(activity)
+	for a, act := range preferredActivities {
+		if strings.EqualFold(a, availability) && (activity == "" || strings.EqualFold(act, activity)) {
+			return a, act, nil
+		}
+	}
+	return "", "", fmt.Errorf("preferred presence %q: want Available, Busy, DoNotDisturb, BeRightBack, Away or Offline with its matching activity", s)
+}
+
+// SetPreferredPresence sets the user's preferred presence (Graph setUserPreferredPresence),
+// expiring after expiration (0 = until cleared). Unlike the presence sessions SetPresence
+// writes, the preferred presence is what Teams shows while it is set, whatever the
+// sessions say; it only shows while the user has at least one presence session.
+// Writes go through the user's circuit breaker like SetPresence.
+func (c *Client) SetPreferredPresence(ctx context.Context, userID, availability, activity string, expiration time.Duration) error {
+	if err := c.breaker.allow(userID); err != nil {
+		return err
+	}
+	err := c.setPreferredPresence(ctx, userID, availability, activity, expiration)
+	c.breaker.record(userID, err)
+	return err
+}
+
+func (c *Client) setPreferredPresence(ctx context.Context, userID, availability, activity string, expiration time.Duration) error {
+	objectID, err := c.resolveUserID(ctx, userID)
+	if err != nil {
+		c.log.Error("resolve user ID failed", "user", userID, "error", err)
+		return err
+	}
+	body := users.NewItemPresenceSetUserPreferredPresencePostRequestBody()
+	body.SetAvailability(&availability)
+	body.SetActivity(&activity)
+	if expiration > 0 {
+		body.SetExpirationDuration(isoExpiration(expiration))
+	}
+	err = c.doWithRetry(ctx, "setUserPreferredPresence", func(ctx context.Context) error {
+		return c.graph.Users().ByUserId(objectID).Presence().SetUserPreferredPresence().Post(ctx, body, nil)
+	})
+	if err != nil {
+		c.log.Error("setUserPreferredPresence failed", "user", userID, "availability", availability, "activity", activity, "error", err, "error_chain", errorChain(err))
+		if errors.Is(err, ErrUserNotFound) {
+			c.forgetUserID(userID)
+		}
+		return err
+	}
+	c.log.Debug("setUserPreferredPresence ok", "user", userID, "availability", availability, "expiration", expiration)
+	return nil
+}
+
+// ClearPreferredPresence clears the user's preferred presence (Graph
+// clearUserPreferredPresence), so Teams shows the aggregate of the presence sessions again.
+func (c *Client) ClearPreferredPresence(ctx context.Context, userID string) error {
+	objectID, err := c.resolveUserID(ctx, userID)
+	if err != nil {
+		c.log.Error("resolve user ID failed", "user", userID, "error", err)
+		return err
+	}
+	err = c.doWithRetry(ctx, "clearUserPreferredPresence", func(ctx context.Context) error {
+		return c.graph.Users().ByUserId(objectID).Presence().ClearUserPreferredPresence().Post(ctx, nil)
+	})
+	if err != nil {
+		c.log.Error("clearUserPreferredPresence failed", "user", userID, "error", err, "error_chain", errorChain(err))
+		return err
+	}
+	c.log.Debug("clearUserPreferredPresence ok", "user", userID)
+	return nil
+}
@@ -0,0 +1,127 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+)
+
+const (
+	maxRetries       = 3
+	defaultRetryWait = 2 * time.Second
+	maxRetryWait     = 30 * time.Second
+)
+
+// DefaultTimeout is the default limit of one Graph request (see SetTimeout).
+const DefaultTimeout = 10 * time.Second
+
+// ErrTimeout is wrapped by the error of a Graph request that did not complete within the
+// client's timeout, so a stalled endpoint can be told apart from throttling.
+var ErrTimeout = errors.New("graph request timed out")
+
+// SetTimeout limits each Graph request (each attempt, when a throttled request is retried)
+// to d; 0 disables the limit. Call it before the client is used.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// attempt runs one Graph request fn for op within the client's timeout. When the timeout,
+// not ctx, ends the request, the error wraps ErrTimeout.
+func (c *Client) attempt(ctx context.Context, op string, fn func(context.Context) error) error {
+	if c.timeout <= 0 {
+		return fn(ctx)
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := fn(reqCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+		c.log.Warn("graph request timed out", "op", op, "timeout", c.timeout)
+		return fmt.Errorf("%s: %w after %s: %w", op, ErrTimeout, c.timeout, err)
+	}
+	return err
+}
+
+// doWithRetry runs fn and retries it when Graph answers 429 (throttled) or 503 (unavailable).
+// The wait honours the Retry-After header when present, otherwise backs off exponentially;
+// it is capped at maxRetryWait and jittered. Cancelling ctx aborts the wait. Each attempt
+// is limited by the client's timeout (see attempt). The final error is classified (see
+// classifyGraphError).
+func (c *Client) doWithRetry(ctx context.Context, op string, fn func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, op, fn)
+		if err == nil {
+			return nil
+		}
+		status, retryAfter, ok := retryableStatus(err)
+		if !ok || attempt >= maxRetries {
+			return classifyGraphError(err)
+		}
+		wait := retryWait(attempt, retryAfter)
+		c.log.Warn("graph request throttled, backing off",
+			"op", op,
+			"status", status,
+			"attempt", attempt+1,
+			"max_retries", maxRetries,
+			"wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryableStatus reports whether err is a Graph API error with status 429 or 503, and
+// returns the status code and the Retry-After delay (0 if absent or unparseable).
+func retryableStatus(err error) (status int, retryAfter time.Duration, ok bool) {
+	var apiErr abstractions.ApiErrorable
+	if !errors.As(err, &apiErr) {
+		return 0, 0, false
+	}
+	status = apiErr.GetStatusCode()
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return status, 0, false
+	}
+	if h := apiErr.GetResponseHeaders(); h != nil {
+		if vals := h.Get("Retry-After"); len(vals) > 0 {
+			retryAfter = parseRetryAfter(vals[0])
+		}
+	}
+	return status, retryAfter, true
+}
+
+// parseRetryAfter parses a Retry-After value given as delay-seconds or an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryWait returns the delay before the next attempt: Retry-After when given, else
+// exponential backoff from defaultRetryWait, capped at maxRetryWait, plus up to 20% jitter.
+func retryWait(attempt int, retryAfter time.Duration) time.Duration {
+	wait := retryAfter
+	if wait <= 0 {
+		wait = defaultRetryWait << attempt
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait + rand.N(wait/5+1)
+}
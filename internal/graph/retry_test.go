@@ -0,0 +1,46 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestDoWithRetry_Timeout(t *testing.T) {
+	c := &Client{log: slog.New(slog.NewTextHandler(io.Discard, nil)), timeout: 20 * time.Millisecond}
+	calls := 0
+	hang := func(ctx context.Context) error {
+		calls++
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	err := c.doWithRetry(context.Background(), "setPresence", hang)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("hung request: err = %v, want ErrTimeout", err)
+	}
+	if calls != 1 {
+		t.Errorf("hung request sent %d times, want 1 (timeouts are not retried)", calls)
+	}
+
+	// A cancelled caller is not a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.doWithRetry(ctx, "setPresence", hang); errors.Is(err, ErrTimeout) || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller: err = %v, want context.Canceled", err)
+	}
+
+	// Without a timeout the request runs until it completes.
+	c.timeout = 0
+	if err := c.doWithRetry(context.Background(), "setPresence", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); ok {
+			return errors.New("deadline set")
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("no timeout: err = %v", err)
+	}
+}
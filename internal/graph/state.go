@@ -1,45 +1,164 @@
 package graph
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Session IDs and user IDs are written in batches: a change marks the state dirty and the
+// file is written stateFlushDelay later, or at once after stateFlushThreshold changes.
+const (
+	stateFlushDelay     = 2 * time.Second
+	stateFlushThreshold = 50
 )
 
-// SessionState persists extension -> sessionId (UUID) for Graph presence sessions.
+// SessionState persists extension -> sessionId (UUID) for Graph presence sessions, the
+// resolved user object IDs and, with device-code auth, the signed-in account and its tokens.
 type SessionState struct {
-	mu     sync.RWMutex
-	path   string
-	ByExt  map[string]string // extension -> sessionId UUID
+	mu      sync.RWMutex
+	path    string
+	ByExt   map[string]string // extension -> sessionId UUID
+	userIDs map[string]string // UPN/email -> object ID (GUID)
+	auth    *azidentity.AuthenticationRecord
+	tokens  json.RawMessage // MSAL token cache of device-code auth; nil when none
+
+	// readOnly is why the state file cannot be written (nil when it can); state is then
+	// kept in memory only and save is a no-op.
+	readOnly error
+
+	log        *slog.Logger
+	flushMu    sync.Mutex // serializes writes; guards dirty and flushTimer
+	dirty      int        // changes not yet written
+	flushTimer *time.Timer
+	flushDelay time.Duration
+}
+
+// stateFile is the state file layout once user IDs or an account are stored. Without them
+// the file is the plain extension -> sessionId map, as written by earlier versions.
+type stateFile struct {
+	Sessions   map[string]string                `json:"sessions"`
+	UserIDs    map[string]string                `json:"user_ids,omitempty"`
+	Auth       *azidentity.AuthenticationRecord `json:"auth_record,omitempty"`
+	TokenCache json.RawMessage                  `json:"token_cache,omitempty"`
 }
 
 // LoadSessionState reads the state file and returns a SessionState. If the file
 // does not exist, creates it with an empty map. If the file is empty, returns state with empty map.
-func LoadSessionState(path string) (*SessionState, error) {
+// Writability is probed once: when the file cannot be created or written (e.g. a read-only
+// volume), the state is kept in memory only; see ReadOnly. A file that does not parse (e.g.
+// truncated by a crash in an earlier version) is moved aside to path.corrupt-<time> and
+// state starts empty, logged to log (slog.Default() when nil).
+func LoadSessionState(path string, log *slog.Logger) (*SessionState, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	s := &SessionState{path: path, ByExt: make(map[string]string), userIDs: make(map[string]string), log: log, flushDelay: stateFlushDelay}
 	data, err := os.ReadFile(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			s := &SessionState{path: path, ByExt: make(map[string]string)}
-			if err := s.save(); err != nil {
-				return nil, err
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := s.save(); err != nil {
+			s.readOnly = err
+		}
+	} else {
+		s.readOnly = probeWritable(filepath.Dir(path))
+		if err := s.decode(data); err != nil {
+			if s.readOnly != nil {
+				// Nothing is saved to a read-only file, so it is left as it is.
+				log.Error("presence state file is corrupt and not writable; starting with empty state in memory (session IDs will be recreated, the file is left untouched)",
+					"path", path, "error", err)
+			} else {
+				backup := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102T150405"))
+				if os.Rename(path, backup) != nil {
+					backup = "" // left in place; the next save overwrites it
+				}
+				log.Error("presence state file is corrupt; starting with empty state (session IDs will be recreated)",
+					"path", path, "backup", backup, "error", err)
 			}
-			return s, nil
+			s.ByExt, s.userIDs, s.auth, s.tokens = make(map[string]string), make(map[string]string), nil, nil
 		}
-		return nil, err
 	}
-	var byExt map[string]string
-	if len(data) == 0 {
-		byExt = make(map[string]string)
-	} else {
-		if err := json.Unmarshal(data, &byExt); err != nil {
+	if s.readOnly != nil {
+		log.Warn("presence state file is not writable; keeping session state in memory only (new session IDs and sign-ins are lost on restart)",
+			"path", path, "error", s.readOnly)
+	}
+	return s, nil
+}
+
+// errOpenedReadOnly is ReadOnly for a state opened with OpenSessionStateReadOnly.
+var errOpenedReadOnly = errors.New("state file opened read-only")
+
+// OpenSessionStateReadOnly reads the state file like LoadSessionState but never writes it:
+// a missing or corrupt file is an empty state and changes are kept in memory only. It lets
+// a second process (e.g. the check command) use the state of a running service without
+// overwriting it.
+func OpenSessionStateReadOnly(path string, log *slog.Logger) (*SessionState, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	s := &SessionState{path: path, ByExt: make(map[string]string), userIDs: make(map[string]string), log: log, flushDelay: stateFlushDelay, readOnly: errOpenedReadOnly}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
 			return nil, err
 		}
-		if byExt == nil {
-			byExt = make(map[string]string)
+		return s, nil
+	}
+	if err := s.decode(data); err != nil {
+		log.Warn("presence state file is corrupt; using an empty state", "path", path, "error", err)
+		s.ByExt, s.userIDs, s.auth, s.tokens = make(map[string]string), make(map[string]string), nil, nil
+	}
+	return s, nil
+}
+
+// decode fills s from the state file contents: the legacy extension -> sessionId map or
+// stateFile. Empty data is an empty state.
+func (s *SessionState) decode(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, &s.ByExt); err != nil {
+		var f stateFile
+		if json.Unmarshal(data, &f) != nil {
+			return err
 		}
+		s.ByExt, s.userIDs, s.auth, s.tokens = f.Sessions, f.UserIDs, f.Auth, f.TokenCache
+	}
+	if s.ByExt == nil {
+		s.ByExt = make(map[string]string)
 	}
-	return &SessionState{path: path, ByExt: byExt}, nil
+	if s.userIDs == nil {
+		s.userIDs = make(map[string]string)
+	}
+	return nil
+}
+
+// probeWritable returns why files cannot be created in dir (save writes a temporary file
+// there and renames it over the state file), or nil.
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".presence-state-probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// ReadOnly returns why the state file cannot be written, or nil when changes are persisted.
+func (s *SessionState) ReadOnly() error {
+	return s.readOnly
 }
 
 // GetSessionID returns the session ID for the extension, or "" if not set.
@@ -49,25 +168,176 @@ func (s *SessionState) GetSessionID(extension string) string {
 	return s.ByExt[extension]
 }
 
-// SetSessionID sets the session ID for the extension and persists to file.
+// SetSessionID sets the session ID for the extension; it is written to file with the next
+// batch (see Flush).
 func (s *SessionState) SetSessionID(extension, sessionID string) error {
 	s.mu.Lock()
 	s.ByExt[extension] = sessionID
 	s.mu.Unlock()
-	return s.save()
+	s.changed()
+	return nil
+}
+
+// UserIDs returns a copy of the persisted UPN/email -> object ID map.
+func (s *SessionState) UserIDs() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.userIDs)
+}
+
+// SetUserID stores the object ID resolved for upn; it is written to file with the next batch.
+func (s *SessionState) SetUserID(upn, objectID string) error {
+	s.mu.Lock()
+	s.userIDs[upn] = objectID
+	s.mu.Unlock()
+	s.changed()
+	return nil
+}
+
+// DeleteUserID forgets the object ID of upn; the change is written to file with the next batch.
+func (s *SessionState) DeleteUserID(upn string) error {
+	s.mu.Lock()
+	_, ok := s.userIDs[upn]
+	delete(s.userIDs, upn)
+	s.mu.Unlock()
+	if ok {
+		s.changed()
+	}
+	return nil
+}
+
+// AuthRecord returns the signed-in account of device-code auth, or nil.
+func (s *SessionState) AuthRecord() *azidentity.AuthenticationRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.auth
+}
+
+// SetAuthRecord stores the signed-in account and writes the file at once (with any pending
+// changes), so a sign-in is not lost. The record identifies the account for silent token
+// requests; it holds no secrets (the tokens are in the token cache, see SetTokenCache).
+func (s *SessionState) SetAuthRecord(rec azidentity.AuthenticationRecord) error {
+	s.mu.Lock()
+	s.auth = &rec
+	s.mu.Unlock()
+	s.flushMu.Lock()
+	s.dirty++
+	s.flushMu.Unlock()
+	return s.Flush()
+}
+
+// TokenCache returns the stored MSAL token cache of device-code auth, or nil.
+func (s *SessionState) TokenCache() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tokens
+}
+
+// SetTokenCache stores the MSAL token cache of device-code auth, which holds the refresh
+// token, and writes the file after the flush delay. The cache is JSON and embedded as such.
+func (s *SessionState) SetTokenCache(data []byte) error {
+	if !json.Valid(data) {
+		return errors.New("token cache is not JSON")
+	}
+	s.mu.Lock()
+	if bytes.Equal(s.tokens, data) {
+		s.mu.Unlock()
+		return nil
+	}
+	s.tokens = slices.Clone(data)
+	s.mu.Unlock()
+	s.changed()
+	return nil
+}
+
+// changed records a change to persist: the file is written after flushDelay, or at once
+// once stateFlushThreshold changes are pending.
+func (s *SessionState) changed() {
+	if s.readOnly != nil {
+		return
+	}
+	s.flushMu.Lock()
+	s.dirty++
+	if s.dirty < stateFlushThreshold {
+		if s.flushTimer == nil {
+			s.flushTimer = time.AfterFunc(s.flushDelay, s.flushLogged)
+		}
+		s.flushMu.Unlock()
+		return
+	}
+	s.flushMu.Unlock()
+	s.flushLogged()
+}
+
+// flushLogged runs Flush for a background write, logging a failure; the changes stay
+// pending and are retried with the next one.
+func (s *SessionState) flushLogged() {
+	if err := s.Flush(); err != nil {
+		s.log.Warn("write presence state file failed", "path", s.path, "error", err)
+	}
+}
+
+// Flush writes pending changes to the state file now. Call it on shutdown so changes made
+// within the last flush delay are not lost.
+func (s *SessionState) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if s.dirty == 0 {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.dirty = 0
+	return nil
 }
 
 func (s *SessionState) save() error {
+	if s.readOnly != nil {
+		return nil
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	data, err := json.MarshalIndent(s.ByExt, "", "  ")
+	var v any = s.ByExt
+	if s.auth != nil || len(s.userIDs) > 0 || len(s.tokens) > 0 {
+		v = stateFile{Sessions: s.ByExt, UserIDs: s.userIDs, Auth: s.auth, TokenCache: s.tokens}
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	if dir := filepath.Dir(s.path); dir != "." {
-		if err := os.MkdirAll(dir, 0750); err != nil {
-			return err
-		}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file in path's directory and renames it over
+// path, so a crash leaves either the old or the new file, never a partial one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
 	}
-	return os.WriteFile(s.path, data, 0600)
+	return os.Rename(tmp.Name(), path)
 }
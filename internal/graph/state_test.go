@@ -0,0 +1,186 @@
+package graph
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var discardLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestLoadSessionState_ReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0o700) })
+	s, err := LoadSessionState(filepath.Join(dir, "presence-state.json"), discardLog)
+	if err != nil {
+		t.Fatalf("LoadSessionState: %v, want in-memory state", err)
+	}
+	if s.ReadOnly() == nil {
+		t.Error("ReadOnly() = nil, want the write error")
+	}
+	if err := s.SetSessionID("101", "session-1"); err != nil {
+		t.Errorf("SetSessionID: %v, want nil in memory-only mode", err)
+	}
+	if got := s.GetSessionID("101"); got != "session-1" {
+		t.Errorf("GetSessionID = %q, want session-1 kept in memory", got)
+	}
+}
+
+func TestLoadSessionState_Writable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "presence-state.json")
+	s, err := LoadSessionState(path, discardLog)
+	if err != nil || s.ReadOnly() != nil {
+		t.Fatalf("LoadSessionState = %v, ReadOnly = %v; want a writable state", err, s.ReadOnly())
+	}
+	if err := s.SetSessionID("101", "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadSessionState(path, discardLog)
+	if err != nil || again.GetSessionID("101") != "session-1" {
+		t.Errorf("reloaded session = %q (%v), want session-1", again.GetSessionID("101"), err)
+	}
+}
+
+func TestLoadSessionState_Truncated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "presence-state.json")
+	if err := os.WriteFile(path, []byte(`{"sessions": {"101": "sess`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSessionState(path, discardLog)
+	if err != nil {
+		t.Fatalf("LoadSessionState: %v, want a fresh state", err)
+	}
+	if len(s.ByExt) != 0 {
+		t.Errorf("ByExt = %v, want empty", s.ByExt)
+	}
+	entries, _ := os.ReadDir(dir)
+	var backups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "presence-state.json.corrupt-") {
+			backups = append(backups, e.Name())
+		}
+	}
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v, want one presence-state.json.corrupt-* file", backups)
+	}
+	if err := s.SetSessionID("101", "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadSessionState(path, discardLog)
+	if err != nil || again.GetSessionID("101") != "session-1" {
+		t.Errorf("reloaded session = %q (%v), want session-1", again.GetSessionID("101"), err)
+	}
+	entries, _ = os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("dir has %d entries, want the state file and the backup (no leftover temp files)", len(entries))
+	}
+}
+
+func TestSessionState_BatchedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presence-state.json")
+	s, err := LoadSessionState(path, discardLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.flushDelay = time.Hour
+	onDisk := func() string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	s.SetSessionID("101", "session-1")
+	if strings.Contains(onDisk(), "session-1") {
+		t.Error("session ID written before the flush delay")
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(onDisk(), "session-1") {
+		t.Error("session ID not written by Flush")
+	}
+
+	for i := range stateFlushThreshold {
+		s.SetSessionID(strconv.Itoa(200+i), "bulk-"+strconv.Itoa(i))
+	}
+	if !strings.Contains(onDisk(), "bulk-"+strconv.Itoa(stateFlushThreshold-1)) {
+		t.Errorf("%d changes not written without Flush", stateFlushThreshold)
+	}
+}
+
+func TestSessionState_FlushAfterDelay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presence-state.json")
+	s, err := LoadSessionState(path, discardLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.flushDelay = 10 * time.Millisecond
+	s.SetUserID("alice@example.com", "oid-1")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), "oid-1") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("user ID not written after the flush delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOpenSessionStateReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presence-state.json")
+	const content = `{"sessions": {"101": "session-1"}, "user_ids": {"a@example.com": "id-a"}}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSessionStateReadOnly(path, discardLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ReadOnly() == nil || s.GetSessionID("101") != "session-1" || s.UserIDs()["a@example.com"] != "id-a" {
+		t.Fatalf("ReadOnly = %v, state %v %v; want the file's state, read-only", s.ReadOnly(), s.ByExt, s.UserIDs())
+	}
+	if err := s.SetUserID("b@example.com", "id-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSessionID("102", "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != content {
+		t.Errorf("state file = %s, want it untouched", data)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := OpenSessionStateReadOnly(missing, discardLog); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Stat(missing) = %v, want the file not created", err)
+	}
+}
@@ -0,0 +1,102 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStatusMessageInterval is the default minimum time between status message writes
+// for one user; Graph throttles setStatusMessage harder than setPresence.
+const DefaultStatusMessageInterval = 30 * time.Second
+
+// statusFlushTimeout bounds a held status message write.
+const statusFlushTimeout = time.Minute
+
+// statusWrite is one status message write.
+type statusWrite struct {
+	userID, extension, message string
+	ttl                        time.Duration
+}
+
+// statusThrottle spaces status message writes for each user at least interval apart. A
+// write arriving sooner is held and sent when the interval ends; a newer one replaces a
+// held one, so a chatty extension costs at most one write per interval and the last
+// message still lands.
+type statusThrottle struct {
+	interval time.Duration // 0 disables throttling
+	write    func(context.Context, statusWrite) error
+	now      func() time.Time
+	log      *slog.Logger
+
+	mu    sync.Mutex
+	users map[string]*statusState // lower-case user -> state
+}
+
+type statusState struct {
+	last    time.Time    // when the last write was sent
+	pending *statusWrite // held write, sent by timer
+	timer   *time.Timer
+}
+
+func newStatusThrottle(interval time.Duration, write func(context.Context, statusWrite) error, log *slog.Logger) *statusThrottle {
+	return &statusThrottle{interval: interval, write: write, now: time.Now, log: log, users: make(map[string]*statusState)}
+}
+
+// submit sends w now, or holds it when the user's last write was less than interval ago.
+func (t *statusThrottle) submit(ctx context.Context, w statusWrite) error {
+	if t.interval <= 0 {
+		return t.write(ctx, w)
+	}
+	key := strings.ToLower(w.userID)
+	t.mu.Lock()
+	st := t.users[key]
+	if st == nil {
+		st = &statusState{}
+		t.users[key] = st
+	}
+	now := t.now()
+	if wait := st.last.Add(t.interval).Sub(now); wait > 0 {
+		st.pending = &w
+		if st.timer == nil {
+			st.timer = time.AfterFunc(wait, func() { t.flush(key) })
+		}
+		t.mu.Unlock()
+		t.log.Debug("status message held", "user", w.userID, "for", wait.Round(time.Second))
+		return nil
+	}
+	st.last, st.pending = now, nil
+	t.mu.Unlock()
+	return t.write(ctx, w)
+}
+
+// cancel drops a held write for user, e.g. when the message it would replace is current again.
+func (t *statusThrottle) cancel(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st := t.users[strings.ToLower(user)]; st != nil {
+		st.pending = nil
+	}
+}
+
+// flush sends the write held for key.
+func (t *statusThrottle) flush(key string) {
+	t.mu.Lock()
+	st := t.users[key]
+	w := st.pending
+	st.pending, st.timer = nil, nil
+	if w == nil {
+		t.mu.Unlock()
+		return
+	}
+	st.last = t.now()
+	t.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), statusFlushTimeout)
+	defer cancel()
+	if err := t.write(ctx, *w); err != nil && !errors.Is(err, ErrCircuitOpen) {
+		t.log.Warn("held status message write failed", "user", w.userID, "extension", w.extension, "error", err)
+	}
+}
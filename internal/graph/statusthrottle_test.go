@@ -0,0 +1,61 @@
+package graph
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusThrottle(t *testing.T) {
+	var mu sync.Mutex
+	var written []string
+	write := func(_ context.Context, w statusWrite) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, w.userID+" "+w.message)
+		return nil
+	}
+	got := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(written)
+	}
+	th := newStatusThrottle(50*time.Millisecond, write, discardLog)
+	ctx := context.Background()
+
+	th.submit(ctx, statusWrite{userID: "alice@example.com", message: "ringing"})
+	th.submit(ctx, statusWrite{userID: "Alice@example.com", message: "on a call"})
+	th.submit(ctx, statusWrite{userID: "alice@example.com", message: "on hold"})
+	th.submit(ctx, statusWrite{userID: "bob@example.com", message: "on a call"})
+	if want := []string{"alice@example.com ringing", "bob@example.com on a call"}; !slices.Equal(got(), want) {
+		t.Fatalf("immediate writes = %q, want %q (other users are not held)", got(), want)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(got()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if want := []string{"alice@example.com ringing", "bob@example.com on a call", "alice@example.com on hold"}; !slices.Equal(got(), want) {
+		t.Errorf("writes = %q, want only the latest held message after the interval", got())
+	}
+
+	th.submit(ctx, statusWrite{userID: "alice@example.com", message: ""})
+	th.cancel("alice@example.com")
+	time.Sleep(100 * time.Millisecond)
+	if n := len(got()); n != 3 {
+		t.Errorf("cancelled write was sent: %q", got())
+	}
+}
+
+func TestStatusThrottle_Disabled(t *testing.T) {
+	n := 0
+	th := newStatusThrottle(0, func(context.Context, statusWrite) error { n++; return nil }, discardLog)
+	for range 3 {
+		th.submit(context.Background(), statusWrite{userID: "alice@example.com", message: "x"})
+	}
+	if n != 3 {
+		t.Errorf("%d writes, want 3 without an interval", n)
+	}
+}
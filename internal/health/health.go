@@ -0,0 +1,94 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Check is a named readiness check. Fn returns nil when the check passes.
+type Check struct {
+	Name string
+	Fn   func() error
+}
+
+// Server serves /healthz (process up) and /readyz (all checks pass). Additional handlers
+// (e.g. metrics) can be mounted with Handle before ListenAndServe.
+type Server struct {
+	addr   string
+	mux    *http.ServeMux
+	checks []Check
+	log    *slog.Logger
+}
+
+// NewServer creates a health server for addr (e.g. ":8080") with the given readiness checks.
+func NewServer(addr string, checks ...Check) *Server {
+	s := &Server{
+		addr:   addr,
+		mux:    http.NewServeMux(),
+		checks: checks,
+		log:    slog.Default().With("component", "health"),
+	}
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /readyz", s.handleReadyz)
+	return s
+}
+
+// Handle registers an additional handler on the health listener.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// ListenAndServe serves until ctx is cancelled, then shuts down gracefully.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	s.log.Info("health server listening", "addr", s.addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+type status struct {
+	Status string            `json:"status"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, status{Status: "ok"})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	failed := make(map[string]string)
+	for _, c := range s.checks {
+		if err := c.Fn(); err != nil {
+			failed[c.Name] = err.Error()
+		}
+	}
+	if len(failed) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, status{Status: "unavailable", Failed: failed})
+		return
+	}
+	writeJSON(w, http.StatusOK, status{Status: "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
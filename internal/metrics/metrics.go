@@ -0,0 +1,125 @@
+// Package metrics holds the Prometheus collectors for SIP and presence activity.
+// Collectors are always updated (cheaply) and only exposed when Handler is mounted.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcome label values.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	notifyReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sip_blf_notify_received_total",
+		Help: "NOTIFY requests received, by extension.",
+	}, []string{"extension"})
+
+	presenceWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sip_blf_presence_writes_total",
+		Help: "Graph setPresence calls, by extension and outcome (success or failure).",
+	}, []string{"extension", "outcome"})
+
+	setPresenceLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sip_blf_graph_set_presence_duration_seconds",
+		Help:    "Latency of Graph setPresence calls, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	activeSubscriptions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sip_blf_active_subscriptions",
+		Help: "Extensions with an established BLF subscription, by PBX server.",
+	}, []string{"server"})
+
+	staleSubscriptions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sip_blf_stale_subscriptions",
+		Help: "Subscriptions without a NOTIFY within the staleness window, by PBX server.",
+	}, []string{"server"})
+
+	registers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sip_blf_register_total",
+		Help: "SIP REGISTER attempts, by outcome.",
+	}, []string{"outcome"})
+
+	subscribes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sip_blf_subscribe_total",
+		Help: "SIP SUBSCRIBE attempts, by outcome.",
+	}, []string{"outcome"})
+
+	eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sip_blf_events_dropped_total",
+		Help: "BLF events dropped because an Events consumer's buffer was full.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		notifyReceived,
+		presenceWrites,
+		setPresenceLatency,
+		activeSubscriptions,
+		staleSubscriptions,
+		registers,
+		subscribes,
+		eventsDropped,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns the Prometheus scrape handler for the collectors in this package.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// NotifyReceived counts a NOTIFY for extension.
+func NotifyReceived(extension string) {
+	notifyReceived.WithLabelValues(extension).Inc()
+}
+
+// PresenceWrite records a setPresence call for extension and how long it took.
+func PresenceWrite(extension string, err error, d time.Duration) {
+	presenceWrites.WithLabelValues(extension, outcome(err)).Inc()
+	setPresenceLatency.Observe(d.Seconds())
+}
+
+// SetActiveSubscriptions sets the active subscription gauge for server.
+func SetActiveSubscriptions(server string, n int) {
+	activeSubscriptions.WithLabelValues(server).Set(float64(n))
+}
+
+// SetStaleSubscriptions sets the stale subscription gauge for server.
+func SetStaleSubscriptions(server string, n int) {
+	staleSubscriptions.WithLabelValues(server).Set(float64(n))
+}
+
+// Register counts a REGISTER attempt.
+func Register(err error) {
+	registers.WithLabelValues(outcome(err)).Inc()
+}
+
+// Subscribe counts a SUBSCRIBE attempt.
+func Subscribe(err error) {
+	subscribes.WithLabelValues(outcome(err)).Inc()
+}
+
+// EventDropped counts a BLF event dropped for a slow consumer.
+func EventDropped() {
+	eventsDropped.Inc()
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
@@ -0,0 +1,99 @@
+package sip
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/icholy/digest"
+)
+
+// digestAuth computes Authorization headers and remembers the last challenge per realm so
+// later requests (re-REGISTER, re-SUBSCRIBE) can authenticate pre-emptively. With qop=auth
+// the nonce count (nc) is incremented on every use of the same nonce, and a nextnonce from
+// Authentication-Info replaces the nonce and restarts the count.
+type digestAuth struct {
+	mu       sync.Mutex
+	username string
+	password string
+	realms   map[string]*nonceState // realm -> current nonce state
+	realm    string                 // realm of the most recent challenge
+}
+
+type nonceState struct {
+	chal   *digest.Challenge
+	nc     int
+	cnonce string
+}
+
+func newDigestAuth(username, password string) *digestAuth {
+	return &digestAuth{username: username, password: password, realms: make(map[string]*nonceState)}
+}
+
+// challenge records a WWW-Authenticate (or Proxy-Authenticate) header value.
+func (a *digestAuth) challenge(header string) error {
+	chal, err := digest.ParseChallenge(header)
+	if err != nil {
+		return fmt.Errorf("parse challenge: %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.realms[chal.Realm] = &nonceState{chal: chal}
+	a.realm = chal.Realm
+	return nil
+}
+
+// authorize returns an Authorization header value for method and uri using the most recent
+// challenge, incrementing the nonce count. ok is false when no challenge has been seen yet.
+func (a *digestAuth) authorize(method, uri string) (value string, ok bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.realms[a.realm]
+	if st == nil {
+		return "", false, nil
+	}
+	st.nc++
+	cred, err := digest.Digest(st.chal, digest.Options{
+		Method:   method,
+		URI:      uri,
+		Username: a.username,
+		Password: a.password,
+		Count:    st.nc,
+		Cnonce:   st.cnonce,
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("digest: %w", err)
+	}
+	st.cnonce = cred.Cnonce
+	return cred.String(), true, nil
+}
+
+// authenticationInfo applies the nextnonce from an Authentication-Info header value, if any.
+func (a *digestAuth) authenticationInfo(header string) {
+	next := authParam(header, "nextnonce")
+	if next == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.realms[a.realm]
+	if st == nil {
+		return
+	}
+	chal := *st.chal
+	chal.Nonce = next
+	a.realms[a.realm] = &nonceState{chal: &chal}
+}
+
+// authParam returns the value of name in a comma-separated auth-param list
+// (e.g. `nextnonce="abc", qop=auth`), unquoted.
+func authParam(header, name string) string {
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), name) {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+func TestDigestAuth_NonceCountAndNextNonce(t *testing.T) {
+	a := newDigestAuth("blf-client", "secret")
+	if _, ok, _ := a.authorize("REGISTER", "sip:pbx.example.com"); ok {
+		t.Fatal("authorize before any challenge: ok = true, want false")
+	}
+	if err := a.challenge(`Digest realm="asterisk", nonce="n1", qop="auth", algorithm=MD5`); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _, err := a.authorize("REGISTER", "sip:pbx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, _ := a.authorize("SUBSCRIBE", "sip:6000@pbx.example.com")
+	if !strings.Contains(first, "nc=00000001") || !strings.Contains(second, "nc=00000002") {
+		t.Errorf("nonce count not incremented: %q, %q", first, second)
+	}
+
+	a.authenticationInfo(`qop=auth, rspauth="x", nextnonce="n2"`)
+	third, _, _ := a.authorize("REGISTER", "sip:pbx.example.com")
+	if !strings.Contains(third, `nonce="n2"`) || !strings.Contains(third, "nc=00000001") {
+		t.Errorf("nextnonce not applied: %q", third)
+	}
+}
+
+// TestDigestURI checks the digest uri of authenticated REGISTER and SUBSCRIBE requests
+// against the Request-URI the PBX receives, and the host-only form.
+func TestDigestURI(t *testing.T) {
+	for _, hostOnly := range []bool{false, true} {
+		ua, err := sipgo.NewUA()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ua.Close()
+		pbx, err := sipgo.NewServer(ua)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type seen struct{ requestURI, digestURI string }
+		got := make(chan seen, 2)
+		challenge := func(req *sip.Request, tx sip.ServerTransaction) {
+			auth := req.GetHeader("Authorization")
+			if auth == nil {
+				res := sip.NewResponseFromRequest(req, 401, "Unauthorized", nil)
+				res.AppendHeader(sip.NewHeader("WWW-Authenticate", `Digest realm="asterisk", nonce="n1", algorithm=MD5`))
+				tx.Respond(res)
+				return
+			}
+			cred, err := digest.ParseCredentials(auth.Value())
+			if err != nil {
+				t.Error(err)
+			}
+			got <- seen{req.Recipient.String(), cred.URI}
+			res := sip.NewResponseFromRequest(req, 200, "OK", nil)
+			res.AppendHeader(sip.NewHeader("Expires", "120"))
+			tx.Respond(res)
+		}
+		pbx.OnRegister(challenge)
+		pbx.OnSubscribe(challenge)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		addr := make(chan string, 1)
+		ready := sipgo.ListenReadyFuncCtxValue(func(_, a string) { addr <- a })
+		go pbx.ListenAndServe(context.WithValue(ctx, sipgo.ListenReadyCtxKey, ready), "tcp", "127.0.0.1:0")
+		var server string
+		select {
+		case server = <-addr:
+		case <-time.After(5 * time.Second):
+			t.Fatal("listener not ready")
+		}
+
+		cfg := Config{Server: server, Transport: "tcp", Username: "blf-client", Password: "secret", ContactIP: "127.0.0.1", DigestURIHostOnly: hostOnly}
+		c, err := NewClient(cfg, []string{"101"}, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		reqCtx, reqCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer reqCancel()
+		if _, err := c.registerOnce(reqCtx, false); err != nil {
+			t.Fatalf("REGISTER: %v", err)
+		}
+		c.auth = newDigestAuth("blf-client", "secret") // challenge the SUBSCRIBE too
+		if _, err := c.subscribeAttempt(reqCtx, "101", EventDialog); err != nil {
+			t.Fatalf("SUBSCRIBE: %v", err)
+		}
+
+		host, _, _ := strings.Cut(server, ":")
+		for _, method := range []string{"REGISTER", "SUBSCRIBE"} {
+			s := <-got
+			want := s.requestURI
+			if hostOnly {
+				want = host
+			}
+			if s.digestURI != want {
+				t.Errorf("host only %v: %s digest uri = %q, want %q (Request-URI %q)", hostOnly, method, s.digestURI, want, s.requestURI)
+			}
+		}
+	}
+}
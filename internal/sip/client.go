@@ -1,45 +1,122 @@
 package sip
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emiago/sipgo"
 	"github.com/emiago/sipgo/sip"
-	"github.com/icholy/digest"
+	"github.com/google/uuid"
 
 	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
 )
 
 // Config holds SIP endpoint and auth settings.
 type Config struct {
-	Server      string   // host:port
-	Transport   string   // UDP, TCP, etc.
+	Server      string // host:port; a bare host or domain is resolved by ResolveServer (DNS SRV)
+	Domain      string // SIP domain for the From header when Server was resolved via SRV
+	Transport   string // udp, tcp, or TransportWS/TransportWSS (see IsWebSocket)
 	Username    string
 	Password    string
 	ContactIP   string   // our IP for Contact header; use "auto" or leave empty for STUN discovery
 	ContactPort int      // port for Contact (0 = 5060 or omit); set by STUN when behind NAT
 	STUNServers []string // STUN servers for NAT discovery (e.g. stun.l.google.com)
-	UserAgent   string
+	UserAgent   string   // User-Agent header of every request; empty omits it
+	// ExtraHeaders are added to REGISTER and SUBSCRIBE requests (see ParseExtraHeaders).
+	ExtraHeaders []Header
+	// STUNParallel queries all STUN servers at once and takes the first answer;
+	// STUNStrict additionally requires two servers to agree on the public IP.
+	STUNParallel bool
+	STUNStrict   bool
+	// STUNTransport is STUNTransportUDP (default) or STUNTransportTCP.
+	STUNTransport string
+	// STUNFamily is STUNFamilyAny (default), STUNFamilyIPv4 or STUNFamilyIPv6.
+	STUNFamily string
+	// STUNTimeout limits each binding request (0 = the STUN client's retransmissions,
+	// about 9.5s); a failed one is repeated STUNRetries times before the server is skipped.
+	STUNTimeout time.Duration
+	STUNRetries int
+	// SymmetricNAT is set by ResolveContactIfNeeded when STUN servers saw different
+	// mapped addresses for one socket; the discovered Contact is then likely unreachable.
+	SymmetricNAT bool
+	// ContactDiscovered is set by ResolveContactIfNeeded when ContactIP and ContactPort
+	// came from STUN.
+	ContactDiscovered bool
+	// LearnContact moves the Contact to the address the server reports in the received/rport
+	// parameters of the top Via of REGISTER/SUBSCRIBE responses (for discovered Contacts).
+	LearnContact bool
+	// DisplayName, when set, is sent as the display name in From and Contact.
+	DisplayName string
+	// SubscribeExpires and RegisterExpires are the requested lifetimes in seconds
+	// (0 = 3600; otherwise 60-86400). Refreshes follow the lifetime the PBX grants.
+	SubscribeExpires int
+	RegisterExpires  int
+	// PresenceFallback retries an extension with the presence event package (RFC 3856)
+	// when the dialog SUBSCRIBE returns 404. A 489 Bad Event always falls back.
+	PresenceFallback bool
+	// SubscribeConcurrency is how many initial SUBSCRIBEs may be in flight at once
+	// (0 = DefaultSubscribeConcurrency).
+	SubscribeConcurrency int
+	// UnavailableRetries is how many times a REGISTER or SUBSCRIBE answered 503 Service
+	// Unavailable is retried, after the response's Retry-After (see retryUnavailable);
+	// 0 fails on the first 503.
+	UnavailableRetries int
+	// DigestURIHostOnly sends only the server host as the digest uri instead of the
+	// Request-URI, for PBXs that expect the host form.
+	DigestURIHostOnly bool
+	// ExtensionPolicy normalizes the extensions passed to the BLF handler and Events
+	// listeners (see blf.NormalizeExtension); "" is blf.ExtensionAsIs.
+	ExtensionPolicy string
+	// DNDIndicators, when set, turn NOTIFYs whose body signals Do Not Disturb into
+	// blf.StateDND (see blf.DetectDND).
+	DNDIndicators []string
 }
 
+// Event packages used for BLF subscriptions.
+const (
+	EventDialog   = "dialog"   // RFC 4235 dialog-info
+	EventPresence = "presence" // RFC 3856 presence (PIDF)
+)
+
+// DefaultSubscribeConcurrency is the number of SUBSCRIBEs Subscribe keeps in flight by default.
+const DefaultSubscribeConcurrency = 8
+
 // BLFHandler is called when a BLF state change is received (extension, state).
 type BLFHandler func(extension string, state blf.State)
 
 // Client registers to a SIP server and subscribes to BLF (dialog) for a list of extensions.
 type Client struct {
-	ua     *sipgo.UserAgent
-	client *sipgo.Client
-	server *sipgo.Server
-	cfg    Config
+	ua         *sipgo.UserAgent
+	client     *sipgo.Client // replaced by SetContact; guarded by mu
+	server     *sipgo.Server
+	cfg        Config
 	extensions []string
-	onBLF  BLFHandler
-	log    *slog.Logger
-	mu     sync.Mutex
+	onBLF      BLFHandler
+	log        *slog.Logger
+	mu         sync.Mutex
+	subs       map[string]*subscription // extension -> active subscription dialog; guarded by mu
+	registered bool                     // last REGISTER succeeded; guarded by mu
+	pending    map[string]*subscription // Call-ID -> SUBSCRIBE awaiting its 2xx; guarded by mu
+	views      map[string]*dialogView   // extension -> dialogs seen in NOTIFYs; guarded by mu
+	notified   map[string]notifyRecord  // extension -> last NOTIFY; guarded by mu (see updateNotified)
+	stale      map[string]bool          // extensions RunStaleWatchdog flagged; guarded by mu
+	ended      map[string]ended         // extension -> subscription the PBX terminated; guarded by mu
+	auth       *digestAuth
+	failures   chan struct{}    // transport failures for Supervise; capacity 1
+	listeners  []chan blf.Event // Events channels; guarded by mu
+
+	registerRefresh time.Time // when RunRefresh re-registers; guarded by mu
+	tcpPeer         string    // remote address of the TCP connection to the PBX; guarded by mu
+	fromHost        string    // host of our From URI (server host or SRV domain)
 }
 
 // serverHost returns the host part of cfg.Server (no port) for use in From header.
@@ -53,21 +130,40 @@ func serverHost(server string) string {
 
 // NewClient creates a SIP client. Call Register then Subscribe; run the server to handle NOTIFY.
 // cfg.ContactIP and cfg.ContactPort should already be set (e.g. from STUN when behind NAT).
-// The UA identity (From header) is set to cfg.Username@serverHost so the PBX can match the registered peer.
-func NewClient(cfg Config, extensions []string, onBLF BLFHandler) (*Client, error) {
+// The UA identity (From header) is set to cfg.Username@serverHost (or cfg.Domain when the server
+// was resolved via SRV) so the PBX can match the registered peer. The client logs to log
+// (slog.Default() when nil).
+func NewClient(cfg Config, extensions []string, onBLF BLFHandler, log *slog.Logger) (*Client, error) {
+	if err := validateExpires("subscribe expires", cfg.SubscribeExpires); err != nil {
+		return nil, err
+	}
+	if err := validateExpires("register expires", cfg.RegisterExpires); err != nil {
+		return nil, err
+	}
+	if log == nil {
+		log = slog.Default()
+	}
 	host := serverHost(cfg.Server)
-	ua, err := sipgo.NewUA(
+	if cfg.Domain != "" {
+		host = cfg.Domain
+	}
+	uaOpts := []sipgo.UserAgentOption{
 		sipgo.WithUserAgent(cfg.Username),
 		sipgo.WithUserAgentHostname(host),
-	)
+	}
+	if IsWebSocket(cfg.Transport) {
+		cfg.Transport = strings.ToLower(strings.TrimSpace(cfg.Transport))
+		cfg.ContactIP, cfg.ContactPort = webSocketContactHost(), 0
+		cfg.LearnContact = false
+		// sipgo needs a TLS config to dial wss; the zero one verifies the server certificate
+		// against the system roots and the server host name.
+		uaOpts = append(uaOpts, sipgo.WithUserAgenTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	ua, err := sipgo.NewUA(uaOpts...)
 	if err != nil {
 		return nil, err
 	}
-	opts := []sipgo.ClientOption{sipgo.WithClientHostname(cfg.ContactIP)}
-	if cfg.ContactPort > 0 {
-		opts = append(opts, sipgo.WithClientPort(cfg.ContactPort), sipgo.WithClientNAT())
-	}
-	client, err := sipgo.NewClient(ua, opts...)
+	client, err := sipgo.NewClient(ua, clientOptions(cfg.ContactIP, cfg.ContactPort)...)
 	if err != nil {
 		ua.Close()
 		return nil, err
@@ -84,8 +180,14 @@ func NewClient(cfg Config, extensions []string, onBLF BLFHandler) (*Client, erro
 		server:     server,
 		cfg:        cfg,
 		extensions: extensions,
-		onBLF:     onBLF,
-		log:        slog.Default().With("component", "sip"),
+		onBLF:      onBLF,
+		log:        log.With("component", "sip"),
+		subs:       make(map[string]*subscription),
+		pending:    make(map[string]*subscription),
+		views:      make(map[string]*dialogView),
+		auth:       newDigestAuth(cfg.Username, cfg.Password),
+		failures:   make(chan struct{}, 1),
+		fromHost:   host,
 	}
 	server.OnNotify(c.handleNOTIFY)
 	return c, nil
@@ -93,176 +195,467 @@ func NewClient(cfg Config, extensions []string, onBLF BLFHandler) (*Client, erro
 
 // Close shuts down the client and UA.
 func (c *Client) Close() error {
-	c.client.Close()
+	c.sipClient().Close()
 	return c.ua.Close()
 }
 
+// Registered reports whether the last REGISTER succeeded.
+func (c *Client) Registered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registered
+}
+
+// ActiveSubscriptions returns the number of extensions with an established subscription.
+func (c *Client) ActiveSubscriptions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.subs)
+}
+
+// SymmetricNAT reports whether STUN detected a symmetric NAT at startup.
+func (c *Client) SymmetricNAT() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.SymmetricNAT
+}
+
 // ListenAndServe starts the SIP server listening for NOTIFYs. Call in a goroutine or block.
+// Over a WebSocket transport NOTIFYs arrive on the client's connection, so it only waits
+// for ctx.
 func (c *Client) ListenAndServe(ctx context.Context, network, addr string) error {
+	if IsWebSocket(c.cfg.Transport) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
 	return c.server.ListenAndServe(ctx, network, addr)
 }
 
-// Register sends REGISTER and handles 401 with digest auth.
-func (c *Client) Register(ctx context.Context) error {
-	recipient := sip.Uri{}
-	parseURI := fmt.Sprintf("sip:%s@%s", c.cfg.Username, c.cfg.Server)
-	if err := sip.ParseUri(parseURI, &recipient); err != nil {
-		return err
+// Register sends REGISTER and handles 401 with digest auth. It returns the registration
+// lifetime the server granted (see grantedExpires), which also schedules the refresh. A
+// final error response from the server is returned as a *SIPError.
+func (c *Client) Register(ctx context.Context) (time.Duration, error) {
+	granted, err := c.register(ctx)
+	metrics.Register(err)
+	if err != nil {
+		c.mu.Lock()
+		c.registered = false
+		c.mu.Unlock()
 	}
-	req := sip.NewRequest(sip.REGISTER, recipient)
-	req.AppendHeader(sip.NewHeader("Contact", c.contactAddr()))
-	req.SetTransport(strings.ToUpper(c.cfg.Transport))
+	return granted, err
+}
 
-	tx, err := c.client.TransactionRequest(ctx, req, sipgo.ClientRequestRegisterBuild)
-	if err != nil {
+func (c *Client) register(ctx context.Context) (time.Duration, error) {
+	var granted time.Duration
+	err := c.retryUnavailable(ctx, func() error {
+		var err error
+		granted, err = c.registerOnce(ctx, true)
 		return err
-	}
-	defer tx.Terminate()
+	})
+	return granted, err
+}
 
-	res, err := c.getResponse(tx)
+// registerOnce sends one REGISTER and returns the granted lifetime; with learn set, a
+// Contact correction from the response Via triggers one more REGISTER.
+func (c *Client) registerOnce(ctx context.Context, learn bool) (time.Duration, error) {
+	requested := orDefaultExpires(c.cfg.RegisterExpires)
+	res, err := c.sendRegister(ctx, requested)
 	if err != nil {
+		return 0, err
+	}
+	if learn && c.learnContact(res) {
+		// Re-register (once) so the binding the PBX stores uses the corrected Contact.
+		return c.registerOnce(ctx, false)
+	}
+	granted := grantedExpires(res, c.contactHost(), requested)
+	c.mu.Lock()
+	c.registered = true
+	c.registerRefresh = time.Now().Add(refreshAfter(granted))
+	c.mu.Unlock()
+	c.log.Debug("registered", "status", res.StatusCode, "expires", granted)
+	return granted, nil
+}
+
+// Unregister removes the binding Register created by sending REGISTER with Expires: 0.
+func (c *Client) Unregister(ctx context.Context) error {
+	if _, err := c.sendRegister(ctx, 0); err != nil {
 		return err
 	}
+	c.mu.Lock()
+	c.registered = false
+	c.mu.Unlock()
+	c.log.Debug("unregistered")
+	return nil
+}
 
-	if res.StatusCode == 401 {
-		wwwAuth := res.GetHeader("WWW-Authenticate")
-		if wwwAuth == nil {
-			return fmt.Errorf("401 without WWW-Authenticate")
-		}
-		chal, err := digest.ParseChallenge(wwwAuth.Value())
-		if err != nil {
-			return err
-		}
-		cred, err := digest.Digest(chal, digest.Options{
-			Method:   req.Method.String(),
-			URI:      recipient.Host,
-			Username: c.cfg.Username,
-			Password: c.cfg.Password,
-		})
-		if err != nil {
-			return err
-		}
-		newReq := req.Clone()
-		newReq.RemoveHeader("Via")
-		newReq.AppendHeader(sip.NewHeader("Authorization", cred.String()))
-		tx2, err := c.client.TransactionRequest(ctx, newReq, sipgo.ClientRequestIncreaseCSEQ, sipgo.ClientRequestAddVia)
-		if err != nil {
-			return err
-		}
-		defer tx2.Terminate()
-		res, err = c.getResponse(tx2)
-		if err != nil {
-			return err
-		}
+// sendRegister sends one REGISTER for the Contact with the given Expires (seconds) and
+// returns the final 200 or 202 response; any other final response is a *SIPError.
+func (c *Client) sendRegister(ctx context.Context, expires int) (*sip.Response, error) {
+	recipient := sip.Uri{}
+	parseURI := fmt.Sprintf("sip:%s@%s", c.cfg.Username, c.cfg.Server)
+	if err := sip.ParseUri(parseURI, &recipient); err != nil {
+		return nil, err
 	}
+	req := sip.NewRequest(sip.REGISTER, recipient)
+	c.setFrom(req)
+	c.addHeaders(req)
+	req.AppendHeader(sip.NewHeader("Contact", c.contactAddr()))
+	req.AppendHeader(sip.NewHeader("Expires", strconv.Itoa(expires)))
+	req.SetTransport(strings.ToUpper(c.cfg.Transport))
 
+	res, _, err := c.transact(ctx, req, recipient, sipgo.ClientRequestRegisterBuild)
+	if err != nil {
+		return nil, err
+	}
 	if res.StatusCode != 200 && res.StatusCode != 202 {
-		return fmt.Errorf("register failed: %d", res.StatusCode)
+		return nil, responseError("REGISTER", c.cfg.Username, res)
 	}
-	c.log.Info("registered", "status", res.StatusCode)
-	return nil
+	return res, nil
 }
 
 // Subscribe sends SUBSCRIBE for the dialog event package for each extension.
-// Continues on 404 so other extensions can still be subscribed; returns error only if all fail.
+// When cfg.PresenceFallback is set, an extension whose dialog SUBSCRIBE returns 404 is retried
+// with the presence event package, as is any extension answered 489 Bad Event. Up to
+// cfg.SubscribeConcurrency extensions are subscribed at once. Continues on failures so other
+// extensions can still be subscribed; returns error only if all fail. A client without
+// extensions (e.g. all of them removed by a reload) has nothing to subscribe and succeeds.
 func (c *Client) Subscribe(ctx context.Context) error {
-	var failed []string
-	for _, ext := range c.extensions {
-		if err := c.subscribeOne(ctx, ext); err != nil {
-			if strings.Contains(err.Error(), "404") {
-				c.log.Warn("subscribe 404 (extension may lack BLF hint on PBX)", "extension", ext, "hint", "See README or FreePBX dialplan hints / res_pjsip allow_subscribe")
-			} else {
-				c.log.Error("subscribe failed", "extension", ext, "error", err)
-			}
-			failed = append(failed, ext)
-			continue
-		}
-		c.log.Info("subscribed to BLF", "extension", ext)
+	extensions := c.Extensions()
+	if len(extensions) == 0 {
+		c.log.Debug("no extensions to subscribe")
+		return nil
 	}
-	if len(failed) == len(c.extensions) {
+	start := time.Now()
+	failed := c.subscribeAll(ctx, extensions)
+	if len(failed) == len(extensions) {
 		return fmt.Errorf("all subscriptions failed (extensions: %v); check PBX dialplan hints and res_pjsip allow_subscribe", failed)
 	}
+	c.log.Info("subscriptions established", "subscribed", len(extensions)-len(failed), "failed", len(failed), "duration", time.Since(start).Round(time.Millisecond))
 	if len(failed) > 0 {
 		c.log.Warn("some extensions could not be subscribed", "failed", failed)
 	}
 	return nil
 }
 
-func (c *Client) subscribeOne(ctx context.Context, extension string) error {
+// subscribeExtension subscribes one extension (with the presence fallback), records the
+// subscription dialog and logs the outcome.
+func (c *Client) subscribeExtension(ctx context.Context, ext string) error {
+	sub, err := c.subscribeOne(ctx, ext, EventDialog)
+	switch code := statusCode(err); {
+	case code == 489:
+		// Bad Event: the PBX does not implement the dialog package, so presence is the only option.
+		c.log.Info("dialog event package not supported (489), retrying with presence event package", "extension", ext)
+		sub, err = c.subscribeOne(ctx, ext, EventPresence)
+	case code == 404 && c.cfg.PresenceFallback:
+		c.log.Info("dialog subscribe 404, retrying with presence event package", "extension", ext)
+		sub, err = c.subscribeOne(ctx, ext, EventPresence)
+	}
+	metrics.Subscribe(err)
+	if err != nil {
+		switch statusCode(err) {
+		case 404:
+			c.log.Warn("subscribe 404 (extension may lack BLF hint on PBX)", "extension", ext, "hint", "See README or FreePBX dialplan hints / res_pjsip allow_subscribe")
+		case 403:
+			c.log.Warn("subscribe 403 forbidden (PBX refused this peer by policy or credentials)", "extension", ext, "hint", "Check allow_subscribe and the subscribe context / ACL for the SIP user on the PBX")
+		case 489:
+			c.log.Warn("subscribe 489 bad event (PBX supports neither dialog nor presence for this extension)", "extension", ext)
+		default:
+			c.log.Error("subscribe failed", "extension", ext, "error", err)
+		}
+		return err
+	}
+	c.mu.Lock()
+	c.subs[ext] = sub
+	delete(c.pending, sub.callID)
+	delete(c.ended, ext)
+	metrics.SetActiveSubscriptions(c.cfg.Server, len(c.subs))
+	c.mu.Unlock()
+	c.log.Info("subscribed to BLF", "extension", ext, "event", sub.event, "expires", sub.expires)
+	return nil
+}
+
+// subscribeOne sends SUBSCRIBE for one extension using the given event package
+// (EventDialog or EventPresence), handling 401 with digest auth and retrying 503 responses.
+func (c *Client) subscribeOne(ctx context.Context, extension, event string) (*subscription, error) {
+	var sub *subscription
+	err := c.retryUnavailable(ctx, func() error {
+		var err error
+		sub, err = c.subscribeAttempt(ctx, extension, event)
+		return err
+	})
+	return sub, err
+}
+
+// subscribeAttempt sends one SUBSCRIBE for subscribeOne.
+func (c *Client) subscribeAttempt(ctx context.Context, extension, event string) (*subscription, error) {
 	recipient := sip.Uri{}
 	parseURI := fmt.Sprintf("sip:%s@%s", extension, c.cfg.Server)
 	if err := sip.ParseUri(parseURI, &recipient); err != nil {
-		return err
+		return nil, err
 	}
 	req := sip.NewRequest(sip.SUBSCRIBE, recipient)
-	req.AppendHeader(sip.NewHeader("Event", "dialog"))
-	req.AppendHeader(sip.NewHeader("Expires", "3600"))
-	req.AppendHeader(sip.NewHeader("Accept", "application/dialog-info+xml"))
+	c.setFrom(req)
+	c.setDialogID(req)
+	c.addHeaders(req)
+	req.AppendHeader(sip.NewHeader("Event", event))
+	requested := orDefaultExpires(c.cfg.SubscribeExpires)
+	req.AppendHeader(sip.NewHeader("Expires", strconv.Itoa(requested)))
+	req.AppendHeader(sip.NewHeader("Accept", acceptFor(event)))
+	req.AppendHeader(sip.NewHeader("Contact", c.contactAddr()))
 	req.SetTransport(strings.ToUpper(c.cfg.Transport))
 
-	tx, err := c.client.TransactionRequest(ctx, req, sipgo.ClientRequestBuild, sipgo.ClientRequestAddVia)
+	// The PBX may send the first NOTIFY before the 2xx; subscribeExtension drops the pending
+	// record once the subscription is stored.
+	callID := c.beginSubscribe(extension, event, req)
+	res, sent, err := c.transact(ctx, req, recipient, sipgo.ClientRequestBuild, sipgo.ClientRequestAddVia)
 	if err != nil {
-		return err
+		c.abortSubscribe(callID)
+		return nil, fmt.Errorf("subscribe %s: %w", extension, err)
 	}
-	defer tx.Terminate()
+	if res.StatusCode != 200 && res.StatusCode != 202 {
+		c.abortSubscribe(callID)
+		return nil, responseError("SUBSCRIBE", extension, res)
+	}
+	c.learnContact(res)
+	return newSubscription(extension, event, sent, res, requested), nil
+}
 
-	res, err := c.getResponse(tx)
-	if err != nil {
-		return err
+// transact sends req built with opts and, on 401, resends it once with digest credentials.
+// When a challenge from an earlier request is known, credentials are sent pre-emptively so
+// refreshes avoid a 401 round-trip; Authentication-Info nextnonce values are honoured.
+// It returns the final response and the request that produced it (the authenticated clone
+// when the server challenged).
+func (c *Client) transact(ctx context.Context, req *sip.Request, recipient sip.Uri, opts ...sipgo.ClientRequestOption) (*sip.Response, *sip.Request, error) {
+	req.RemoveHeader("Authorization")
+	if value, ok, err := c.auth.authorize(req.Method.String(), c.digestURI(req)); err != nil {
+		return nil, nil, err
+	} else if ok {
+		req.AppendHeader(sip.NewHeader("Authorization", value))
 	}
 
+	res, err := c.send(ctx, req, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
 	if res.StatusCode == 401 {
 		wwwAuth := res.GetHeader("WWW-Authenticate")
 		if wwwAuth == nil {
-			return fmt.Errorf("subscribe %s: 401 without WWW-Authenticate", extension)
+			return nil, nil, fmt.Errorf("%w: no WWW-Authenticate", responseError(req.Method.String(), recipient.User, res))
 		}
-		chal, err := digest.ParseChallenge(wwwAuth.Value())
-		if err != nil {
-			return fmt.Errorf("subscribe %s: parse challenge: %w", extension, err)
+		if err := c.auth.challenge(wwwAuth.Value()); err != nil {
+			return nil, nil, err
 		}
-		cred, err := digest.Digest(chal, digest.Options{
-			Method:   req.Method.String(),
-			URI:      recipient.Host,
-			Username: c.cfg.Username,
-			Password: c.cfg.Password,
-		})
+		value, _, err := c.auth.authorize(req.Method.String(), c.digestURI(req))
 		if err != nil {
-			return fmt.Errorf("subscribe %s: digest: %w", extension, err)
+			return nil, nil, err
 		}
 		newReq := req.Clone()
 		newReq.RemoveHeader("Via")
-		newReq.AppendHeader(sip.NewHeader("Authorization", cred.String()))
-		tx2, err := c.client.TransactionRequest(ctx, newReq, sipgo.ClientRequestIncreaseCSEQ, sipgo.ClientRequestAddVia)
+		newReq.RemoveHeader("Authorization")
+		newReq.AppendHeader(sip.NewHeader("Authorization", value))
+		res, err = c.send(ctx, newReq, sipgo.ClientRequestIncreaseCSEQ, sipgo.ClientRequestAddVia)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		defer tx2.Terminate()
-		res, err = c.getResponse(tx2)
-		if err != nil {
-			return err
+		req = newReq
+	}
+	if info := res.GetHeader("Authentication-Info"); info != nil {
+		c.auth.authenticationInfo(info.Value())
+	}
+	c.noteTCPPeer(res)
+	return res, req, nil
+}
+
+// digestURI returns the digest-uri for req (RFC 3261 22.4): its Request-URI as sent, which
+// for REGISTER has no user part (sipgo strips it), or just the host with
+// Config.DigestURIHostOnly.
+func (c *Client) digestURI(req *sip.Request) string {
+	if c.cfg.DigestURIHostOnly {
+		return req.Recipient.Host
+	}
+	uri := req.Recipient
+	if req.Method == sip.REGISTER {
+		uri.User = ""
+	}
+	return uri.String()
+}
+
+// send runs one client transaction and returns its first response.
+func (c *Client) send(ctx context.Context, req *sip.Request, opts ...sipgo.ClientRequestOption) (*sip.Response, error) {
+	res, err := c.roundTrip(ctx, req, opts...)
+	if err != nil && ctx.Err() == nil {
+		c.transportFailed(err)
+	}
+	return res, err
+}
+
+// roundTrip is send without reporting failures to Supervise.
+func (c *Client) roundTrip(ctx context.Context, req *sip.Request, opts ...sipgo.ClientRequestOption) (*sip.Response, error) {
+	tx, err := c.sipClient().TransactionRequest(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Terminate()
+	return c.getResponse(ctx, tx)
+}
+
+// acceptFor returns the Accept header value for the event package.
+func acceptFor(event string) string {
+	if event == EventPresence {
+		return blf.ContentTypePIDF + ", " + blf.ContentTypeXPIDF
+	}
+	return blf.ContentTypeDialogInfo
+}
+
+// eventPackage returns the event package name from an Event header value (without ;id= etc.).
+func eventPackage(h sip.Header) string {
+	if h == nil {
+		return ""
+	}
+	v := h.Value()
+	if idx := strings.Index(v, ";"); idx >= 0 {
+		v = v[:idx]
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+// userFromHeader returns the user part of the sip: URI in a From/To header value.
+func userFromHeader(h sip.Header) string {
+	if h == nil {
+		return ""
+	}
+	val := h.Value()
+	if idx := strings.Index(val, ":"); idx >= 0 {
+		rest := val[idx+1:]
+		if end := strings.IndexAny(rest, ">;"); end >= 0 {
+			rest = rest[:end]
+		}
+		if at := strings.Index(rest, "@"); at >= 0 {
+			return rest[:at]
 		}
 	}
+	return ""
+}
 
-	if res.StatusCode != 200 && res.StatusCode != 202 {
-		return fmt.Errorf("subscribe %s: %d", extension, res.StatusCode)
+// uriHost returns host as it must appear in a SIP URI: IPv6 addresses are bracketed
+// (RFC 3261 section 25.1), anything else is returned unchanged.
+func uriHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
 	}
-	return nil
+	return host
+}
+
+// sameHost reports whether two URI hosts are equal, ignoring case and IPv6 brackets.
+func sameHost(a, b string) bool {
+	return strings.EqualFold(strings.Trim(a, "[]"), strings.Trim(b, "[]"))
 }
 
-// contactAddr returns the Contact header value (sip:user@host or sip:user@host:port).
+// contactAddr returns the Contact header value (sip:user@host or sip:user@host:port),
+// preceded by the quoted display name when cfg.DisplayName is set.
 func (c *Client) contactAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr := fmt.Sprintf("<sip:%s@%s>", c.cfg.Username, uriHost(c.cfg.ContactIP))
 	if c.cfg.ContactPort > 0 && c.cfg.ContactPort != 5060 {
-		return fmt.Sprintf("<sip:%s@%s:%d>", c.cfg.Username, c.cfg.ContactIP, c.cfg.ContactPort)
+		addr = fmt.Sprintf("<sip:%s@%s:%d>", c.cfg.Username, uriHost(c.cfg.ContactIP), c.cfg.ContactPort)
+	}
+	switch {
+	case IsWebSocket(c.cfg.Transport):
+		addr = fmt.Sprintf("<sip:%s@%s;transport=%s>", c.cfg.Username, c.cfg.ContactIP, c.cfg.Transport)
+	case isTCP(c.cfg.Transport):
+		// Without it the PBX would send NOTIFYs to the Contact over UDP.
+		addr = strings.TrimSuffix(addr, ">") + ";transport=tcp>"
+	}
+	if c.cfg.DisplayName != "" {
+		return `"` + escapeDisplayName(c.cfg.DisplayName) + `" ` + addr
+	}
+	return addr
+}
+
+// setFrom adds our From header with cfg.DisplayName. Without a display name sipgo builds
+// From itself (using the username as display name), so nothing is added.
+func (c *Client) setFrom(req *sip.Request) {
+	if c.cfg.DisplayName == "" {
+		return
+	}
+	from := &sip.FromHeader{
+		DisplayName: escapeDisplayName(c.cfg.DisplayName), // sipgo adds the surrounding quotes
+		Address:     sip.Uri{Scheme: req.Recipient.Scheme, User: c.cfg.Username, Host: c.fromHost},
+		Params:      sip.NewParams(),
 	}
-	return fmt.Sprintf("<sip:%s@%s>", c.cfg.Username, c.cfg.ContactIP)
+	from.Params.Add("tag", sip.GenerateTagN(16))
+	req.AppendHeader(from)
 }
 
-func (c *Client) getResponse(tx sip.ClientTransaction) (*sip.Response, error) {
+// setDialogID adds the From tag and Call-ID that sipgo would otherwise add when sending
+// req, so its dialog is known before it goes out.
+func (c *Client) setDialogID(req *sip.Request) {
+	if req.From() == nil {
+		from := &sip.FromHeader{
+			DisplayName: c.cfg.Username,
+			Address:     sip.Uri{Scheme: req.Recipient.Scheme, User: c.cfg.Username, Host: c.fromHost},
+			Params:      sip.NewParams(),
+		}
+		from.Params.Add("tag", sip.GenerateTagN(16))
+		req.AppendHeader(from)
+	}
+	if req.CallID() == nil {
+		id := sip.CallIDHeader(uuid.NewString())
+		req.AppendHeader(&id)
+	}
+}
+
+// escapeDisplayName escapes a display name for use inside a quoted-string (RFC 3261
+// section 25.1): backslash and double quote are backslash-escaped, and control characters
+// (which cannot be quoted) are dropped.
+func escapeDisplayName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// clientOptions returns the sipgo client options for a Contact address. Via always carries
+// ;rport (RFC 3581) so the server reports the address it saw in received/rport.
+func clientOptions(ip string, port int) []sipgo.ClientOption {
+	opts := []sipgo.ClientOption{sipgo.WithClientHostname(ip), sipgo.WithClientNAT()}
+	if port > 0 {
+		opts = append(opts, sipgo.WithClientPort(port))
+	}
+	return opts
+}
+
+// contactHost returns the host advertised in Contact.
+func (c *Client) contactHost() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.ContactIP
+}
+
+// sipClient returns the sipgo client; it is replaced by SetContact.
+func (c *Client) sipClient() *sipgo.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+func (c *Client) getResponse(ctx context.Context, tx sip.ClientTransaction) (*sip.Response, error) {
 	select {
 	case <-tx.Done():
 		return nil, fmt.Errorf("transaction died")
 	case res := <-tx.Responses():
 		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -274,35 +667,130 @@ func (c *Client) handleNOTIFY(req *sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 
+	// A final NOTIFY (Subscription-State: terminated) may still carry the last state, so the
+	// subscription is dropped once the body has been handled.
+	if st, ok := parseSubscriptionState(req); ok && st.ended() {
+		defer c.endSubscription(req, st)
+	}
+
 	body := req.Body()
 	if len(body) == 0 {
 		return
 	}
+	// A NOTIFY in one of our subscription dialogs (Call-ID and tags) is for that
+	// subscription's extension, whatever the body says. Otherwise, for a presence NOTIFY From
+	// is the monitored resource (it mirrors the SUBSCRIBE To); dialog NOTIFYs name it in the
+	// body, and some PBXs also send it as To.
+	resource, inDialog := c.dialogExtension(req)
+	if !inDialog {
+		c.log.Debug("NOTIFY outside any subscription dialog; taking the extension from the message", "call_id", callIDOf(req))
+		resource = userFromHeader(req.GetHeader("To"))
+		if eventPackage(req.GetHeader("Event")) == EventPresence {
+			resource = userFromHeader(req.GetHeader("From"))
+		}
+	}
+	var contentType string
+	if h := req.GetHeader("Content-Type"); h != nil {
+		contentType = h.Value()
+	}
+	contentType, body, err := unwrapMultipart(contentType, body)
+	if err != nil {
+		c.log.Warn("NOTIFY body not understood", "resource", resource, "error", err)
+		return
+	}
+	c.processNotify(contentType, resource, inDialog, body)
+}
 
-	extension := blf.ExtensionFromDialogInfo(body)
+// callIDOf returns the Call-ID of req, or "" when it has none.
+func callIDOf(req *sip.Request) string {
+	if id := req.CallID(); id != nil {
+		return id.Value()
+	}
+	return ""
+}
+
+// InjectNotify runs a NOTIFY body through the handling of a NOTIFY received from the PBX
+// (dialog-info version ordering, DND detection, then Events listeners and the BLF
+// handler) without SIP transport, e.g. to replay captured bodies in tests. extension
+// stands in for the header naming the monitored resource; a dialog-info entity takes
+// precedence, as for a real NOTIFY. The body type is sniffed as for a NOTIFY without
+// Content-Type. It returns the extension and state published, with ok false when nothing
+// was (no extension, or an out-of-order dialog-info version).
+func (c *Client) InjectNotify(extension string, body []byte) (ext string, state blf.State, ok bool) {
+	return c.processNotify("", extension, false, body)
+}
+
+// processNotify interprets a NOTIFY body of the media type contentType (from Content-Type,
+// "" when absent; see bodyType) for resource and publishes the resulting state; see
+// InjectNotify. inDialog means resource is the extension of the subscription dialog the
+// NOTIFY arrived in, which a dialog-info entity does not override; otherwise resource comes
+// from the request headers.
+func (c *Client) processNotify(contentType, resource string, inDialog bool, body []byte) (extension string, state blf.State, ok bool) {
+	kind := bodyType(contentType, body)
+	extension = resource
+	if kind == blf.ContentTypeDialogInfo && !inDialog {
+		if ext := blf.ExtensionFromDialogInfo(body); ext != "" {
+			extension = ext
+		}
+	}
 	if extension == "" {
-		// Fallback: try To header (some PBXs send NOTIFY with To = monitored resource)
-		if to := req.GetHeader("To"); to != nil {
-			// Parse sip:user@host from To
-			val := to.Value()
-			if idx := strings.Index(val, ":"); idx >= 0 {
-				rest := val[idx+1:]
-				if end := strings.IndexAny(rest, ">;"); end >= 0 {
-					rest = rest[:end]
-				}
-				if at := strings.Index(rest, "@"); at >= 0 {
-					extension = rest[:at]
-				}
-			}
+		return "", "", false
+	}
+	metrics.NotifyReceived(extension)
+	c.noteNotify(extension)
+
+	switch kind {
+	case blf.ContentTypeDialogInfo:
+		doc, err := blf.ParseDialogDocument(body)
+		if err != nil {
+			state = blf.ParsePresenceBody(body)
+			break
+		}
+		var fresh bool
+		if state, fresh = c.applyDocument(extension, doc); !fresh {
+			c.log.Debug("dropping out-of-order NOTIFY", "extension", extension, "version", doc.Version)
+			return extension, "", false
+		}
+	case blf.ContentTypeXPIDF:
+		if doc, err := blf.ParseXPIDF(body); err == nil {
+			state = doc.State()
+		} else {
+			state = blf.ParsePresenceBody(body)
+		}
+	default:
+		if doc, err := blf.ParsePIDF(body); err == nil {
+			state = doc.State()
+		} else {
+			state = blf.ParsePresenceBody(body)
 		}
 	}
+	state = c.dnd(body, state)
+	c.publish(extension, state)
+	return extension, state, true
+}
 
-	state := blf.ParseDialogInfo(body)
-	if state == blf.StateUnknown {
-		state = blf.ParsePresenceBody(body)
+// bodyType returns which parser handles a NOTIFY body: blf.ContentTypeDialogInfo,
+// blf.ContentTypePIDF or blf.ContentTypeXPIDF. The declared contentType decides when it
+// is one of those; only a missing or unknown one falls back to sniffing the body.
+func bodyType(contentType string, body []byte) string {
+	switch contentType {
+	case blf.ContentTypeDialogInfo, blf.ContentTypePIDF, blf.ContentTypeXPIDF:
+		return contentType
+	}
+	if bytes.Contains(body, []byte("dialog-info")) {
+		return blf.ContentTypeDialogInfo
 	}
+	if _, err := blf.ParseXPIDF(body); err == nil {
+		return blf.ContentTypeXPIDF
+	}
+	return blf.ContentTypePIDF
+}
 
-	if extension != "" && c.onBLF != nil {
-		c.onBLF(extension, state)
+// dnd returns blf.StateDND when body signals Do Not Disturb per cfg.DNDIndicators,
+// otherwise state.
+func (c *Client) dnd(body []byte, state blf.State) blf.State {
+	if blf.DetectDND(body, c.cfg.DNDIndicators) {
+		return blf.StateDND
 	}
+	return state
 }
@@ -0,0 +1,190 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestEscapeDisplayName(t *testing.T) {
+	tests := map[string]string{
+		"BLF Sync":        "BLF Sync",
+		`Front "Desk"`:    `Front \"Desk\"`,
+		`C:\PBX`:          `C:\\PBX`,
+		"Müller, Anna":    "Müller, Anna",
+		"line\r\nbreak\t": "linebreak",
+	}
+	for in, want := range tests {
+		if got := escapeDisplayName(in); got != want {
+			t.Errorf("escapeDisplayName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestContactAddr_DisplayName(t *testing.T) {
+	c := &Client{cfg: Config{Username: "blf-client", ContactIP: "203.0.113.5", ContactPort: 5070, DisplayName: `BLF "Sync"`}}
+	if got, want := c.contactAddr(), `"BLF \"Sync\"" <sip:blf-client@203.0.113.5:5070>`; got != want {
+		t.Errorf("contactAddr() = %q, want %q", got, want)
+	}
+	c.cfg.DisplayName = ""
+	if got, want := c.contactAddr(), "<sip:blf-client@203.0.113.5:5070>"; got != want {
+		t.Errorf("contactAddr() = %q, want %q", got, want)
+	}
+}
+
+func TestContactAddr_IPv6(t *testing.T) {
+	c := &Client{cfg: Config{Username: "blf-client", ContactIP: "2001:db8::1"}}
+	if got, want := c.contactAddr(), "<sip:blf-client@[2001:db8::1]>"; got != want {
+		t.Errorf("contactAddr() = %q, want %q", got, want)
+	}
+	c.cfg.ContactPort = 5070
+	if got, want := c.contactAddr(), "<sip:blf-client@[2001:db8::1]:5070>"; got != want {
+		t.Errorf("contactAddr() = %q, want %q", got, want)
+	}
+}
+
+func TestURIHost(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.5":     "203.0.113.5",
+		"pbx.example.com": "pbx.example.com",
+		"2001:db8::1":     "[2001:db8::1]",
+		"[2001:db8::1]":   "[2001:db8::1]",
+		"::1":             "[::1]",
+	}
+	for in, want := range tests {
+		if got := uriHost(in); got != want {
+			t.Errorf("uriHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInjectNotify(t *testing.T) {
+	type published struct {
+		ext   string
+		state blf.State
+	}
+	var got []published
+	c := &Client{
+		cfg:   Config{DNDIndicators: []string{"dnd"}},
+		log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		views: make(map[string]*dialogView),
+		onBLF: func(ext string, s blf.State) { got = append(got, published{ext, s}) },
+	}
+	confirmed := []byte(`<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="2" state="full" entity="sip:101@pbx">
+  <dialog id="a"><state>confirmed</state></dialog>
+</dialog-info>`)
+	stale := []byte(`<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="full" entity="sip:101@pbx">
+  <dialog id="a"><state>early</state></dialog>
+</dialog-info>`)
+	dnd := []byte(`<?xml version="1.0"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="sip:102@pbx">
+  <tuple id="t"><status><basic>open</basic></status><note>DND</note></tuple>
+</presence>`)
+
+	if ext, state, ok := c.InjectNotify("999", confirmed); !ok || ext != "101" || state != blf.StateBusy {
+		t.Errorf("dialog-info = %q %q %v, want 101 busy from the entity", ext, state, ok)
+	}
+	if _, _, ok := c.InjectNotify("101", stale); ok {
+		t.Error("older version published, want it dropped as out of order")
+	}
+	if ext, state, ok := c.InjectNotify("102", dnd); !ok || ext != "102" || state != blf.StateDND {
+		t.Errorf("PIDF = %q %q %v, want 102 dnd", ext, state, ok)
+	}
+	if _, _, ok := c.InjectNotify("", dnd); ok {
+		t.Error("PIDF without extension published")
+	}
+	want := []published{{"101", blf.StateBusy}, {"102", blf.StateDND}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("handler saw %v, want %v", got, want)
+	}
+}
+
+func TestBodyType(t *testing.T) {
+	// A PIDF note mentioning dialog-info must not be parsed as dialog-info when declared.
+	pidf := []byte(`<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="pres:101@pbx"><!-- not dialog-info -->
+  <tuple id="t"><status><basic>open</basic></status></tuple></presence>`)
+	xpidf := []byte(`<presence><presentity uri="sip:101@pbx"/><atom id="1"><address uri="sip:101@pbx"><status status="inuse"/></address></atom></presence>`)
+	tests := []struct {
+		name, contentType string
+		body              []byte
+		want              string
+	}{
+		{"declared PIDF", blf.ContentTypePIDF, pidf, blf.ContentTypePIDF},
+		{"sniffed PIDF with dialog-info comment", "", pidf, blf.ContentTypeDialogInfo},
+		{"declared XPIDF", blf.ContentTypeXPIDF, xpidf, blf.ContentTypeXPIDF},
+		{"sniffed XPIDF", "text/plain", xpidf, blf.ContentTypeXPIDF},
+		{"declared dialog-info", blf.ContentTypeDialogInfo, []byte("<dialog-info/>"), blf.ContentTypeDialogInfo},
+		{"garbled header", "application/", pidf[:0], blf.ContentTypePIDF},
+	}
+	for _, tt := range tests {
+		if got := bodyType(tt.contentType, tt.body); got != tt.want {
+			t.Errorf("%s: bodyType = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	c := &Client{log: slog.New(slog.NewTextHandler(io.Discard, nil)), views: make(map[string]*dialogView)}
+	if ext, state, ok := c.processNotify(blf.ContentTypePIDF, "101", false, pidf); !ok || ext != "101" || state != blf.StateIdle {
+		t.Errorf("declared PIDF = %q %q %v, want 101 idle", ext, state, ok)
+	}
+}
+
+// TestUnregister checks that Unregister sends a REGISTER for the same Contact with
+// Expires: 0 and clears Registered.
+func TestUnregister(t *testing.T) {
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+	pbx, err := sipgo.NewServer(ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type binding struct{ contact, expires string }
+	got := make(chan binding, 2)
+	pbx.OnRegister(func(req *sip.Request, tx sip.ServerTransaction) {
+		got <- binding{req.GetHeader("Contact").Value(), req.GetHeader("Expires").Value()}
+		tx.Respond(sip.NewResponseFromRequest(req, 200, "OK", nil))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := make(chan string, 1)
+	ready := sipgo.ListenReadyFuncCtxValue(func(_, a string) { addr <- a })
+	go pbx.ListenAndServe(context.WithValue(ctx, sipgo.ListenReadyCtxKey, ready), "tcp", "127.0.0.1:0")
+	var server string
+	select {
+	case server = <-addr:
+	case <-ctx.Done():
+		t.Fatal("listener not ready")
+	}
+
+	cfg := Config{Server: server, Transport: "tcp", Username: "blf-client", ContactIP: "127.0.0.1"}
+	c, err := NewClient(cfg, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Register(ctx); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := c.Unregister(ctx); err != nil {
+		t.Fatalf("Unregister: %v", err)
+	}
+	if c.Registered() {
+		t.Error("Registered = true after Unregister")
+	}
+	register, unregister := <-got, <-got
+	if register.expires != "3600" || unregister.expires != "0" || unregister.contact != register.contact {
+		t.Errorf("REGISTERs = %+v then %+v, want Expires 3600 then 0 for the same Contact", register, unregister)
+	}
+}
@@ -0,0 +1,63 @@
+package sip
+
+import (
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// dialogView is the per-extension picture built from dialog-info NOTIFYs: the last applied
+// document version and the state of each live dialog by ID. Full documents replace the set,
+// partial documents (RFC 4235 state="partial") update it in place, and terminated dialogs are
+// removed so the set only holds calls that are still up.
+type dialogView struct {
+	version    uint64
+	hasVersion bool
+	dialogs    map[string]blf.State
+}
+
+func newDialogView() *dialogView {
+	return &dialogView{dialogs: make(map[string]blf.State)}
+}
+
+// apply merges doc into the view and returns the aggregate state of the merged dialogs.
+// A document whose version is lower than the last applied one is stale (delayed or
+// reordered) and is ignored: fresh is false.
+func (v *dialogView) apply(doc *blf.Document) (state blf.State, fresh bool) {
+	if doc.HasVersion && v.hasVersion && doc.Version < v.version {
+		return "", false
+	}
+	if !doc.Partial {
+		clear(v.dialogs)
+	}
+	for _, d := range doc.Dialogs {
+		if d.State == blf.StateIdle {
+			delete(v.dialogs, d.ID)
+			continue
+		}
+		v.dialogs[d.ID] = d.State
+	}
+	if doc.HasVersion {
+		v.version, v.hasVersion = doc.Version, true
+	}
+	return v.state(), true
+}
+
+// state returns the aggregate state of the live dialogs (idle when none).
+func (v *dialogView) state() blf.State {
+	states := make([]blf.State, 0, len(v.dialogs))
+	for _, st := range v.dialogs {
+		states = append(states, st)
+	}
+	return blf.Aggregate(states)
+}
+
+// applyDocument merges doc into the extension's dialog view; see dialogView.apply.
+func (c *Client) applyDocument(extension string, doc *blf.Document) (state blf.State, fresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.views[extension]
+	if v == nil {
+		v = newDialogView()
+		c.views[extension] = v
+	}
+	return v.apply(doc)
+}
@@ -0,0 +1,55 @@
+package sip
+
+import (
+	"testing"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func mustDoc(t *testing.T, body string) *blf.Document {
+	t.Helper()
+	doc, err := blf.ParseDialogDocument([]byte(body))
+	if err != nil {
+		t.Fatalf("ParseDialogDocument: %v", err)
+	}
+	return doc
+}
+
+func TestDialogView_FullPartialInterleaving(t *testing.T) {
+	v := newDialogView()
+	steps := []struct {
+		name  string
+		body  string
+		want  blf.State
+		fresh bool
+	}{
+		{"full: one call up", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="0" state="full" entity="sip:6000@pbx">
+  <dialog id="a"><state>confirmed</state></dialog>
+</dialog-info>`, blf.StateBusy, true},
+		{"partial: second call rings", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="partial" entity="sip:6000@pbx">
+  <dialog id="b"><state>early</state></dialog>
+</dialog-info>`, blf.StateBusy, true},
+		{"partial: first call ends, second still ringing", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="2" state="partial" entity="sip:6000@pbx">
+  <dialog id="a"><state>terminated</state></dialog>
+</dialog-info>`, blf.StateRinging, true},
+		{"stale: delayed version 1 is dropped", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="1" state="partial" entity="sip:6000@pbx">
+  <dialog id="a"><state>confirmed</state></dialog>
+</dialog-info>`, "", false},
+		{"partial: second call answered", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="3" state="partial" entity="sip:6000@pbx">
+  <dialog id="b"><state>confirmed</state></dialog>
+</dialog-info>`, blf.StateBusy, true},
+		{"full: no dialogs replaces the set", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="4" state="full" entity="sip:6000@pbx"/>`, blf.StateIdle, true},
+		{"partial: unrelated dialog terminated stays idle", `<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="5" state="partial" entity="sip:6000@pbx">
+  <dialog id="c"><state>terminated</state></dialog>
+</dialog-info>`, blf.StateIdle, true},
+	}
+	for _, st := range steps {
+		got, fresh := v.apply(mustDoc(t, st.body))
+		if fresh != st.fresh || (fresh && got != st.want) {
+			t.Errorf("%s: apply = %v (fresh %v), want %v (fresh %v)", st.name, got, fresh, st.want, st.fresh)
+		}
+	}
+	if len(v.dialogs) != 0 {
+		t.Errorf("terminated dialogs not pruned: %v", v.dialogs)
+	}
+}
@@ -0,0 +1,58 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// SIPError is a final non-success response to a request the client sent. Callers branch on
+// StatusCode with errors.As rather than matching the error text.
+type SIPError struct {
+	Method     string // e.g. "SUBSCRIBE"
+	Target     string // extension or AOR the request was for
+	StatusCode int
+	Reason     string
+	RetryAfter time.Duration // Retry-After of the response; 0 when absent
+}
+
+func (e *SIPError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Target, e.StatusCode, e.Reason)
+}
+
+// responseError returns the SIPError for res, a final response to a method request for target.
+func responseError(method, target string, res *sip.Response) *SIPError {
+	return &SIPError{Method: method, Target: target, StatusCode: res.StatusCode, Reason: res.Reason, RetryAfter: retryAfter(res)}
+}
+
+// retryAfter returns the delay in the Retry-After header of res (RFC 3261 20.33: seconds,
+// optionally followed by a comment and parameters), or 0 when it is absent or invalid.
+func retryAfter(res *sip.Response) time.Duration {
+	h := res.GetHeader("Retry-After")
+	if h == nil {
+		return 0
+	}
+	v := strings.TrimSpace(h.Value())
+	end := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		v = v[:end]
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// statusCode returns the SIP status code carried by err, or 0 when err is not a SIPError.
+func statusCode(err error) int {
+	var se *SIPError
+	if errors.As(err, &se) {
+		return se.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,31 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestSIPError(t *testing.T) {
+	res := sip.NewResponse(404, "Not Found (try 403 later)")
+	err := fmt.Errorf("subscribe batch: %w", responseError("SUBSCRIBE", "101", res))
+
+	var se *SIPError
+	if !errors.As(err, &se) {
+		t.Fatalf("errors.As(%v) = false, want *SIPError", err)
+	}
+	if se.StatusCode != 404 || se.Reason != "Not Found (try 403 later)" {
+		t.Errorf("SIPError = %+v, want 404 with the reason phrase", se)
+	}
+	if got := statusCode(err); got != 404 {
+		t.Errorf("statusCode = %d, want 404 (digits in the reason must not matter)", got)
+	}
+	if got := statusCode(errors.New("SUBSCRIBE 101: 404")); got != 0 {
+		t.Errorf("statusCode(plain error) = %d, want 0", got)
+	}
+	if got, want := se.Error(), "SUBSCRIBE 101: 404 Not Found (try 403 later)"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
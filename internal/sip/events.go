@@ -0,0 +1,47 @@
+package sip
+
+import (
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
+)
+
+// Events registers a new channel that receives every BLF state change the client reports,
+// alongside the BLFHandler, and returns it. The channel buffers size events (at least one).
+// Delivery never blocks NOTIFY handling: when a consumer falls behind and its buffer is
+// full, the event is dropped for that consumer and a warning is logged. The channel is
+// never closed.
+func (c *Client) Events(size int) <-chan blf.Event {
+	ch := make(chan blf.Event, max(size, 1))
+	c.mu.Lock()
+	c.listeners = append(c.listeners, ch)
+	c.mu.Unlock()
+	return ch
+}
+
+// publish reports a state change to every Events channel and then to the BLFHandler.
+// Channels go first so a slow handler (e.g. Graph writes) does not delay consumers. The
+// state is kept as the extension's LastState (see Subscriptions); the consumers get the
+// extension normalized per Config.ExtensionPolicy.
+func (c *Client) publish(extension string, state blf.State) {
+	c.mu.Lock()
+	listeners := c.listeners
+	c.updateNotified(extension, func(n *notifyRecord) { n.state = state })
+	c.mu.Unlock()
+	extension = blf.NormalizeExtension(extension, c.cfg.ExtensionPolicy)
+	if len(listeners) > 0 {
+		ev := blf.Event{Extension: extension, State: state, Time: time.Now()}
+		for _, ch := range listeners {
+			select {
+			case ch <- ev:
+			default:
+				metrics.EventDropped()
+				c.log.Warn("BLF event dropped; consumer is not keeping up", "extension", extension, "state", state)
+			}
+		}
+	}
+	if c.onBLF != nil {
+		c.onBLF(extension, state)
+	}
+}
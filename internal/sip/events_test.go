@@ -0,0 +1,56 @@
+package sip
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func TestEvents_DropWhenFull(t *testing.T) {
+	var handled []blf.State
+	c := &Client{
+		log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		onBLF: func(_ string, s blf.State) { handled = append(handled, s) },
+	}
+	slow := c.Events(1)
+	fast := c.Events(4)
+
+	c.publish("101", blf.StateRinging)
+	c.publish("101", blf.StateBusy) // slow is full: dropped there, delivered elsewhere
+
+	if got := len(slow); got != 1 {
+		t.Fatalf("slow consumer has %d events, want 1", got)
+	}
+	if ev := <-slow; ev.Extension != "101" || ev.State != blf.StateRinging || ev.Time.IsZero() {
+		t.Errorf("slow consumer got %+v, want the ringing event", ev)
+	}
+	if got := len(fast); got != 2 {
+		t.Errorf("fast consumer has %d events, want 2", got)
+	}
+	if len(handled) != 2 {
+		t.Errorf("handler saw %v, want both states", handled)
+	}
+}
+
+func TestEvents_NormalizedExtension(t *testing.T) {
+	var handled []string
+	c := &Client{
+		cfg:   Config{ExtensionPolicy: blf.ExtensionDigits},
+		log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		views: make(map[string]*dialogView),
+		onBLF: func(ext string, _ blf.State) { handled = append(handled, ext) },
+	}
+	events := c.Events(4)
+	// The entity carries a "+"; the To-header fallback an Asterisk context.
+	c.InjectNotify("101", []byte(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="0" state="full" entity="sip:+1001@pbx"/>`))
+	c.InjectNotify("1002@from-internal", []byte(`<presence xmlns="urn:ietf:params:xml:ns:pidf"><tuple id="t"><status><basic>open</basic></status></tuple></presence>`))
+	if want := []string{"1001", "1002"}; !slices.Equal(handled, want) {
+		t.Errorf("handler saw %v, want %v", handled, want)
+	}
+	if ev := <-events; ev.Extension != "1001" {
+		t.Errorf("event extension = %q, want 1001", ev.Extension)
+	}
+}
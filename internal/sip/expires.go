@@ -0,0 +1,169 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Expires bounds and defaults, in seconds.
+const (
+	defaultExpires = 3600
+	minExpires     = 60
+	maxExpires     = 86400
+)
+
+// refreshTick is how often RunRefresh checks for registrations and subscriptions due;
+// refreshRetry is the delay before retrying a failed registration refresh.
+const (
+	refreshTick  = 5 * time.Second
+	refreshRetry = 30 * time.Second
+)
+
+// validateExpires checks a configured Expires value; 0 means the default.
+func validateExpires(name string, v int) error {
+	if v != 0 && (v < minExpires || v > maxExpires) {
+		return fmt.Errorf("%s must be between %d and %d seconds, got %d", name, minExpires, maxExpires, v)
+	}
+	return nil
+}
+
+// orDefaultExpires returns v, or defaultExpires when v is 0.
+func orDefaultExpires(v int) int {
+	if v == 0 {
+		return defaultExpires
+	}
+	return v
+}
+
+// refreshAfter returns when to refresh something granted for expires: at 80% of the
+// lifetime, so a lost refresh can still be retried before it lapses.
+func refreshAfter(expires time.Duration) time.Duration {
+	return expires * 4 / 5
+}
+
+// grantedExpires returns the registration lifetime the server granted in res: the expires
+// parameter of the Contact matching contactHost, else as headerExpires.
+func grantedExpires(res *sip.Response, contactHost string, requested int) time.Duration {
+	for _, h := range res.GetHeaders("Contact") {
+		ch, ok := h.(*sip.ContactHeader)
+		if !ok || !sameHost(ch.Address.Host, contactHost) {
+			continue
+		}
+		if v, ok := ch.Params.Get("expires"); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return headerExpires(res, requested)
+}
+
+// headerExpires returns the lifetime in the Expires header of res, or requested (seconds)
+// when it is missing or invalid.
+func headerExpires(res *sip.Response, requested int) time.Duration {
+	if h := res.GetHeader("Expires"); h != nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(h.Value())); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return time.Duration(requested) * time.Second
+}
+
+// RunRefresh re-registers and refreshes subscriptions before their granted lifetimes
+// lapse, until ctx is done. A subscription the PBX no longer knows is re-established
+// from scratch, as is one it terminated, when its reason allows (see endSubscription).
+func (c *Client) RunRefresh(ctx context.Context) {
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		c.mu.Lock()
+		regDue := !c.registerRefresh.IsZero() && now.After(c.registerRefresh)
+		var due []*subscription
+		for _, sub := range c.subs {
+			if now.After(sub.refreshAt) {
+				due = append(due, sub)
+			}
+		}
+		var again []string
+		for ext, e := range c.ended {
+			if !e.resubscribeAt.IsZero() && now.After(e.resubscribeAt) && c.subs[ext] == nil {
+				again = append(again, ext)
+			}
+		}
+		c.mu.Unlock()
+
+		if regDue {
+			if _, err := c.Register(ctx); err != nil {
+				c.log.Warn("registration refresh failed", "error", err, "retry_in", refreshRetry)
+				c.mu.Lock()
+				c.registerRefresh = time.Now().Add(refreshRetry)
+				c.mu.Unlock()
+			}
+		}
+		for _, sub := range due {
+			c.refreshSubscription(ctx, sub)
+		}
+		for _, ext := range again {
+			c.resubscribe(ctx, ext)
+		}
+	}
+}
+
+// refreshSubscription refreshes sub in its dialog, or subscribes again when the dialog is gone.
+func (c *Client) refreshSubscription(ctx context.Context, sub *subscription) {
+	next, err := c.refreshOne(ctx, sub)
+	if statusCode(err) == 481 { // Call/Transaction Does Not Exist: the PBX dropped the dialog
+		c.log.Info("subscription gone, subscribing again", "extension", sub.extension)
+		_ = c.subscribeExtension(ctx, sub.extension)
+		return
+	}
+	if err != nil {
+		c.log.Warn("subscription refresh failed", "extension", sub.extension, "error", err)
+		return
+	}
+	c.mu.Lock()
+	if c.subs[sub.extension] == sub { // not replaced or removed meanwhile
+		c.subs[sub.extension] = next
+	}
+	c.mu.Unlock()
+	c.log.Debug("subscription refreshed", "extension", sub.extension, "expires", next.expires)
+}
+
+// refreshOne sends an in-dialog SUBSCRIBE renewing sub for the configured Expires.
+func (c *Client) refreshOne(ctx context.Context, sub *subscription) (*subscription, error) {
+	requested := orDefaultExpires(c.cfg.SubscribeExpires)
+	req := sub.req.Clone()
+	req.RemoveHeader("Via")
+	req.RemoveHeader("Authorization")
+	req.RemoveHeader("Expires")
+	req.RemoveHeader("Contact")
+	req.AppendHeader(sip.NewHeader("Expires", strconv.Itoa(requested)))
+	req.AppendHeader(sip.NewHeader("Contact", c.contactAddr()))
+	if to := req.To(); to != nil && sub.toTag != "" {
+		to.Params.Add("tag", sub.toTag)
+	}
+	applyRoutes(req, sub.routes, sub.target)
+	res, sent, err := c.transact(ctx, req, req.Recipient, sipgo.ClientRequestIncreaseCSEQ, sipgo.ClientRequestAddVia)
+	if err != nil {
+		return nil, fmt.Errorf("refresh %s: %w", sub.extension, err)
+	}
+	if res.StatusCode != 200 && res.StatusCode != 202 {
+		return nil, responseError("SUBSCRIBE", sub.extension, res)
+	}
+	// The route set is fixed when the dialog is established (RFC 3261 12.2.1.2).
+	next := newSubscription(sub.extension, sub.event, sent, res, requested)
+	next.routes, next.target, next.established = sub.routes, sub.target, sub.established
+	return next, nil
+}
@@ -0,0 +1,62 @@
+package sip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestGrantedExpires(t *testing.T) {
+	contact := func(host, expires string) sip.Header {
+		h := &sip.ContactHeader{Address: sip.Uri{User: "blf-client", Host: host}, Params: sip.NewParams()}
+		if expires != "" {
+			h.Params.Add("expires", expires)
+		}
+		return h
+	}
+	tests := []struct {
+		name    string
+		headers []sip.Header
+		want    time.Duration
+	}{
+		{"none: requested", nil, 3600 * time.Second},
+		{"Expires header", []sip.Header{sip.NewHeader("Expires", "600")}, 600 * time.Second},
+		{"our Contact wins", []sip.Header{contact("10.0.0.9", "900"), contact("203.0.113.5", "300"), sip.NewHeader("Expires", "600")}, 300 * time.Second},
+		{"other Contact ignored", []sip.Header{contact("10.0.0.9", "900")}, 3600 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := sip.NewResponse(200, "OK")
+			for _, h := range tt.headers {
+				res.AppendHeader(h)
+			}
+			if got := grantedExpires(res, "203.0.113.5", 3600); got != tt.want {
+				t.Errorf("grantedExpires = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantedExpires_IPv6Contact(t *testing.T) {
+	res := sip.NewResponse(200, "OK")
+	h := &sip.ContactHeader{Address: sip.Uri{User: "blf-client", Host: "[2001:DB8::1]"}, Params: sip.NewParams()}
+	h.Params.Add("expires", "300")
+	res.AppendHeader(h)
+	if got, want := grantedExpires(res, "2001:db8::1", 3600), 300*time.Second; got != want {
+		t.Errorf("grantedExpires = %v, want %v", got, want)
+	}
+}
+
+func TestValidateExpires(t *testing.T) {
+	for _, v := range []int{0, 60, 3600, 86400} {
+		if err := validateExpires("x", v); err != nil {
+			t.Errorf("validateExpires(%d) = %v, want nil", v, err)
+		}
+	}
+	for _, v := range []int{-1, 59, 86401} {
+		if err := validateExpires("x", v); err == nil {
+			t.Errorf("validateExpires(%d) = nil, want error", v)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package sip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// Header is an extra header sent on REGISTER and SUBSCRIBE requests (Config.ExtraHeaders).
+type Header struct {
+	Name  string
+	Value string
+}
+
+// reservedHeader reports whether name is a header the client sets itself (compact forms
+// included), which an extra header may not replace.
+func reservedHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "via", "v", "from", "f", "to", "t", "call-id", "i", "cseq", "contact", "m",
+		"max-forwards", "expires", "event", "o", "accept", "content-length", "l",
+		"content-type", "c", "route", "record-route", "authorization", "proxy-authorization",
+		"user-agent": // User-Agent is Config.UserAgent
+		return true
+	}
+	return false
+}
+
+// ParseExtraHeaders parses "Name: value" entries (e.g. "X-Tenant: acme") into headers.
+// Names must be RFC 3261 tokens and may not be one of the headers the client sets itself
+// (Via, From, To, Call-ID, CSeq, Contact, Expires, Event, Authorization, User-Agent, ...);
+// values may not be empty or contain line breaks.
+func ParseExtraHeaders(entries []string) ([]Header, error) {
+	var headers []Header
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case !ok || value == "":
+			return nil, fmt.Errorf("extra header %q: want Name: value", entry)
+		case !isToken(name):
+			return nil, fmt.Errorf("extra header %q: invalid header name", entry)
+		case reservedHeader(name):
+			return nil, fmt.Errorf("extra header %q: %s is set by the client", entry, name)
+		case strings.ContainsAny(value, "\r\n"):
+			return nil, fmt.Errorf("extra header %q: value contains a line break", entry)
+		}
+		headers = append(headers, Header{Name: name, Value: value})
+	}
+	return headers, nil
+}
+
+// isToken reports whether s is a non-empty RFC 3261 token (section 25.1).
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-.!%*_+`'~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setUserAgent adds the User-Agent header (Config.UserAgent) to req.
+func (c *Client) setUserAgent(req *sip.Request) {
+	if c.cfg.UserAgent != "" {
+		req.AppendHeader(sip.NewHeader("User-Agent", c.cfg.UserAgent))
+	}
+}
+
+// addHeaders adds the User-Agent and Config.ExtraHeaders to the REGISTER or initial
+// SUBSCRIBE req; refreshes and unsubscribes copy them from the SUBSCRIBE.
+func (c *Client) addHeaders(req *sip.Request) {
+	c.setUserAgent(req)
+	for _, h := range c.cfg.ExtraHeaders {
+		req.AppendHeader(sip.NewHeader(h.Name, h.Value))
+	}
+}
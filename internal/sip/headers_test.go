@@ -0,0 +1,54 @@
+package sip
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestParseExtraHeaders(t *testing.T) {
+	got, err := ParseExtraHeaders([]string{"X-Tenant: acme", " P-Preferred-Identity:<sip:blf@pbx;user=phone> "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Header{{"X-Tenant", "acme"}, {"P-Preferred-Identity", "<sip:blf@pbx;user=phone>"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseExtraHeaders = %v, want %v", got, want)
+	}
+
+	for _, entry := range []string{
+		"X-Tenant",         // no value
+		"X-Tenant:",        // empty value
+		"X Tenant: acme",   // not a token
+		": acme",           // no name
+		"Call-ID: x",       // set by the client
+		"contact: <sip:x>", // case-insensitive
+		"i: x",             // compact form of Call-ID
+		"User-Agent: x",    // SIP_USER_AGENT
+		"X-Tenant: a\r\nVia: x",
+	} {
+		if _, err := ParseExtraHeaders([]string{entry}); err == nil {
+			t.Errorf("ParseExtraHeaders(%q): want error", entry)
+		}
+	}
+}
+
+func TestAddHeaders(t *testing.T) {
+	c := &Client{cfg: Config{UserAgent: "blf/1.0", ExtraHeaders: []Header{{"X-Tenant", "acme"}}}}
+	req := sip.NewRequest(sip.SUBSCRIBE, sip.Uri{Scheme: "sip", User: "101", Host: "pbx"})
+	c.addHeaders(req)
+	if h := req.GetHeader("User-Agent"); h == nil || h.Value() != "blf/1.0" {
+		t.Errorf("User-Agent = %v, want blf/1.0", h)
+	}
+	if h := req.GetHeader("X-Tenant"); h == nil || h.Value() != "acme" {
+		t.Errorf("X-Tenant = %v, want acme", h)
+	}
+
+	c.cfg.UserAgent = ""
+	req = sip.NewRequest(sip.OPTIONS, sip.Uri{Scheme: "sip", Host: "pbx"})
+	c.setUserAgent(req)
+	if h := req.GetHeader("User-Agent"); h != nil {
+		t.Errorf("User-Agent = %q with none configured", h.Value())
+	}
+}
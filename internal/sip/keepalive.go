@@ -0,0 +1,69 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// keepaliveMaxMisses is how many consecutive unanswered keepalives mark the path dead.
+const keepaliveMaxMisses = 2
+
+// RunKeepalive sends an OPTIONS request to the SIP server every interval until ctx is done,
+// keeping the NAT binding that NOTIFYs arrive through open. Any response, even an error
+// status, proves the path works; after keepaliveMaxMisses consecutive requests go
+// unanswered, a reconnect is triggered (see Supervise).
+func (c *Client) RunKeepalive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	misses := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := c.ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			if misses > 0 {
+				c.log.Info("keepalive answered again", "missed", misses)
+			}
+			misses = 0
+			continue
+		}
+		misses++
+		c.log.Warn("keepalive unanswered", "misses", misses, "error", err)
+		if misses >= keepaliveMaxMisses {
+			misses = 0
+			c.transportFailed(fmt.Errorf("%d keepalives unanswered: %w", keepaliveMaxMisses, err))
+		}
+	}
+}
+
+// ping sends one OPTIONS to the server and waits for any response.
+func (c *Client) ping(ctx context.Context) error {
+	recipient := sip.Uri{}
+	if err := sip.ParseUri(fmt.Sprintf("sip:%s", c.cfg.Server), &recipient); err != nil {
+		return err
+	}
+	req := sip.NewRequest(sip.OPTIONS, recipient)
+	c.setFrom(req)
+	c.setUserAgent(req)
+	req.AppendHeader(sip.NewHeader("Contact", c.contactAddr()))
+	req.SetTransport(strings.ToUpper(c.cfg.Transport))
+	res, err := c.roundTrip(ctx, req, sipgo.ClientRequestBuild, sipgo.ClientRequestAddVia)
+	if err != nil {
+		return err
+	}
+	c.log.Debug("keepalive", "status", res.StatusCode)
+	return nil
+}
@@ -0,0 +1,51 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// maxMultipartParts bounds how many parts of a multipart NOTIFY body are examined.
+const maxMultipartParts = 16
+
+// unwrapMultipart returns the media type (lower-cased, without parameters) and body to
+// parse for a NOTIFY with the Content-Type value contentType. A multipart/* body (e.g. a
+// multipart/related one from an SBC, or an RFC 4662 resource list) is split at its
+// boundary and its first part with a known presence format (dialog-info, PIDF, XPIDF) is
+// returned; other bodies are returned as they are.
+func unwrapMultipart(contentType string, body []byte) (string, []byte, error) {
+	media, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Missing or garbled header: let bodyType sniff the body.
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0])), body, nil
+	}
+	if !strings.HasPrefix(media, "multipart/") {
+		return media, body, nil
+	}
+	if params["boundary"] == "" {
+		return "", nil, errors.New("multipart body without boundary")
+	}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for range maxMultipartParts {
+		part, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case blf.ContentTypeDialogInfo, blf.ContentTypePIDF, blf.ContentTypeXPIDF:
+			data, err := io.ReadAll(part)
+			return partType, data, err
+		}
+	}
+	return "", nil, errors.New("multipart body has no dialog-info, PIDF or XPIDF part")
+}
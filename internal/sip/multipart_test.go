@@ -0,0 +1,45 @@
+package sip
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestUnwrapMultipart(t *testing.T) {
+	data, err := os.ReadFile("testdata/notify-multipart.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sip.ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := msg.(*sip.Request)
+	if !ok {
+		t.Fatalf("fixture parsed as %T, want a request", msg)
+	}
+	contentType, body, err := unwrapMultipart(req.GetHeader("Content-Type").Value(), req.Body())
+	if err != nil {
+		t.Fatalf("unwrapMultipart: %v", err)
+	}
+	if contentType != blf.ContentTypeDialogInfo {
+		t.Errorf("content type = %q, want the dialog-info part", contentType)
+	}
+
+	c := &Client{log: slog.New(slog.NewTextHandler(io.Discard, nil)), views: make(map[string]*dialogView)}
+	if ext, state, ok := c.processNotify(contentType, "", false, body); !ok || ext != "1001" || state != blf.StateBusy {
+		t.Errorf("processNotify = %q %q %v, want 1001 busy", ext, state, ok)
+	}
+
+	if _, _, err := unwrapMultipart(`multipart/mixed; boundary="b"`, []byte("--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n--b--\r\n")); err == nil {
+		t.Error("multipart without a presence part: want an error")
+	}
+	if ct, got, err := unwrapMultipart("Application/PIDF+XML; charset=UTF-8", []byte("<presence/>")); err != nil || ct != blf.ContentTypePIDF || string(got) != "<presence/>" {
+		t.Errorf("plain body = %q %q %v, want it unchanged with the bare media type", ct, got, err)
+	}
+}
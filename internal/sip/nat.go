@@ -0,0 +1,68 @@
+package sip
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// DiscoverNATBehavior sends binding requests to two different STUN servers from the same
+// local socket and compares the mapped addresses. A NAT that maps one socket to different
+// public ports per destination is symmetric: the address STUN reports is not the one the
+// PBX will see, so NOTIFYs are unlikely to arrive without a port forward or relay.
+// The check always runs over UDP, the transport NOTIFYs use through the NAT, restricted to
+// the STUN address family.
+func DiscoverNATBehavior(servers []string, family string, log *slog.Logger) (symmetric bool, err error) {
+	network := stunNetwork(STUNTransportUDP, family)
+	var addrs []string
+	for _, srv := range servers {
+		if srv = strings.TrimSpace(srv); srv == "" {
+			continue
+		}
+		ua, err := net.ResolveUDPAddr(network, normalizeSTUNAddr(srv, STUNTransportUDP))
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, ua.String())
+	}
+	if len(addrs) < 2 {
+		return false, fmt.Errorf("NAT check needs at least two STUN servers")
+	}
+
+	conn, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	client := stun.NewClientWithConnection(conn)
+
+	var mapped []string
+	var answered []string
+	for _, addr := range addrs {
+		client.SetServerAddr(addr)
+		host, err := client.Keepalive()
+		if err != nil || host == nil {
+			continue
+		}
+		mapped = append(mapped, net.JoinHostPort(host.IP(), strconv.Itoa(int(host.Port()))))
+		answered = append(answered, addr)
+		if len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) < 2 {
+		return false, fmt.Errorf("NAT check: fewer than two STUN servers answered")
+	}
+	if mapped[0] != mapped[1] {
+		if log != nil {
+			log.Warn("symmetric NAT likely: STUN servers saw different mapped addresses; BLF NOTIFYs may never arrive without a port forward or TURN relay",
+				"servers", answered, "mapped", mapped)
+		}
+		return true, nil
+	}
+	return false, nil
+}
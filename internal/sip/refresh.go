@@ -0,0 +1,146 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// stunConfirmations is how many consecutive STUN answers must agree on a new public
+// address before the Contact is moved, so a flapping NAT does not cause re-registration storms.
+const stunConfirmations = 2
+
+// SetContact changes the address advertised in Contact and Via headers. Existing
+// registrations and subscriptions still point at the old address; re-register and
+// re-subscribe afterwards.
+func (c *Client) SetContact(ip string, port int) error {
+	client, err := sipgo.NewClient(c.ua, clientOptions(ip, port)...)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.client
+	c.client = client
+	c.cfg.ContactIP = ip
+	c.cfg.ContactPort = port
+	c.mu.Unlock()
+	old.Close()
+	return nil
+}
+
+// WatchPublicAddress re-runs STUN discovery every interval until ctx is done. When the
+// public IP differs from the current Contact on stunConfirmations consecutive checks, the
+// Contact moves to it and the client re-registers and re-subscribes all extensions. Only
+// the IP is compared: the binding requests go out from a fresh socket, so behind a
+// port-rewriting NAT their mapped port differs on every check and says nothing about the
+// SIP socket's. The Contact keeps its port.
+func (c *Client) WatchPublicAddress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var candidate string
+	seen := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ip, _, err := discoverPublic(ctx, &c.cfg, c.log)
+		if err != nil {
+			c.log.Warn("STUN refresh failed; keeping current contact", "error", err)
+			continue
+		}
+		c.mu.Lock()
+		current, port := c.cfg.ContactIP, c.cfg.ContactPort
+		c.mu.Unlock()
+		if sameHost(ip, current) {
+			candidate, seen = "", 0
+			continue
+		}
+		if ip != candidate {
+			candidate, seen = ip, 0
+		}
+		seen++
+		if seen < stunConfirmations {
+			c.log.Info("STUN reports a new public IP; waiting for confirmation", "current", current, "new", ip)
+			continue
+		}
+		candidate, seen = "", 0
+		c.log.Warn("public IP changed; re-registering", "old", current, "new", ip)
+		if err := c.moveContact(ctx, ip, port); err != nil {
+			c.log.Error("contact update failed", "new", ip, "error", err)
+		}
+	}
+}
+
+// moveContact switches to the new public address and re-establishes the registration and
+// subscriptions with it. The old subscriptions are ended first; their NOTIFYs would go
+// to the stale address.
+func (c *Client) moveContact(ctx context.Context, ip string, port int) error {
+	c.Unsubscribe(ctx)
+	if err := c.SetContact(ip, port); err != nil {
+		return err
+	}
+	if _, err := c.Register(ctx); err != nil {
+		return fmt.Errorf("re-register: %w", err)
+	}
+	return c.Subscribe(ctx)
+}
+
+// learnContact applies the received/rport parameters of the top Via in res (RFC 3581) when
+// cfg.LearnContact is set. It reports whether the Contact changed.
+func (c *Client) learnContact(res *sip.Response) bool {
+	if !c.cfg.LearnContact {
+		return false
+	}
+	via := res.Via()
+	if via == nil {
+		return false
+	}
+	c.mu.Lock()
+	ip, port := c.cfg.ContactIP, c.cfg.ContactPort
+	c.mu.Unlock()
+	if received, ok := via.Params.Get("received"); ok && received != "" {
+		ip = received
+	}
+	if rport, ok := via.Params.Get("rport"); ok {
+		if n, err := strconv.Atoi(rport); err == nil && n > 0 {
+			port = n
+		}
+	}
+	old := c.publicAddr()
+	shown := port
+	if shown == 0 {
+		shown = defaultSIPPort
+	}
+	next := net.JoinHostPort(ip, strconv.Itoa(shown))
+	if next == old {
+		return false
+	}
+	if err := c.SetContact(ip, port); err != nil {
+		c.log.Error("contact update from Via failed", "new", next, "error", err)
+		return false
+	}
+	c.mu.Lock()
+	// The Contact is now what the server actually sees, so a symmetric NAT no longer matters.
+	c.cfg.SymmetricNAT = false
+	c.mu.Unlock()
+	c.log.Warn("server sees a different address; Contact updated from Via received/rport", "old", old, "new", next)
+	return true
+}
+
+// publicAddr returns the current Contact address as host:port.
+func (c *Client) publicAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	port := c.cfg.ContactPort
+	if port == 0 {
+		port = defaultSIPPort
+	}
+	return net.JoinHostPort(c.cfg.ContactIP, strconv.Itoa(port))
+}
@@ -0,0 +1,71 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const defaultSIPPort = 5060
+
+// ResolveServer resolves cfg.Server when it has no explicit port. It looks up the
+// _sip._udp (or _sip._tcp) SRV records for the host and uses the first target that
+// resolves, in priority/weight order (RFC 2782). Without SRV records it falls back to the
+// host's A/AAAA records with port 5060. On success cfg.Server is the resolved host:port and
+// cfg.Domain keeps the original name for the From header. A server with a port is left as is.
+// A WebSocket server (see IsWebSocket) has no SIP SRV records: it gets port 80 (ws) or 443
+// (wss) and keeps its name, which wss needs to verify the certificate.
+func ResolveServer(ctx context.Context, cfg *Config, log *slog.Logger) error {
+	host := strings.TrimSpace(cfg.Server)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return nil
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		return fmt.Errorf("SIP server is empty")
+	}
+	if IsWebSocket(cfg.Transport) {
+		cfg.Server = net.JoinHostPort(host, strconv.Itoa(webSocketDefaultPort(cfg.Transport)))
+		return nil
+	}
+
+	if net.ParseIP(host) != nil {
+		cfg.Server = net.JoinHostPort(host, strconv.Itoa(defaultSIPPort))
+		return nil
+	}
+
+	proto := "udp"
+	if strings.EqualFold(strings.TrimSpace(cfg.Transport), "tcp") {
+		proto = "tcp"
+	}
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "sip", proto, host)
+	if err == nil {
+		for _, srv := range addrs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			if _, err := net.DefaultResolver.LookupHost(ctx, target); err != nil {
+				if log != nil {
+					log.Warn("SRV target does not resolve; trying next", "target", target, "error", err)
+				}
+				continue
+			}
+			cfg.Domain = host
+			cfg.Server = net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+			if log != nil {
+				log.Info("resolved SIP server via SRV", "domain", host, "record", "_sip._"+proto+"."+host, "target", cfg.Server, "priority", srv.Priority, "weight", srv.Weight)
+			}
+			return nil
+		}
+	}
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("resolve SIP server %s: no SRV record and no A/AAAA record: %w", host, err)
+	}
+	cfg.Server = net.JoinHostPort(host, strconv.Itoa(defaultSIPPort))
+	if log != nil {
+		log.Info("no SRV record for SIP server; using A/AAAA with default port", "target", cfg.Server)
+	}
+	return nil
+}
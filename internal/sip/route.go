@@ -0,0 +1,81 @@
+package sip
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// routeSet returns the route set of the dialog established by the 2xx res (RFC 3261
+// 12.1.2): its Record-Route entries in reverse order, as in-dialog requests list them in
+// Route. A header line may carry several comma-separated entries.
+func routeSet(res *sip.Response) []string {
+	var entries []string
+	for _, h := range res.GetHeaders("Record-Route") {
+		entries = append(entries, splitAddressList(h.Value())...)
+	}
+	routes := make([]string, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		routes = append(routes, entries[i])
+	}
+	return routes
+}
+
+// splitAddressList splits a header value of comma-separated name-addrs, ignoring commas
+// inside <...> and quoted display names.
+func splitAddressList(value string) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' && (i == 0 || value[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			depth++
+		case c == '>' && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			if p := strings.TrimSpace(value[start:i]); p != "" {
+				parts = append(parts, p)
+			}
+			start = i + 1
+		}
+	}
+	if p := strings.TrimSpace(value[start:]); p != "" {
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// applyRoutes sets the Route headers of the in-dialog request req from routes, replacing
+// any it has, and sets its Request-URI for target, the dialog's remote target. The request
+// is sent to the first route. With a strict router (the first route lacks ;lr) the
+// Request-URI is that route and target goes last in Route (RFC 3261 12.2.1.1).
+func applyRoutes(req *sip.Request, routes []string, target sip.Uri) {
+	req.RemoveHeader("Route")
+	req.Recipient = target
+	if len(routes) == 0 {
+		return
+	}
+	var first sip.Uri
+	if _, err := sip.ParseAddressValue(routes[0], &first, nil); err != nil {
+		return
+	}
+	// Clones keep the destination of the request they copy, so set it explicitly.
+	port := first.Port
+	if port == 0 {
+		port = sip.DefaultPort(req.Transport())
+	}
+	req.SetDestination(net.JoinHostPort(strings.Trim(first.Host, "[]"), strconv.Itoa(port)))
+	if !first.UriParams.Has("lr") {
+		req.Recipient = first
+		routes = append(slices.Clone(routes[1:]), "<"+target.String()+">")
+	}
+	for _, r := range routes {
+		req.AppendHeader(sip.NewHeader("Route", r))
+	}
+}
@@ -0,0 +1,71 @@
+package sip
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestRouteSet(t *testing.T) {
+	res := sip.NewResponse(200, "OK")
+	res.AppendHeader(sip.NewHeader("Record-Route", "<sip:pbx-edge.example.com;lr>, <sip:10.0.0.2;lr>"))
+	res.AppendHeader(sip.NewHeader("Record-Route", `"SBC, outer" <sip:sbc.example.com;lr>`))
+	want := []string{`"SBC, outer" <sip:sbc.example.com;lr>`, "<sip:10.0.0.2;lr>", "<sip:pbx-edge.example.com;lr>"}
+	if got := routeSet(res); !slices.Equal(got, want) {
+		t.Errorf("routeSet = %q, want %q", got, want)
+	}
+	if got := routeSet(sip.NewResponse(200, "OK")); len(got) != 0 {
+		t.Errorf("no Record-Route: routeSet = %q, want none", got)
+	}
+}
+
+func routeValues(req *sip.Request) []string {
+	var values []string
+	for _, h := range req.GetHeaders("Route") {
+		values = append(values, h.Value())
+	}
+	return values
+}
+
+func TestApplyRoutes(t *testing.T) {
+	target := sip.Uri{Scheme: "sip", User: "101", Host: "pbx.example.com"}
+
+	t.Run("loose", func(t *testing.T) {
+		req := sip.NewRequest(sip.SUBSCRIBE, target)
+		req.AppendHeader(sip.NewHeader("Route", "<sip:stale.example.com;lr>"))
+		req = req.Clone() // in-dialog requests are clones, with an explicit destination
+		applyRoutes(req, []string{"<sip:sbc.example.com;lr>", "<sip:10.0.0.2;lr>"}, target)
+		if got, want := routeValues(req), []string{"<sip:sbc.example.com;lr>", "<sip:10.0.0.2;lr>"}; !slices.Equal(got, want) {
+			t.Errorf("Route = %q, want %q", got, want)
+		}
+		if req.Recipient.Host != "pbx.example.com" {
+			t.Errorf("Request-URI = %s, want the target", req.Recipient.String())
+		}
+		if got := req.Destination(); got != "sbc.example.com:5060" {
+			t.Errorf("destination = %s, want the first route", got)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		req := sip.NewRequest(sip.SUBSCRIBE, target)
+		applyRoutes(req, []string{"<sip:strict.example.com>", "<sip:10.0.0.2;lr>"}, target)
+		if req.Recipient.Host != "strict.example.com" {
+			t.Errorf("Request-URI = %s, want the strict router", req.Recipient.String())
+		}
+		if got := req.Destination(); got != "strict.example.com:5060" {
+			t.Errorf("destination = %s, want the strict router", got)
+		}
+		if got, want := routeValues(req), []string{"<sip:10.0.0.2;lr>", "<sip:101@pbx.example.com>"}; !slices.Equal(got, want) {
+			t.Errorf("Route = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		req := sip.NewRequest(sip.SUBSCRIBE, sip.Uri{Scheme: "sip", Host: "elsewhere.example.com"})
+		applyRoutes(req, nil, target)
+		if len(routeValues(req)) != 0 || req.Recipient.Host != "pbx.example.com" {
+			t.Errorf("Route = %q, Request-URI = %s; want no Route and the target", routeValues(req), req.Recipient.String())
+		}
+	})
+}
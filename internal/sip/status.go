@@ -0,0 +1,89 @@
+package sip
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// SubscriptionStatus describes the subscription of one monitored extension.
+type SubscriptionStatus struct {
+	Extension  string
+	Subscribed bool // a subscription dialog is established
+	Event      string
+	// CallID, FromTag and ToTag identify the subscription dialog.
+	CallID  string
+	FromTag string
+	ToTag   string
+	Expires time.Duration // lifetime the PBX granted
+	// RefreshAt is when RunRefresh renews the subscription.
+	RefreshAt time.Time
+	// LastNotify is when the last NOTIFY for the extension arrived (zero when none has
+	// since startup), and LastState the last state reported from one.
+	LastNotify time.Time
+	LastState  blf.State
+	// Stale is set while RunStaleWatchdog finds no NOTIFY within its window.
+	Stale bool
+	// Terminated is set while a subscription the PBX ended is not re-established, with
+	// TerminatedReason the reason it gave ("" when none) and ResubscribeAt when RunRefresh
+	// subscribes again (zero when it will not, e.g. after "noresource").
+	Terminated       bool
+	TerminatedReason string
+	ResubscribeAt    time.Time
+}
+
+// notifyRecord is the last NOTIFY seen for an extension.
+type notifyRecord struct {
+	at    time.Time
+	state blf.State // last state published; "" until one is
+}
+
+// Subscriptions returns the status of every monitored extension, sorted by extension.
+func (c *Client) Subscriptions() []SubscriptionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]SubscriptionStatus, 0, len(c.extensions))
+	for _, ext := range c.extensions {
+		st := SubscriptionStatus{Extension: ext}
+		if n, ok := c.notified[ext]; ok {
+			st.LastNotify, st.LastState = n.at, n.state
+		}
+		if e, ok := c.ended[ext]; ok {
+			st.Terminated, st.TerminatedReason, st.ResubscribeAt = true, e.reason, e.resubscribeAt
+		}
+		if sub := c.subs[ext]; sub != nil {
+			st.Subscribed = true
+			st.Stale = c.stale[ext]
+			st.Event = sub.event
+			st.ToTag = sub.toTag
+			st.Expires = sub.expires
+			st.RefreshAt = sub.refreshAt
+			st.CallID = sub.callID
+			st.FromTag = sub.fromTag
+		}
+		out = append(out, st)
+	}
+	slices.SortFunc(out, func(a, b SubscriptionStatus) int {
+		return strings.Compare(a.Extension, b.Extension)
+	})
+	return out
+}
+
+// noteNotify records that a NOTIFY for extension arrived now.
+func (c *Client) noteNotify(extension string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateNotified(extension, func(n *notifyRecord) { n.at = time.Now() })
+}
+
+// updateNotified applies fn to extension's notifyRecord. c.mu must be held.
+func (c *Client) updateNotified(extension string, fn func(*notifyRecord)) {
+	if c.notified == nil {
+		c.notified = make(map[string]notifyRecord)
+	}
+	n := c.notified[extension]
+	fn(&n)
+	c.notified[extension] = n
+}
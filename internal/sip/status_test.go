@@ -0,0 +1,49 @@
+package sip
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func TestSubscriptions(t *testing.T) {
+	req := sip.NewRequest(sip.SUBSCRIBE, sip.Uri{Scheme: "sip", User: "101", Host: "pbx.example.com"})
+	fromParams, toParams := sip.NewParams(), sip.NewParams()
+	fromParams.Add("tag", "from1")
+	toParams.Add("tag", "to1")
+	req.AppendHeader(&sip.FromHeader{Address: sip.Uri{Scheme: "sip", User: "blf-client", Host: "pbx.example.com"}, Params: fromParams})
+	callID := sip.CallIDHeader("call-101")
+	req.AppendHeader(&callID)
+	res := sip.NewResponse(200, "OK")
+	res.AppendHeader(&sip.ToHeader{Address: sip.Uri{Scheme: "sip", User: "101", Host: "pbx.example.com"}, Params: toParams})
+	res.AppendHeader(sip.NewHeader("Expires", "600"))
+
+	c := &Client{
+		log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		extensions: []string{"102", "101"},
+		subs:       map[string]*subscription{"101": newSubscription("101", EventDialog, req, res, 3600)},
+	}
+	before := time.Now()
+	c.noteNotify("101")
+	c.publish("101", blf.StateBusy)
+
+	got := c.Subscriptions()
+	if len(got) != 2 || got[0].Extension != "101" || got[1].Extension != "102" {
+		t.Fatalf("Subscriptions = %+v, want 101 and 102 in order", got)
+	}
+	s := got[0]
+	if !s.Subscribed || s.Event != EventDialog || s.CallID != "call-101" || s.FromTag != "from1" || s.ToTag != "to1" || s.Expires != 600*time.Second {
+		t.Errorf("101 = %+v, want the subscribed dialog", s)
+	}
+	if s.LastNotify.Before(before) || s.LastState != blf.StateBusy {
+		t.Errorf("101 last NOTIFY = %v %q, want now and busy", s.LastNotify, s.LastState)
+	}
+	if s := got[1]; s.Subscribed || !s.LastNotify.IsZero() || s.LastState != "" {
+		t.Errorf("102 = %+v, want not subscribed and no NOTIFY", s)
+	}
+}
@@ -1,20 +1,64 @@
 package sip
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ccding/go-stun/stun"
 )
 
-const defaultSTUNPort = 19302 // Google STUN; standard is 3478
+const (
+	defaultSTUNPort    = 19302 // Google STUN (UDP only); standard is 3478
+	defaultSTUNTCPPort = 3478  // RFC 5389 port for STUN over TCP
+)
+
+// STUN transports for Config.STUNTransport.
+const (
+	STUNTransportUDP = "udp"
+	STUNTransportTCP = "tcp"
+)
+
+// STUN address families for Config.STUNFamily. With STUNFamilyAny the server address
+// family is whatever the resolver returns first; the others restrict both the server
+// lookup and the local socket, so the mapped address is of that family.
+const (
+	STUNFamilyAny  = ""
+	STUNFamilyIPv4 = "ipv4"
+	STUNFamilyIPv6 = "ipv6"
+)
+
+// STUNAttempt limits the binding requests sent to one STUN server: each gets at most
+// Timeout (0 = the STUN client's own retransmissions, about 9.5s), and a failed one is
+// repeated up to Retries times before the server counts as failed.
+type STUNAttempt struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// stunNetwork returns the Go network name for transport restricted to family ("udp6" etc.).
+func stunNetwork(transport, family string) string {
+	switch family {
+	case STUNFamilyIPv4:
+		return transport + "4"
+	case STUNFamilyIPv6:
+		return transport + "6"
+	}
+	return transport
+}
 
 // DiscoverPublicAddress tries each STUN server in order using a simple binding
-// request (RFC 5389) and returns the public (mapped) IP and port.
-func DiscoverPublicAddress(servers []string, log *slog.Logger) (ip string, port int, err error) {
+// request (RFC 5389) and returns the public (mapped) IP and port. transport is
+// STUNTransportUDP (default) or STUNTransportTCP; TCP falls back to UDP per server.
+// family is one of the STUNFamily constants; attempt limits the requests to each server.
+func DiscoverPublicAddress(servers []string, transport, family string, attempt STUNAttempt, log *slog.Logger) (ip string, port int, err error) {
 	if len(servers) == 0 {
 		return "", 0, fmt.Errorf("no STUN servers configured")
 	}
@@ -25,18 +69,18 @@ func DiscoverPublicAddress(servers []string, log *slog.Logger) (ip string, port
 		if srv == "" {
 			continue
 		}
-		addr := normalizeSTUNAddr(srv)
-		ip, port, err = discoverOne(addr)
+		var used string
+		ip, port, used, err = discoverServer(context.Background(), srv, transport, family, attempt, log)
 		if err != nil {
 			lastErr = err
-			tried = append(tried, fmt.Sprintf("%s: %v", addr, err))
+			tried = append(tried, fmt.Sprintf("%s: %v", srv, err))
 			if log != nil {
-				log.Warn("STUN attempt failed", "server", addr, "error", err)
+				log.Warn("STUN attempt failed", "server", srv, "error", err)
 			}
 			continue
 		}
 		if log != nil {
-			log.Info("STUN discovery succeeded", "server", addr, "public", net.JoinHostPort(ip, strconv.Itoa(port)))
+			log.Info("STUN discovery succeeded", "server", srv, "transport", used, "public", net.JoinHostPort(ip, strconv.Itoa(port)))
 		}
 		return ip, port, nil
 	}
@@ -50,13 +94,17 @@ func DiscoverPublicAddress(servers []string, log *slog.Logger) (ip string, port
 	return "", 0, fmt.Errorf("%s", msg)
 }
 
-func normalizeSTUNAddr(srv string) string {
-	host, portStr := srv, ""
-	if idx := strings.LastIndex(srv, ":"); idx > 0 {
-		host = srv[:idx]
-		portStr = srv[idx+1:]
+// normalizeSTUNAddr adds the default port for transport when srv has none. srv may be a
+// hostname, an IPv4 address or an IPv6 address, bracketed when it carries a port.
+func normalizeSTUNAddr(srv, transport string) string {
+	host, portStr, err := net.SplitHostPort(srv)
+	if err != nil {
+		host, portStr = strings.Trim(srv, "[]"), ""
 	}
 	portNum := defaultSTUNPort
+	if transport == STUNTransportTCP {
+		portNum = defaultSTUNTCPPort
+	}
 	if portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
 			portNum = p
@@ -73,33 +121,247 @@ func IsContactSentinel(contactIP string) bool {
 }
 
 // ResolveContactIfNeeded runs STUN discovery when cfg.ContactIP is empty, "auto", or "stun",
-// and sets cfg.ContactIP and cfg.ContactPort to the public address. Returns nil if no resolution needed or success.
+// and sets cfg.ContactIP and cfg.ContactPort to the public address. With two or more servers
+// it also sets cfg.SymmetricNAT (see DiscoverNATBehavior). Returns nil if no resolution needed or success.
+// A WebSocket transport needs no public address (see IsWebSocket), so nothing is discovered.
 func ResolveContactIfNeeded(cfg *Config, log *slog.Logger) error {
-	if !IsContactSentinel(cfg.ContactIP) {
+	if !IsContactSentinel(cfg.ContactIP) || IsWebSocket(cfg.Transport) {
 		return nil
 	}
 	if len(cfg.STUNServers) == 0 {
 		return fmt.Errorf("STUN requested but no STUN_SERVERS configured")
 	}
-	ip, port, err := DiscoverPublicAddress(cfg.STUNServers, log)
+	switch cfg.STUNFamily {
+	case STUNFamilyAny, STUNFamilyIPv4, STUNFamilyIPv6:
+	default:
+		return fmt.Errorf("unknown STUN address family %q (want ipv4 or ipv6)", cfg.STUNFamily)
+	}
+	if cfg.STUNTimeout < 0 || cfg.STUNRetries < 0 {
+		return fmt.Errorf("STUN timeout and retries cannot be negative")
+	}
+	ip, port, err := discoverPublic(context.Background(), cfg, log)
 	if err != nil {
 		return err
 	}
 	cfg.ContactIP = ip
 	cfg.ContactPort = port
+	cfg.ContactDiscovered = true
+	if len(cfg.STUNServers) >= 2 {
+		symmetric, err := DiscoverNATBehavior(cfg.STUNServers, cfg.STUNFamily, log)
+		if err != nil {
+			if log != nil {
+				log.Warn("NAT behavior check skipped", "error", err)
+			}
+		} else {
+			cfg.SymmetricNAT = symmetric
+		}
+	}
 	return nil
 }
 
-func discoverOne(serverAddr string) (ip string, port int, err error) {
-	conn, err := net.ListenPacket("udp", ":0")
+// discoverPublic runs STUN discovery the way cfg asks for: in parallel when
+// cfg.STUNParallel is set, otherwise sequentially.
+func discoverPublic(ctx context.Context, cfg *Config, log *slog.Logger) (string, int, error) {
+	attempt := STUNAttempt{Timeout: cfg.STUNTimeout, Retries: cfg.STUNRetries}
+	if cfg.STUNParallel {
+		return DiscoverPublicAddressParallel(ctx, cfg.STUNServers, cfg.STUNTransport, cfg.STUNFamily, cfg.STUNStrict, attempt, log)
+	}
+	return DiscoverPublicAddress(cfg.STUNServers, cfg.STUNTransport, cfg.STUNFamily, attempt, log)
+}
+
+// stunResult is one server's answer in DiscoverPublicAddressParallel.
+type stunResult struct {
+	server    string
+	transport string
+	ip        string
+	port      int
+	err       error
+}
+
+// DiscoverPublicAddressParallel sends binding requests to all servers at once and returns
+// the first mapped address, cancelling the outstanding queries. With strict set, it waits
+// until two servers report the same IP, guarding against a single misbehaving server.
+// attempt limits the requests to each server.
+func DiscoverPublicAddressParallel(ctx context.Context, servers []string, transport, family string, strict bool, attempt STUNAttempt, log *slog.Logger) (ip string, port int, err error) {
+	var addrs []string
+	for _, srv := range servers {
+		if srv = strings.TrimSpace(srv); srv != "" {
+			addrs = append(addrs, srv)
+		}
+	}
+	if len(addrs) == 0 {
+		return "", 0, fmt.Errorf("no STUN servers configured")
+	}
+	if strict && len(addrs) < 2 {
+		return "", 0, fmt.Errorf("strict STUN needs at least two servers")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan stunResult, len(addrs))
+	for _, addr := range addrs {
+		go func() {
+			ip, port, used, err := discoverServer(ctx, addr, transport, family, attempt, log)
+			results <- stunResult{server: addr, transport: used, ip: ip, port: port, err: err}
+		}()
+	}
+
+	var tried []string
+	byIP := make(map[string]string) // ip -> first server that reported it
+	for range addrs {
+		r := <-results
+		if r.err != nil {
+			tried = append(tried, fmt.Sprintf("%s: %v", r.server, r.err))
+			if log != nil && ctx.Err() == nil {
+				log.Warn("STUN attempt failed", "server", r.server, "error", r.err)
+			}
+			continue
+		}
+		public := net.JoinHostPort(r.ip, strconv.Itoa(r.port))
+		if !strict {
+			if log != nil {
+				log.Info("STUN discovery succeeded", "server", r.server, "transport", r.transport, "public", public)
+			}
+			return r.ip, r.port, nil
+		}
+		if first, ok := byIP[r.ip]; ok {
+			if log != nil {
+				log.Info("STUN discovery succeeded", "servers", []string{first, r.server}, "public", public)
+			}
+			return r.ip, r.port, nil
+		}
+		byIP[r.ip] = r.server
+	}
+	if strict && len(byIP) > 0 {
+		if log != nil {
+			log.Error("STUN servers disagree on public IP", "answers", byIP)
+		}
+		return "", 0, fmt.Errorf("no two STUN servers agreed on the public IP (answers: %v)", byIP)
+	}
+	if log != nil {
+		log.Error("STUN discovery failed", "servers_tried", tried)
+	}
+	return "", 0, errors.New("all STUN servers failed (tried: " + strings.Join(tried, "; ") + ")")
+}
+
+// discoverServer queries srv over transport. Over TCP, a failure is retried once over UDP
+// so a server or network without STUN/TCP still works; usedTransport reports which answered.
+// A mapped address that is not publicly routable (see isRoutablePublic) is an error, so the
+// callers move on to the next server.
+func discoverServer(ctx context.Context, srv, transport, family string, attempt STUNAttempt, log *slog.Logger) (ip string, port int, usedTransport string, err error) {
+	usedTransport = STUNTransportUDP
+	if transport == STUNTransportTCP {
+		ip, port, err = discoverRetrying(ctx, normalizeSTUNAddr(srv, STUNTransportTCP), STUNTransportTCP, family, attempt, log)
+		if err == nil || ctx.Err() != nil {
+			usedTransport = STUNTransportTCP
+		} else if log != nil {
+			log.Warn("STUN over TCP failed; trying UDP", "server", srv, "error", err)
+		}
+	}
+	if usedTransport == STUNTransportUDP {
+		ip, port, err = discoverRetrying(ctx, normalizeSTUNAddr(srv, STUNTransportUDP), STUNTransportUDP, family, attempt, log)
+	}
+	if err == nil && !isRoutablePublic(ip) {
+		// E.g. a STUN server that itself sits behind NAT reports its private view.
+		return "", 0, usedTransport, fmt.Errorf("mapped address %s is not publicly routable", ip)
+	}
+	return ip, port, usedTransport, err
+}
+
+// discoverRetrying runs discoverOne up to attempt.Retries+1 times until it succeeds or ctx
+// is done, logging the time each binding request took.
+func discoverRetrying(ctx context.Context, serverAddr, transport, family string, attempt STUNAttempt, log *slog.Logger) (ip string, port int, err error) {
+	for i := 0; ; i++ {
+		start := time.Now()
+		ip, port, err = discoverOne(ctx, serverAddr, transport, family, attempt.Timeout)
+		if log != nil {
+			log.Debug("STUN binding request", "server", serverAddr, "transport", transport, "attempt", i+1, "elapsed", time.Since(start).Round(time.Millisecond), "error", err)
+		}
+		if err == nil || ctx.Err() != nil || i >= attempt.Retries {
+			return ip, port, err
+		}
+	}
+}
+
+// nonPublicPrefixes are the special-purpose ranges (RFC 6890 and successors) that cannot be
+// a public Contact: private, shared (CGNAT), loopback, link-local, documentation,
+// benchmarking, multicast and reserved addresses, and their IPv6 equivalents.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("2001:db8::/32"), // other IPv6 ranges fall outside 2000::/3
+}
+
+// isRoutablePublic reports whether ip (textual IPv4 or IPv6) is a publicly routable
+// unicast address. IPv6 must be global unicast (2000::/3); IPv4-mapped IPv6 addresses are
+// judged as IPv4.
+func isRoutablePublic(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return "", 0, err
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is6() && !netip.MustParsePrefix("2000::/3").Contains(addr) {
+		return false // loopback, unspecified, link-local, ULA, multicast, ...
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverOne sends a binding request to serverAddr over transport, restricted to the
+// address family. It gives up after timeout (0 = when the STUN client stops retransmitting);
+// cancelling ctx abandons the query.
+func discoverOne(ctx context.Context, serverAddr, transport, family string, timeout time.Duration) (ip string, port int, err error) {
+	network := stunNetwork(transport, family)
+	var conn net.PacketConn
+	if transport == STUNTransportTCP {
+		d := net.Dialer{Timeout: timeout}
+		tc, err := d.DialContext(ctx, network, serverAddr)
+		if err != nil {
+			return "", 0, err
+		}
+		conn = &streamPacketConn{Conn: tc}
+	} else {
+		// Resolve here so the family applies; the STUN client would resolve with plain "udp".
+		ua, err := net.ResolveUDPAddr(network, serverAddr)
+		if err != nil {
+			return "", 0, err
+		}
+		serverAddr = ua.String()
+		conn, err = net.ListenPacket(network, ":0")
+		if err != nil {
+			return "", 0, err
+		}
 	}
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
+	if timeout > 0 {
+		conn = &deadlineConn{PacketConn: conn, deadline: time.Now().Add(timeout)}
+	}
 	client := stun.NewClientWithConnection(conn)
 	client.SetServerAddr(serverAddr)
 	host, err := client.Keepalive()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "", 0, fmt.Errorf("no answer within %s", timeout)
+	}
 	if err != nil {
 		return "", 0, err
 	}
@@ -108,3 +370,25 @@ func discoverOne(serverAddr string) (ip string, port int, err error) {
 	}
 	return host.IP(), int(host.Port()), nil
 }
+
+// deadlineConn ends a binding request at deadline: the STUN client sets its own read
+// deadlines for its retransmissions, which are capped at deadline, and writes after it
+// fail with os.ErrDeadlineExceeded.
+type deadlineConn struct {
+	net.PacketConn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() || t.After(c.deadline) {
+		t = c.deadline
+	}
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !time.Now().Before(c.deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
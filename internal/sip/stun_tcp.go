@@ -0,0 +1,38 @@
+package sip
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// stunHeaderLen is the fixed STUN message header size (RFC 5389 section 6).
+const stunHeaderLen = 20
+
+// streamPacketConn adapts a TCP connection to net.PacketConn for the STUN client, which
+// only speaks datagrams. STUN messages over TCP are self-delimiting: the header carries the
+// body length, so each ReadFrom returns exactly one message.
+type streamPacketConn struct {
+	net.Conn
+}
+
+func (c *streamPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Conn.Write(p)
+}
+
+func (c *streamPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(p) < stunHeaderLen {
+		return 0, nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(c.Conn, p[:stunHeaderLen]); err != nil {
+		return 0, nil, err
+	}
+	n := stunHeaderLen + int(binary.BigEndian.Uint16(p[2:4]))
+	if n > len(p) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(c.Conn, p[stunHeaderLen:n]); err != nil {
+		return 0, nil, err
+	}
+	return n, c.Conn.RemoteAddr(), nil
+}
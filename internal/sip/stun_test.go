@@ -0,0 +1,144 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSTUNAddr(t *testing.T) {
+	tests := []struct {
+		srv, transport, want string
+	}{
+		{"stun.l.google.com", STUNTransportUDP, "stun.l.google.com:19302"},
+		{"stun.example.com", STUNTransportTCP, "stun.example.com:3478"},
+		{"198.51.100.7:3478", STUNTransportUDP, "198.51.100.7:3478"},
+		{"2001:db8::7", STUNTransportUDP, "[2001:db8::7]:19302"},
+		{"[2001:db8::7]", STUNTransportTCP, "[2001:db8::7]:3478"},
+		{"[2001:db8::7]:3479", STUNTransportUDP, "[2001:db8::7]:3479"},
+	}
+	for _, tt := range tests {
+		if got := normalizeSTUNAddr(tt.srv, tt.transport); got != tt.want {
+			t.Errorf("normalizeSTUNAddr(%q, %q) = %q, want %q", tt.srv, tt.transport, got, tt.want)
+		}
+	}
+}
+
+func TestSTUNNetwork(t *testing.T) {
+	tests := []struct {
+		transport, family, want string
+	}{
+		{STUNTransportUDP, STUNFamilyAny, "udp"},
+		{STUNTransportUDP, STUNFamilyIPv6, "udp6"},
+		{STUNTransportTCP, STUNFamilyIPv4, "tcp4"},
+	}
+	for _, tt := range tests {
+		if got := stunNetwork(tt.transport, tt.family); got != tt.want {
+			t.Errorf("stunNetwork(%q, %q) = %q, want %q", tt.transport, tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestIsRoutablePublic(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":              true,
+		"198.51.99.1":          true,
+		"2001:4860:4860::8888": true,
+		"::ffff:8.8.8.8":       true,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"172.31.255.255":       false,
+		"172.32.0.1":           true,
+		"192.168.1.10":         false,
+		"100.64.0.1":           false, // CGNAT
+		"127.0.0.1":            false,
+		"169.254.10.1":         false,
+		"0.0.0.0":              false,
+		"192.0.2.10":           false,
+		"203.0.113.5":          false,
+		"224.0.0.1":            false,
+		"255.255.255.255":      false,
+		"::ffff:192.168.1.10":  false,
+		"::1":                  false,
+		"::":                   false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"ff02::1":              false,
+		"2001:db8::1":          false,
+		"":                     false,
+		"not-an-ip":            false,
+	}
+	for ip, want := range tests {
+		if got := isRoutablePublic(ip); got != want {
+			t.Errorf("isRoutablePublic(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+// stunResponder answers STUN binding requests on a local UDP socket with the mapped address
+// 8.8.4.4:40000, ignoring the first drop requests. It returns the server address and the
+// count of requests received.
+func stunResponder(t *testing.T, drop int32) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var received atomic.Int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if received.Add(1) <= drop || n < stunHeaderLen {
+				continue
+			}
+			res := make([]byte, stunHeaderLen, stunHeaderLen+12)
+			binary.BigEndian.PutUint16(res[0:2], 0x0101) // binding success response
+			binary.BigEndian.PutUint16(res[2:4], 12)
+			copy(res[4:20], buf[4:20])                       // magic cookie and transaction ID
+			res = binary.BigEndian.AppendUint16(res, 0x0001) // MAPPED-ADDRESS
+			res = binary.BigEndian.AppendUint16(res, 8)
+			res = append(res, 0, 0x01)
+			res = binary.BigEndian.AppendUint16(res, 40000)
+			res = append(res, 8, 8, 4, 4)
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &received
+}
+
+func TestDiscoverServer_TimeoutAndRetries(t *testing.T) {
+	attempt := STUNAttempt{Timeout: 50 * time.Millisecond, Retries: 2}
+
+	// The first request is lost; the retry is answered.
+	addr, received := stunResponder(t, 1)
+	ip, port, _, err := discoverServer(context.Background(), addr, STUNTransportUDP, STUNFamilyIPv4, attempt, nil)
+	if err != nil || ip != "8.8.4.4" || port != 40000 {
+		t.Fatalf("lossy server: discoverServer = %s %d %v, want 8.8.4.4 40000", ip, port, err)
+	}
+	if n := received.Load(); n != 2 {
+		t.Errorf("lossy server: %d requests, want 2", n)
+	}
+
+	// A black-holed server fails after Retries+1 attempts of Timeout each.
+	addr, received = stunResponder(t, 1<<30)
+	start := time.Now()
+	_, _, _, err = discoverServer(context.Background(), addr, STUNTransportUDP, STUNFamilyIPv4, attempt, nil)
+	if err == nil || !strings.Contains(err.Error(), "no answer within 50ms") {
+		t.Fatalf("black-holed server: err = %v, want no answer within 50ms", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("black-holed server took %s, want about 150ms", elapsed)
+	}
+	if n := received.Load(); n != 3 {
+		t.Errorf("black-holed server: %d requests, want 3", n)
+	}
+}
@@ -0,0 +1,255 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
+)
+
+// subscription is an established SUBSCRIBE dialog for one extension.
+type subscription struct {
+	extension string
+	event     string       // EventDialog or EventPresence
+	req       *sip.Request // last SUBSCRIBE sent in the dialog (Call-ID, From tag, CSeq)
+	callID    string       // Call-ID of the dialog
+	fromTag   string       // our tag (From of the SUBSCRIBE, To of the NOTIFYs)
+	toTag     string       // tag from the 2xx To header
+	routes    []string     // route set from the 2xx Record-Route, applied to in-dialog requests
+	target    sip.Uri      // Request-URI of in-dialog requests (before strict routing)
+	expires   time.Duration
+	refreshAt time.Time // when RunRefresh renews the subscription
+	// established is when the dialog was set up; refreshes keep it.
+	established time.Time
+}
+
+// newSubscription records the dialog established by req and its 2xx response res. The
+// lifetime is the Expires granted in res, or requested (seconds) when absent. The route set
+// is taken from res; refreshes keep the one of the initial 2xx (see refreshOne).
+func newSubscription(extension, event string, req *sip.Request, res *sip.Response, requested int) *subscription {
+	sub := &subscription{extension: extension, event: event, req: req, routes: routeSet(res), target: req.Recipient}
+	if id := req.CallID(); id != nil {
+		sub.callID = id.Value()
+	}
+	if from := req.From(); from != nil {
+		sub.fromTag, _ = from.Params.Get("tag")
+	}
+	if to := res.To(); to != nil {
+		sub.toTag, _ = to.Params.Get("tag")
+	}
+	sub.expires = headerExpires(res, requested)
+	sub.established = time.Now()
+	sub.refreshAt = sub.established.Add(refreshAfter(sub.expires))
+	return sub
+}
+
+// matches reports whether a NOTIFY with the given Call-ID, To tag (ours) and From tag (the
+// PBX's) belongs to sub's dialog. The PBX's tag is only compared once the 2xx gave one.
+func (sub *subscription) matches(callID, localTag, remoteTag string) bool {
+	return callID == sub.callID && localTag == sub.fromTag && (sub.toTag == "" || remoteTag == sub.toTag)
+}
+
+// dialogExtension returns the extension of the subscription dialog the NOTIFY req belongs
+// to, matched by Call-ID and tags, with ok false when it belongs to none.
+func (c *Client) dialogExtension(req *sip.Request) (extension string, ok bool) {
+	callID, localTag, remoteTag := notifyDialog(req)
+	if callID == "" || localTag == "" {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ext, sub := range c.subs {
+		if sub.matches(callID, localTag, remoteTag) {
+			return ext, true
+		}
+	}
+	if sub, ok := c.pending[callID]; ok && sub.matches(callID, localTag, remoteTag) {
+		return sub.extension, true
+	}
+	return "", false
+}
+
+// notifyDialog returns the dialog identifiers of a NOTIFY from the PBX: its Call-ID, our
+// tag (in To) and the PBX's tag (in From).
+func notifyDialog(req *sip.Request) (callID, localTag, remoteTag string) {
+	callID = callIDOf(req)
+	if to := req.To(); to != nil {
+		localTag, _ = to.Params.Get("tag")
+	}
+	if from := req.From(); from != nil {
+		remoteTag, _ = from.Params.Get("tag")
+	}
+	return callID, localTag, remoteTag
+}
+
+// beginSubscribe records the dialog of the initial SUBSCRIBE req for extension as pending
+// before it is sent, so a NOTIFY the PBX sends ahead of the 2xx (RFC 6665 section 4.1.2.4)
+// is attributed to the extension. It returns the Call-ID for abortSubscribe.
+func (c *Client) beginSubscribe(extension, event string, req *sip.Request) string {
+	sub := &subscription{extension: extension, event: event, req: req, target: req.Recipient}
+	if id := req.CallID(); id != nil {
+		sub.callID = id.Value()
+	}
+	if from := req.From(); from != nil {
+		sub.fromTag, _ = from.Params.Get("tag")
+	}
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = make(map[string]*subscription)
+	}
+	c.pending[sub.callID] = sub
+	delete(c.views, extension) // a new subscription restarts dialog-info versions at 0
+	c.mu.Unlock()
+	return sub.callID
+}
+
+// abortSubscribe drops the pending record of a SUBSCRIBE that did not establish a dialog.
+func (c *Client) abortSubscribe(callID string) {
+	c.mu.Lock()
+	delete(c.pending, callID)
+	c.mu.Unlock()
+}
+
+// Extensions returns a copy of the monitored extensions.
+func (c *Client) Extensions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.extensions)
+}
+
+// AddExtensions starts monitoring the given extensions and subscribes to each. Extensions
+// already monitored are ignored. Extensions whose SUBSCRIBE fails stay in the monitored list,
+// matching Subscribe; the error lists them.
+func (c *Client) AddExtensions(ctx context.Context, extensions []string) error {
+	var added []string
+	c.mu.Lock()
+	for _, ext := range extensions {
+		if !slices.Contains(c.extensions, ext) {
+			c.extensions = append(c.extensions, ext)
+			added = append(added, ext)
+		}
+	}
+	c.mu.Unlock()
+	if failed := c.subscribeAll(ctx, added); len(failed) > 0 {
+		return fmt.Errorf("subscribe failed for extensions: %v", failed)
+	}
+	return nil
+}
+
+// subscribeAll subscribes the extensions with up to Config.SubscribeConcurrency SUBSCRIBEs
+// in flight and returns the failed extensions in input order.
+func (c *Client) subscribeAll(ctx context.Context, extensions []string) (failed []string) {
+	return forEachLimit(extensions, orDefaultConcurrency(c.cfg.SubscribeConcurrency), func(ext string) error {
+		return c.subscribeExtension(ctx, ext)
+	})
+}
+
+// forEachLimit calls fn for every item with at most limit calls running at once and returns
+// the items whose call failed, in input order.
+func forEachLimit(items []string, limit int, fn func(string) error) (failed []string) {
+	errs := make([]error, len(items))
+	sem := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = fn(item)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, items[i])
+		}
+	}
+	return failed
+}
+
+// orDefaultConcurrency returns n, or DefaultSubscribeConcurrency when n is not positive.
+func orDefaultConcurrency(n int) int {
+	if n <= 0 {
+		return DefaultSubscribeConcurrency
+	}
+	return n
+}
+
+// RemoveExtensions stops monitoring the given extensions and ends their subscriptions with
+// an Expires: 0 SUBSCRIBE. Unsubscribe failures are logged; the extension is removed regardless.
+func (c *Client) RemoveExtensions(ctx context.Context, extensions []string) {
+	for _, ext := range extensions {
+		c.mu.Lock()
+		c.extensions = slices.DeleteFunc(c.extensions, func(e string) bool { return e == ext })
+		sub := c.subs[ext]
+		delete(c.subs, ext)
+		delete(c.notified, ext)
+		delete(c.ended, ext)
+		metrics.SetActiveSubscriptions(c.cfg.Server, len(c.subs))
+		c.mu.Unlock()
+		if sub == nil {
+			continue
+		}
+		if err := c.unsubscribeOne(ctx, sub); err != nil {
+			c.log.Warn("unsubscribe failed", "extension", ext, "error", err)
+			continue
+		}
+		c.log.Info("unsubscribed from BLF", "extension", ext)
+	}
+}
+
+// Unsubscribe ends all active subscriptions with Expires: 0 SUBSCRIBEs, sent concurrently.
+// It returns when all are answered or ctx is done; failures are logged. The monitored
+// extension list is kept, so Subscribe can re-establish the subscriptions.
+func (c *Client) Unsubscribe(ctx context.Context) {
+	c.mu.Lock()
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	clear(c.subs)
+	metrics.SetActiveSubscriptions(c.cfg.Server, 0)
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, sub := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.unsubscribeOne(ctx, sub); err != nil {
+				c.log.Warn("unsubscribe failed", "extension", sub.extension, "error", err)
+				return
+			}
+			c.log.Debug("unsubscribed from BLF", "extension", sub.extension)
+		}()
+	}
+	wg.Wait()
+	c.log.Info("unsubscribed from BLF", "count", len(subs))
+}
+
+// unsubscribeOne sends an in-dialog SUBSCRIBE with Expires: 0 to terminate sub.
+func (c *Client) unsubscribeOne(ctx context.Context, sub *subscription) error {
+	req := sub.req.Clone()
+	req.RemoveHeader("Via")
+	req.RemoveHeader("Authorization")
+	req.RemoveHeader("Expires")
+	req.AppendHeader(sip.NewHeader("Expires", "0"))
+	if to := req.To(); to != nil && sub.toTag != "" {
+		to.Params.Add("tag", sub.toTag)
+	}
+	applyRoutes(req, sub.routes, sub.target)
+	res, _, err := c.transact(ctx, req, req.Recipient, sipgo.ClientRequestIncreaseCSEQ, sipgo.ClientRequestAddVia)
+	if err != nil {
+		return fmt.Errorf("unsubscribe %s: %w", sub.extension, err)
+	}
+	if res.StatusCode != 200 && res.StatusCode != 202 && res.StatusCode != 481 {
+		return responseError("SUBSCRIBE", sub.extension, res)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func TestForEachLimit(t *testing.T) {
+	items := []string{"101", "102", "103", "104", "105", "106", "107", "108", "109", "110"}
+	var running, peak atomic.Int32
+	failed := forEachLimit(items, 3, func(ext string) error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		if ext == "109" || ext == "102" || ext == "105" {
+			return errors.New("404")
+		}
+		return nil
+	})
+	if want := []string{"102", "105", "109"}; !slices.Equal(failed, want) {
+		t.Errorf("failed = %v, want %v (input order)", failed, want)
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("peak concurrency = %d, want <= 3", p)
+	}
+}
+
+// testDialog returns the subscription of a SUBSCRIBE dialog for extension with the given
+// Call-ID and tags (toTag "" for a 2xx without one).
+func testDialog(extension, callID, fromTag, toTag string) *subscription {
+	req := sip.NewRequest(sip.SUBSCRIBE, sip.Uri{Scheme: "sip", User: extension, Host: "pbx"})
+	fromParams := sip.NewParams()
+	fromParams.Add("tag", fromTag)
+	req.AppendHeader(&sip.FromHeader{Address: sip.Uri{Scheme: "sip", User: "blf-client", Host: "pbx"}, Params: fromParams})
+	id := sip.CallIDHeader(callID)
+	req.AppendHeader(&id)
+	res := sip.NewResponse(200, "OK")
+	toParams := sip.NewParams()
+	if toTag != "" {
+		toParams.Add("tag", toTag)
+	}
+	res.AppendHeader(&sip.ToHeader{Address: sip.Uri{Scheme: "sip", User: extension, Host: "pbx"}, Params: toParams})
+	return newSubscription(extension, EventDialog, req, res, 3600)
+}
+
+// testNotify returns a NOTIFY for extension (in To and From) in the dialog with the given
+// Call-ID and tags.
+func testNotify(extension, callID, localTag, remoteTag string) *sip.Request {
+	req := sip.NewRequest(sip.NOTIFY, sip.Uri{Scheme: "sip", User: "blf-client", Host: "client"})
+	toParams, fromParams := sip.NewParams(), sip.NewParams()
+	toParams.Add("tag", localTag)
+	fromParams.Add("tag", remoteTag)
+	req.AppendHeader(&sip.FromHeader{Address: sip.Uri{Scheme: "sip", User: extension, Host: "pbx"}, Params: fromParams})
+	req.AppendHeader(&sip.ToHeader{Address: sip.Uri{Scheme: "sip", User: extension, Host: "pbx"}, Params: toParams})
+	id := sip.CallIDHeader(callID)
+	req.AppendHeader(&id)
+	return req
+}
+
+func TestDialogExtension(t *testing.T) {
+	c := &Client{
+		log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		views: make(map[string]*dialogView),
+		subs: map[string]*subscription{
+			"101": testDialog("101", "call-a", "ours-a", "pbx-a"),
+			"102": testDialog("102", "call-b", "ours-b", ""),
+		},
+	}
+	tests := []struct {
+		name                        string
+		callID, localTag, remoteTag string
+		want                        string
+	}{
+		{"matching dialog", "call-a", "ours-a", "pbx-a", "101"},
+		{"other PBX tag", "call-a", "ours-a", "pbx-x", ""},
+		{"other local tag", "call-a", "ours-b", "pbx-a", ""},
+		{"no To tag from the 2xx yet", "call-b", "ours-b", "pbx-b", "102"},
+		{"unknown Call-ID", "call-c", "ours-a", "pbx-a", ""},
+	}
+	for _, tt := range tests {
+		// The headers name 999: the dialog decides, not the message.
+		got, ok := c.dialogExtension(testNotify("999", tt.callID, tt.localTag, tt.remoteTag))
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("%s: dialogExtension = %q %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// In a dialog, the dialog-info entity does not override the subscription's extension.
+	body := []byte(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="0" state="full" entity="sip:102@pbx">
+  <dialog id="a"><state>confirmed</state></dialog></dialog-info>`)
+	if ext, state, ok := c.processNotify(blf.ContentTypeDialogInfo, "101", true, body); !ok || ext != "101" || state != blf.StateBusy {
+		t.Errorf("processNotify in dialog = %q %q %v, want 101 busy", ext, state, ok)
+	}
+}
+
+// TestSubscribe_NotifyBefore2xx has a scripted PBX send the first NOTIFY of a subscription
+// before answering the SUBSCRIBE, naming another extension in its headers and body: the
+// NOTIFY must still be attributed to the subscribed extension.
+func TestSubscribe_NotifyBefore2xx(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type update struct {
+		extension string
+		state     blf.State
+	}
+	updates := make(chan update, 4)
+	onBLF := func(extension string, state blf.State) { updates <- update{extension, state} }
+	cfg := Config{Server: ln.Addr().String(), Transport: "tcp", Username: "blf-client", ContactIP: "127.0.0.1"}
+	c, err := NewClient(cfg, []string{"101"}, onBLF, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pbxErr := make(chan error, 1)
+	go func() {
+		pbxErr <- func() error {
+			conn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 8192)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			msg, err := sip.ParseMessage(buf[:n])
+			if err != nil {
+				return err
+			}
+			subscribe := msg.(*sip.Request)
+			ourTag, _ := subscribe.From().Params.Get("tag")
+
+			notify := sip.NewRequest(sip.NOTIFY, subscribe.Contact().Address)
+			via := sip.NewParams()
+			via.Add("branch", sip.GenerateBranch())
+			notify.AppendHeader(&sip.ViaHeader{ProtocolName: "SIP", ProtocolVersion: "2.0", Transport: "TCP", Host: "127.0.0.1", Port: 5060, Params: via})
+			fromParams, toParams := sip.NewParams(), sip.NewParams()
+			fromParams.Add("tag", "pbx-tag")
+			toParams.Add("tag", ourTag)
+			notify.AppendHeader(&sip.FromHeader{Address: sip.Uri{Scheme: "sip", User: "999", Host: "pbx"}, Params: fromParams})
+			notify.AppendHeader(&sip.ToHeader{Address: sip.Uri{Scheme: "sip", User: "999", Host: "pbx"}, Params: toParams})
+			notify.AppendHeader(subscribe.CallID())
+			notify.AppendHeader(&sip.CSeqHeader{SeqNo: 1, MethodName: sip.NOTIFY})
+			notify.AppendHeader(sip.NewHeader("Max-Forwards", "70"))
+			notify.AppendHeader(sip.NewHeader("Event", EventDialog))
+			notify.AppendHeader(sip.NewHeader("Subscription-State", "active;expires=3600"))
+			notify.AppendHeader(sip.NewHeader("Content-Type", blf.ContentTypeDialogInfo))
+			notify.SetBody([]byte(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="0" state="full" entity="sip:999@pbx">
+  <dialog id="a"><state>confirmed</state></dialog></dialog-info>`))
+			if _, err := conn.Write([]byte(notify.String())); err != nil {
+				return err
+			}
+			if n, err = conn.Read(buf); err != nil {
+				return err
+			}
+			if msg, err = sip.ParseMessage(buf[:n]); err != nil {
+				return err
+			}
+			if res, ok := msg.(*sip.Response); !ok || res.StatusCode != 200 {
+				return fmt.Errorf("NOTIFY answered %q, want 200", strings.SplitN(msg.String(), "\r\n", 2)[0])
+			}
+
+			ok := sip.NewResponseFromRequest(subscribe, 200, "OK", nil)
+			ok.To().Params.Add("tag", "pbx-tag")
+			ok.AppendHeader(sip.NewHeader("Expires", "3600"))
+			if _, err := conn.Write([]byte(ok.String())); err != nil {
+				return err
+			}
+			// Keep the connection open until the client is done with it.
+			_, _ = conn.Read(buf)
+			return nil
+		}()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Subscribe(ctx); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	select {
+	case u := <-updates:
+		if u.extension != "101" || u.state != blf.StateBusy {
+			t.Errorf("early NOTIFY = %q %q, want 101 busy", u.extension, u.state)
+		}
+	case err := <-pbxErr:
+		t.Fatalf("PBX: %v", err)
+	case <-ctx.Done():
+		t.Fatal("early NOTIFY not delivered")
+	}
+	c.mu.Lock()
+	pending := len(c.pending)
+	c.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d pending SUBSCRIBEs left after the 2xx", pending)
+	}
+}
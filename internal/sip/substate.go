@@ -0,0 +1,153 @@
+package sip
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Subscription-State values (RFC 6665 section 8.2.3).
+const (
+	subStateActive     = "active"
+	subStatePending    = "pending"
+	subStateTerminated = "terminated"
+)
+
+// subscriptionState is the Subscription-State of a NOTIFY.
+type subscriptionState struct {
+	state      string        // subStateActive, subStatePending or subStateTerminated
+	reason     string        // reason parameter, lower case; "" when absent
+	retryAfter time.Duration // retry-after parameter; 0 when absent
+	expires    time.Duration // expires parameter; -1 when absent
+}
+
+// parseSubscriptionState returns the Subscription-State of req, with ok false when it has
+// none. Some PBXs end a subscription with only Expires: 0, which is read as terminated
+// without a reason.
+func parseSubscriptionState(req *sip.Request) (st subscriptionState, ok bool) {
+	h := req.GetHeader("Subscription-State")
+	if h == nil {
+		if e := req.GetHeader("Expires"); e != nil && strings.TrimSpace(e.Value()) == "0" {
+			return subscriptionState{state: subStateTerminated, expires: 0}, true
+		}
+		return subscriptionState{}, false
+	}
+	parts := strings.Split(h.Value(), ";")
+	st = subscriptionState{state: strings.ToLower(strings.TrimSpace(parts[0])), expires: -1}
+	for _, p := range parts[1:] {
+		name, value, _ := strings.Cut(p, "=")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "reason":
+			st.reason = strings.ToLower(value)
+		case "retry-after":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				st.retryAfter = time.Duration(n) * time.Second
+			}
+		case "expires":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				st.expires = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return st, st.state != ""
+}
+
+// ended reports whether the PBX has ended the subscription: terminated, or no lifetime left.
+func (s subscriptionState) ended() bool {
+	return s.state == subStateTerminated || s.expires == 0
+}
+
+// resubscribeDelay returns how long to wait before subscribing again after the PBX ended a
+// subscription with s, with ok false when it should not be retried (RFC 6665 section
+// 4.1.3): the resource was refused or is gone, and would only be refused again.
+func (s subscriptionState) resubscribeDelay() (delay time.Duration, ok bool) {
+	switch s.reason {
+	case "rejected", "noresource", "invariant":
+		return 0, false
+	case "probation", "giveup":
+		if s.retryAfter > 0 {
+			return s.retryAfter, true
+		}
+		return refreshRetry, true
+	}
+	// deactivated, timeout, or no (or an unknown) reason: subscribe again right away.
+	return s.retryAfter, true
+}
+
+// ended is a subscription the PBX terminated and that has not been re-established.
+type ended struct {
+	reason        string    // from Subscription-State; "" when none was given
+	at            time.Time // when the final NOTIFY arrived
+	resubscribeAt time.Time // when RunRefresh subscribes again; zero when it will not
+}
+
+// endSubscription drops the subscription dialog a final NOTIFY req belongs to and schedules
+// a new SUBSCRIBE when st allows one. The extension stays monitored, reported as not
+// subscribed. A NOTIFY outside the active dialogs (e.g. for one already replaced) is ignored.
+func (c *Client) endSubscription(req *sip.Request, st subscriptionState) {
+	callID, localTag, remoteTag := notifyDialog(req)
+	now := time.Now()
+	c.mu.Lock()
+	var sub *subscription
+	for ext, s := range c.subs {
+		if s.matches(callID, localTag, remoteTag) {
+			sub = s
+			delete(c.subs, ext)
+			break
+		}
+	}
+	if sub == nil {
+		c.mu.Unlock()
+		c.log.Debug("subscription terminated outside any active dialog", "call_id", callID, "reason", st.reason)
+		return
+	}
+	delete(c.stale, sub.extension)
+	e := ended{reason: st.reason, at: now}
+	delay, again := st.resubscribeDelay()
+	if again {
+		// A PBX ending every new subscription at once must not be hammered every refreshTick.
+		if now.Sub(sub.established) < refreshRetry {
+			delay = max(delay, refreshRetry)
+		}
+		e.resubscribeAt = now.Add(delay)
+	}
+	if c.ended == nil {
+		c.ended = make(map[string]ended)
+	}
+	c.ended[sub.extension] = e
+	metrics.SetActiveSubscriptions(c.cfg.Server, len(c.subs))
+	c.mu.Unlock()
+
+	if !again {
+		c.log.Warn("subscription terminated by the PBX, not subscribing again", "extension", sub.extension, "reason", st.reason)
+		return
+	}
+	c.log.Info("subscription terminated by the PBX, subscribing again", "extension", sub.extension, "reason", st.reason, "in", delay)
+}
+
+// resubscribe subscribes extension again after the PBX ended its subscription, scheduling
+// another attempt after refreshRetry unless the PBX refused it outright.
+func (c *Client) resubscribe(ctx context.Context, extension string) {
+	err := c.subscribeExtension(ctx, extension)
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.ended[extension]
+	if !ok {
+		return
+	}
+	switch statusCode(err) {
+	case 403, 404, 489:
+		e.resubscribeAt = time.Time{}
+	default:
+		e.resubscribeAt = time.Now().Add(refreshRetry)
+	}
+	c.ended[extension] = e
+}
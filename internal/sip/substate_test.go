@@ -0,0 +1,127 @@
+package sip
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestParseSubscriptionState(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    subscriptionState
+		ok      bool
+		ended   bool
+	}{
+		{"active", map[string]string{"Subscription-State": "active;expires=3599"}, subscriptionState{state: subStateActive, expires: 3599 * time.Second}, true, false},
+		{"active without expires", map[string]string{"Subscription-State": "Active"}, subscriptionState{state: subStateActive, expires: -1}, true, false},
+		{"active with no time left", map[string]string{"Subscription-State": "active;expires=0"}, subscriptionState{state: subStateActive}, true, true},
+		{"terminated with reason", map[string]string{"Subscription-State": "terminated;reason=noresource"}, subscriptionState{state: subStateTerminated, reason: "noresource", expires: -1}, true, true},
+		{"terminated with retry-after", map[string]string{"Subscription-State": "terminated ; reason=Probation ; retry-after=120"}, subscriptionState{state: subStateTerminated, reason: "probation", retryAfter: 2 * time.Minute, expires: -1}, true, true},
+		{"only Expires: 0", map[string]string{"Expires": "0"}, subscriptionState{state: subStateTerminated}, true, true},
+		{"only Expires", map[string]string{"Expires": "600"}, subscriptionState{}, false, false},
+		{"none", nil, subscriptionState{}, false, false},
+	}
+	for _, tt := range tests {
+		req := sip.NewRequest(sip.NOTIFY, sip.Uri{Scheme: "sip", User: "blf-client", Host: "client"})
+		for name, value := range tt.headers {
+			req.AppendHeader(sip.NewHeader(name, value))
+		}
+		got, ok := parseSubscriptionState(req)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: parseSubscriptionState = %+v %v, want %+v %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+		if ok && got.ended() != tt.ended {
+			t.Errorf("%s: ended = %v, want %v", tt.name, got.ended(), tt.ended)
+		}
+	}
+}
+
+func TestResubscribeDelay(t *testing.T) {
+	tests := []struct {
+		reason     string
+		retryAfter time.Duration
+		want       time.Duration
+		ok         bool
+	}{
+		{"", 0, 0, true},
+		{"deactivated", 0, 0, true},
+		{"timeout", 10 * time.Second, 10 * time.Second, true},
+		{"probation", 0, refreshRetry, true},
+		{"giveup", time.Minute, time.Minute, true},
+		{"rejected", 0, 0, false},
+		{"noresource", time.Minute, 0, false},
+		{"invariant", 0, 0, false},
+		{"something-new", 0, 0, true},
+	}
+	for _, tt := range tests {
+		st := subscriptionState{state: subStateTerminated, reason: tt.reason, retryAfter: tt.retryAfter}
+		if got, ok := st.resubscribeDelay(); got != tt.want || ok != tt.ok {
+			t.Errorf("resubscribeDelay(%q, %v) = %v %v, want %v %v", tt.reason, tt.retryAfter, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestEndSubscription checks that a final NOTIFY drops its dialog and stale flag, keeps the
+// extension monitored and schedules a new SUBSCRIBE only when the reason allows one.
+func TestEndSubscription(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	dialog := func(extension, callID string) *subscription {
+		sub := testDialog(extension, callID, "ours-"+extension, "pbx-"+extension)
+		sub.established = old
+		return sub
+	}
+	c := &Client{
+		log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		extensions: []string{"101", "102", "103"},
+		subs: map[string]*subscription{
+			"101": dialog("101", "call-a"),
+			"102": dialog("102", "call-b"),
+			"103": testDialog("103", "call-c", "ours-103", "pbx-103"), // just established
+		},
+		stale: map[string]bool{"101": true},
+	}
+	final := func(extension, callID, state string) *sip.Request {
+		req := testNotify(extension, callID, "ours-"+extension, "pbx-"+extension)
+		req.AppendHeader(sip.NewHeader("Subscription-State", state))
+		return req
+	}
+
+	before := time.Now()
+	for _, n := range []struct{ extension, callID, state string }{
+		{"101", "call-a", "terminated;reason=deactivated"},
+		{"102", "call-b", "terminated;reason=noresource"},
+		{"103", "call-c", "terminated;reason=timeout"},
+		{"102", "call-x", "terminated"}, // no such dialog
+	} {
+		req := final(n.extension, n.callID, n.state)
+		st, _ := parseSubscriptionState(req)
+		c.endSubscription(req, st)
+	}
+
+	if len(c.subs) != 0 || len(c.stale) != 0 {
+		t.Errorf("subs %v stale %v, want both empty", c.subs, c.stale)
+	}
+	got := c.Subscriptions()
+	if len(got) != 3 {
+		t.Fatalf("Subscriptions = %+v, want the 3 extensions still monitored", got)
+	}
+	if s := got[0]; s.Subscribed || s.Stale || !s.Terminated || s.TerminatedReason != "deactivated" || s.ResubscribeAt.Before(before) || s.ResubscribeAt.After(time.Now()) {
+		t.Errorf("101 = %+v, want terminated (deactivated) with a resubscribe due now", s)
+	}
+	if s := got[1]; !s.Terminated || s.TerminatedReason != "noresource" || !s.ResubscribeAt.IsZero() {
+		t.Errorf("102 = %+v, want terminated (noresource) without a resubscribe", s)
+	}
+	if s := got[2]; !s.Terminated || s.ResubscribeAt.Before(before.Add(refreshRetry)) {
+		t.Errorf("103 = %+v, want its resubscribe held off by refreshRetry", s)
+	}
+
+	c.RemoveExtensions(t.Context(), []string{"102"})
+	if _, ok := c.ended["102"]; ok {
+		t.Error("RemoveExtensions kept the terminated record of 102")
+	}
+}
@@ -0,0 +1,103 @@
+package sip
+
+import (
+	"context"
+	"time"
+)
+
+// Reconnect backoff bounds for Serve and Supervise.
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+)
+
+// transportFailed records a transport-level failure (listener stopped, request could not be
+// sent or its transaction died) so Supervise runs a reconnect cycle. It never blocks;
+// failures arriving while a cycle is pending are folded into it.
+func (c *Client) transportFailed(err error) {
+	c.log.Warn("SIP transport failure", "error", err)
+	c.mu.Lock()
+	c.registered = false
+	c.mu.Unlock()
+	select {
+	case c.failures <- struct{}{}:
+	default:
+	}
+}
+
+// Serve runs the SIP listener until ctx is done. When the listener fails it is restarted
+// with exponential backoff and the failure is reported to Supervise.
+func (c *Client) Serve(ctx context.Context, network, addr string) {
+	backoff := reconnectMinBackoff
+	for {
+		started := time.Now()
+		err := c.ListenAndServe(ctx, network, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > reconnectMaxBackoff {
+			backoff = reconnectMinBackoff // it ran fine for a while; restart promptly
+		}
+		c.log.Error("SIP listener stopped; restarting", "addr", addr, "error", err, "backoff", backoff)
+		c.transportFailed(err)
+		if !sleepCtx(ctx, backoff) {
+			return
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// Supervise waits for transport failures and, for each, re-registers and re-subscribes all
+// extensions, retrying with exponential backoff until the cycle succeeds. It returns when
+// ctx is done.
+func (c *Client) Supervise(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.failures:
+		}
+		c.reconnect(ctx)
+	}
+}
+
+// reconnect runs register + subscribe until both succeed or ctx is done.
+func (c *Client) reconnect(ctx context.Context) {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		c.log.Info("SIP reconnect attempt", "attempt", attempt)
+		_, err := c.Register(ctx)
+		if err == nil {
+			err = c.Subscribe(ctx)
+		}
+		if err == nil {
+			c.log.Info("SIP reconnected", "attempts", attempt)
+			// Failures reported during the cycle are already handled by it.
+			select {
+			case <-c.failures:
+			default:
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.log.Warn("SIP reconnect failed", "attempt", attempt, "error", err, "backoff", backoff)
+		if !sleepCtx(ctx, backoff) {
+			return
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// sleepCtx waits for d or until ctx is done; it reports whether the full wait elapsed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
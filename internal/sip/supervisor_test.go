@@ -0,0 +1,63 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// TestReconnect_NoExtensions checks that a client without extensions (e.g. the SIP_SERVER
+// client when every extension names another PBX) reconnects on the first attempt instead
+// of retrying an empty Subscribe forever.
+func TestReconnect_NoExtensions(t *testing.T) {
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+	pbx, err := sipgo.NewServer(ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbx.OnRegister(func(req *sip.Request, tx sip.ServerTransaction) {
+		tx.Respond(sip.NewResponseFromRequest(req, 200, "OK", nil))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := make(chan string, 1)
+	ready := sipgo.ListenReadyFuncCtxValue(func(_, a string) { addr <- a })
+	go pbx.ListenAndServe(context.WithValue(ctx, sipgo.ListenReadyCtxKey, ready), "tcp", "127.0.0.1:0")
+	var server string
+	select {
+	case server = <-addr:
+	case <-ctx.Done():
+		t.Fatal("listener not ready")
+	}
+
+	var logs bytes.Buffer
+	cfg := Config{Server: server, Transport: "tcp", Username: "blf-client", ContactIP: "127.0.0.1"}
+	c, err := NewClient(cfg, nil, nil, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	c.reconnect(ctx)
+	if ctx.Err() != nil || time.Since(start) >= reconnectMinBackoff {
+		t.Fatalf("reconnect took %v, want no retry", time.Since(start))
+	}
+	if !c.Registered() {
+		t.Error("Registered = false after reconnect")
+	}
+	if out := logs.String(); !strings.Contains(out, `msg="SIP reconnected"`) || !strings.Contains(out, "attempts=1") || strings.Contains(out, "reconnect failed") {
+		t.Errorf("log:\n%s\nwant one successful attempt", out)
+	}
+}
@@ -0,0 +1,102 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// tcpKeepAlivePeriod is the socket-level keepalive period of the connection to the PBX.
+const tcpKeepAlivePeriod = 30 * time.Second
+
+// crlfPing is the RFC 5626 section 3.5.1 keepalive ping (double CRLF).
+var crlfPing = []byte("\r\n\r\n")
+
+// isTCP reports whether transport is plain TCP (any case).
+func isTCP(transport string) bool {
+	return strings.EqualFold(strings.TrimSpace(transport), "tcp")
+}
+
+// noteTCPPeer records the remote address of the connection res arrived on, which is the
+// one sipgo reuses for every request to the PBX and the PBX sends NOTIFYs back over.
+func (c *Client) noteTCPPeer(res *sip.Response) {
+	if !isTCP(c.cfg.Transport) || res.Source() == "" {
+		return
+	}
+	c.mu.Lock()
+	c.tcpPeer = res.Source()
+	c.mu.Unlock()
+}
+
+// RunTCPKeepalive keeps the TCP connection to the PBX alive while the client is registered
+// (Transport tcp only): every interval it sends a CRLF ping (RFC 5626) on the connection,
+// and the first time it sees a connection it enables socket-level keepalive on it. When the
+// connection is gone (the PBX or the network closed it) or the ping cannot be written, a
+// reconnect is triggered (see Supervise): it registers and subscribes again over a new
+// connection, so NOTIFYs keep arriving. It returns when ctx is done.
+func (c *Client) RunTCPKeepalive(ctx context.Context, interval time.Duration) {
+	if !isTCP(c.cfg.Transport) {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var tuned net.Conn
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		peer, registered := c.tcpPeer, c.registered
+		c.mu.Unlock()
+		if !registered || peer == "" {
+			continue // Supervise is reconnecting, or nothing was sent yet
+		}
+		conn, err := c.ua.TransportLayer().GetConnection("tcp", peer)
+		if err != nil {
+			c.transportFailed(fmt.Errorf("TCP connection to %s closed", peer))
+			continue
+		}
+		nc := netConn(conn)
+		if nc != nil && nc != tuned {
+			tuned = nc
+			c.enableTCPKeepAlive(nc)
+		}
+		if nc != nil {
+			_, err = nc.Write(crlfPing)
+		}
+		conn.TryClose() // drop the reference GetConnection took
+		if err != nil {
+			c.transportFailed(fmt.Errorf("TCP keepalive to %s: %w", peer, err))
+			continue
+		}
+		c.log.Debug("TCP keepalive", "peer", peer)
+	}
+}
+
+// netConn returns the network connection under a sipgo TCP connection, or nil.
+func netConn(conn sip.Connection) net.Conn {
+	if tc, ok := conn.(*sip.TCPConnection); ok {
+		return tc.Conn
+	}
+	return nil
+}
+
+// enableTCPKeepAlive turns on socket-level keepalive with tcpKeepAlivePeriod, so a peer
+// that vanished without closing the connection is noticed.
+func (c *Client) enableTCPKeepAlive(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: tcpKeepAlivePeriod, Interval: tcpKeepAlivePeriod}); err != nil {
+		c.log.Warn("enable TCP keepalive", "peer", tc.RemoteAddr(), "error", err)
+		return
+	}
+	c.log.Debug("TCP keepalive enabled", "peer", tc.RemoteAddr(), "period", tcpKeepAlivePeriod)
+}
@@ -0,0 +1,92 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// TestRunTCPKeepalive registers over TCP with a scripted PBX, then checks the CRLF ping
+// arrives on the registration's connection and that closing it triggers a reconnect.
+func TestRunTCPKeepalive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := Config{Server: ln.Addr().String(), Transport: "tcp", Username: "blf-client", ContactIP: "127.0.0.1"}
+	c, err := NewClient(cfg, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type result struct {
+		contact string
+		ping    bool
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() { done <- r }()
+		conn, err := ln.Accept()
+		if err != nil {
+			r.err = err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			r.err = err
+			return
+		}
+		msg, err := sip.ParseMessage(buf[:n])
+		if err != nil {
+			r.err = err
+			return
+		}
+		req := msg.(*sip.Request)
+		r.contact = req.GetHeader("Contact").Value()
+		res := sip.NewResponseFromRequest(req, 200, "OK", nil)
+		res.AppendHeader(sip.NewHeader("Expires", "120"))
+		if _, r.err = conn.Write([]byte(res.String())); r.err != nil {
+			return
+		}
+		n, r.err = conn.Read(buf)
+		r.ping = bytes.Equal(buf[:n], crlfPing)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Register(ctx); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	go c.RunTCPKeepalive(ctx, 20*time.Millisecond)
+
+	r := <-done // the PBX closes the connection after the ping
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !strings.Contains(r.contact, ";transport=tcp>") {
+		t.Errorf("Contact = %q, want transport=tcp", r.contact)
+	}
+	if !r.ping {
+		t.Error("no CRLF ping on the registration's connection")
+	}
+	select {
+	case <-c.failures:
+	case <-ctx.Done():
+		t.Fatal("closed connection did not trigger a reconnect")
+	}
+}
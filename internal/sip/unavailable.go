@@ -0,0 +1,40 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Delays before retrying a request answered 503 Service Unavailable: the response's
+// Retry-After, unavailableRetryDelay without one, and at most maxUnavailableRetryDelay.
+const (
+	unavailableRetryDelay    = 5 * time.Second
+	maxUnavailableRetryDelay = 2 * time.Minute
+)
+
+// retryUnavailable runs attempt and, while it fails with 503 Service Unavailable (a PBX
+// overloaded or still starting), waits for the delay the PBX asked for and runs it again,
+// up to cfg.UnavailableRetries times. It returns the last error; when ctx ends during a
+// wait, the 503 that caused it.
+func (c *Client) retryUnavailable(ctx context.Context, attempt func() error) error {
+	err := attempt()
+	for retry := 1; retry <= c.cfg.UnavailableRetries && statusCode(err) == 503; retry++ {
+		delay := unavailableDelay(err)
+		c.log.Warn("PBX unavailable (503); retrying", "error", err, "retry_in", delay, "retry", retry, "of", c.cfg.UnavailableRetries)
+		if !sleepCtx(ctx, delay) {
+			return err
+		}
+		err = attempt()
+	}
+	return err
+}
+
+// unavailableDelay returns how long to wait before retrying after the 503 in err.
+func unavailableDelay(err error) time.Duration {
+	var se *SIPError
+	if !errors.As(err, &se) || se.RetryAfter <= 0 {
+		return unavailableRetryDelay
+	}
+	return min(se.RetryAfter, maxUnavailableRetryDelay)
+}
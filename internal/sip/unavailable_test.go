@@ -0,0 +1,79 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestRetryUnavailable(t *testing.T) {
+	c := &Client{cfg: Config{UnavailableRetries: 2}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	unavailable := &SIPError{Method: "REGISTER", Target: "blf", StatusCode: 503, RetryAfter: time.Millisecond}
+
+	attempts := 0
+	err := c.retryUnavailable(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("recovering PBX: err = %v after %d attempts, want nil after 3", err, attempts)
+	}
+
+	attempts = 0
+	err = c.retryUnavailable(context.Background(), func() error {
+		attempts++
+		return unavailable
+	})
+	if statusCode(err) != 503 || attempts != 3 {
+		t.Errorf("PBX stays unavailable: err = %v after %d attempts, want the 503 after 3", err, attempts)
+	}
+
+	attempts = 0
+	err = c.retryUnavailable(context.Background(), func() error {
+		attempts++
+		return &SIPError{Method: "REGISTER", Target: "blf", StatusCode: 403}
+	})
+	if statusCode(err) != 403 || attempts != 1 {
+		t.Errorf("403: err = %v after %d attempts, want no retry", err, attempts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	err = c.retryUnavailable(ctx, func() error {
+		attempts++
+		return &SIPError{Method: "REGISTER", Target: "blf", StatusCode: 503, RetryAfter: time.Hour}
+	})
+	if statusCode(err) != 503 || attempts != 1 {
+		t.Errorf("cancelled: err = %v after %d attempts, want the 503 without waiting", err, attempts)
+	}
+}
+
+func TestUnavailableDelay(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", unavailableRetryDelay},
+		{"30", 30 * time.Second},
+		{"18 (restarting);duration=3600", 18 * time.Second},
+		{"3600", maxUnavailableRetryDelay},
+		{"soon", unavailableRetryDelay},
+	}
+	for _, tt := range tests {
+		res := sip.NewResponse(503, "Service Unavailable")
+		if tt.header != "" {
+			res.AppendHeader(sip.NewHeader("Retry-After", tt.header))
+		}
+		if got := unavailableDelay(responseError("SUBSCRIBE", "101", res)); got != tt.want {
+			t.Errorf("Retry-After %q: delay = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
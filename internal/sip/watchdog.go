@@ -0,0 +1,70 @@
+package sip
+
+import (
+	"context"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/metrics"
+)
+
+// minWatchdogTick bounds how often RunStaleWatchdog checks, whatever the window.
+const minWatchdogTick = time.Second
+
+// RunStaleWatchdog flags subscriptions that have gone quiet until ctx is done. A
+// subscription is stale when neither a NOTIFY nor the subscription itself is more recent
+// than window: the PBX answers every SUBSCRIBE, refreshes included, with a NOTIFY, so a
+// window longer than the refresh interval only trips when NOTIFYs stopped arriving (lost
+// NAT binding, PBX bug). Each stale extension is logged once, until a NOTIFY arrives; with
+// resubscribe its subscription is replaced by a new one.
+func (c *Client) RunStaleWatchdog(ctx context.Context, window time.Duration, resubscribe bool) {
+	ticker := time.NewTicker(max(window/4, minWatchdogTick))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, sub := range c.markStale(time.Now(), window) {
+			c.log.Warn("no NOTIFY within the staleness window; presence may be stale",
+				"extension", sub.extension, "window", window, "resubscribe", resubscribe)
+			if !resubscribe {
+				continue
+			}
+			if err := c.unsubscribeOne(ctx, sub); err != nil {
+				c.log.Debug("unsubscribe of stale subscription failed", "extension", sub.extension, "error", err)
+			}
+			_ = c.subscribeExtension(ctx, sub.extension)
+		}
+	}
+}
+
+// markStale updates the stale set for now and returns the subscriptions that newly went
+// stale. An extension leaves the set once a NOTIFY or a new subscription is within window.
+func (c *Client) markStale(now time.Time, window time.Duration) (newly []*subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stale == nil {
+		c.stale = make(map[string]bool)
+	}
+	for ext := range c.stale {
+		if c.subs[ext] == nil {
+			delete(c.stale, ext)
+		}
+	}
+	for ext, sub := range c.subs {
+		last := sub.established
+		if n := c.notified[ext]; n.at.After(last) {
+			last = n.at
+		}
+		switch quiet := now.Sub(last) > window; {
+		case quiet && !c.stale[ext]:
+			c.stale[ext] = true
+			newly = append(newly, sub)
+		case !quiet:
+			delete(c.stale, ext)
+		}
+	}
+	metrics.SetStaleSubscriptions(c.cfg.Server, len(c.stale))
+	return newly
+}
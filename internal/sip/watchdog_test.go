@@ -0,0 +1,39 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMarkStale(t *testing.T) {
+	start := time.Now()
+	c := &Client{
+		subs: map[string]*subscription{
+			"101": {extension: "101", established: start},
+			"102": {extension: "102", established: start},
+		},
+		notified: map[string]notifyRecord{"102": {at: start.Add(50 * time.Minute)}},
+	}
+	window := time.Hour
+
+	if newly := c.markStale(start.Add(30*time.Minute), window); len(newly) != 0 {
+		t.Fatalf("within window: newly stale = %d, want 0", len(newly))
+	}
+	newly := c.markStale(start.Add(61*time.Minute), window)
+	if len(newly) != 1 || newly[0].extension != "101" {
+		t.Fatalf("after window: newly stale = %v, want 101 only (102 had a NOTIFY)", newly)
+	}
+	if newly := c.markStale(start.Add(62*time.Minute), window); len(newly) != 0 {
+		t.Errorf("still stale: newly stale = %d, want 0 (flagged once)", len(newly))
+	}
+
+	c.notified["101"] = notifyRecord{at: start.Add(63 * time.Minute)}
+	c.markStale(start.Add(64*time.Minute), window)
+	if c.stale["101"] {
+		t.Error("101 still flagged after a NOTIFY")
+	}
+	newly = c.markStale(start.Add(111*time.Minute), window)
+	if len(newly) != 1 || newly[0].extension != "102" {
+		t.Errorf("later: newly stale = %v, want 102", newly)
+	}
+}
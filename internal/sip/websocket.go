@@ -0,0 +1,40 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// WebSocket transports for Config.Transport (RFC 7118).
+const (
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+)
+
+// IsWebSocket reports whether transport is TransportWS or TransportWSS (any case). Over a
+// WebSocket every request and NOTIFY rides on the one connection the client opens to the
+// PBX, so there is no SIP listener, no STUN discovery and no Contact to keep reachable.
+func IsWebSocket(transport string) bool {
+	switch strings.ToLower(strings.TrimSpace(transport)) {
+	case TransportWS, TransportWSS:
+		return true
+	}
+	return false
+}
+
+// webSocketDefaultPort returns the port of a WebSocket server given without one (80 or 443).
+func webSocketDefaultPort(transport string) int {
+	return sip.DefaultPort(strings.ToLower(strings.TrimSpace(transport)))
+}
+
+// webSocketContactHost returns a random "<token>.invalid" host for Contact and Via: a
+// WebSocket client has no address the PBX could reach, so RFC 7118 section 5 has it use
+// a name that never resolves, and the PBX sends everything over the connection instead.
+func webSocketContactHost() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b) + ".invalid"
+}
@@ -0,0 +1,78 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestIsWebSocket(t *testing.T) {
+	for transport, want := range map[string]bool{"ws": true, " WSS ": true, "udp": false, "tcp": false, "": false} {
+		if got := IsWebSocket(transport); got != want {
+			t.Errorf("IsWebSocket(%q) = %v, want %v", transport, got, want)
+		}
+	}
+}
+
+// TestRegister_WebSocket registers against a sipgo server listening on ws and checks the
+// Contact and Via use the .invalid host RFC 7118 asks for.
+func TestRegister_WebSocket(t *testing.T) {
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+	pbx, err := sipgo.NewServer(ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registers := make(chan *sip.Request, 1)
+	pbx.OnRegister(func(req *sip.Request, tx sip.ServerTransaction) {
+		registers <- req
+		res := sip.NewResponseFromRequest(req, 200, "OK", nil)
+		res.AppendHeader(sip.NewHeader("Expires", "120"))
+		tx.Respond(res)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := make(chan string, 1)
+	ready := sipgo.ListenReadyFuncCtxValue(func(_, a string) { addr <- a })
+	go pbx.ListenAndServe(context.WithValue(ctx, sipgo.ListenReadyCtxKey, ready), "ws", "127.0.0.1:0")
+	var server string
+	select {
+	case server = <-addr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ws listener not ready")
+	}
+
+	cfg := Config{Server: server, Transport: "WS", Username: "blf-client", ContactIP: "auto"}
+	c, err := NewClient(cfg, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	regCtx, regCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer regCancel()
+	if granted, err := c.Register(regCtx); err != nil {
+		t.Fatalf("Register: %v", err)
+	} else if granted != 120*time.Second {
+		t.Errorf("Register granted %v, want the 120s of the response", granted)
+	}
+
+	req := <-registers
+	contact := req.GetHeader("Contact").Value()
+	if !strings.Contains(contact, ".invalid;transport=ws>") {
+		t.Errorf("Contact = %q, want a .invalid host with transport=ws", contact)
+	}
+	via := req.Via()
+	if via.Transport != "WS" || !strings.HasSuffix(via.Host, ".invalid") {
+		t.Errorf("Via = %s, want WS from a .invalid host", via.Value())
+	}
+}
@@ -0,0 +1,165 @@
+// Package webhook forwards BLF state changes to an HTTP endpoint as signed JSON.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+// SignatureHeader carries "sha256=" + hex(HMAC-SHA256(secret, body)) when a secret is set.
+const SignatureHeader = "X-BLF-Signature-256"
+
+const (
+	defaultTimeout = 5 * time.Second
+	defaultRetries = 3
+	defaultBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Payload is the JSON body POSTed for each state change.
+type Payload struct {
+	Extension    string    `json:"extension"`
+	Email        string    `json:"email,omitempty"`
+	State        blf.State `json:"state"`
+	Availability string    `json:"availability"`
+	Activity     string    `json:"activity"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// Config configures a Forwarder. A zero Timeout and a negative Retries use the defaults
+// (5s, 3); Retries 0 sends each event once.
+type Config struct {
+	URL     string
+	Secret  string        // HMAC key for SignatureHeader; empty sends no signature
+	Timeout time.Duration // per attempt
+	Retries int           // additional attempts after the first
+	Mapping blf.Mapping   // availability/activity reported alongside the state
+	// Email returns the user for an extension; unknown extensions are sent without one.
+	Email func(extension string) (string, bool)
+}
+
+// Forwarder POSTs each BLF event to Config.URL. Deliveries are sequential, so the
+// endpoint sees changes in order; a failing endpoint delays later events, which the
+// event channel absorbs or drops (see sip.Client.Events).
+type Forwarder struct {
+	cfg     Config
+	http    *http.Client
+	backoff time.Duration
+	log     *slog.Logger
+}
+
+// New returns a Forwarder for cfg.
+func New(cfg Config) *Forwarder {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = defaultRetries
+	}
+	return &Forwarder{
+		cfg:     cfg,
+		http:    &http.Client{Timeout: cfg.Timeout},
+		backoff: defaultBackoff,
+		log:     slog.Default().With("component", "webhook"),
+	}
+}
+
+// Run delivers events until ctx is cancelled or events is closed.
+func (f *Forwarder) Run(ctx context.Context, events <-chan blf.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := f.Send(ctx, ev); err != nil && ctx.Err() == nil {
+				f.log.Error("webhook delivery failed", "extension", ev.Extension, "state", ev.State, "error", err)
+			}
+		}
+	}
+}
+
+// Send delivers one event, retrying network errors, 429 and 5xx responses with
+// exponential backoff. Other 4xx responses are not retried.
+func (f *Forwarder) Send(ctx context.Context, ev blf.Event) error {
+	body, err := json.Marshal(f.payload(ev))
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := f.post(ctx, body)
+		if err == nil {
+			f.log.Debug("webhook delivered", "extension", ev.Extension, "state", ev.State)
+			return nil
+		}
+		if !retry || attempt >= f.cfg.Retries {
+			return err
+		}
+		wait := min(f.backoff<<attempt, maxBackoff)
+		f.log.Warn("webhook delivery failed, retrying", "extension", ev.Extension, "attempt", attempt+1, "wait", wait, "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// payload builds the JSON body for ev.
+func (f *Forwarder) payload(ev blf.Event) Payload {
+	p := Payload{Extension: ev.Extension, State: ev.State, Timestamp: ev.Time.UTC()}
+	if ev.Time.IsZero() {
+		p.Timestamp = time.Now().UTC()
+	}
+	p.Availability, p.Activity = f.cfg.Mapping.ToGraph(ev.State)
+	if f.cfg.Email != nil {
+		p.Email, _ = f.cfg.Email(ev.Extension)
+	}
+	return p
+}
+
+// post sends body once. retry reports whether a failure is worth another attempt.
+func (f *Forwarder) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(f.cfg.Secret, body))
+	}
+	res, err := f.http.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+	return retry, fmt.Errorf("webhook: %s", res.Status)
+}
+
+// Sign returns the SignatureHeader value for body: "sha256=" followed by the hex
+// HMAC-SHA256 of body keyed with secret. Receivers recompute it to verify the sender.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
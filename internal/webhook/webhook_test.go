@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darrenwiebe/teams_freepbx/internal/blf"
+)
+
+func newTestForwarder(url string, cfg Config) *Forwarder {
+	cfg.URL = url
+	f := New(cfg)
+	f.backoff = time.Millisecond
+	f.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return f
+}
+
+func TestSend_SignedPayloadAfterRetry(t *testing.T) {
+	var calls atomic.Int32
+	var got Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get(SignatureHeader); sig != Sign("s3cret", body) {
+			t.Errorf("signature = %q, want %q", sig, Sign("s3cret", body))
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	f := newTestForwarder(srv.URL, Config{
+		Secret:  "s3cret",
+		Retries: 1,
+		Email:   func(ext string) (string, bool) { return "alice@example.com", ext == "101" },
+	})
+	at := time.Date(2025, 3, 1, 9, 30, 0, 0, time.UTC)
+	if err := f.Send(context.Background(), blf.Event{Extension: "101", State: blf.StateBusy, Time: at}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("server called %d times, want 2 (one retry)", calls.Load())
+	}
+	want := Payload{Extension: "101", Email: "alice@example.com", State: blf.StateBusy, Availability: "Busy", Activity: "InACall", Timestamp: at}
+	if got != want {
+		t.Errorf("payload = %+v, want %+v", got, want)
+	}
+}
+
+func TestSend_ClientErrorNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	f := newTestForwarder(srv.URL, Config{Retries: 3})
+	if err := f.Send(context.Background(), blf.Event{Extension: "101", State: blf.StateIdle}); err == nil {
+		t.Fatal("Send succeeded, want error")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("server called %d times, want 1", calls.Load())
+	}
+}
+
+func TestSend_GivesUpAfterRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	f := newTestForwarder(srv.URL, Config{Retries: 2})
+	if err := f.Send(context.Background(), blf.Event{Extension: "101", State: blf.StateRinging}); err == nil {
+		t.Fatal("Send succeeded, want error")
+	}
+	if calls.Load() != 3 {
+		t.Errorf("server called %d times, want 3", calls.Load())
+	}
+
+	// Retries 0 disables retrying.
+	calls.Store(0)
+	f = newTestForwarder(srv.URL, Config{Retries: 0})
+	if err := f.Send(context.Background(), blf.Event{Extension: "101", State: blf.StateRinging}); err == nil {
+		t.Fatal("Send without retries succeeded, want error")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("without retries: server called %d times, want 1", calls.Load())
+	}
+}